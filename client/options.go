@@ -0,0 +1,99 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultReadTimeout is how long to wait for the next frame before reconnecting
+	DefaultReadTimeout = 10 * time.Second
+
+	// DefaultMinBackoff and DefaultMaxBackoff bound the delay between reconnection attempts
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+
+	// DefaultSnapshotInterval is how often snapshots are polled when falling back to snapshots
+	DefaultSnapshotInterval = time.Second
+
+	// DefaultFallbackAfter is the number of consecutive failed stream
+	// connection attempts before falling back to polling snapshots
+	DefaultFallbackAfter = 3
+
+	// DefaultFallbackDuration is how long snapshots are polled before
+	// trying to connect to the stream again
+	DefaultFallbackDuration = 30 * time.Second
+)
+
+// Option configures a Client
+type Option func(*Client) error
+
+// Set the HTTP client used for all requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) error {
+		if httpClient == nil {
+			return errors.New("HTTP client is required")
+		}
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// Set how long to wait for the next frame before reconnecting
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *Client) error {
+		if timeout <= 0 {
+			return errors.New("read timeout must be positive")
+		}
+		c.readTimeout = timeout
+		return nil
+	}
+}
+
+// Set the minimum and maximum delay between reconnection attempts,
+// with the delay doubling after every failed attempt
+func WithBackoff(minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) error {
+		if minBackoff <= 0 || maxBackoff < minBackoff {
+			return errors.New("backoff must be positive and min must not exceed max")
+		}
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// Set the snapshot URL, which is otherwise derived from the stream URL
+func WithSnapshotURL(snapshotURL string) Option {
+	return func(c *Client) error {
+		c.snapshotURL = snapshotURL
+		return nil
+	}
+}
+
+// Fall back to polling snapshots at the given interval after the given number
+// of consecutive failed stream connection attempts, for the given duration
+// before trying to connect to the stream again
+func WithSnapshotFallback(interval time.Duration, after int, duration time.Duration) Option {
+	return func(c *Client) error {
+		if interval <= 0 || after <= 0 || duration <= 0 {
+			return errors.New("snapshot fallback interval, attempts and duration must be positive")
+		}
+		c.snapshotFallback = true
+		c.snapshotInterval = interval
+		c.fallbackAfter = after
+		c.fallbackDuration = duration
+		return nil
+	}
+}
+
+// Log connection problems (such as lost connections and falling back to snapshots) to the given logger,
+// which aren't logged otherwise
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) error {
+		c.logger = logger
+		return nil
+	}
+}
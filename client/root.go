@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotJPEG = errors.New("response is not a JPEG image")
+
+// Frame is a single JPEG image received from a stream or snapshot
+type Frame struct {
+	Data []byte
+
+	// Sequence is the frame sequence number provided by the server,
+	// or a locally counted sequence number if the server didn't provide one
+	Sequence uint64
+
+	// Timestamp is the capture time provided by the server,
+	// or the time the frame was received if the server didn't provide one
+	Timestamp time.Time
+
+	// Received is the time the frame was received
+	Received time.Time
+
+	// Snapshot is true if the frame was polled as a snapshot instead of streamed
+	Snapshot bool
+
+	// Header holds all the headers of the stream part or snapshot response
+	Header textproto.MIMEHeader
+}
+
+// Client consumes an MJPEG stream, reconnecting whenever the connection is lost
+type Client struct {
+	streamURL        string
+	snapshotURL      string
+	httpClient       *http.Client
+	readTimeout      time.Duration
+	minBackoff       time.Duration
+	maxBackoff       time.Duration
+	snapshotFallback bool
+	snapshotInterval time.Duration
+	fallbackAfter    int
+	fallbackDuration time.Duration
+	logger           *log.Logger
+
+	mutex        sync.Mutex
+	stats        Stats
+	lastSequence uint64
+	hasSequence  bool
+	lastSnapshot bool
+	lastFrame    time.Time
+}
+
+// Create a new Client for the given stream URL
+func New(streamURL string, options ...Option) (*Client, error) {
+	if _, err := url.Parse(streamURL); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		streamURL:        streamURL,
+		snapshotURL:      snapshotURLFromStreamURL(streamURL),
+		httpClient:       http.DefaultClient,
+		readTimeout:      DefaultReadTimeout,
+		minBackoff:       DefaultMinBackoff,
+		maxBackoff:       DefaultMaxBackoff,
+		snapshotInterval: DefaultSnapshotInterval,
+		fallbackAfter:    DefaultFallbackAfter,
+		fallbackDuration: DefaultFallbackDuration,
+	}
+
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Derive the snapshot URL from a stream URL, by swapping the
+// mjpg-streamer compatible "action" query parameter
+func snapshotURLFromStreamURL(streamURL string) string {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return streamURL
+	}
+	query := u.Query()
+	query.Set("action", "snapshot")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Get a channel that receives every frame until the context is done,
+// after which the channel is closed
+func (c *Client) Frames(ctx context.Context) <-chan *Frame {
+	frames := make(chan *Frame)
+	go func() {
+		defer close(frames)
+		c.Run(ctx, func(f *Frame) error {
+			select {
+			case frames <- f:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return frames
+}
+
+// Consume the stream until the context is done or the handler returns an error,
+// calling the handler for every frame and reconnecting whenever the connection is lost
+func (c *Client) Run(ctx context.Context, handler func(*Frame) error) error {
+	backoff := c.minBackoff
+	failures := 0
+
+	for ctx.Err() == nil {
+		// Fall back to polling snapshots after too many failed attempts
+		if c.snapshotFallback && failures >= c.fallbackAfter {
+			c.log("Stream unavailable, falling back to snapshots for", c.fallbackDuration, "...")
+			if err := c.pollSnapshots(ctx, handler); err != nil {
+				return err
+			}
+			failures = 0
+			backoff = c.minBackoff
+			continue
+		}
+
+		// Consume the stream until it fails
+		received, err := c.consumeStream(ctx, handler)
+		if err != nil {
+			var handlerErr *handlerError
+			if errors.As(err, &handlerErr) {
+				return handlerErr.err
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Reset the backoff if we managed to receive frames
+		if received > 0 {
+			failures = 0
+			backoff = c.minBackoff
+		} else {
+			failures++
+		}
+
+		c.log("Stream connection lost:", err, "(reconnecting in", backoff, ")")
+		c.mutex.Lock()
+		c.stats.Reconnects++
+		c.mutex.Unlock()
+
+		// Wait before reconnecting, doubling the delay every time
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+
+	return ctx.Err()
+}
+
+// handlerError wraps errors returned by the frame handler,
+// so they can be told apart from connection errors
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+// Connect to the stream and pass every frame to the handler until the stream fails,
+// returning the number of frames that were received
+func (c *Client) consumeStream(ctx context.Context, handler func(*Frame) error) (int, error) {
+	// Cancel the request if no frame is received within the read timeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(c.readTimeout, cancel)
+	defer watchdog.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.streamURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return 0, fmt.Errorf("unexpected content type: %s", mediaType)
+	}
+
+	c.setConnected(true, false)
+	defer c.setConnected(false, false)
+
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	received := 0
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return received, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return received, err
+		}
+
+		// The handler may take a while (eg. when nobody is reading the frames channel),
+		// which doesn't mean the connection is broken
+		watchdog.Stop()
+		f := c.newFrame(data, part.Header, false)
+		received++
+		if err := handler(f); err != nil {
+			return received, &handlerError{err}
+		}
+		watchdog.Reset(c.readTimeout)
+	}
+}
+
+// Poll snapshots for the fallback duration, passing every frame to the handler
+func (c *Client) pollSnapshots(ctx context.Context, handler func(*Frame) error) error {
+	c.setConnected(false, true)
+	defer c.setConnected(false, false)
+
+	ticker := time.NewTicker(c.snapshotInterval)
+	defer ticker.Stop()
+	deadline := time.After(c.fallbackDuration)
+
+	for {
+		f, err := c.Snapshot(ctx)
+		if err != nil {
+			c.log("Failed to poll snapshot:", err)
+		} else if err := handler(f); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get a single snapshot
+func (c *Client) Snapshot(ctx context.Context) (*Frame, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.readTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.snapshotURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "image/jpeg") {
+		return nil, ErrNotJPEG
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newFrame(data, textproto.MIMEHeader(res.Header), true), nil
+}
+
+// Create a new frame from the given data and headers, updating the stats
+func (c *Client) newFrame(data []byte, header textproto.MIMEHeader, snapshot bool) *Frame {
+	now := time.Now()
+	f := &Frame{
+		Data:      data,
+		Timestamp: now,
+		Received:  now,
+		Snapshot:  snapshot,
+		Header:    header,
+	}
+
+	// Use the capture timestamp provided by the server
+	if timestamp, err := frame.ParseTimestamp(header.Get(frame.HeaderTimestamp)); err == nil && timestamp.Unix() > 0 {
+		f.Timestamp = timestamp
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Use the sequence number provided by the server, counting any gaps in between
+	// (except around snapshots, which are expected to skip frames)
+	sequence, err := strconv.ParseUint(header.Get(frame.HeaderSequence), 10, 64)
+	if err == nil {
+		if c.hasSequence && !snapshot && !c.lastSnapshot && sequence > c.lastSequence+1 {
+			c.stats.Gaps += sequence - c.lastSequence - 1
+		}
+		if c.hasSequence && sequence == c.lastSequence && snapshot {
+			c.stats.Duplicates++
+		}
+		c.hasSequence = true
+	} else {
+		sequence = c.lastSequence + 1
+	}
+	c.lastSequence = sequence
+	c.lastSnapshot = snapshot
+	f.Sequence = sequence
+
+	c.stats.update(now, c.lastFrame, len(data))
+	c.lastFrame = now
+
+	return f
+}
+
+// Log a message, if a logger was given
+func (c *Client) log(v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Println(v...)
+	}
+}
+
+// Update the connection state in the stats
+func (c *Client) setConnected(connected bool, snapshot bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Connected = connected
+	c.stats.Snapshot = snapshot
+}
+
+// Get a copy of the current stats
+func (c *Client) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
@@ -0,0 +1,366 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/server"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long a test waits for something to happen before it fails
+const testTimeout = 5 * time.Second
+
+// testSource is a server.Source whose frames are published by the test
+type testSource struct {
+	mutex sync.Mutex
+	frame *frame.Frame
+	ready chan struct{}
+}
+
+func newTestSource() *testSource {
+	return &testSource{ready: make(chan struct{}, 1)}
+}
+
+func (s *testSource) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (s *testSource) GetCurrentFrame() *frame.Frame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.frame
+}
+
+func (s *testSource) FrameReady() <-chan struct{} {
+	return s.ready
+}
+
+// Publish a new frame with the given sequence number and capture timestamp,
+// whose content is different for every sequence number
+func (s *testSource) publish(t *testing.T, sequence uint64, timestamp time.Time) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(sequence * 37)
+	}
+	img.Set(int(sequence%64), 0, color.White)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := frame.New(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Sequence = sequence
+	f.Timestamp = timestamp
+
+	s.mutex.Lock()
+	s.frame = f
+	s.mutex.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run a server for the source, serving its handler (wrapped by the given function, if any) with httptest
+func newTestServer(t *testing.T, source *testSource, wrap func(http.Handler) http.Handler) (*server.Server, *httptest.Server) {
+	t.Helper()
+	s, err := server.New(source, server.WithAddress(""), server.WithPassthrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+
+	var handler http.Handler = s
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		ts.Close()
+	})
+	return s, ts
+}
+
+// Run the client until the test ends, sending every frame it receives to the returned channel
+// after calling the given function (if any) with it
+func runClient(t *testing.T, c *Client, each func(*Frame)) <-chan *Frame {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	frames := make(chan *Frame, 16)
+	go func() {
+		defer close(done)
+		c.Run(ctx, func(f *Frame) error {
+			if each != nil {
+				each(f)
+			}
+			frames <- f
+			return nil
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return frames
+}
+
+// Wait until the client receives a frame with the given sequence number
+func waitForFrame(t *testing.T, frames <-chan *Frame, sequence uint64) *Frame {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case f := <-frames:
+			if f.Sequence == sequence {
+				return f
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for frame %d", sequence)
+			return nil
+		}
+	}
+}
+
+// Wait until the condition is true
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStream(t *testing.T) {
+	source := newTestSource()
+	_, ts := newTestServer(t, source, nil)
+	c, err := New(ts.URL + "/?action=stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames <-chan *Frame
+
+	// The server only accepts clients once it has a frame, which is the first frame they receive
+	timestamp := time.Unix(1700000000, 123456000)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		source.publish(t, sequence, timestamp.Add(time.Duration(sequence)*time.Second))
+		if sequence == 1 {
+			frames = runClient(t, c, nil)
+		}
+		f := waitForFrame(t, frames, sequence)
+		if f.Snapshot {
+			t.Errorf("frame %d: streamed frame is marked as a snapshot", sequence)
+		}
+		if want := timestamp.Add(time.Duration(sequence) * time.Second); !f.Timestamp.Equal(want) {
+			t.Errorf("frame %d: timestamp is %s, want %s", sequence, f.Timestamp, want)
+		}
+		if got := f.Header.Get(frame.HeaderWidth); got != "64" {
+			t.Errorf("frame %d: width header is %q, want 64", sequence, got)
+		}
+		if _, err := jpeg.DecodeConfig(bytes.NewReader(f.Data)); err != nil {
+			t.Errorf("frame %d: invalid JPEG: %v", sequence, err)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Frames != 3 || stats.Gaps != 0 || stats.Reconnects != 0 || !stats.Connected || stats.Snapshot {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Bytes == 0 {
+		t.Error("no bytes counted")
+	}
+}
+
+func TestSequenceGaps(t *testing.T) {
+	source := newTestSource()
+	_, ts := newTestServer(t, source, nil)
+	c, err := New(ts.URL + "/?action=stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.publish(t, 1, time.Now())
+	frames := runClient(t, c, nil)
+	waitForFrame(t, frames, 1)
+
+	// Frames 3 and 4 are never sent, and frame 7 and 8 are missed
+	for _, sequence := range []uint64{2, 5, 6, 9} {
+		source.publish(t, sequence, time.Now())
+		waitForFrame(t, frames, sequence)
+	}
+	if gaps := c.Stats().Gaps; gaps != 4 {
+		t.Errorf("counted %d gaps, want 4", gaps)
+	}
+}
+
+func TestTimestampHeader(t *testing.T) {
+	c, err := New("http://localhost/?action=stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"1700000000.123456", time.Unix(1700000000, 123456000)},
+		{"1700000000.5", time.Unix(1700000000, 500000000)},
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"1700000000.1234567891", time.Unix(1700000000, 123456789)},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set(frame.HeaderTimestamp, test.value)
+		if f := c.newFrame(nil, header, false); !f.Timestamp.Equal(test.want) {
+			t.Errorf("%q: timestamp is %s, want %s", test.value, f.Timestamp, test.want)
+		}
+	}
+
+	// Frames without a valid timestamp are stamped with the time they were received
+	for _, value := range []string{"", "0", "invalid", "1.2.3"} {
+		header := textproto.MIMEHeader{}
+		header.Set(frame.HeaderTimestamp, value)
+		if f := c.newFrame(nil, header, false); !f.Timestamp.Equal(f.Received) {
+			t.Errorf("%q: timestamp is %s, want the time it was received (%s)", value, f.Timestamp, f.Received)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	const minBackoff = 20 * time.Millisecond
+
+	// Refuse the first few connections, keeping track of when they were made
+	var mutex sync.Mutex
+	var attempts []time.Time
+	source := newTestSource()
+	s, ts := newTestServer(t, source, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			attempts = append(attempts, time.Now())
+			refused := len(attempts) <= 3
+			mutex.Unlock()
+			if refused {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c, err := New(ts.URL+"/?action=stream", WithBackoff(minBackoff, 4*minBackoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.publish(t, 1, time.Now())
+	frames := runClient(t, c, nil)
+	waitForFrame(t, frames, 1)
+
+	// The delay between attempts doubles every time
+	mutex.Lock()
+	for i, want := range []time.Duration{minBackoff, 2 * minBackoff, 4 * minBackoff} {
+		if delay := attempts[i+1].Sub(attempts[i]); delay < want {
+			t.Errorf("attempt %d was made %s after the previous one, want at least %s", i+2, delay, want)
+		}
+	}
+	mutex.Unlock()
+	if reconnects := c.Stats().Reconnects; reconnects != 3 {
+		t.Errorf("counted %d reconnects, want 3", reconnects)
+	}
+
+	// Reconnect after the connection is lost, and keep receiving frames
+	ts.CloseClientConnections()
+	waitFor(t, "client to reconnect", func() bool { return c.Stats().Reconnects == 4 && s.Viewers() == 1 })
+	source.publish(t, 2, time.Now())
+	waitForFrame(t, frames, 2)
+	if stats := c.Stats(); !stats.Connected || stats.Gaps != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	// Refuse every stream connection, but serve snapshots
+	source := newTestSource()
+	_, ts := newTestServer(t, source, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("action") == "stream" {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c, err := New(ts.URL+"/?action=stream",
+		WithBackoff(time.Millisecond, time.Millisecond),
+		WithSnapshotFallback(10*time.Millisecond, 2, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.publish(t, 1, time.Now())
+	frames := runClient(t, c, nil)
+
+	// Polling snapshots skips frames, which aren't counted as gaps
+	f := waitForFrame(t, frames, 1)
+	if !f.Snapshot {
+		t.Error("polled frame isn't marked as a snapshot")
+	}
+	if !strings.HasPrefix(f.Header.Get("Content-Type"), "image/jpeg") {
+		t.Errorf("unexpected content type: %s", f.Header.Get("Content-Type"))
+	}
+	waitFor(t, "snapshot to be polled again", func() bool { return c.Stats().Duplicates > 0 })
+	source.publish(t, 5, time.Now())
+	waitForFrame(t, frames, 5)
+
+	stats := c.Stats()
+	if !stats.Snapshot || stats.Connected {
+		t.Errorf("client isn't polling snapshots: %+v", stats)
+	}
+	if stats.Gaps != 0 {
+		t.Errorf("counted %d gaps between snapshots, want 0", stats.Gaps)
+	}
+}
+
+func TestSlowHandler(t *testing.T) {
+	const readTimeout = 100 * time.Millisecond
+
+	source := newTestSource()
+	_, ts := newTestServer(t, source, nil)
+	c, err := New(ts.URL+"/?action=stream", WithReadTimeout(readTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A handler that takes longer than the read timeout doesn't break the connection
+	source.publish(t, 1, time.Now())
+	frames := runClient(t, c, func(f *Frame) {
+		if f.Sequence == 1 {
+			time.Sleep(3 * readTimeout)
+		}
+	})
+	waitForFrame(t, frames, 1)
+	source.publish(t, 2, time.Now())
+	waitForFrame(t, frames, 2)
+	if reconnects := c.Stats().Reconnects; reconnects != 0 {
+		t.Errorf("counted %d reconnects, want 0", reconnects)
+	}
+}
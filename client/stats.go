@@ -0,0 +1,47 @@
+package client
+
+import (
+	"time"
+)
+
+// fpsSmoothing is the weight given to the most recent frame interval
+// in the exponential moving average of the frame intervals
+const fpsSmoothing = 0.1
+
+// Stats holds the statistics of a Client
+type Stats struct {
+	Frames     uint64  // Number of frames received
+	Bytes      uint64  // Number of frame bytes received
+	Gaps       uint64  // Number of frames missed while streaming, based on the server's sequence numbers
+	Duplicates uint64  // Number of snapshots that were polled more than once
+	Reconnects uint64  // Number of times the stream connection was lost
+	FPS        float64 // Smoothed frame rate
+	Connected  bool    // True while connected to the stream
+	Snapshot   bool    // True while polling snapshots instead of streaming
+	LastFrame  time.Time
+
+	averageInterval float64
+}
+
+// Update the stats with a newly received frame
+func (s *Stats) update(now time.Time, last time.Time, size int) {
+	s.Frames++
+	s.Bytes += uint64(size)
+	s.LastFrame = now
+
+	if last.IsZero() {
+		return
+	}
+
+	// Average the frame intervals rather than the frame rates,
+	// so frames arriving in bursts don't skew the frame rate
+	interval := now.Sub(last).Seconds()
+	if s.averageInterval == 0 {
+		s.averageInterval = interval
+	} else {
+		s.averageInterval = (1-fpsSmoothing)*s.averageInterval + fpsSmoothing*interval
+	}
+	if s.averageInterval > 0 {
+		s.FPS = 1 / s.averageInterval
+	}
+}
@@ -0,0 +1,64 @@
+package frame
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers that are set on every stream part and snapshot response
+const (
+	HeaderSequence  = "X-Frame-Sequence"
+	HeaderTimestamp = "X-Timestamp" // Same format as mjpg-streamer (seconds.microseconds)
+	HeaderWidth     = "X-Frame-Width"
+	HeaderHeight    = "X-Frame-Height"
+	HeaderStream    = "X-Stream-Name"
+)
+
+// Set the frame headers on the given header
+func (f *Frame) SetHeaders(header textproto.MIMEHeader, stream string) {
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Content-Length", strconv.Itoa(len(f.Data)))
+	header.Set(HeaderSequence, strconv.FormatUint(f.Sequence, 10))
+	if !f.Timestamp.IsZero() {
+		header.Set(HeaderTimestamp, FormatTimestamp(f.Timestamp))
+	}
+	header.Set(HeaderWidth, strconv.Itoa(f.Width))
+	header.Set(HeaderHeight, strconv.Itoa(f.Height))
+	if stream != "" {
+		header.Set(HeaderStream, stream)
+	}
+}
+
+// Format a timestamp as seconds with microsecond precision
+func FormatTimestamp(t time.Time) string {
+	micros := t.UnixNano() / int64(time.Microsecond)
+	return fmt.Sprintf("%d.%06d", micros/1e6, micros%1e6)
+}
+
+// Parse a timestamp in (fractional) seconds, without losing precision to floating point
+func ParseTimestamp(value string) (time.Time, error) {
+	secondsPart, fractionPart := value, ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		secondsPart, fractionPart = value[:i], value[i+1:]
+	}
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Pad or truncate the fraction to nanoseconds
+	if len(fractionPart) > 9 {
+		fractionPart = fractionPart[:9]
+	}
+	nanos := int64(0)
+	if fractionPart != "" {
+		nanos, err = strconv.ParseInt(fractionPart+strings.Repeat("0", 9-len(fractionPart)), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(seconds, nanos), nil
+}
@@ -0,0 +1,78 @@
+package frame
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"1700000000.123456", time.Unix(1700000000, 123456000)},
+		{"1700000000.000001", time.Unix(1700000000, 1000)},
+		{"1700000000.5", time.Unix(1700000000, 500000000)},
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"1700000000.1234567891", time.Unix(1700000000, 123456789)},
+	} {
+		got, err := ParseTimestamp(test.value)
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%q: parsed as %s, want %s", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "invalid", "1.2.3", "1700000000.x"} {
+		if _, err := ParseTimestamp(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+
+	// Formatting keeps microsecond precision, which parses back to the same time
+	timestamp := time.Unix(1700000000, 123456789)
+	formatted := FormatTimestamp(timestamp)
+	if formatted != "1700000000.123456" {
+		t.Errorf("formatted as %q, want 1700000000.123456", formatted)
+	}
+	if parsed, err := ParseTimestamp(formatted); err != nil || !parsed.Equal(timestamp.Truncate(time.Microsecond)) {
+		t.Errorf("%q parses as %s (%v), want %s", formatted, parsed, err, timestamp.Truncate(time.Microsecond))
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	f := &Frame{
+		Data:      []byte{0xFF, 0xD8, 0xFF, 0xD9},
+		Sequence:  7,
+		Timestamp: time.Unix(1700000000, 250000000),
+		Info:      Info{Width: 640, Height: 480},
+	}
+	header := textproto.MIMEHeader{}
+	f.SetHeaders(header, "garage")
+	for key, want := range map[string]string{
+		"Content-Type":   "image/jpeg",
+		"Content-Length": "4",
+		HeaderSequence:   "7",
+		HeaderTimestamp:  "1700000000.250000",
+		HeaderWidth:      "640",
+		HeaderHeight:     "480",
+		HeaderStream:     "garage",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s header is %q, want %q", key, got, want)
+		}
+	}
+
+	// Frames without a timestamp or stream name don't get those headers
+	header = textproto.MIMEHeader{}
+	(&Frame{}).SetHeaders(header, "")
+	for _, key := range []string{HeaderTimestamp, HeaderStream} {
+		if _, ok := header[key]; ok {
+			t.Errorf("unexpected %s header: %q", key, header.Get(key))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package frame
+
+import (
+	"errors"
+	"fmt"
+)
+
+// JPEG markers (see https://github.com/corkami/formats/blob/master/image/jpeg.md)
+const (
+	markerSOI = 0xD8 // Start of image
+	markerEOI = 0xD9 // End of image
+	markerSOS = 0xDA // Start of scan
+	markerTEM = 0x01 // Temporary (standalone)
+	markerRST = 0xD0 // Restart markers RST0-RST7 (standalone)
+)
+
+var (
+	ErrNotJPEG     = errors.New("missing JPEG start of image marker")
+	ErrTruncated   = errors.New("truncated JPEG segment")
+	ErrMissingSOF  = errors.New("missing JPEG start of frame segment")
+	ErrInvalidSOF  = errors.New("invalid JPEG start of frame segment")
+	ErrInvalidSize = errors.New("invalid JPEG image dimensions")
+)
+
+// Check if the given marker is a start of frame marker
+// (excluding DHT, JPG and DAC, which share the same range)
+func isSOF(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// Check if the given marker is a standalone marker without a length
+func isStandalone(marker byte) bool {
+	return marker == markerTEM || marker == markerSOI || marker == markerEOI || (marker >= markerRST && marker <= markerRST+7)
+}
+
+// Walk the JPEG segments up until the start of scan, filling in the frame
+// dimensions and sampling information from the start of frame segment
+func parseHeader(data []byte, info *Info) error {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return ErrNotJPEG
+	}
+
+	found := false
+	for i := 2; i < len(data); {
+		// Every segment starts with (one or more) 0xFF bytes
+		if data[i] != 0xFF {
+			return fmt.Errorf("unexpected byte 0x%02X at offset %d", data[i], i)
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return ErrTruncated
+		}
+		marker := data[i]
+		i++
+
+		// Standalone markers have no payload
+		if isStandalone(marker) {
+			if marker == markerEOI {
+				break
+			}
+			continue
+		}
+
+		// Every other segment is prefixed by its length (including the length itself)
+		if i+2 > len(data) {
+			return ErrTruncated
+		}
+		length := int(data[i])<<8 | int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			return ErrTruncated
+		}
+		segment := data[i+2 : i+length]
+
+		if isSOF(marker) {
+			if err := parseSOF(marker, segment, info); err != nil {
+				return err
+			}
+			found = true
+		}
+
+		// Everything after the start of scan is entropy coded data,
+		// so there's no more metadata to be found from here on
+		if marker == markerSOS {
+			break
+		}
+
+		i += length
+	}
+
+	if !found {
+		return ErrMissingSOF
+	}
+	return nil
+}
+
+// Parse the start of frame segment payload
+func parseSOF(marker byte, segment []byte, info *Info) error {
+	// Precision (1), height (2), width (2), component count (1)
+	if len(segment) < 6 {
+		return ErrInvalidSOF
+	}
+	height := int(segment[1])<<8 | int(segment[2])
+	width := int(segment[3])<<8 | int(segment[4])
+	components := int(segment[5])
+
+	// Every component has an id (1), sampling factors (1) and quantization table (1)
+	if components < 1 || len(segment) < 6+components*3 {
+		return ErrInvalidSOF
+	}
+	if width <= 0 || height <= 0 {
+		return ErrInvalidSize
+	}
+
+	info.SOF = marker
+	info.Width = width
+	info.Height = height
+	info.Components = components
+	info.Subsampling = subsampling(segment[6:], components)
+	return nil
+}
+
+// Describe the chroma subsampling, based on the sampling factors of the luma component
+func subsampling(components []byte, count int) string {
+	if count == 1 {
+		return "gray"
+	}
+
+	// Chroma components are expected to be sampled once per MCU (1x1),
+	// so the luma sampling factors alone determine the subsampling
+	h := components[1] >> 4
+	v := components[1] & 0x0F
+	switch {
+	case h == 1 && v == 1:
+		return "4:4:4"
+	case h == 2 && v == 1:
+		return "4:2:2"
+	case h == 2 && v == 2:
+		return "4:2:0"
+	case h == 1 && v == 2:
+		return "4:4:0"
+	case h == 4 && v == 1:
+		return "4:1:1"
+	default:
+		return fmt.Sprintf("%dx%d", h, v)
+	}
+}
@@ -0,0 +1,142 @@
+package frame
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JPEG metadata markers
+const (
+	markerAPP0 = 0xE0 // Application segments APP0-APP15
+	markerCOM  = 0xFE // Comment
+)
+
+var (
+	ErrInvalidSegment = errors.New("invalid JPEG segment name")
+	ErrCommentTooLong = errors.New("JPEG comment is too long")
+)
+
+// MetadataFilter removes the application (APPn) and comment (COM) segments of JPEG images,
+// such as EXIF data with GPS coordinates, without re-encoding them (except for the ones it keeps)
+type MetadataFilter struct {
+	// The APPn segments that are kept, eg. APP0 for JFIF and APP14 for Adobe (which affects the colors of some images)
+	KeepApp [16]bool
+
+	// Whether comment segments are kept
+	KeepComments bool
+}
+
+// Parse a metadata filter from the comma separated segments to keep (eg. "APP0,APP14,COM"),
+// where an empty string strips every APPn and comment segment
+func ParseMetadataFilter(keep string) (*MetadataFilter, error) {
+	filter := &MetadataFilter{}
+	for _, name := range strings.Split(keep, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "COM" {
+			filter.KeepComments = true
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "APP"))
+		if !strings.HasPrefix(name, "APP") || err != nil || n < 0 || n > 15 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSegment, name)
+		}
+		filter.KeepApp[n] = true
+	}
+	return filter, nil
+}
+
+// Remove the filtered segments from the JPEG image data, returning the new data
+// and the number of bytes that were removed (images that can't be parsed are returned as is)
+func (m *MetadataFilter) Apply(data []byte) ([]byte, int) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return data, 0
+	}
+
+	var out []byte
+	kept := 2
+	for i := 2; i < len(data); {
+		start := i
+		if data[i] != 0xFF {
+			return data, 0
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return data, 0
+		}
+		marker := data[i]
+		i++
+		if isStandalone(marker) {
+			continue
+		}
+		if i+2 > len(data) {
+			return data, 0
+		}
+		length := int(data[i])<<8 | int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			return data, 0
+		}
+		i += length
+
+		// Everything from the start of scan on is kept as is
+		if marker == markerSOS {
+			break
+		}
+
+		// Copy everything before the removed segment, and skip the segment itself
+		if m.removes(marker) {
+			if out == nil {
+				out = append(make([]byte, 0, len(data)), data[:2]...)
+			}
+			out = append(out, data[kept:start]...)
+			kept = i
+		}
+	}
+
+	if out == nil {
+		return data, 0
+	}
+	out = append(out, data[kept:]...)
+	return out, len(data) - len(out)
+}
+
+// Check if the filter removes the segment with the given marker
+func (m *MetadataFilter) removes(marker byte) bool {
+	if marker >= markerAPP0 && marker <= markerAPP0+15 {
+		return !m.KeepApp[marker-markerAPP0]
+	}
+	return marker == markerCOM && !m.KeepComments
+}
+
+// Insert a comment segment with the given text into the JPEG image data, returning the new data.
+//
+// The comment is inserted after any leading APP0 segment, as JFIF requires it to come first.
+func InsertComment(data []byte, text string) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, ErrNotJPEG
+	}
+	length := 2 + len(text)
+	if length > 0xFFFF {
+		return nil, ErrCommentTooLong
+	}
+
+	at := 2
+	if data[2] == 0xFF && data[3] == markerAPP0 && len(data) >= 6 {
+		at = 4 + (int(data[4])<<8 | int(data[5]))
+		if at > len(data) {
+			return nil, ErrTruncated
+		}
+	}
+
+	out := make([]byte, 0, len(data)+2+length)
+	out = append(out, data[:at]...)
+	out = append(out, 0xFF, markerCOM, byte(length>>8), byte(length))
+	out = append(out, text...)
+	return append(out, data[at:]...), nil
+}
@@ -0,0 +1,170 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// Build a segment with the given marker and payload
+func segment(marker byte, payload string) []byte {
+	length := 2 + len(payload)
+	return append([]byte{0xFF, marker, byte(length >> 8), byte(length)}, payload...)
+}
+
+// List the markers of the segments before the scan data, including the start of scan
+func segmentMarkers(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	var markers []byte
+	for i := 2; i+4 <= len(data); {
+		markers = append(markers, data[i+1])
+		if data[i+1] == markerSOS {
+			return markers
+		}
+		i += 2 + (int(data[i+2])<<8 | int(data[i+3]))
+	}
+	tb.Fatal("no start of scan")
+	return nil
+}
+
+// Check that the image data still decodes
+func checkDecodes(tb testing.TB, name string, data []byte) {
+	tb.Helper()
+	if err := Validate(data, ValidateDecode); err != nil {
+		tb.Errorf("%s: %v", name, err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		tb.Errorf("%s: %v", name, err)
+	}
+}
+
+func TestMetadataFilterApply(t *testing.T) {
+	// A frame with JFIF, EXIF and Adobe segments and a comment, as written by some cameras
+	encoded := smallJPEG(t)
+	data := concat(
+		encoded[:2],
+		segment(markerAPP0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"),
+		segment(markerAPP0+1, "Exif\x00\x00GPS 59.3293N 18.0686E"),
+		segment(markerCOM, "Front door"),
+		segment(markerAPP0+14, "Adobe\x00\x64\x00\x00\x00\x00\x01"),
+		encoded[2:],
+	)
+	tables := segmentMarkers(t, encoded)
+
+	for _, test := range []struct {
+		keep string
+		want []byte
+		exif bool
+	}{
+		{"", tables, false},
+		{"APP0,APP14", concat([]byte{markerAPP0, markerAPP0 + 14}, tables), false},
+		{"APP1", concat([]byte{markerAPP0 + 1}, tables), true},
+		{"COM", concat([]byte{markerCOM}, tables), false},
+		{"app0, com", concat([]byte{markerAPP0, markerCOM}, tables), false},
+	} {
+		filter, err := ParseMetadataFilter(test.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, removed := filter.Apply(data)
+		if got := segmentMarkers(t, out); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: kept segments % X, want % X", test.keep, got, test.want)
+		}
+		if removed != len(data)-len(out) || removed == 0 {
+			t.Errorf("%q: reported %d bytes removed, but %d were removed", test.keep, removed, len(data)-len(out))
+		}
+		if !bytes.HasSuffix(out, encoded[2:]) {
+			t.Errorf("%q: tables or scan data were changed", test.keep)
+		}
+		if bytes.Contains(out, []byte("GPS")) != test.exif {
+			t.Errorf("%q: EXIF data wasn't filtered", test.keep)
+		}
+		checkDecodes(t, test.keep, out)
+	}
+
+	// Frames that keep every segment, and frames that can't be parsed, are returned as is
+	keepAll, err := ParseMetadataFilter("APP0,APP1,APP14,COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		filter *MetadataFilter
+		data   []byte
+	}{
+		{"every segment kept", keepAll, data},
+		{"no metadata", &MetadataFilter{}, encoded},
+		{"not a JPEG", &MetadataFilter{}, []byte("not a JPEG image")},
+		{"truncated segment", &MetadataFilter{}, data[:10]},
+	} {
+		if out, removed := test.filter.Apply(test.data); removed != 0 || &out[0] != &test.data[0] {
+			t.Errorf("%s: data was changed, %d bytes removed", test.name, removed)
+		}
+	}
+}
+
+func TestParseMetadataFilter(t *testing.T) {
+	filter, err := ParseMetadataFilter(" APP0 ,app15,COM,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, keep := range filter.KeepApp {
+		if keep != (n == 0 || n == 15) {
+			t.Errorf("APP%d is kept: %t", n, keep)
+		}
+	}
+	if !filter.KeepComments {
+		t.Error("comments aren't kept")
+	}
+
+	for _, keep := range []string{"APP16", "APP-1", "APPX", "EXIF", "0"} {
+		if _, err := ParseMetadataFilter(keep); !errors.Is(err, ErrInvalidSegment) {
+			t.Errorf("%q: unexpected error %v", keep, err)
+		}
+	}
+}
+
+func TestInsertComment(t *testing.T) {
+	encoded := smallJPEG(t)
+	jfif := segment(markerAPP0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	comment := segment(markerCOM, "camera 1, 2024-03-05 06:08:09")
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		// The comment lands right after the start of image, or after the JFIF header which has to come first
+		{"no JFIF header", encoded, concat(encoded[:2], comment, encoded[2:])},
+		{"JFIF header", concat(encoded[:2], jfif, encoded[2:]), concat(encoded[:2], jfif, comment, encoded[2:])},
+	} {
+		out, err := InsertComment(test.data, "camera 1, 2024-03-05 06:08:09")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, test.want) {
+			t.Errorf("%s: comment was inserted at segments % X", test.name, segmentMarkers(t, out))
+		}
+		checkDecodes(t, test.name, out)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		text string
+		err  error
+	}{
+		{"not a JPEG", []byte("not a JPEG image"), "text", ErrNotJPEG},
+		{"truncated JFIF header", concat(encoded[:2], jfif[:10]), "text", ErrTruncated},
+		{"too long", encoded, strings.Repeat("x", 0xFFFE), ErrCommentTooLong},
+	} {
+		if _, err := InsertComment(test.data, test.text); !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+	if _, err := InsertComment(encoded, strings.Repeat("x", 0xFFFD)); err != nil {
+		t.Errorf("longest comment: %v", err)
+	}
+}
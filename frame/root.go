@@ -0,0 +1,70 @@
+package frame
+
+import (
+	"time"
+)
+
+// FNV-1a constants (see hash/fnv), inlined to avoid allocating a hasher per frame
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Frame is a single complete JPEG image, along with the metadata
+// that was parsed from it when it was received
+type Frame struct {
+	// Data holds the encoded JPEG image and must not be modified,
+	// as the same frame is shared between all consumers
+	Data []byte
+
+	// Sequence is incremented by the source for every frame it receives
+	Sequence uint64
+
+	// Timestamp is the time the source received the frame
+	Timestamp time.Time
+
+	// Placeholder is set for frames the source shows while it isn't receiving any frames,
+	// so they can be told apart from real frames
+	Placeholder bool
+
+	Info
+}
+
+// Info holds the metadata of a single JPEG image
+type Info struct {
+	Width       int
+	Height      int
+	SOF         byte   // Start of frame marker (eg. 0xC0 for baseline, 0xC2 for progressive)
+	Components  int    // Number of color components (1 for grayscale, 3 for YCbCr)
+	Subsampling string // Chroma subsampling (eg. "4:2:0"), or "gray" for single component images
+	Size        int    // Size of the encoded image in bytes
+	Hash        uint64 // FNV-1a hash of the encoded image
+}
+
+// Create a new Frame from the given JPEG image data, parsing its metadata once
+func New(data []byte) (*Frame, error) {
+	info, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Data: data, Info: info}, nil
+}
+
+// Parse the metadata of the given JPEG image data
+func Parse(data []byte) (Info, error) {
+	info := Info{Size: len(data), Hash: Hash(data)}
+	if err := parseHeader(data, &info); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// Calculate the FNV-1a hash of the given data
+func Hash(data []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return h
+}
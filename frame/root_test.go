@@ -0,0 +1,69 @@
+package frame
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Encode a 1280x720 test frame
+func testJPEG(tb testing.TB) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 1280, 720))
+	for y := 0; y < 720; y++ {
+		for x := 0; x < 1280; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Measure parsing the metadata of a frame once, when it's received
+func BenchmarkNew(b *testing.B) {
+	data := testJPEG(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := New(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if f.Width != 1280 || f.Height != 720 {
+			b.Fatalf("unexpected frame size: %dx%d", f.Width, f.Height)
+		}
+	}
+}
+
+// Measure decoding the configuration of a frame with image.DecodeConfig,
+// which is what getting the size of the current frame used to do on every tick
+func BenchmarkDecodeConfig(b *testing.B) {
+	data := testJPEG(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if config.Width != 1280 || config.Height != 720 {
+			b.Fatalf("unexpected frame size: %dx%d", config.Width, config.Height)
+		}
+	}
+}
+
+// Measure the default validation of a received frame
+func BenchmarkValidate(b *testing.B) {
+	data := testJPEG(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Validate(data, DefaultValidation); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
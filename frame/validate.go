@@ -0,0 +1,344 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"strings"
+)
+
+// Validation is how thoroughly incoming frames are checked before they are published
+type Validation int
+
+const (
+	// ValidateNone only requires the start and end of image markers
+	ValidateNone Validation = iota
+
+	// ValidateMarkers walks every segment and the entropy coded data,
+	// rejecting frames with truncated segments, unexpected bytes or markers, or without a scan
+	// (frames that lost data from the middle of a scan are only caught by decoding them)
+	ValidateMarkers
+
+	// ValidateHeader also checks the quantization and Huffman tables, the frame header
+	// and the scan headers, rejecting frames that reference tables or components that don't exist
+	ValidateHeader
+
+	// ValidateDecode also decodes the whole image, rejecting frames with corrupt image data
+	ValidateDecode
+)
+
+// DefaultValidation is the validation that is used when none is given
+const DefaultValidation = ValidateMarkers
+
+// Reasons why a frame was rejected
+const (
+	ReasonNotJPEG   = "not_jpeg"
+	ReasonTruncated = "truncated"
+	ReasonStructure = "structure"
+	ReasonHeader    = "header"
+	ReasonDecode    = "decode"
+	ReasonInvalid   = "invalid"
+)
+
+var (
+	ErrInvalidValidation = errors.New("invalid validation level")
+	ErrMissingEOI        = errors.New("missing JPEG end of image marker")
+	ErrMissingScan       = errors.New("missing JPEG start of scan segment")
+	ErrTrailingData      = errors.New("unexpected data after JPEG end of image marker")
+	ErrMissingHuffman    = errors.New("missing JPEG Huffman table")
+	ErrMissingQuant      = errors.New("missing JPEG quantization table")
+)
+
+var validationNames = [...]string{"none", "markers", "header", "decode"}
+
+// Get the name of the validation level
+func (v Validation) String() string {
+	if v < 0 || int(v) >= len(validationNames) {
+		return fmt.Sprintf("Validation(%d)", int(v))
+	}
+	return validationNames[v]
+}
+
+// Parse a validation level from its name
+func ParseValidation(name string) (Validation, error) {
+	name = strings.ToLower(name)
+	for i, validationName := range validationNames {
+		if name == validationName {
+			return Validation(i), nil
+		}
+	}
+	return DefaultValidation, fmt.Errorf("%w: %s", ErrInvalidValidation, name)
+}
+
+// ValidationError is returned for frames that failed validation, along with the reason they were rejected
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Create a new ValidationError
+func reject(reason string, err error) error {
+	return &ValidationError{Reason: reason, Err: err}
+}
+
+// Get the reason a frame was rejected for the given validation or parsing error
+func Reason(err error) string {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return validationErr.Reason
+	case errors.Is(err, ErrNotJPEG):
+		return ReasonNotJPEG
+	case errors.Is(err, ErrTruncated):
+		return ReasonTruncated
+	case errors.Is(err, ErrMissingSOF), errors.Is(err, ErrInvalidSOF), errors.Is(err, ErrInvalidSize):
+		return ReasonHeader
+	default:
+		return ReasonInvalid
+	}
+}
+
+// Validate the given JPEG image data at the given level, returning a ValidationError if it should be rejected
+func Validate(data []byte, level Validation) error {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return reject(ReasonNotJPEG, ErrNotJPEG)
+	}
+	if data[len(data)-2] != 0xFF || data[len(data)-1] != markerEOI {
+		return reject(ReasonTruncated, ErrMissingEOI)
+	}
+	if level <= ValidateNone {
+		return nil
+	}
+
+	var tables *headerTables
+	if level >= ValidateHeader {
+		tables = &headerTables{}
+	}
+	if err := validateSegments(data, tables); err != nil {
+		return err
+	}
+
+	if level >= ValidateDecode {
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			return reject(ReasonDecode, err)
+		}
+	}
+	return nil
+}
+
+// Walk every segment and the entropy coded data of the scans until the end of image marker,
+// checking the tables and headers along the way if they are given
+func validateSegments(data []byte, tables *headerTables) error {
+	sawSOF, sawSOS := false, false
+	for i := 2; ; {
+		if i >= len(data) {
+			return reject(ReasonTruncated, ErrMissingEOI)
+		}
+
+		// Every segment starts with (one or more) 0xFF bytes
+		if data[i] != 0xFF {
+			return reject(ReasonStructure, fmt.Errorf("unexpected byte 0x%02X at offset %d", data[i], i))
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return reject(ReasonTruncated, ErrTruncated)
+		}
+		marker := data[i]
+		i++
+
+		// The end of image marker has to be the last thing in the frame, after at least one scan
+		if marker == markerEOI {
+			if !sawSOS {
+				return reject(ReasonStructure, ErrMissingScan)
+			}
+			if i != len(data) {
+				return reject(ReasonStructure, ErrTrailingData)
+			}
+			return nil
+		}
+		if marker == markerSOI || marker == 0x00 {
+			return reject(ReasonStructure, fmt.Errorf("unexpected marker 0x%02X at offset %d", marker, i-1))
+		}
+		if isStandalone(marker) {
+			continue
+		}
+
+		// Every other segment is prefixed by its length (including the length itself)
+		if i+2 > len(data) {
+			return reject(ReasonTruncated, ErrTruncated)
+		}
+		length := int(data[i])<<8 | int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			return reject(ReasonTruncated, ErrTruncated)
+		}
+		segment := data[i+2 : i+length]
+		i += length
+
+		if tables != nil {
+			if err := tables.check(marker, segment); err != nil {
+				return reject(ReasonHeader, err)
+			}
+		}
+		if isSOF(marker) {
+			sawSOF = true
+		}
+		if marker != markerSOS {
+			continue
+		}
+		if !sawSOF {
+			return reject(ReasonStructure, ErrMissingSOF)
+		}
+		sawSOS = true
+
+		// Skip the entropy coded data, which may only contain stuffed 0xFF bytes,
+		// fill bytes and restart markers, until the next marker
+		for {
+			next := bytes.IndexByte(data[i:], 0xFF)
+			if next < 0 || i+next+1 >= len(data) {
+				return reject(ReasonTruncated, ErrMissingEOI)
+			}
+			i += next
+			if following := data[i+1]; following == 0x00 || (following >= markerRST && following <= markerRST+7) {
+				i += 2
+				continue
+			} else if following == 0xFF {
+				i++
+				continue
+			}
+			break
+		}
+	}
+}
+
+// headerTables keeps track of the tables and components that were defined so far,
+// so the scans can be checked against them
+type headerTables struct {
+	quant      [4]bool
+	huffman    [2][4]bool // DC and AC tables
+	sof        byte
+	components []byte // Component ids and their quantization tables, in pairs
+}
+
+// Check a single segment, recording the tables and components it defines
+func (h *headerTables) check(marker byte, segment []byte) error {
+	switch {
+	case marker == 0xDB:
+		return h.checkDQT(segment)
+	case marker == 0xC4:
+		return h.checkDHT(segment)
+	case isSOF(marker):
+		return h.checkSOF(marker, segment)
+	case marker == markerSOS:
+		return h.checkSOS(segment)
+	}
+	return nil
+}
+
+// Check a quantization table segment, which may define several tables
+func (h *headerTables) checkDQT(segment []byte) error {
+	for len(segment) > 0 {
+		precision, id := segment[0]>>4, segment[0]&0x0F
+		size := 1 + 64*(int(precision)+1)
+		if precision > 1 || id > 3 || len(segment) < size {
+			return errors.New("invalid JPEG quantization table")
+		}
+		h.quant[id] = true
+		segment = segment[size:]
+	}
+	return nil
+}
+
+// Check a Huffman table segment, which may define several tables
+func (h *headerTables) checkDHT(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errors.New("invalid JPEG Huffman table")
+		}
+		class, id := segment[0]>>4, segment[0]&0x0F
+		count := 0
+		for _, n := range segment[1:17] {
+			count += int(n)
+		}
+		if class > 1 || id > 3 || count > 256 || len(segment) < 17+count {
+			return errors.New("invalid JPEG Huffman table")
+		}
+		h.huffman[class][id] = true
+		segment = segment[17+count:]
+	}
+	return nil
+}
+
+// Check the frame header, recording its components
+func (h *headerTables) checkSOF(marker byte, segment []byte) error {
+	if h.sof != 0 {
+		return errors.New("duplicate JPEG start of frame segment")
+	}
+	var info Info
+	if err := parseSOF(marker, segment, &info); err != nil {
+		return err
+	}
+	h.sof = marker
+	for c := 0; c < info.Components; c++ {
+		id, table := segment[6+c*3], segment[6+c*3+2]
+		if table > 3 {
+			return ErrInvalidSOF
+		}
+		h.components = append(h.components, id, table)
+	}
+	return nil
+}
+
+// Check a scan header against the frame header and the tables defined so far
+func (h *headerTables) checkSOS(segment []byte) error {
+	if len(segment) < 1 {
+		return errors.New("invalid JPEG start of scan segment")
+	}
+	count := int(segment[0])
+	if count < 1 || count > 4 || len(segment) != 1+2*count+3 {
+		return errors.New("invalid JPEG start of scan segment")
+	}
+	start, approximation := segment[1+2*count], segment[3+2*count]>>4
+
+	// Huffman coded frames need the tables that their scans use, where progressive scans
+	// only use either the DC tables (and refining the DC coefficients uses none) or the AC tables
+	huffman := h.sof >= 0xC0 && h.sof <= 0xC7
+	progressive := h.sof == 0xC2 || h.sof == 0xC6
+	needsDC := huffman && (!progressive || (start == 0 && approximation == 0))
+	needsAC := huffman && (!progressive || start > 0)
+
+	for c := 0; c < count; c++ {
+		id, dc, ac := segment[1+c*2], segment[2+c*2]>>4, segment[2+c*2]&0x0F
+		table, ok := h.component(id)
+		if !ok {
+			return fmt.Errorf("JPEG scan references unknown component %d", id)
+		}
+		if !h.quant[table] {
+			return fmt.Errorf("%w %d", ErrMissingQuant, table)
+		}
+		if (needsDC && (dc > 3 || !h.huffman[0][dc])) || (needsAC && (ac > 3 || !h.huffman[1][ac])) {
+			return ErrMissingHuffman
+		}
+	}
+	return nil
+}
+
+// Get the quantization table of the component with the given id
+func (h *headerTables) component(id byte) (byte, bool) {
+	for i := 0; i+1 < len(h.components); i += 2 {
+		if h.components[i] == id {
+			return h.components[i+1], true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,150 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Encode a small test frame
+func smallJPEG(tb testing.TB) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Find the first segment with the given marker before the scan data, returning its start and end offsets
+func findSegment(tb testing.TB, data []byte, marker byte) (int, int) {
+	tb.Helper()
+	for i := 2; i+4 <= len(data); {
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if data[i+1] == marker {
+			return i, i + 2 + length
+		}
+		if data[i+1] == markerSOS {
+			break
+		}
+		i += 2 + length
+	}
+	tb.Fatalf("no segment with marker 0x%02X", marker)
+	return 0, 0
+}
+
+// Remove the first segment with the given marker
+func removeSegment(tb testing.TB, data []byte, marker byte) []byte {
+	tb.Helper()
+	start, end := findSegment(tb, data, marker)
+	return concat(data[:start], data[end:])
+}
+
+// Concatenate byte slices into a new slice
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestValidate(t *testing.T) {
+	valid := smallJPEG(t)
+	_, scan := findSegment(t, valid, markerSOS)
+	middle := scan + (len(valid)-scan)/2
+	eoi := []byte{0xFF, markerEOI}
+
+	// The scan references a component that isn't in the frame header
+	unknownComponent := concat(valid)
+	unknownComponent[scan-6] = 9
+
+	for _, test := range []struct {
+		name string
+		data []byte
+
+		// Reason the frame is rejected for at every level (none, markers, header and decode),
+		// or an empty string if it's accepted
+		reasons [4]string
+	}{
+		{"valid", valid, [4]string{"", "", "", ""}},
+		{"empty", nil, [4]string{ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG}},
+		{"garbage", []byte("<html>not a JPEG image</html>"), [4]string{ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG}},
+		{"missing SOI", valid[2:], [4]string{ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG, ReasonNotJPEG}},
+
+		// Frames that are cut off anywhere lose their end of image marker
+		{"missing EOI", valid[:len(valid)-2], [4]string{ReasonTruncated, ReasonTruncated, ReasonTruncated, ReasonTruncated}},
+		{"truncated scan", valid[:middle], [4]string{ReasonTruncated, ReasonTruncated, ReasonTruncated, ReasonTruncated}},
+
+		// Frames that lost data but still end with the end of image marker
+		{"truncated headers", concat(valid[:30], eoi), [4]string{"", ReasonTruncated, ReasonTruncated, ReasonTruncated}},
+		{"missing scan", concat(valid[:scan-14], eoi), [4]string{"", ReasonStructure, ReasonStructure, ReasonStructure}},
+		{"corrupt scan", concat(valid[:scan+16], valid[middle:]), [4]string{"", "", "", ReasonDecode}},
+		{"unexpected marker in the scan", concat(valid[:middle], []byte{0xFF, markerSOI}, valid[middle:]), [4]string{"", ReasonStructure, ReasonStructure, ReasonStructure}},
+		{"trailing data", concat(valid, []byte("trailing"), eoi), [4]string{"", ReasonStructure, ReasonStructure, ReasonStructure}},
+
+		// Frames with headers that reference tables or components that don't exist,
+		// which includes a scan without a frame header once the headers are checked
+		{"missing Huffman tables", removeSegment(t, valid, 0xC4), [4]string{"", "", ReasonHeader, ReasonHeader}},
+		{"missing quantization tables", removeSegment(t, valid, 0xDB), [4]string{"", "", ReasonHeader, ReasonHeader}},
+		{"missing frame header", removeSegment(t, valid, 0xC0), [4]string{"", ReasonStructure, ReasonHeader, ReasonHeader}},
+		{"unknown component", unknownComponent, [4]string{"", "", ReasonHeader, ReasonHeader}},
+	} {
+		for level, want := range test.reasons {
+			err := Validate(test.data, Validation(level))
+			var validationErr *ValidationError
+			switch {
+			case want == "" && err != nil:
+				t.Errorf("%s: rejected at level %s: %v", test.name, Validation(level), err)
+			case want != "" && err == nil:
+				t.Errorf("%s: accepted at level %s, want it rejected as %s", test.name, Validation(level), want)
+			case want != "" && !errors.As(err, &validationErr):
+				t.Errorf("%s: level %s returned %T, want a ValidationError", test.name, Validation(level), err)
+			case want != "" && Reason(err) != want:
+				t.Errorf("%s: rejected at level %s as %s (%v), want %s", test.name, Validation(level), Reason(err), err, want)
+			}
+		}
+	}
+}
+
+func TestReason(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{reject(ReasonDecode, errors.New("corrupt")), ReasonDecode},
+		{ErrNotJPEG, ReasonNotJPEG},
+		{ErrTruncated, ReasonTruncated},
+		{ErrMissingSOF, ReasonHeader},
+		{ErrInvalidSize, ReasonHeader},
+		{errors.New("something else"), ReasonInvalid},
+	} {
+		if got := Reason(test.err); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want Validation
+	}{
+		{"none", ValidateNone}, {"Markers", ValidateMarkers}, {"HEADER", ValidateHeader}, {"decode", ValidateDecode},
+	} {
+		validation, err := ParseValidation(test.name)
+		if err != nil || validation != test.want {
+			t.Errorf("%q: got %v (%v), want %v", test.name, validation, err, test.want)
+		}
+		if validation.String() != validationNames[test.want] {
+			t.Errorf("%v: unexpected name %q", validation, validation.String())
+		}
+	}
+	if _, err := ParseValidation("strict"); !errors.Is(err, ErrInvalidValidation) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
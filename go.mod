@@ -1,5 +1,3 @@
 module didstopia/mjpeg-server
 
 go 1.18
-
-require github.com/mattn/go-mjpeg v0.0.3
@@ -0,0 +1,21 @@
+package imaging
+
+import (
+	"image"
+)
+
+// Crop an image to the given rectangle (relative to the top left corner of the image),
+// which is clipped to the bounds of the image
+func Crop(src *image.RGBA, rect image.Rectangle) *image.RGBA {
+	rect = rect.Add(src.Rect.Min).Intersect(src.Rect)
+	if rect == src.Rect {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	for y := 0; y < rect.Dy(); y++ {
+		offset := src.PixOffset(rect.Min.X, rect.Min.Y+y)
+		copy(dst.Pix[y*dst.Stride:y*dst.Stride+rect.Dx()*4], src.Pix[offset:])
+	}
+	return dst
+}
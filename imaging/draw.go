@@ -0,0 +1,297 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fill the rectangle with the given color, blending it with the image if the color is translucent
+func FillRect(img *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	rect = rect.Intersect(img.Rect)
+	if rect.Empty() || c.A == 0 {
+		return
+	}
+
+	// Colors are alpha premultiplied, so blending is dst*(1-alpha) + src
+	inverse := 255 - uint32(c.A)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if inverse == 0 {
+				row[i], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+				continue
+			}
+			row[i] = uint8((uint32(row[i])*inverse+127)/255 + uint32(c.R))
+			row[i+1] = uint8((uint32(row[i+1])*inverse+127)/255 + uint32(c.G))
+			row[i+2] = uint8((uint32(row[i+2])*inverse+127)/255 + uint32(c.B))
+			row[i+3] = uint8((uint32(row[i+3])*inverse+127)/255 + uint32(c.A))
+		}
+	}
+}
+
+// Draw the outline of the rectangle with the given line thickness, on the inside of the rectangle
+func DrawRect(img *image.RGBA, rect image.Rectangle, thickness int, c color.RGBA) {
+	if rect.Dx() <= 2*thickness || rect.Dy() <= 2*thickness {
+		FillRect(img, rect, c)
+		return
+	}
+	FillRect(img, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+thickness), c)
+	FillRect(img, image.Rect(rect.Min.X, rect.Max.Y-thickness, rect.Max.X, rect.Max.Y), c)
+	FillRect(img, image.Rect(rect.Min.X, rect.Min.Y+thickness, rect.Min.X+thickness, rect.Max.Y-thickness), c)
+	FillRect(img, image.Rect(rect.Max.X-thickness, rect.Min.Y+thickness, rect.Max.X, rect.Max.Y-thickness), c)
+}
+
+// Draw a line between the two points with the given thickness, with square ends
+// (translucent colors are blended more than once where the line overlaps itself)
+func DrawLine(img *image.RGBA, from, to image.Point, thickness int, c color.RGBA) {
+	// Only the part of the line that can touch the image is drawn,
+	// so lines far outside of it don't take any longer to draw
+	from, to, ok := clipLine(from, to, img.Rect.Inset(-thickness))
+	if !ok {
+		return
+	}
+
+	abs := func(value int) int {
+		if value < 0 {
+			return -value
+		}
+		return value
+	}
+	dx, dy := abs(to.X-from.X), -abs(to.Y-from.Y)
+	sx, sy := 1, 1
+	if from.X > to.X {
+		sx = -1
+	}
+	if from.Y > to.Y {
+		sy = -1
+	}
+
+	// Stamp a square at the first point of the line, and then only the edges of the square
+	// that move past the previous one at every further point (Bresenham's algorithm)
+	offset := image.Pt(thickness/2, thickness/2)
+	square := func(p image.Point) image.Rectangle {
+		min := p.Sub(offset)
+		return image.Rectangle{Min: min, Max: min.Add(image.Pt(thickness, thickness))}
+	}
+	FillRect(img, square(from), c)
+	for err := dx + dy; from != to; {
+		var step image.Point
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			step.X = sx
+		}
+		if e2 <= dx {
+			err += dx
+			step.Y = sy
+		}
+		from = from.Add(step)
+
+		rect := square(from)
+		if step.X != 0 {
+			column := rect
+			if step.X > 0 {
+				column.Min.X = rect.Max.X - 1
+				rect.Max.X--
+			} else {
+				column.Max.X = rect.Min.X + 1
+				rect.Min.X++
+			}
+			FillRect(img, column, c)
+		}
+		if step.Y > 0 {
+			rect.Min.Y = rect.Max.Y - 1
+			FillRect(img, rect, c)
+		} else if step.Y < 0 {
+			rect.Max.Y = rect.Min.Y + 1
+			FillRect(img, rect, c)
+		}
+	}
+}
+
+// Outcodes of a point, telling on which sides of a rectangle it lies
+const (
+	outsideLeft = 1 << iota
+	outsideRight
+	outsideTop
+	outsideBottom
+)
+
+// Clip the line between the two points to the rectangle (Cohen–Sutherland),
+// returning false if none of it lies within the rectangle
+func clipLine(from, to image.Point, rect image.Rectangle) (image.Point, image.Point, bool) {
+	if rect.Empty() {
+		return from, to, false
+	}
+	outcode := func(p image.Point) int {
+		code := 0
+		if p.X < rect.Min.X {
+			code |= outsideLeft
+		} else if p.X >= rect.Max.X {
+			code |= outsideRight
+		}
+		if p.Y < rect.Min.Y {
+			code |= outsideTop
+		} else if p.Y >= rect.Max.Y {
+			code |= outsideBottom
+		}
+		return code
+	}
+
+	codeFrom, codeTo := outcode(from), outcode(to)
+	for {
+		switch {
+		case codeFrom|codeTo == 0:
+			return from, to, true
+		case codeFrom&codeTo != 0:
+			return from, to, false
+		}
+
+		// Move the point that lies outside onto the edge it lies beyond
+		code := codeFrom
+		if code == 0 {
+			code = codeTo
+		}
+		x0, y0, x1, y1 := float64(from.X), float64(from.Y), float64(to.X), float64(to.Y)
+		var p image.Point
+		switch {
+		case code&outsideTop != 0:
+			p.Y = rect.Min.Y
+			p.X = int(math.Round(x0 + (x1-x0)*(float64(p.Y)-y0)/(y1-y0)))
+		case code&outsideBottom != 0:
+			p.Y = rect.Max.Y - 1
+			p.X = int(math.Round(x0 + (x1-x0)*(float64(p.Y)-y0)/(y1-y0)))
+		case code&outsideLeft != 0:
+			p.X = rect.Min.X
+			p.Y = int(math.Round(y0 + (y1-y0)*(float64(p.X)-x0)/(x1-x0)))
+		default:
+			p.X = rect.Max.X - 1
+			p.Y = int(math.Round(y0 + (y1-y0)*(float64(p.X)-x0)/(x1-x0)))
+		}
+		if code == codeFrom {
+			from, codeFrom = p, outcode(p)
+		} else {
+			to, codeTo = p, outcode(p)
+		}
+	}
+}
+
+// Get the brightness (BT.601 luma) of every pixel of the image, row by row
+func Luma(img *image.RGBA) []uint8 {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	luma := make([]uint8, width*height)
+	for y := 0; y < height; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):]
+		for x := 0; x < width; x++ {
+			r, g, b := uint32(row[x*4]), uint32(row[x*4+1]), uint32(row[x*4+2])
+			luma[y*width+x] = uint8((299*r + 587*g + 114*b + 500) / 1000)
+		}
+	}
+	return luma
+}
+
+// Parse a color in the #RGB, #RRGGBB or #RRGGBBAA format (the # is optional),
+// or one of the names black, white, red, green, blue, yellow and transparent
+func ParseColor(value string) (color.RGBA, error) {
+	switch strings.ToLower(value) {
+	case "black":
+		return color.RGBA{0, 0, 0, 255}, nil
+	case "white":
+		return color.RGBA{255, 255, 255, 255}, nil
+	case "red":
+		return color.RGBA{255, 0, 0, 255}, nil
+	case "green":
+		return color.RGBA{0, 255, 0, 255}, nil
+	case "blue":
+		return color.RGBA{0, 0, 255, 255}, nil
+	case "yellow":
+		return color.RGBA{255, 255, 0, 255}, nil
+	case "", "none", "transparent":
+		return color.RGBA{}, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color: %s", value)
+	}
+	parsed, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color: %s", value)
+	}
+
+	// Convert to alpha premultiplied
+	c := color.NRGBA{R: uint8(parsed >> 24), G: uint8(parsed >> 16), B: uint8(parsed >> 8), A: uint8(parsed)}
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
+
+// ErrInvalidPosition is returned when parsing an unknown position
+var ErrInvalidPosition = errors.New("invalid position")
+
+// Position is where something is placed within an image
+type Position int
+
+const (
+	TopLeft Position = iota
+	Top
+	TopRight
+	Left
+	Center
+	Right
+	BottomLeft
+	Bottom
+	BottomRight
+)
+
+var positionNames = []string{"top-left", "top", "top-right", "left", "center", "right", "bottom-left", "bottom", "bottom-right"}
+
+// Get the name of the position
+func (p Position) String() string {
+	if p < 0 || int(p) >= len(positionNames) {
+		return fmt.Sprintf("Position(%d)", int(p))
+	}
+	return positionNames[p]
+}
+
+// Parse a position from its name (such as top-left or bottom)
+func ParsePosition(name string) (Position, error) {
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	for i, positionName := range positionNames {
+		if name == positionName {
+			return Position(i), nil
+		}
+	}
+	return TopLeft, fmt.Errorf("%w: %s", ErrInvalidPosition, name)
+}
+
+// Place a box of the given size within the bounds at the position, keeping the margin from the edges
+func (p Position) Place(bounds image.Rectangle, width, height, margin int) image.Rectangle {
+	var x, y int
+	switch p % 3 {
+	case 0:
+		x = bounds.Min.X + margin
+	case 1:
+		x = bounds.Min.X + (bounds.Dx()-width)/2
+	default:
+		x = bounds.Max.X - margin - width
+	}
+	switch p / 3 {
+	case 0:
+		y = bounds.Min.Y + margin
+	case 1:
+		y = bounds.Min.Y + (bounds.Dy()-height)/2
+	default:
+		y = bounds.Max.Y - margin - height
+	}
+	return image.Rect(x, y, x+width, y+height)
+}
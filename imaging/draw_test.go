@@ -0,0 +1,122 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestClipLine(t *testing.T) {
+	rect := image.Rect(0, 0, 100, 50)
+	for _, test := range []struct {
+		from, to image.Point
+		want     [2]image.Point
+		ok       bool
+	}{
+		{image.Pt(10, 10), image.Pt(90, 40), [2]image.Point{{10, 10}, {90, 40}}, true},
+		{image.Pt(-1000, 10), image.Pt(1000, 10), [2]image.Point{{0, 10}, {99, 10}}, true},
+		{image.Pt(20, 500), image.Pt(20, -500), [2]image.Point{{20, 49}, {20, 0}}, true},
+		{image.Pt(-100000, -50000), image.Pt(100000, 50000), [2]image.Point{{0, 0}, {98, 49}}, true},
+		{image.Pt(50, 25), image.Pt(50, 100000), [2]image.Point{{50, 25}, {50, 49}}, true},
+
+		// Lines that miss the rectangle, either on one side of it or past one of its corners
+		{image.Pt(-10, -10), image.Pt(200, -5), [2]image.Point{}, false},
+		{image.Pt(100000, 0), image.Pt(100000, 100000), [2]image.Point{}, false},
+		{image.Pt(-10, 40), image.Pt(10, 70), [2]image.Point{}, false},
+	} {
+		from, to, ok := clipLine(test.from, test.to, rect)
+		if ok != test.ok || (ok && (from != test.want[0] || to != test.want[1])) {
+			t.Errorf("%v-%v: clipped to %v-%v (%t), want %v (%t)", test.from, test.to, from, to, ok, test.want, test.ok)
+		}
+	}
+	if _, _, ok := clipLine(image.Pt(0, 0), image.Pt(10, 10), image.Rectangle{}); ok {
+		t.Error("line was clipped to an empty rectangle")
+	}
+}
+
+func TestDrawLine(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	for _, test := range []struct {
+		name      string
+		from, to  image.Point
+		thickness int
+
+		// Pixels that are drawn, and pixels that aren't
+		drawn, clear []image.Point
+	}{
+		{"inside", image.Pt(10, 10), image.Pt(50, 30), 1, []image.Point{{10, 10}, {30, 20}, {50, 30}}, []image.Point{{10, 30}, {51, 30}}},
+		{"far outside", image.Pt(-100000, -50000), image.Pt(100000, 50000), 1, []image.Point{{0, 0}, {32, 16}, {63, 31}}, []image.Point{{0, 31}, {63, 0}}},
+		{"just outside", image.Pt(-3, 10), image.Pt(-3, 20), 8, []image.Point{{0, 10}, {0, 20}}, []image.Point{{1, 15}, {0, 5}}},
+		{"missing", image.Pt(-100000, -20), image.Pt(100000, -20), 8, nil, []image.Point{{0, 0}, {32, 0}, {63, 0}}},
+	} {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+		DrawLine(img, test.from, test.to, test.thickness, red)
+		for _, p := range test.drawn {
+			if img.RGBAAt(p.X, p.Y) != red {
+				t.Errorf("%s: pixel %v wasn't drawn", test.name, p)
+			}
+		}
+		for _, p := range test.clear {
+			if img.RGBAAt(p.X, p.Y) != (color.RGBA{}) {
+				t.Errorf("%s: pixel %v was drawn", test.name, p)
+			}
+		}
+	}
+}
+
+// Draw a line by stamping a whole square at every point of it
+func stampLine(img *image.RGBA, from, to image.Point, thickness int, c color.RGBA) {
+	steps := to.X - from.X
+	if steps < 0 {
+		steps = -steps
+	}
+	if dy := to.Y - from.Y; dy > steps {
+		steps = dy
+	} else if -dy > steps {
+		steps = -dy
+	}
+	for i := 0; i <= steps; i++ {
+		p := from
+		if steps > 0 {
+			p = from.Add(to.Sub(from).Mul(i).Div(steps))
+		}
+		min := p.Sub(image.Pt(thickness/2, thickness/2))
+		FillRect(img, image.Rectangle{Min: min, Max: min.Add(image.Pt(thickness, thickness))}, c)
+	}
+}
+
+func TestDrawLineEdges(t *testing.T) {
+	// Lines in every direction, which are straight or diagonal so every way of drawing them agrees
+	opaque, translucent := color.RGBA{255, 0, 0, 255}, color.RGBA{64, 0, 0, 128}
+	center := image.Pt(32, 32)
+	for _, direction := range []image.Point{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+		for _, thickness := range []int{1, 2, 5, 8} {
+			to := center.Add(direction.Mul(20))
+			want := image.NewRGBA(image.Rect(0, 0, 64, 64))
+			stampLine(want, center, to, thickness, opaque)
+			got := image.NewRGBA(want.Rect)
+			DrawLine(got, center, to, thickness, opaque)
+			if string(got.Pix) != string(want.Pix) {
+				t.Errorf("line to %v with thickness %d: drawn pixels differ from stamping squares", direction, thickness)
+			}
+
+			// Every pixel of a straight line is blended only once
+			blended := image.NewRGBA(want.Rect)
+			DrawLine(blended, center, to, thickness, translucent)
+			for i := 0; i < len(blended.Pix); i += 4 {
+				if drawn := want.Pix[i] != 0; drawn && blended.Pix[i] != translucent.R || !drawn && blended.Pix[i] != 0 {
+					t.Errorf("line to %v with thickness %d: pixel blended to %d", direction, thickness, blended.Pix[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+// Measure drawing the longest line an annotation can have, which is clipped to the image
+func BenchmarkDrawLine(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 1280, 720))
+	for i := 0; i < b.N; i++ {
+		DrawLine(img, image.Pt(-100000, -100000), image.Pt(100000, 100000), 64, color.RGBA{255, 0, 0, 255})
+	}
+}
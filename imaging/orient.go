@@ -0,0 +1,40 @@
+package imaging
+
+import (
+	"image"
+)
+
+// Transform an image by transposing it (mirroring it along the top left to bottom right diagonal),
+// then flipping it horizontally and/or vertically, which covers every rotation and mirroring
+func Orient(src *image.RGBA, transpose, flipH, flipV bool) *image.RGBA {
+	if !transpose && !flipH && !flipV {
+		return src
+	}
+
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	width, height := srcWidth, srcHeight
+	if transpose {
+		width, height = srcHeight, srcWidth
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		dstRow := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			// Map the destination pixel back to the source pixel
+			srcX, srcY := x, y
+			if flipH {
+				srcX = width - 1 - srcX
+			}
+			if flipV {
+				srcY = height - 1 - srcY
+			}
+			if transpose {
+				srcX, srcY = srcY, srcX
+			}
+			offset := src.PixOffset(src.Rect.Min.X+srcX, src.Rect.Min.Y+srcY)
+			copy(dstRow[x*4:x*4+4], src.Pix[offset:offset+4])
+		}
+	}
+	return dst
+}
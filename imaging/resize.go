@@ -0,0 +1,239 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Filter selects the resampling algorithm used when resizing
+type Filter int
+
+const (
+	// Area averages every source pixel covered by the destination pixel,
+	// which gives the best results when downscaling (falls back to Bilinear when upscaling)
+	Area Filter = iota
+
+	// Bilinear interpolates between the four nearest source pixels
+	Bilinear
+
+	// Nearest picks the nearest source pixel, which is the fastest but blockiest
+	Nearest
+)
+
+// DefaultFilter is the filter used when none is given
+const DefaultFilter = Area
+
+// Get the name of the filter
+func (f Filter) String() string {
+	switch f {
+	case Area:
+		return "area"
+	case Bilinear:
+		return "bilinear"
+	case Nearest:
+		return "nearest"
+	default:
+		return fmt.Sprintf("Filter(%d)", int(f))
+	}
+}
+
+// Encode the filter as its name
+func (f Filter) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// Parse a filter from its name
+func ParseFilter(name string) (Filter, error) {
+	switch strings.ToLower(name) {
+	case "", "area", "box":
+		return Area, nil
+	case "bilinear", "linear":
+		return Bilinear, nil
+	case "nearest", "nearest-neighbor":
+		return Nearest, nil
+	default:
+		return DefaultFilter, fmt.Errorf("unknown resampling filter: %s", name)
+	}
+}
+
+// Calculate the size that fits within the requested width and/or height while preserving
+// the aspect ratio of the source size, where zero means the dimension is unconstrained
+func FitSize(srcWidth, srcHeight, width, height int) (int, int) {
+	if srcWidth <= 0 || srcHeight <= 0 {
+		return 0, 0
+	}
+	switch {
+	case width <= 0 && height <= 0:
+		return srcWidth, srcHeight
+	case height <= 0:
+		height = int(math.Round(float64(width) * float64(srcHeight) / float64(srcWidth)))
+	case width <= 0:
+		width = int(math.Round(float64(height) * float64(srcWidth) / float64(srcHeight)))
+	default:
+		// Fit within the box, using whichever dimension is the most constraining
+		scaleX := float64(width) / float64(srcWidth)
+		scaleY := float64(height) / float64(srcHeight)
+		if scaleX < scaleY {
+			height = int(math.Round(float64(srcHeight) * scaleX))
+		} else {
+			width = int(math.Round(float64(srcWidth) * scaleY))
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// Resize an image to the given size using the given filter
+func Resize(src *image.RGBA, width, height int, filter Filter) *image.RGBA {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	if width == srcWidth && height == srcHeight {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if srcWidth == 0 || srcHeight == 0 || width == 0 || height == 0 {
+		return dst
+	}
+
+	switch filter {
+	case Nearest:
+		resizeNearest(src, dst)
+	case Bilinear:
+		resizeBilinear(src, dst)
+	default:
+		if width > srcWidth || height > srcHeight {
+			resizeBilinear(src, dst)
+		} else {
+			resizeArea(src, dst)
+		}
+	}
+	return dst
+}
+
+// Resize by picking the nearest source pixel
+func resizeNearest(src, dst *image.RGBA) {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+
+	// Precalculate the source offset of every column
+	columns := make([]int, width)
+	for x := range columns {
+		columns[x] = (x*srcWidth + srcWidth/2) / width * 4
+	}
+
+	for y := 0; y < height; y++ {
+		srcY := (y*srcHeight + srcHeight/2) / height
+		srcRow := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+srcY):]
+		dstRow := dst.Pix[y*dst.Stride:]
+		for x, offset := range columns {
+			copy(dstRow[x*4:x*4+4], srcRow[offset:offset+4])
+		}
+	}
+}
+
+// Resize by interpolating between the four nearest source pixels,
+// using 8-bit fixed point weights
+func resizeBilinear(src, dst *image.RGBA) {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+
+	// Map the destination pixel centers onto the source image
+	mapAxis := func(i, srcSize, size int) (int, int, uint32) {
+		position := (float64(i)+0.5)*float64(srcSize)/float64(size) - 0.5
+		if position < 0 {
+			position = 0
+		}
+		first := int(position)
+		if first >= srcSize-1 {
+			return srcSize - 1, srcSize - 1, 0
+		}
+		return first, first + 1, uint32((position - float64(first)) * 256)
+	}
+
+	type sample struct {
+		first, second int
+		weight        uint32
+	}
+	columns := make([]sample, width)
+	for x := range columns {
+		first, second, weight := mapAxis(x, srcWidth, width)
+		columns[x] = sample{first * 4, second * 4, weight}
+	}
+
+	for y := 0; y < height; y++ {
+		firstY, secondY, weightY := mapAxis(y, srcHeight, height)
+		top := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+firstY):]
+		bottom := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+secondY):]
+		dstRow := dst.Pix[y*dst.Stride:]
+		for x, column := range columns {
+			for c := 0; c < 4; c++ {
+				topValue := uint32(top[column.first+c])*(256-column.weight) + uint32(top[column.second+c])*column.weight
+				bottomValue := uint32(bottom[column.first+c])*(256-column.weight) + uint32(bottom[column.second+c])*column.weight
+				dstRow[x*4+c] = uint8((topValue*(256-weightY) + bottomValue*weightY) >> 16)
+			}
+		}
+	}
+}
+
+// Resize by averaging every source pixel that is covered by the destination pixel
+func resizeArea(src, dst *image.RGBA) {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+
+	// Precalculate the source column range of every destination column
+	columnStarts := make([]int, width+1)
+	for x := range columnStarts {
+		columnStarts[x] = x * srcWidth / width
+	}
+
+	sums := make([]uint32, width*4)
+	for y := 0; y < height; y++ {
+		firstY := y * srcHeight / height
+		lastY := (y + 1) * srcHeight / height
+		if lastY <= firstY {
+			lastY = firstY + 1
+		}
+
+		// Sum up every source row covered by this destination row
+		for i := range sums {
+			sums[i] = 0
+		}
+		for srcY := firstY; srcY < lastY; srcY++ {
+			srcRow := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+srcY):]
+			for x := 0; x < width; x++ {
+				firstX, lastX := columnStarts[x], columnStarts[x+1]
+				if lastX <= firstX {
+					lastX = firstX + 1
+				}
+				sum := sums[x*4 : x*4+4]
+				for srcX := firstX; srcX < lastX; srcX++ {
+					pixel := srcRow[srcX*4 : srcX*4+4]
+					sum[0] += uint32(pixel[0])
+					sum[1] += uint32(pixel[1])
+					sum[2] += uint32(pixel[2])
+					sum[3] += uint32(pixel[3])
+				}
+			}
+		}
+
+		// Divide by the number of source pixels to get the average
+		dstRow := dst.Pix[y*dst.Stride:]
+		rows := uint32(lastY - firstY)
+		for x := 0; x < width; x++ {
+			firstX, lastX := columnStarts[x], columnStarts[x+1]
+			if lastX <= firstX {
+				lastX = firstX + 1
+			}
+			count := rows * uint32(lastX-firstX)
+			for c := 0; c < 4; c++ {
+				dstRow[x*4+c] = uint8((sums[x*4+c] + count/2) / count)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// DefaultQuality is the JPEG quality used when re-encoding frames
+const DefaultQuality = 85
+
+// Decode a JPEG image
+func Decode(data []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// Encode an image as a JPEG with the given quality (1-100)
+func Encode(img image.Image, quality int) ([]byte, error) {
+	if quality < 1 || quality > 100 {
+		quality = DefaultQuality
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Convert an image to RGBA, returning it as is if it already is one
+func ToRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// Copy an image to a new RGBA image, so it can be modified without affecting the original
+func CloneRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		clone := image.NewRGBA(rgba.Rect)
+		copy(clone.Pix, rgba.Pix)
+		return clone
+	}
+	return ToRGBA(img)
+}
@@ -0,0 +1,386 @@
+package jpegtran
+
+import (
+	"errors"
+)
+
+// HuffmanTable is a Huffman table, as stored in a DHT segment
+type HuffmanTable struct {
+	Class  byte     // 0 for DC tables, 1 for AC tables
+	ID     byte     // Destination identifier (0-3)
+	Bits   [16]byte // Number of codes of each length (1-16 bits)
+	Values []byte   // Symbols, in order of increasing code length
+}
+
+// StandardTables are the typical Huffman tables from the JPEG specification (Annex K.3),
+// which every baseline decoder implicitly uses for MJPEG frames without any DHT segments
+var StandardTables = []HuffmanTable{
+	// Luminance DC
+	{
+		Class:  0,
+		ID:     0,
+		Bits:   [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		Values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Luminance AC
+	{
+		Class: 1,
+		ID:    0,
+		Bits:  [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		Values: []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	// Chrominance DC
+	{
+		Class:  0,
+		ID:     1,
+		Bits:   [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		Values: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Chrominance AC
+	{
+		Class: 1,
+		ID:    1,
+		Bits:  [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		Values: []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+var (
+	errInvalidHuffmanTable = errors.New("invalid Huffman table")
+	errInvalidHuffmanCode  = errors.New("invalid Huffman code")
+)
+
+// Build a complete DHT segment (including its marker) holding the given tables
+func DHTSegment(tables []HuffmanTable) []byte {
+	length := 2
+	for _, table := range tables {
+		length += 1 + 16 + len(table.Values)
+	}
+	segment := make([]byte, 0, 2+length)
+	segment = append(segment, 0xFF, markerDHT, byte(length>>8), byte(length))
+	for _, table := range tables {
+		segment = append(segment, table.Class<<4|table.ID)
+		segment = append(segment, table.Bits[:]...)
+		segment = append(segment, table.Values...)
+	}
+	return segment
+}
+
+// Insert the standard Huffman tables right before the start of scan of a sequential JPEG image
+// that has no DHT segments (as some MJPEG sources leave them out), so it can be decoded on its own.
+//
+// Images that already have Huffman tables (or aren't sequential Huffman coded, or can't be parsed)
+// are returned as is, along with false.
+func InsertStandardTables(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return data, false
+	}
+
+	sequential := false
+	for i := 2; i < len(data); {
+		// Skip any fill bytes before the marker
+		start := i
+		if data[i] != 0xFF {
+			return data, false
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i+2 >= len(data) {
+			return data, false
+		}
+		marker := data[i]
+		if marker == markerSOI || marker == markerEOI || (marker >= markerRST0 && marker <= markerRST0+7) {
+			i++
+			continue
+		}
+		length := int(data[i+1])<<8 | int(data[i+2])
+		if length < 2 {
+			return data, false
+		}
+		i += 1 + length
+
+		switch {
+		case marker == markerDHT:
+			return data, false
+		case marker == markerSOF0 || marker == markerSOF1:
+			sequential = true
+		case marker == markerSOS:
+			if !sequential {
+				return data, false
+			}
+			dht := DHTSegment(StandardTables)
+			out := make([]byte, 0, len(data)+len(dht))
+			out = append(out, data[:start]...)
+			out = append(out, dht...)
+			return append(out, data[start:]...), true
+		}
+	}
+	return data, false
+}
+
+// Parse the tables of a DHT segment payload
+func parseDHT(payload []byte) ([]HuffmanTable, error) {
+	var tables []HuffmanTable
+	for len(payload) > 0 {
+		if len(payload) < 17 {
+			return nil, errInvalidHuffmanTable
+		}
+		table := HuffmanTable{Class: payload[0] >> 4, ID: payload[0] & 0x0F}
+		copy(table.Bits[:], payload[1:17])
+		count := 0
+		for _, n := range table.Bits {
+			count += int(n)
+		}
+		if table.Class > 1 || table.ID > 3 || count > 256 || len(payload) < 17+count {
+			return nil, errInvalidHuffmanTable
+		}
+		table.Values = payload[17 : 17+count]
+		tables = append(tables, table)
+		payload = payload[17+count:]
+	}
+	return tables, nil
+}
+
+// huffmanDecoder decodes symbols using the canonical code ranges of each code length
+// (see the DECODE procedure in section F.2.2.3 of the JPEG specification)
+type huffmanDecoder struct {
+	minCode [17]int32
+	maxCode [17]int32
+	valPtr  [17]int32
+	values  []byte
+}
+
+// Create a new decoder for the given table
+func newHuffmanDecoder(table HuffmanTable) *huffmanDecoder {
+	d := &huffmanDecoder{values: table.Values}
+	code, index := int32(0), int32(0)
+	for length := 1; length <= 16; length++ {
+		count := int32(table.Bits[length-1])
+		d.maxCode[length] = -1
+		if count > 0 {
+			d.valPtr[length] = index
+			d.minCode[length] = code
+			code += count
+			index += count
+			d.maxCode[length] = code - 1
+		}
+		code <<= 1
+	}
+	return d
+}
+
+// huffmanEncoder holds the code and code length of every symbol
+type huffmanEncoder struct {
+	code [256]uint32
+	size [256]uint8
+}
+
+// Create a new encoder for the given table
+func newHuffmanEncoder(table HuffmanTable) *huffmanEncoder {
+	e := &huffmanEncoder{}
+	code, index := uint32(0), 0
+	for length := 1; length <= 16; length++ {
+		for i := 0; i < int(table.Bits[length-1]); i++ {
+			symbol := table.Values[index]
+			e.code[symbol] = code
+			e.size[symbol] = uint8(length)
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return e
+}
+
+// bitReader reads bits from entropy coded data, removing any stuffed zero bytes
+type bitReader struct {
+	data []byte
+	pos  int
+	bits uint32
+	n    uint
+}
+
+// Read a single byte of entropy coded data
+func (r *bitReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errTruncatedScan
+	}
+	b := r.data[r.pos]
+	if b == 0xFF {
+		// A stuffed zero byte follows every 0xFF data byte,
+		// anything else is a marker that ends the entropy coded data
+		if r.pos+1 >= len(r.data) || r.data[r.pos+1] != 0x00 {
+			return 0, errTruncatedScan
+		}
+		r.pos += 2
+		return b, nil
+	}
+	r.pos++
+	return b, nil
+}
+
+// Read the given number of bits (at most 16)
+func (r *bitReader) readBits(count uint) (uint32, error) {
+	for r.n < count {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		r.bits = r.bits<<8 | uint32(b)
+		r.n += 8
+	}
+	value := (r.bits >> (r.n - count)) & (1<<count - 1)
+	r.n -= count
+	return value, nil
+}
+
+// Decode a single symbol using the given decoder
+func (r *bitReader) decode(d *huffmanDecoder) (byte, error) {
+	code := int32(0)
+	for length := 1; length <= 16; length++ {
+		bit, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(bit)
+		if code <= d.maxCode[length] {
+			return d.values[d.valPtr[length]+code-d.minCode[length]], nil
+		}
+	}
+	return 0, errInvalidHuffmanCode
+}
+
+// Read a value of the given size category and extend its sign
+// (see the RECEIVE and EXTEND procedures in section F.2.2.1 of the JPEG specification)
+func (r *bitReader) receiveExtend(size uint8) (int32, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	bits, err := r.readBits(uint(size))
+	if err != nil {
+		return 0, err
+	}
+	value := int32(bits)
+	if value < 1<<(size-1) {
+		value += -1<<size + 1
+	}
+	return value, nil
+}
+
+// Skip past the restart marker that is expected at the current position
+func (r *bitReader) restart(expected byte) error {
+	r.bits, r.n = 0, 0
+	for r.pos < len(r.data) && r.data[r.pos] == 0xFF && r.pos+1 < len(r.data) && r.data[r.pos+1] == 0xFF {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xFF || r.data[r.pos+1] != expected {
+		return errMissingRestart
+	}
+	r.pos += 2
+	return nil
+}
+
+// Check that the entropy coded data is followed by the end of image,
+// as images with more than a single scan are not supported
+func (r *bitReader) finish() error {
+	for r.pos+1 < len(r.data) && r.data[r.pos] == 0xFF && r.data[r.pos+1] == 0xFF {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xFF || r.data[r.pos+1] != markerEOI {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// bitWriter writes bits as entropy coded data, stuffing a zero byte after every 0xFF byte
+type bitWriter struct {
+	out  []byte
+	bits uint32
+	n    uint
+}
+
+// Write the given number of bits (at most 16)
+func (w *bitWriter) writeBits(bits uint32, count uint) {
+	w.bits = w.bits<<count | bits&(1<<count-1)
+	w.n += count
+	for w.n >= 8 {
+		b := byte(w.bits >> (w.n - 8))
+		w.out = append(w.out, b)
+		if b == 0xFF {
+			w.out = append(w.out, 0x00)
+		}
+		w.n -= 8
+	}
+}
+
+// Write a single symbol using the given encoder
+func (w *bitWriter) encode(e *huffmanEncoder, symbol byte) {
+	w.writeBits(e.code[symbol], uint(e.size[symbol]))
+}
+
+// Pad the last byte with one bits
+func (w *bitWriter) flush() {
+	if w.n > 0 {
+		w.writeBits(1<<(8-w.n)-1, 8-w.n)
+	}
+}
+
+// Get the size category of a coefficient value, and the bits that encode it
+func category(value int32) (uint8, uint32) {
+	magnitude := value
+	if magnitude < 0 {
+		magnitude = -magnitude
+		value--
+	}
+	size := uint8(0)
+	for magnitude > 0 {
+		size++
+		magnitude >>= 1
+	}
+	return size, uint32(value) & (1<<size - 1)
+}
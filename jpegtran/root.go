@@ -0,0 +1,625 @@
+//
+// Lossless JPEG transforms, inspired by libjpeg's jpegtran:
+// the quantized DCT coefficients are rearranged instead of being
+// decoded to pixels and re-encoded, so no quality is lost.
+//
+
+package jpegtran
+
+import (
+	"errors"
+	"fmt"
+)
+
+// JPEG markers
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOF0 = 0xC0 // Baseline
+	markerSOF1 = 0xC1 // Extended sequential, Huffman coded
+	markerDHT  = 0xC4
+	markerSOS  = 0xDA
+	markerDQT  = 0xDB
+	markerDRI  = 0xDD
+	markerRST0 = 0xD0
+)
+
+var (
+	// ErrUnsupported is returned when the image can't be transformed losslessly,
+	// either because of its encoding or because its size isn't a multiple of the MCU size
+	ErrUnsupported = errors.New("image can't be transformed losslessly")
+
+	errNotJPEG        = errors.New("missing JPEG start of image marker")
+	errTruncated      = errors.New("truncated JPEG segment")
+	errTruncatedScan  = errors.New("truncated JPEG scan")
+	errMissingRestart = errors.New("missing JPEG restart marker")
+	errMissingTable   = errors.New("missing JPEG Huffman table")
+)
+
+// unzig maps the zig-zag order of the coefficients to their natural order
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Op describes a lossless transform, applied in the order transpose, flip horizontally,
+// flip vertically (which is enough to express every rotation and mirroring)
+type Op struct {
+	Transpose bool // Mirror along the top left to bottom right diagonal
+	FlipH     bool // Mirror horizontally (left becomes right)
+	FlipV     bool // Mirror vertically (top becomes bottom)
+}
+
+// Get the transform for the given clockwise rotation (0, 90, 180 or 270 degrees),
+// optionally followed by flipping the rotated image horizontally and/or vertically
+func Rotation(degrees int, flipH, flipV bool) (Op, error) {
+	var op Op
+	switch ((degrees % 360) + 360) % 360 {
+	case 0:
+	case 90:
+		op = Op{Transpose: true, FlipH: true}
+	case 180:
+		op = Op{FlipH: true, FlipV: true}
+	case 270:
+		op = Op{Transpose: true, FlipV: true}
+	default:
+		return op, fmt.Errorf("rotation must be a multiple of 90 degrees, got %d", degrees)
+	}
+	op.FlipH = op.FlipH != flipH
+	op.FlipV = op.FlipV != flipV
+	return op, nil
+}
+
+// Check if the transform leaves the image unchanged
+func (op Op) IsIdentity() bool {
+	return !op.Transpose && !op.FlipH && !op.FlipV
+}
+
+// segment is a single marker segment, with its payload excluding the length
+type segment struct {
+	marker  byte
+	payload []byte
+}
+
+// component is a single color component and its quantized DCT coefficients
+type component struct {
+	id, h, v, tq    byte
+	dcTable         byte
+	acTable         byte
+	blocksPerLine   int
+	blocksPerColumn int
+	blocks          [][64]int32 // Natural order, row by row
+}
+
+// jpegImage is a parsed baseline JPEG image
+type jpegImage struct {
+	segments        []segment // Every segment before the start of scan, except DHT and DRI
+	sof             int       // Index of the start of frame segment
+	width, height   int
+	hmax, vmax      int
+	components      []*component
+	restartInterval int
+	dcTables        [4]*huffmanDecoder
+	acTables        [4]*huffmanDecoder
+}
+
+// Transform a baseline JPEG image losslessly, returning ErrUnsupported
+// if the image can't be transformed without decoding it
+func Transform(data []byte, op Op) ([]byte, error) {
+	if op.IsIdentity() {
+		return data, nil
+	}
+
+	img, scan, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if !img.canTransform(op) {
+		return nil, ErrUnsupported
+	}
+	if err := img.decodeScan(scan); err != nil {
+		return nil, err
+	}
+
+	if op.Transpose {
+		img.transpose()
+	}
+	if op.FlipH {
+		img.flipH()
+	}
+	if op.FlipV {
+		img.flipV()
+	}
+
+	return img.encode(op.Transpose), nil
+}
+
+// Parse the image headers, returning the image and its entropy coded data
+func parse(data []byte) (*jpegImage, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, errNotJPEG
+	}
+
+	img := &jpegImage{sof: -1}
+	for i := 2; ; {
+		// Skip any fill bytes before the marker
+		if i >= len(data) || data[i] != 0xFF {
+			return nil, nil, errTruncated
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i+2 >= len(data) {
+			return nil, nil, errTruncated
+		}
+		marker := data[i]
+		length := int(data[i+1])<<8 | int(data[i+2])
+		if length < 2 || i+1+length > len(data) {
+			return nil, nil, errTruncated
+		}
+		payload := data[i+3 : i+1+length]
+		i += 1 + length
+
+		switch {
+		case marker == markerSOF0 || marker == markerSOF1:
+			if err := img.parseSOF(payload); err != nil {
+				return nil, nil, err
+			}
+			img.sof = len(img.segments)
+		case marker >= 0xC2 && marker <= 0xCF && marker != markerDHT && marker != 0xC8 && marker != 0xCC:
+			// Progressive, lossless and arithmetic coded images
+			return nil, nil, ErrUnsupported
+		case marker == markerDHT:
+			tables, err := parseDHT(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, table := range tables {
+				if table.Class == 0 {
+					img.dcTables[table.ID] = newHuffmanDecoder(table)
+				} else {
+					img.acTables[table.ID] = newHuffmanDecoder(table)
+				}
+			}
+			continue
+		case marker == markerDRI:
+			if len(payload) < 2 {
+				return nil, nil, errTruncated
+			}
+			img.restartInterval = int(payload[0])<<8 | int(payload[1])
+			continue
+		case marker == markerSOS:
+			if img.sof < 0 {
+				return nil, nil, errors.New("missing JPEG start of frame segment")
+			}
+			if err := img.parseSOS(payload); err != nil {
+				return nil, nil, err
+			}
+			return img, data[i:], nil
+		}
+
+		img.segments = append(img.segments, segment{marker, payload})
+	}
+}
+
+// Parse the start of frame segment
+func (img *jpegImage) parseSOF(payload []byte) error {
+	if len(payload) < 6 || payload[0] != 8 {
+		return ErrUnsupported
+	}
+	img.height = int(payload[1])<<8 | int(payload[2])
+	img.width = int(payload[3])<<8 | int(payload[4])
+	count := int(payload[5])
+	if img.width == 0 || img.height == 0 || count == 0 || len(payload) < 6+count*3 {
+		return ErrUnsupported
+	}
+
+	img.components = make([]*component, count)
+	for i := range img.components {
+		c := &component{
+			id: payload[6+i*3],
+			h:  payload[7+i*3] >> 4,
+			v:  payload[7+i*3] & 0x0F,
+			tq: payload[8+i*3],
+		}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return ErrUnsupported
+		}
+		if int(c.h) > img.hmax {
+			img.hmax = int(c.h)
+		}
+		if int(c.v) > img.vmax {
+			img.vmax = int(c.v)
+		}
+		img.components[i] = c
+	}
+
+	// Single component images are never interleaved, so every block is its own MCU,
+	// while interleaved images are padded to a whole number of MCUs
+	if count == 1 {
+		c := img.components[0]
+		c.blocksPerLine = (img.width + 7) / 8
+		c.blocksPerColumn = (img.height + 7) / 8
+	} else {
+		mcusX, mcusY := img.mcus()
+		for _, c := range img.components {
+			c.blocksPerLine = mcusX * int(c.h)
+			c.blocksPerColumn = mcusY * int(c.v)
+		}
+	}
+	for _, c := range img.components {
+		c.blocks = make([][64]int32, c.blocksPerLine*c.blocksPerColumn)
+	}
+	return nil
+}
+
+// Parse the start of scan segment, which must cover every component in a single scan
+func (img *jpegImage) parseSOS(payload []byte) error {
+	if len(payload) < 1 {
+		return errTruncated
+	}
+	count := int(payload[0])
+	if count != len(img.components) || len(payload) < 1+count*2+3 {
+		return ErrUnsupported
+	}
+	for i := 0; i < count; i++ {
+		id, tables := payload[1+i*2], payload[2+i*2]
+		c := img.components[i]
+		if c.id != id {
+			return ErrUnsupported
+		}
+		c.dcTable, c.acTable = tables>>4, tables&0x0F
+		if c.dcTable > 3 || c.acTable > 3 || img.dcTables[c.dcTable] == nil || img.acTables[c.acTable] == nil {
+			return errMissingTable
+		}
+	}
+
+	// Spectral selection and successive approximation must cover every coefficient at once
+	spectral := payload[1+count*2:]
+	if spectral[0] != 0 || spectral[1] != 63 || spectral[2] != 0 {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// Get the MCU size in pixels
+func (img *jpegImage) mcuSize() (int, int) {
+	if len(img.components) == 1 {
+		return 8, 8
+	}
+	return 8 * img.hmax, 8 * img.vmax
+}
+
+// Get the number of MCUs per line and per column
+func (img *jpegImage) mcus() (int, int) {
+	mcuWidth, mcuHeight := img.mcuSize()
+	return (img.width + mcuWidth - 1) / mcuWidth, (img.height + mcuHeight - 1) / mcuHeight
+}
+
+// Check if the image can be transformed without moving any partial MCUs
+// (which would move the padding at the right and bottom edges into the image)
+func (img *jpegImage) canTransform(op Op) bool {
+	width, height := img.width, img.height
+	mcuWidth, mcuHeight := img.mcuSize()
+	if op.Transpose {
+		width, height = height, width
+		mcuWidth, mcuHeight = mcuHeight, mcuWidth
+	}
+	if op.FlipH && width%mcuWidth != 0 {
+		return false
+	}
+	if op.FlipV && height%mcuHeight != 0 {
+		return false
+	}
+	return true
+}
+
+// Decode the quantized DCT coefficients of every block
+func (img *jpegImage) decodeScan(scan []byte) error {
+	r := &bitReader{data: scan}
+	predictions := make([]int32, len(img.components))
+
+	// Decode a single block of the given component
+	decodeBlock := func(index int, c *component, block *[64]int32) error {
+		size, err := r.decode(img.dcTables[c.dcTable])
+		if err != nil {
+			return err
+		}
+		diff, err := r.receiveExtend(size)
+		if err != nil {
+			return err
+		}
+		predictions[index] += diff
+		block[0] = predictions[index]
+
+		for k := 1; k < 64; k++ {
+			symbol, err := r.decode(img.acTables[c.acTable])
+			if err != nil {
+				return err
+			}
+			run, size := int(symbol>>4), symbol&0x0F
+			if size == 0 {
+				if run != 15 {
+					// End of block
+					break
+				}
+				// Sixteen zeros
+				k += 15
+				continue
+			}
+			k += run
+			if k > 63 {
+				return errInvalidHuffmanCode
+			}
+			value, err := r.receiveExtend(size)
+			if err != nil {
+				return err
+			}
+			block[unzig[k]] = value
+		}
+		return nil
+	}
+
+	// Handle the restart interval between MCUs
+	mcu, restarts := 0, 0
+	restart := func(total int) error {
+		mcu++
+		if img.restartInterval > 0 && mcu%img.restartInterval == 0 && mcu < total {
+			if err := r.restart(markerRST0 + byte(restarts%8)); err != nil {
+				return err
+			}
+			restarts++
+			for i := range predictions {
+				predictions[i] = 0
+			}
+		}
+		return nil
+	}
+
+	// Single component images store their blocks in raster order
+	if len(img.components) == 1 {
+		c := img.components[0]
+		for i := range c.blocks {
+			if err := decodeBlock(0, c, &c.blocks[i]); err != nil {
+				return err
+			}
+			if err := restart(len(c.blocks)); err != nil {
+				return err
+			}
+		}
+		return r.finish()
+	}
+
+	// Interleaved images store the blocks of every component per MCU
+	mcusX, mcusY := img.mcus()
+	for mcuY := 0; mcuY < mcusY; mcuY++ {
+		for mcuX := 0; mcuX < mcusX; mcuX++ {
+			for index, c := range img.components {
+				for y := 0; y < int(c.v); y++ {
+					for x := 0; x < int(c.h); x++ {
+						blockX := mcuX*int(c.h) + x
+						blockY := mcuY*int(c.v) + y
+						if err := decodeBlock(index, c, &c.blocks[blockY*c.blocksPerLine+blockX]); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err := restart(mcusX * mcusY); err != nil {
+				return err
+			}
+		}
+	}
+	return r.finish()
+}
+
+// Mirror the image along its diagonal, swapping its dimensions and sampling factors
+func (img *jpegImage) transpose() {
+	img.width, img.height = img.height, img.width
+	img.hmax, img.vmax = img.vmax, img.hmax
+	for _, c := range img.components {
+		blocks := make([][64]int32, len(c.blocks))
+		for y := 0; y < c.blocksPerColumn; y++ {
+			for x := 0; x < c.blocksPerLine; x++ {
+				src := &c.blocks[y*c.blocksPerLine+x]
+				dst := &blocks[x*c.blocksPerColumn+y]
+				for v := 0; v < 8; v++ {
+					for u := 0; u < 8; u++ {
+						dst[u*8+v] = src[v*8+u]
+					}
+				}
+			}
+		}
+		c.blocks = blocks
+		c.blocksPerLine, c.blocksPerColumn = c.blocksPerColumn, c.blocksPerLine
+		c.h, c.v = c.v, c.h
+	}
+}
+
+// Mirror the image horizontally, by reversing the blocks of every line
+// and negating the coefficients of the odd horizontal frequencies
+func (img *jpegImage) flipH() {
+	for _, c := range img.components {
+		for y := 0; y < c.blocksPerColumn; y++ {
+			line := c.blocks[y*c.blocksPerLine : (y+1)*c.blocksPerLine]
+			for left, right := 0, len(line)-1; left < right; left, right = left+1, right-1 {
+				line[left], line[right] = line[right], line[left]
+			}
+			for i := range line {
+				for v := 0; v < 8; v++ {
+					for u := 1; u < 8; u += 2 {
+						line[i][v*8+u] = -line[i][v*8+u]
+					}
+				}
+			}
+		}
+	}
+}
+
+// Mirror the image vertically, by reversing the lines of blocks
+// and negating the coefficients of the odd vertical frequencies
+func (img *jpegImage) flipV() {
+	for _, c := range img.components {
+		for top, bottom := 0, c.blocksPerColumn-1; top < bottom; top, bottom = top+1, bottom-1 {
+			for x := 0; x < c.blocksPerLine; x++ {
+				i, j := top*c.blocksPerLine+x, bottom*c.blocksPerLine+x
+				c.blocks[i], c.blocks[j] = c.blocks[j], c.blocks[i]
+			}
+		}
+		for i := range c.blocks {
+			for v := 1; v < 8; v += 2 {
+				for u := 0; u < 8; u++ {
+					c.blocks[i][v*8+u] = -c.blocks[i][v*8+u]
+				}
+			}
+		}
+	}
+}
+
+// Encode the image, using the standard Huffman tables and without restart markers
+func (img *jpegImage) encode(transposed bool) []byte {
+	out := []byte{0xFF, markerSOI}
+
+	// Write the original segments, updating the ones that depend on the orientation
+	for i, s := range img.segments {
+		payload := s.payload
+		if i == img.sof {
+			payload = img.sofPayload(payload)
+		} else if s.marker == markerDQT && transposed {
+			payload = transposeDQT(payload)
+		}
+		out = append(out, 0xFF, s.marker, byte((len(payload)+2)>>8), byte(len(payload)+2))
+		out = append(out, payload...)
+	}
+
+	// Write the standard Huffman tables, using the luminance tables
+	// for the first component and the chrominance tables for all others
+	out = append(out, DHTSegment(StandardTables)...)
+	sos := []byte{byte(len(img.components))}
+	for i, c := range img.components {
+		table := byte(0)
+		if i > 0 {
+			table = 1
+		}
+		sos = append(sos, c.id, table<<4|table)
+	}
+	sos = append(sos, 0, 63, 0)
+	out = append(out, 0xFF, markerSOS, byte((len(sos)+2)>>8), byte(len(sos)+2))
+	out = append(out, sos...)
+
+	// Write the entropy coded data
+	encoders := [2][2]*huffmanEncoder{
+		{newHuffmanEncoder(StandardTables[0]), newHuffmanEncoder(StandardTables[1])},
+		{newHuffmanEncoder(StandardTables[2]), newHuffmanEncoder(StandardTables[3])},
+	}
+	w := &bitWriter{out: out}
+	predictions := make([]int32, len(img.components))
+	encodeBlock := func(index int, block *[64]int32) {
+		table := 0
+		if index > 0 {
+			table = 1
+		}
+		dc, ac := encoders[table][0], encoders[table][1]
+
+		size, bits := category(block[0] - predictions[index])
+		predictions[index] = block[0]
+		w.encode(dc, size)
+		w.writeBits(bits, uint(size))
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			value := block[unzig[k]]
+			if value == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				w.encode(ac, 0xF0)
+				run -= 16
+			}
+			size, bits := category(value)
+			w.encode(ac, byte(run<<4)|size)
+			w.writeBits(bits, uint(size))
+			run = 0
+		}
+		if run > 0 {
+			w.encode(ac, 0x00)
+		}
+	}
+
+	if len(img.components) == 1 {
+		c := img.components[0]
+		for i := range c.blocks {
+			encodeBlock(0, &c.blocks[i])
+		}
+	} else {
+		mcusX, mcusY := img.mcus()
+		for mcuY := 0; mcuY < mcusY; mcuY++ {
+			for mcuX := 0; mcuX < mcusX; mcuX++ {
+				for index, c := range img.components {
+					for y := 0; y < int(c.v); y++ {
+						for x := 0; x < int(c.h); x++ {
+							blockX := mcuX*int(c.h) + x
+							blockY := mcuY*int(c.v) + y
+							encodeBlock(index, &c.blocks[blockY*c.blocksPerLine+blockX])
+						}
+					}
+				}
+			}
+		}
+	}
+	w.flush()
+
+	return append(w.out, 0xFF, markerEOI)
+}
+
+// Build the start of frame segment payload with the current dimensions and sampling factors
+func (img *jpegImage) sofPayload(original []byte) []byte {
+	payload := make([]byte, len(original))
+	copy(payload, original)
+	payload[1], payload[2] = byte(img.height>>8), byte(img.height)
+	payload[3], payload[4] = byte(img.width>>8), byte(img.width)
+	for i, c := range img.components {
+		payload[7+i*3] = c.h<<4 | c.v
+	}
+	return payload
+}
+
+// Transpose every quantization table in a DQT segment payload,
+// as the coefficients they apply to have been transposed
+func transposeDQT(original []byte) []byte {
+	payload := make([]byte, len(original))
+	copy(payload, original)
+
+	// zig maps the natural order of the coefficients to their zig-zag order
+	var zig [64]int
+	for k, natural := range unzig {
+		zig[natural] = k
+	}
+
+	for i := 0; i < len(payload); {
+		entrySize := 1
+		if payload[i]>>4 != 0 {
+			entrySize = 2
+		}
+		table := payload[i+1:]
+		if len(table) < 64*entrySize {
+			break
+		}
+		transposed := make([]byte, 64*entrySize)
+		for k := 0; k < 64; k++ {
+			natural := unzig[k]
+			target := zig[(natural%8)*8+natural/8]
+			copy(transposed[target*entrySize:(target+1)*entrySize], table[k*entrySize:(k+1)*entrySize])
+		}
+		copy(table, transposed)
+		i += 1 + 64*entrySize
+	}
+	return payload
+}
@@ -0,0 +1,336 @@
+package jpegtran
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// maxPixelDifference is how much a channel of a pixel of a transformed image may differ from the
+// same pixel of the decoded image transformed after decoding, as the rounding of the inverse DCT
+// and the chroma upsampling of image/jpeg aren't exactly symmetric
+const maxPixelDifference = 4
+
+// orientations are every combination of rotation and flipping, which covers every transform
+var orientations = []struct {
+	degrees int
+	flipH   bool
+}{
+	{0, false}, {90, false}, {180, false}, {270, false},
+	{0, true}, {90, true}, {180, true}, {270, true},
+}
+
+// Read a test image from the testdata directory, which holds images encoded by libjpeg
+// (copied from the Go source tree, see src/image/testdata)
+func readTestImage(tb testing.TB, name string) []byte {
+	tb.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// Encode a test image of the given size with image/jpeg, either in color (4:2:0) or in grayscale
+func encodeTestImage(tb testing.TB, width, height int, gray bool) []byte {
+	tb.Helper()
+	var img draw.Image = image.NewRGBA(image.Rect(0, 0, width, height))
+	if gray {
+		img = image.NewGray(img.Bounds())
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x*7 ^ y*13) & 0xFF), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Re-encode a baseline JPEG with a restart marker after every given number of MCUs
+// (which the encoder of image/jpeg never writes), using the standard Huffman tables
+func withRestartInterval(tb testing.TB, data []byte, interval int) []byte {
+	tb.Helper()
+	img, scan, err := parse(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := img.decodeScan(scan); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Reuse the headers of the image encoded without restart markers
+	encoded := img.encode(false)
+	_, encodedScan, err := parse(encoded)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	out := []byte{0xFF, markerSOI, 0xFF, markerDRI, 0, 4, byte(interval >> 8), byte(interval)}
+	out = append(out, encoded[2:len(encoded)-len(encodedScan)]...)
+
+	// Encode every MCU again, resetting the DC predictions after every restart marker
+	encoders := [2][2]*huffmanEncoder{
+		{newHuffmanEncoder(StandardTables[0]), newHuffmanEncoder(StandardTables[1])},
+		{newHuffmanEncoder(StandardTables[2]), newHuffmanEncoder(StandardTables[3])},
+	}
+	w := &bitWriter{out: out}
+	predictions := make([]int32, len(img.components))
+	encodeBlock := func(index int, block *[64]int32) {
+		table := 0
+		if index > 0 {
+			table = 1
+		}
+		size, bits := category(block[0] - predictions[index])
+		predictions[index] = block[0]
+		w.encode(encoders[table][0], size)
+		w.writeBits(bits, uint(size))
+		run := 0
+		for k := 1; k < 64; k++ {
+			value := block[unzig[k]]
+			if value == 0 {
+				run++
+				continue
+			}
+			for ; run > 15; run -= 16 {
+				w.encode(encoders[table][1], 0xF0)
+			}
+			size, bits := category(value)
+			w.encode(encoders[table][1], byte(run<<4)|size)
+			w.writeBits(bits, uint(size))
+			run = 0
+		}
+		if run > 0 {
+			w.encode(encoders[table][1], 0x00)
+		}
+	}
+
+	var mcus [][]func()
+	if len(img.components) == 1 {
+		c := img.components[0]
+		for i := range c.blocks {
+			block := &c.blocks[i]
+			mcus = append(mcus, []func(){func() { encodeBlock(0, block) }})
+		}
+	} else {
+		mcusX, mcusY := img.mcus()
+		for mcuY := 0; mcuY < mcusY; mcuY++ {
+			for mcuX := 0; mcuX < mcusX; mcuX++ {
+				var mcu []func()
+				for index, c := range img.components {
+					for y := 0; y < int(c.v); y++ {
+						for x := 0; x < int(c.h); x++ {
+							index, block := index, &c.blocks[(mcuY*int(c.v)+y)*c.blocksPerLine+mcuX*int(c.h)+x]
+							mcu = append(mcu, func() { encodeBlock(index, block) })
+						}
+					}
+				}
+				mcus = append(mcus, mcu)
+			}
+		}
+	}
+	for i, mcu := range mcus {
+		for _, encode := range mcu {
+			encode()
+		}
+		if (i+1)%interval == 0 && i+1 < len(mcus) {
+			w.flush()
+			w.out = append(w.out, 0xFF, markerRST0+byte((i/interval)%8))
+			for j := range predictions {
+				predictions[j] = 0
+			}
+		}
+	}
+	w.flush()
+	return append(w.out, 0xFF, markerEOI)
+}
+
+// Decode a JPEG image to RGBA
+func decodeRGBA(tb testing.TB, data []byte) *image.RGBA {
+	tb.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// Transform decoded pixels, as the reference for the lossless transform
+func transformPixels(src *image.RGBA, op Op) *image.RGBA {
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if op.Transpose {
+		width, height = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			srcX, srcY := x, y
+			if op.FlipH {
+				srcX = width - 1 - srcX
+			}
+			if op.FlipV {
+				srcY = height - 1 - srcY
+			}
+			if op.Transpose {
+				srcX, srcY = srcY, srcX
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+// Get the largest difference between a channel of the same pixel of two images of the same size
+func maxDifference(a, b *image.RGBA) int {
+	max := 0
+	for i := range a.Pix {
+		difference := int(a.Pix[i]) - int(b.Pix[i])
+		if difference < 0 {
+			difference = -difference
+		}
+		if difference > max {
+			max = difference
+		}
+	}
+	return max
+}
+
+func TestTransform(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+
+		// Whether the size is a multiple of the MCU size, so the image can be flipped losslessly
+		aligned bool
+	}{
+		{"libjpeg 4:2:0", readTestImage(t, "video-001.q50.420.jpeg"), false},
+		{"libjpeg 4:2:2", readTestImage(t, "video-001.q50.422.jpeg"), false},
+		{"libjpeg 4:4:4", readTestImage(t, "video-001.q50.444.jpeg"), false},
+		{"libjpeg grayscale", readTestImage(t, "video-005.gray.q50.jpeg"), false},
+		{"libjpeg restart interval", readTestImage(t, "video-001.restart2.jpeg"), false},
+		{"4:2:0", encodeTestImage(t, 64, 48, false), true},
+		{"4:2:0 not MCU aligned", encodeTestImage(t, 72, 40, false), false},
+		{"grayscale", encodeTestImage(t, 40, 24, true), true},
+		{"grayscale not MCU aligned", encodeTestImage(t, 44, 26, true), false},
+		{"restart interval", withRestartInterval(t, encodeTestImage(t, 64, 48, false), 1), true},
+		{"restart interval of 5 MCUs", withRestartInterval(t, encodeTestImage(t, 64, 48, false), 5), true},
+		{"grayscale restart interval", withRestartInterval(t, encodeTestImage(t, 40, 24, true), 4), true},
+	} {
+		decoded := decodeRGBA(t, test.data)
+		for _, orientation := range orientations {
+			name := fmt.Sprintf("%s rotated %d", test.name, orientation.degrees)
+			if orientation.flipH {
+				name += " flipped"
+			}
+			t.Run(name, func(t *testing.T) {
+				op, err := Rotation(orientation.degrees, orientation.flipH, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				transformed, err := Transform(test.data, op)
+
+				// Images that aren't MCU aligned can only be transposed, as flipping them would move the padding
+				if !test.aligned && (op.FlipH || op.FlipV) {
+					if !errors.Is(err, ErrUnsupported) {
+						t.Fatalf("expected ErrUnsupported, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := transformPixels(decoded, op)
+				got := decodeRGBA(t, transformed)
+				if got.Bounds() != want.Bounds() {
+					t.Fatalf("transformed image is %v, want %v", got.Bounds(), want.Bounds())
+				}
+				if difference := maxDifference(got, want); difference > maxPixelDifference {
+					t.Errorf("transformed pixels differ by up to %d from the reference", difference)
+				}
+			})
+		}
+	}
+}
+
+func TestTransformUnsupported(t *testing.T) {
+	valid := encodeTestImage(t, 64, 48, false)
+	rotate, err := Rotation(90, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the sample precision of the start of frame segment to 12 bits
+	precision := append([]byte(nil), valid...)
+	precision[bytes.Index(precision, []byte{0xFF, markerSOF0})+4] = 12
+
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		unsupported bool
+	}{
+		{"progressive", readTestImage(t, "video-001.progressive.jpeg"), true},
+		{"12 bit precision", precision, true},
+		{"not a JPEG", []byte("not a JPEG image at all"), false},
+		{"empty", nil, false},
+		{"truncated headers", valid[:100], false},
+		{"truncated scan", valid[:len(valid)-100], false},
+	} {
+		output, err := Transform(test.data, rotate)
+		if err == nil {
+			t.Errorf("%s: transformed without an error (%d bytes)", test.name, len(output))
+			continue
+		}
+		if errors.Is(err, ErrUnsupported) != test.unsupported {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+
+	// The identity transform returns any input as is
+	if output, err := Transform(readTestImage(t, "video-001.progressive.jpeg"), Op{}); err != nil || output == nil {
+		t.Errorf("identity transform failed: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	for _, test := range []struct {
+		degrees      int
+		flipH, flipV bool
+		want         Op
+	}{
+		{0, false, false, Op{}},
+		{90, false, false, Op{Transpose: true, FlipH: true}},
+		{180, false, false, Op{FlipH: true, FlipV: true}},
+		{270, false, false, Op{Transpose: true, FlipV: true}},
+		{-90, false, false, Op{Transpose: true, FlipV: true}},
+		{450, false, false, Op{Transpose: true, FlipH: true}},
+		{0, true, false, Op{FlipH: true}},
+		{180, true, false, Op{FlipV: true}},
+		{90, true, false, Op{Transpose: true}},
+		{180, true, true, Op{}},
+	} {
+		op, err := Rotation(test.degrees, test.flipH, test.flipV)
+		if err != nil {
+			t.Errorf("%d degrees: %v", test.degrees, err)
+			continue
+		}
+		if op != test.want {
+			t.Errorf("%d degrees (flipH: %t, flipV: %t): got %+v, want %+v", test.degrees, test.flipH, test.flipV, op, test.want)
+		}
+	}
+	for _, degrees := range []int{45, 100, -30} {
+		if _, err := Rotation(degrees, false, false); err == nil {
+			t.Errorf("%d degrees: expected an error", degrees)
+		}
+	}
+}
@@ -2,77 +2,86 @@ package main
 
 import (
 	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/motion"
+	"didstopia/mjpeg-server/pipeline"
+	"didstopia/mjpeg-server/placeholder"
+	"didstopia/mjpeg-server/server"
 	"didstopia/mjpeg-server/udpserver"
 	"flag"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
-
-	"github.com/mattn/go-mjpeg"
 )
 
 const (
-	defaultWebServerAddress = ":8080"
-	defaultUdpServerAddress = ":8081"
-	defaultFrameRate        = 25
+	defaultWebServerAddress = server.DefaultAddress
+	defaultUdpServerAddress = udpserver.DefaultAddress
+	defaultFrameRate        = server.DefaultFrameRate
 )
 
 var (
-	webServerAddress = flag.String("web-address", defaultWebServerAddress, "Web server address/port")
-	udpServerAddress = flag.String("udp-address", defaultUdpServerAddress, "UDP server address/port")
-	frameRate        = flag.Int("fps", defaultFrameRate, "Frames per second (frame rate)")
+	webServerAddress   = flag.String("web-address", defaultWebServerAddress, "Web server address/port")
+	udpServerAddress   = flag.String("udp-address", defaultUdpServerAddress, "UDP server address/port")
+	streamName         = flag.String("name", "default", "Name of the stream")
+	placeholderKind    = flag.String("placeholder", "card", "Frame shown while no frames are received: card, solid or image")
+	placeholderImage   = flag.String("placeholder-image", "", "Image file (PNG or JPEG) for the image placeholder")
+	placeholderColor   = flag.String("placeholder-color", "#101010", "Background color of the solid and image placeholders")
+	frameRate          = flag.Int("fps", defaultFrameRate, "Frames per second (frame rate)")
+	passthrough        = flag.Bool("passthrough", false, "Publish every frame as soon as it arrives, at the source's own pace (ignores the frame rate)")
+	workers            = flag.Int("workers", 1, "Number of workers that process frames in parallel, dropping frames when every worker is busy (0 uses every core)")
+	rotate             = flag.Int("rotate", 0, "Rotate frames clockwise by 0, 90, 180 or 270 degrees")
+	flipH              = flag.Bool("flip-h", false, "Flip frames horizontally (after rotating them)")
+	flipV              = flag.Bool("flip-v", false, "Flip frames vertically (after rotating them)")
+	masks              = flag.String("masks", "", "Privacy masks to hide on every frame, separated by | (e.g. \"pixelate:0,0,100,50|fill=#808080:10,10 90,10 50,80\")")
+	adminToken         = flag.String("admin-token", "", "Token that admins can present to request unmasked frames with ?unmasked=1, which is also required to change the view, colors and annotations with ?action=ptz, ?action=color and ?action=annotations")
+	crop               = flag.String("crop", "", "Crop frames to x,y,width,height (after rotating them)")
+	outputSize         = flag.String("output-size", "", "Scale every frame to fit widthxheight (e.g. \"1280x720\"), so every frame has the same size")
+	outputFill         = flag.String("output-fill", "black", "Color that fills the rest of frames that don't fill the output size")
+	profiles           = flag.String("profiles", "", "Named renditions that clients select with ?profile=, as name=widthxheight[@quality] separated by commas (e.g. \"hd=1280x720@85,sd=640x360@75,thumb=160x90@60\")")
+	adaptive           = flag.Bool("adaptive", false, "Lower the quality and then the size of the stream for clients that can't keep up with it, and raise them back up once they recover (clients opt out with ?adaptive=false)")
+	adaptiveMinQuality = flag.Int("adaptive-min-quality", server.DefaultAdaptiveMinQuality, "Lowest JPEG quality that slow clients are stepped down to")
+	adaptiveMaxQuality = flag.Int("adaptive-max-quality", server.DefaultAdaptiveMaxQuality, "Highest JPEG quality that clients are stepped up to")
+	adaptiveMinScale   = flag.Float64("adaptive-min-scale", server.DefaultAdaptiveMinScale, "Smallest fraction of the requested size that slow clients are stepped down to, once they're at the lowest quality (1 never changes the size)")
+	constantFPS        = flag.Int("constant-fps", 0, "Write frames to every stream client at exactly this frame rate, repeating the last frame when no new one arrives in time (0 disables, clients can also request a rate with ?fps=)")
+	annotations        = flag.Bool("annotations", false, "Allow annotations (boxes, polygons and text) to be drawn on the stream until they expire with the annotation API (?action=annotations), where clients request frames without them with ?clean=1")
+	keepalive          = flag.Duration("keepalive", server.DefaultKeepalive, "How often a frame that is the same as the last one is resent (duplicate frames are otherwise skipped, 0 publishes every frame)")
+	frozenThreshold    = flag.Int("frozen-threshold", server.DefaultFrozenThreshold, "Number of identical frames in a row after which the source is considered frozen (0 disables)")
+	staleAfter         = flag.Duration("stale-after", server.DefaultStaleAfter, "How long the source can go without sending a frame before the stream is stale and holds its last frame")
+	staleHold          = flag.Duration("stale-hold", server.DefaultStaleHold, "How long a stale stream holds its last frame before it goes offline")
+	staleAction        = flag.String("stale-action", "placeholder", "What an offline stream does: placeholder (show the placeholder), close (disconnect clients) or unavailable (refuse snapshots)")
+	validation         = flag.String("validate", frame.DefaultValidation.String(), "How thoroughly incoming frames are checked before they are published: none, markers, header or decode")
+	stripMetadata      = flag.Bool("strip-metadata", false, "Strip the metadata segments (APPn and COM, eg. EXIF with GPS data) of incoming frames without re-encoding them")
+	keepSegments       = flag.String("keep-segments", "APP0,APP14", "Metadata segments that are kept when stripping metadata, separated by commas (eg. \"APP0,APP14,COM\")")
+	frameComment       = flag.Bool("frame-comment", false, "Insert a comment with the capture timestamp and the stream name into every published frame")
+	brightness         = flag.Float64("brightness", 0, "Brightness offset, from -1 to 1")
+	contrast           = flag.Float64("contrast", 1, "Contrast multiplier, from 0 to 4")
+	gamma              = flag.Float64("gamma", 1, "Gamma correction, from 0.1 to 10 (above 1 brightens the midtones)")
+	saturation         = flag.Float64("saturation", 1, "Saturation multiplier, from 0 to 4")
+	grayscale          = flag.Bool("grayscale", false, "Convert frames to grayscale")
+	autoLevels         = flag.Bool("auto-levels", false, "Stretch the levels of every frame from black to white")
+	motionEnabled      = flag.Bool("motion", false, "Detect motion and report it in the log, at ?action=motion and to the motion webhook")
+	motionZones        = flag.String("motion-zones", "", "Zones to detect motion in, separated by | (e.g. \"bed=100,50,400,300|door=0,0,80,480\"), or the whole frame if empty")
+	motionSensitivity  = flag.Int("motion-sensitivity", 90, "Motion sensitivity, from 1 to 100")
+	motionMinArea      = flag.Float64("motion-min-area", 0.01, "Fraction of a zone (0 to 1) that has to change for it to count as motion")
+	motionWebhook      = flag.String("motion-webhook", "", "URL to POST motion events to as JSON")
+	motionBox          = flag.Bool("motion-box", false, "Draw the bounding box of any motion on the frames")
+	presetsFile        = flag.String("presets-file", "", "JSON file to load and save pan/tilt/zoom presets to")
+	overlay            = flag.String("overlay", "", "Text to draw on frames, with strftime-like conversions and {name}, {fps}, {viewers}, {sequence}, {width} and {height} fields (e.g. \"{name} %Y-%m-%d %H:%M:%S\")")
+	overlayPosition    = flag.String("overlay-position", "top-left", "Position of the overlay (top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right)")
+	overlaySize        = flag.Int("overlay-size", 0, "Line height of the overlay in pixels (0 scales it with the frame)")
+	overlayColor       = flag.String("overlay-color", "#ffffff", "Color of the overlay text (#RRGGBB or #RRGGBBAA)")
+	overlayBgColor     = flag.String("overlay-background", "#000000a0", "Color of the box behind the overlay text (#RRGGBB, #RRGGBBAA or transparent)")
+	watermark          = flag.String("watermark", "", "PNG image to draw on frames, which is reloaded whenever it changes")
+	watermarkPos       = flag.String("watermark-position", "bottom-right", "Position of the watermark (same values as -overlay-position)")
+	watermarkScale     = flag.Float64("watermark-scale", 1, "Scale of the watermark, relative to the size of the image")
+	watermarkOpacity   = flag.Float64("watermark-opacity", 1, "Opacity of the watermark, from 0 to 1")
 )
 
-func capture(ctx context.Context, wg *sync.WaitGroup, stream *mjpeg.Stream) {
-	// Always mark the wait group as done when the function finishes
-	defer wg.Done()
-
-	// Create and start the UDP server
-	udpServer := udpserver.NewUDPServer()
-	go udpServer.Start()
-	defer udpServer.Stop()
-
-	// Keep track of frame time
-	// now := time.Now()
-	var now time.Time
-	lastFrame := time.Now()
-
-	// Process incoming frames until the context is done
-	for len(ctx.Done()) == 0 {
-		// Artificially limit the processing speed based on
-		// how quickly we can process the incoming frames,
-		// as well as what the current/desired frame rate is
-		now = time.Now()
-		delta := now.Sub(lastFrame)
-		lastFrame = now
-		if delta.Seconds() < float64(1/float64(*frameRate)) {
-			time.Sleep(time.Duration(float64(1/float64(*frameRate))*1000) * time.Millisecond)
-		}
-
-		// Update the MJPEG stream
-		frame := udpServer.GetFrame()
-		if /*frame != nil &&*/ len(frame) > 0 {
-			err := stream.Update(udpServer.GetFrame())
-			if err != nil {
-				if err.Error() == "stream was closed" {
-					log.Println("Stream closed, aborting capture")
-					break
-				}
-				log.Println("Failed to update MJPEG stream:", err)
-				break
-			}
-		} /*else {
-			log.Println("WARNING: Failed to get frame from UDP server")
-		}*/
-	}
-
-	log.Println("Capture finished")
-}
-
 func main() {
 	// Parse the command line arguments
 	log.Println("Parsing command line arguments ...")
@@ -87,6 +96,22 @@ func main() {
 		*udpServerAddress = os.Getenv("MJPEG_SERVER_ADDRESS_UDP")
 		log.Println("Overriding UDP server address with", *udpServerAddress)
 	}
+	if os.Getenv("MJPEG_SERVER_NAME") != "" {
+		*streamName = os.Getenv("MJPEG_SERVER_NAME")
+		log.Println("Overriding stream name with", *streamName)
+	}
+	if os.Getenv("MJPEG_SERVER_PLACEHOLDER") != "" {
+		*placeholderKind = os.Getenv("MJPEG_SERVER_PLACEHOLDER")
+		log.Println("Overriding placeholder with", *placeholderKind)
+	}
+	if os.Getenv("MJPEG_SERVER_PLACEHOLDER_IMAGE") != "" {
+		*placeholderImage = os.Getenv("MJPEG_SERVER_PLACEHOLDER_IMAGE")
+		log.Println("Overriding placeholder image with", *placeholderImage)
+	}
+	if os.Getenv("MJPEG_SERVER_PLACEHOLDER_COLOR") != "" {
+		*placeholderColor = os.Getenv("MJPEG_SERVER_PLACEHOLDER_COLOR")
+		log.Println("Overriding placeholder color with", *placeholderColor)
+	}
 	if os.Getenv("MJPEG_SERVER_FRAMERATE") != "" {
 		newFrameRate, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_FRAMERATE"))
 		if err != nil {
@@ -96,118 +121,528 @@ func main() {
 		*frameRate = newFrameRate
 		log.Println("Overriding frame rate with", *frameRate)
 	}
+	if os.Getenv("MJPEG_SERVER_PASSTHROUGH") != "" {
+		newPassthrough, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_PASSTHROUGH"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_PASSTHROUGH:", err, "(defaulting to", *passthrough, ")")
+			newPassthrough = *passthrough
+		}
+		*passthrough = newPassthrough
+		log.Println("Overriding passthrough mode with", *passthrough)
+	}
+	if os.Getenv("MJPEG_SERVER_WORKERS") != "" {
+		newWorkers, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_WORKERS"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_WORKERS:", err, "(defaulting to", *workers, ")")
+			newWorkers = *workers
+		}
+		*workers = newWorkers
+		log.Println("Overriding workers with", *workers)
+	}
+	if os.Getenv("MJPEG_SERVER_ROTATE") != "" {
+		newRotate, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_ROTATE"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ROTATE:", err, "(defaulting to", *rotate, "degrees)")
+			newRotate = *rotate
+		}
+		*rotate = newRotate
+		log.Println("Overriding rotation with", *rotate, "degrees")
+	}
+	if os.Getenv("MJPEG_SERVER_FLIP_H") != "" {
+		newFlipH, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_FLIP_H"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_FLIP_H:", err, "(defaulting to", *flipH, ")")
+			newFlipH = *flipH
+		}
+		*flipH = newFlipH
+		log.Println("Overriding horizontal flip with", *flipH)
+	}
+	if os.Getenv("MJPEG_SERVER_FLIP_V") != "" {
+		newFlipV, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_FLIP_V"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_FLIP_V:", err, "(defaulting to", *flipV, ")")
+			newFlipV = *flipV
+		}
+		*flipV = newFlipV
+		log.Println("Overriding vertical flip with", *flipV)
+	}
+	if os.Getenv("MJPEG_SERVER_MASKS") != "" {
+		*masks = os.Getenv("MJPEG_SERVER_MASKS")
+		log.Println("Overriding masks with", *masks)
+	}
+	if os.Getenv("MJPEG_SERVER_ADMIN_TOKEN") != "" {
+		*adminToken = os.Getenv("MJPEG_SERVER_ADMIN_TOKEN")
+		log.Println("Overriding admin token")
+	}
+	if os.Getenv("MJPEG_SERVER_CROP") != "" {
+		*crop = os.Getenv("MJPEG_SERVER_CROP")
+		log.Println("Overriding crop with", *crop)
+	}
+	if os.Getenv("MJPEG_SERVER_OUTPUT_SIZE") != "" {
+		*outputSize = os.Getenv("MJPEG_SERVER_OUTPUT_SIZE")
+		log.Println("Overriding output size with", *outputSize)
+	}
+	if os.Getenv("MJPEG_SERVER_OUTPUT_FILL") != "" {
+		*outputFill = os.Getenv("MJPEG_SERVER_OUTPUT_FILL")
+		log.Println("Overriding output fill with", *outputFill)
+	}
+	if os.Getenv("MJPEG_SERVER_PROFILES") != "" {
+		*profiles = os.Getenv("MJPEG_SERVER_PROFILES")
+		log.Println("Overriding profiles with", *profiles)
+	}
+	if os.Getenv("MJPEG_SERVER_KEEPALIVE") != "" {
+		newKeepalive, err := time.ParseDuration(os.Getenv("MJPEG_SERVER_KEEPALIVE"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_KEEPALIVE:", err, "(defaulting to", *keepalive, ")")
+			newKeepalive = *keepalive
+		}
+		*keepalive = newKeepalive
+		log.Println("Overriding keepalive with", *keepalive)
+	}
+	if os.Getenv("MJPEG_SERVER_FROZEN_THRESHOLD") != "" {
+		newFrozenThreshold, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_FROZEN_THRESHOLD"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_FROZEN_THRESHOLD:", err, "(defaulting to", *frozenThreshold, ")")
+			newFrozenThreshold = *frozenThreshold
+		}
+		*frozenThreshold = newFrozenThreshold
+		log.Println("Overriding frozen threshold with", *frozenThreshold)
+	}
+	if os.Getenv("MJPEG_SERVER_STALE_AFTER") != "" {
+		newStaleAfter, err := time.ParseDuration(os.Getenv("MJPEG_SERVER_STALE_AFTER"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_STALE_AFTER:", err, "(defaulting to", *staleAfter, ")")
+			newStaleAfter = *staleAfter
+		}
+		*staleAfter = newStaleAfter
+		log.Println("Overriding stale timeout with", *staleAfter)
+	}
+	if os.Getenv("MJPEG_SERVER_STALE_HOLD") != "" {
+		newStaleHold, err := time.ParseDuration(os.Getenv("MJPEG_SERVER_STALE_HOLD"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_STALE_HOLD:", err, "(defaulting to", *staleHold, ")")
+			newStaleHold = *staleHold
+		}
+		*staleHold = newStaleHold
+		log.Println("Overriding stale hold duration with", *staleHold)
+	}
+	if os.Getenv("MJPEG_SERVER_STALE_ACTION") != "" {
+		*staleAction = os.Getenv("MJPEG_SERVER_STALE_ACTION")
+		log.Println("Overriding stale action with", *staleAction)
+	}
+	if os.Getenv("MJPEG_SERVER_ADAPTIVE") != "" {
+		newAdaptive, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_ADAPTIVE"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ADAPTIVE:", err, "(defaulting to", *adaptive, ")")
+			newAdaptive = *adaptive
+		}
+		*adaptive = newAdaptive
+		log.Println("Overriding adaptive quality with", *adaptive)
+	}
+	if os.Getenv("MJPEG_SERVER_ADAPTIVE_MIN_QUALITY") != "" {
+		newAdaptiveMinQuality, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_ADAPTIVE_MIN_QUALITY"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ADAPTIVE_MIN_QUALITY:", err, "(defaulting to", *adaptiveMinQuality, ")")
+			newAdaptiveMinQuality = *adaptiveMinQuality
+		}
+		*adaptiveMinQuality = newAdaptiveMinQuality
+		log.Println("Overriding adaptive minimum quality with", *adaptiveMinQuality)
+	}
+	if os.Getenv("MJPEG_SERVER_ADAPTIVE_MAX_QUALITY") != "" {
+		newAdaptiveMaxQuality, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_ADAPTIVE_MAX_QUALITY"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ADAPTIVE_MAX_QUALITY:", err, "(defaulting to", *adaptiveMaxQuality, ")")
+			newAdaptiveMaxQuality = *adaptiveMaxQuality
+		}
+		*adaptiveMaxQuality = newAdaptiveMaxQuality
+		log.Println("Overriding adaptive maximum quality with", *adaptiveMaxQuality)
+	}
+	if os.Getenv("MJPEG_SERVER_ADAPTIVE_MIN_SCALE") != "" {
+		newAdaptiveMinScale, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_ADAPTIVE_MIN_SCALE"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ADAPTIVE_MIN_SCALE:", err, "(defaulting to", *adaptiveMinScale, ")")
+			newAdaptiveMinScale = *adaptiveMinScale
+		}
+		*adaptiveMinScale = newAdaptiveMinScale
+		log.Println("Overriding adaptive minimum scale with", *adaptiveMinScale)
+	}
+	if os.Getenv("MJPEG_SERVER_CONSTANT_FPS") != "" {
+		newConstantFPS, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_CONSTANT_FPS"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_CONSTANT_FPS:", err, "(defaulting to", *constantFPS, ")")
+			newConstantFPS = *constantFPS
+		}
+		*constantFPS = newConstantFPS
+		log.Println("Overriding constant frame rate with", *constantFPS)
+	}
+	if os.Getenv("MJPEG_SERVER_ANNOTATIONS") != "" {
+		newAnnotations, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_ANNOTATIONS"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_ANNOTATIONS:", err, "(defaulting to", *annotations, ")")
+			newAnnotations = *annotations
+		}
+		*annotations = newAnnotations
+		log.Println("Overriding annotations with", *annotations)
+	}
+	if os.Getenv("MJPEG_SERVER_VALIDATE") != "" {
+		*validation = os.Getenv("MJPEG_SERVER_VALIDATE")
+		log.Println("Overriding validation with", *validation)
+	}
+	if os.Getenv("MJPEG_SERVER_STRIP_METADATA") != "" {
+		newStripMetadata, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_STRIP_METADATA"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_STRIP_METADATA:", err, "(defaulting to", *stripMetadata, ")")
+			newStripMetadata = *stripMetadata
+		}
+		*stripMetadata = newStripMetadata
+		log.Println("Overriding strip metadata with", *stripMetadata)
+	}
+	if os.Getenv("MJPEG_SERVER_KEEP_SEGMENTS") != "" {
+		*keepSegments = os.Getenv("MJPEG_SERVER_KEEP_SEGMENTS")
+		log.Println("Overriding kept segments with", *keepSegments)
+	}
+	if os.Getenv("MJPEG_SERVER_FRAME_COMMENT") != "" {
+		newFrameComment, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_FRAME_COMMENT"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_FRAME_COMMENT:", err, "(defaulting to", *frameComment, ")")
+			newFrameComment = *frameComment
+		}
+		*frameComment = newFrameComment
+		log.Println("Overriding frame comment with", *frameComment)
+	}
 
-	// Calculate the stream interval from the frame rate
-	log.Println("Calculating stream interval from frame rate:", *frameRate)
-	streamInterval := time.Duration(1000/(*frameRate)) * time.Millisecond
-	log.Println("Calculated stream interval:", streamInterval)
-
-	// Create a new MJPEG stream
-	log.Println("Initializing MJPEG stream ...")
-	mjpegStream := mjpeg.NewStreamWithInterval(streamInterval)
-
-	// Create a new cancelable context
-	log.Println("Creating context ...")
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Create and configure a new wait group
-	log.Println("Creating wait group ...")
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	// Start the capture goroutine using the current context, wait group and MJPEG stream
-	log.Println("Starting capture goroutine ...")
-	go capture(ctx, &wg, mjpegStream)
-
-	// TODO: Keep track of both inbound and outbound data and show stats on the web page (or on a separate page)
-
-	// Setup an index page that shows the MJPEG stream
-	log.Println("Setting up index page ...")
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Handle action query parameter
-		action := r.URL.Query().Get("action")
-		if len(action) > 0 {
-			if action == "stream" {
-				// Wait until we have a frame (mjpegStream.Current())
-				for mjpegStream.Current() == nil || len(mjpegStream.Current()) == 0 {
-					time.Sleep(10 * time.Millisecond)
-				}
-
-				// Return the MJPEG stream
-				mjpegStream.ServeHTTP(w, r)
-				return
-			} else if action == "snapshot" {
-				// Wait until we have a frame (mjpegStream.Current())
-				for mjpegStream.Current() == nil || len(mjpegStream.Current()) == 0 {
-					time.Sleep(10 * time.Millisecond)
-				}
-
-				// Return the current frame as a JPEG
-				w.Header().Set("Content-Type", "image/jpeg")
-				w.Write(mjpegStream.Current())
-				return
-			} else {
-				// Redirect back to index page
-				http.Redirect(w, r, "/", http.StatusFound)
-				return
-			}
+	if os.Getenv("MJPEG_SERVER_BRIGHTNESS") != "" {
+		newBrightness, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_BRIGHTNESS"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_BRIGHTNESS:", err, "(defaulting to", *brightness, ")")
+			newBrightness = *brightness
+		}
+		*brightness = newBrightness
+		log.Println("Overriding brightness with", *brightness)
+	}
+	if os.Getenv("MJPEG_SERVER_CONTRAST") != "" {
+		newContrast, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_CONTRAST"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_CONTRAST:", err, "(defaulting to", *contrast, ")")
+			newContrast = *contrast
+		}
+		*contrast = newContrast
+		log.Println("Overriding contrast with", *contrast)
+	}
+	if os.Getenv("MJPEG_SERVER_GAMMA") != "" {
+		newGamma, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_GAMMA"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_GAMMA:", err, "(defaulting to", *gamma, ")")
+			newGamma = *gamma
 		}
+		*gamma = newGamma
+		log.Println("Overriding gamma with", *gamma)
+	}
+	if os.Getenv("MJPEG_SERVER_SATURATION") != "" {
+		newSaturation, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_SATURATION"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_SATURATION:", err, "(defaulting to", *saturation, ")")
+			newSaturation = *saturation
+		}
+		*saturation = newSaturation
+		log.Println("Overriding saturation with", *saturation)
+	}
+	if os.Getenv("MJPEG_SERVER_GRAYSCALE") != "" {
+		newGrayscale, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_GRAYSCALE"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_GRAYSCALE:", err, "(defaulting to", *grayscale, ")")
+			newGrayscale = *grayscale
+		}
+		*grayscale = newGrayscale
+		log.Println("Overriding grayscale with", *grayscale)
+	}
+	if os.Getenv("MJPEG_SERVER_AUTO_LEVELS") != "" {
+		newAutoLevels, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_AUTO_LEVELS"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_AUTO_LEVELS:", err, "(defaulting to", *autoLevels, ")")
+			newAutoLevels = *autoLevels
+		}
+		*autoLevels = newAutoLevels
+		log.Println("Overriding auto-levels with", *autoLevels)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION") != "" {
+		newMotionEnabled, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_MOTION"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_MOTION:", err, "(defaulting to", *motionEnabled, ")")
+			newMotionEnabled = *motionEnabled
+		}
+		*motionEnabled = newMotionEnabled
+		log.Println("Overriding motion detection with", *motionEnabled)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION_ZONES") != "" {
+		*motionZones = os.Getenv("MJPEG_SERVER_MOTION_ZONES")
+		log.Println("Overriding motion zones with", *motionZones)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION_SENSITIVITY") != "" {
+		newMotionSensitivity, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_MOTION_SENSITIVITY"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_MOTION_SENSITIVITY:", err, "(defaulting to", *motionSensitivity, ")")
+			newMotionSensitivity = *motionSensitivity
+		}
+		*motionSensitivity = newMotionSensitivity
+		log.Println("Overriding motion sensitivity with", *motionSensitivity)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION_MIN_AREA") != "" {
+		newMotionMinArea, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_MOTION_MIN_AREA"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_MOTION_MIN_AREA:", err, "(defaulting to", *motionMinArea, ")")
+			newMotionMinArea = *motionMinArea
+		}
+		*motionMinArea = newMotionMinArea
+		log.Println("Overriding motion minimum area with", *motionMinArea)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION_WEBHOOK") != "" {
+		*motionWebhook = os.Getenv("MJPEG_SERVER_MOTION_WEBHOOK")
+		log.Println("Overriding motion webhook with", *motionWebhook)
+	}
+	if os.Getenv("MJPEG_SERVER_MOTION_BOX") != "" {
+		newMotionBox, err := strconv.ParseBool(os.Getenv("MJPEG_SERVER_MOTION_BOX"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_MOTION_BOX:", err, "(defaulting to", *motionBox, ")")
+			newMotionBox = *motionBox
+		}
+		*motionBox = newMotionBox
+		log.Println("Overriding motion bounding box with", *motionBox)
+	}
+	if os.Getenv("MJPEG_SERVER_PRESETS_FILE") != "" {
+		*presetsFile = os.Getenv("MJPEG_SERVER_PRESETS_FILE")
+		log.Println("Overriding presets file with", *presetsFile)
+	}
+	if os.Getenv("MJPEG_SERVER_OVERLAY") != "" {
+		*overlay = os.Getenv("MJPEG_SERVER_OVERLAY")
+		log.Println("Overriding overlay with", *overlay)
+	}
+	if os.Getenv("MJPEG_SERVER_OVERLAY_POSITION") != "" {
+		*overlayPosition = os.Getenv("MJPEG_SERVER_OVERLAY_POSITION")
+		log.Println("Overriding overlay position with", *overlayPosition)
+	}
+	if os.Getenv("MJPEG_SERVER_OVERLAY_SIZE") != "" {
+		newOverlaySize, err := strconv.Atoi(os.Getenv("MJPEG_SERVER_OVERLAY_SIZE"))
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_OVERLAY_SIZE:", err, "(defaulting to", *overlaySize, ")")
+			newOverlaySize = *overlaySize
+		}
+		*overlaySize = newOverlaySize
+		log.Println("Overriding overlay size with", *overlaySize)
+	}
+	if os.Getenv("MJPEG_SERVER_OVERLAY_COLOR") != "" {
+		*overlayColor = os.Getenv("MJPEG_SERVER_OVERLAY_COLOR")
+		log.Println("Overriding overlay color with", *overlayColor)
+	}
+	if os.Getenv("MJPEG_SERVER_OVERLAY_BACKGROUND") != "" {
+		*overlayBgColor = os.Getenv("MJPEG_SERVER_OVERLAY_BACKGROUND")
+		log.Println("Overriding overlay background with", *overlayBgColor)
+	}
+	if os.Getenv("MJPEG_SERVER_WATERMARK") != "" {
+		*watermark = os.Getenv("MJPEG_SERVER_WATERMARK")
+		log.Println("Overriding watermark with", *watermark)
+	}
+	if os.Getenv("MJPEG_SERVER_WATERMARK_POSITION") != "" {
+		*watermarkPos = os.Getenv("MJPEG_SERVER_WATERMARK_POSITION")
+		log.Println("Overriding watermark position with", *watermarkPos)
+	}
+	if os.Getenv("MJPEG_SERVER_WATERMARK_SCALE") != "" {
+		newWatermarkScale, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_WATERMARK_SCALE"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_WATERMARK_SCALE:", err, "(defaulting to", *watermarkScale, ")")
+			newWatermarkScale = *watermarkScale
+		}
+		*watermarkScale = newWatermarkScale
+		log.Println("Overriding watermark scale with", *watermarkScale)
+	}
+	if os.Getenv("MJPEG_SERVER_WATERMARK_OPACITY") != "" {
+		newWatermarkOpacity, err := strconv.ParseFloat(os.Getenv("MJPEG_SERVER_WATERMARK_OPACITY"), 64)
+		if err != nil {
+			log.Println("Failed to parse MJPEG_SERVER_WATERMARK_OPACITY:", err, "(defaulting to", *watermarkOpacity, ")")
+			newWatermarkOpacity = *watermarkOpacity
+		}
+		*watermarkOpacity = newWatermarkOpacity
+		log.Println("Overriding watermark opacity with", *watermarkOpacity)
+	}
 
-		// Render the index page
-		w.Header().Set("Content-Type", "text/html")
+	// Build the server options
+	options := []server.Option{
+		server.WithName(*streamName),
+		server.WithAddress(*webServerAddress),
+		server.WithPassthrough(*passthrough),
+		server.WithWorkers(*workers),
+		server.WithOrientation(*rotate, *flipH, *flipV),
+		server.WithPresetsFile(*presetsFile),
+		server.WithAdminToken(*adminToken),
+		server.WithKeepalive(*keepalive),
+		server.WithFrameComment(*frameComment),
+		server.WithConstantRate(*constantFPS),
+		server.WithAnnotations(*annotations),
+		server.WithFrozenThreshold(*frozenThreshold),
+		server.WithAdjustments(pipeline.Adjustments{
+			Brightness: *brightness,
+			Contrast:   *contrast,
+			Gamma:      *gamma,
+			Saturation: *saturation,
+			Grayscale:  *grayscale,
+			AutoLevels: *autoLevels,
+		}),
+	}
+	stalePolicy := server.StalePolicy{After: *staleAfter, Hold: *staleHold}
+	if action, err := server.ParseStaleAction(*staleAction); err != nil {
+		log.Fatalln("Failed to parse stale action:", err)
+	} else {
+		stalePolicy.Action = action
+	}
+	options = append(options, server.WithStalePolicy(stalePolicy))
+	if *adaptive {
+		options = append(options, server.WithAdaptiveQuality(server.AdaptivePolicy{
+			MinQuality: *adaptiveMinQuality,
+			MaxQuality: *adaptiveMaxQuality,
+			MinScale:   *adaptiveMinScale,
+		}))
+	}
+	if *masks != "" {
+		for _, value := range strings.Split(*masks, "|") {
+			mask, err := pipeline.ParseMask(value)
+			if err != nil {
+				log.Fatalln("Failed to parse mask:", err)
+			}
+			options = append(options, server.WithMasks(mask))
+		}
+	}
+	if *crop != "" {
+		rect, err := pipeline.ParseCrop(*crop)
+		if err != nil {
+			log.Fatalln("Failed to parse crop:", err)
+		}
+		options = append(options, server.WithCrop(rect))
+	}
+	if *profiles != "" {
+		parsedProfiles, err := server.ParseProfiles(*profiles)
+		if err != nil {
+			log.Fatalln("Failed to parse profiles:", err)
+		}
+		options = append(options, server.WithProfiles(parsedProfiles...))
+	}
+	var outputWidth, outputHeight int
+	if *outputSize != "" {
+		var err error
+		if outputWidth, outputHeight, err = pipeline.ParseSize(*outputSize); err != nil {
+			log.Fatalln("Failed to parse output size:", err)
+		}
+		fill, err := imaging.ParseColor(*outputFill)
+		if err != nil {
+			log.Fatalln("Failed to parse output fill:", err)
+		}
+		options = append(options, server.WithOutputSize(outputWidth, outputHeight, fill))
+	}
+	if *motionEnabled {
+		config := motion.DefaultConfig()
+		config.Sensitivity = *motionSensitivity
+		config.MinArea = *motionMinArea
+		config.Webhook = *motionWebhook
+		config.DrawBox = *motionBox
+		if *motionZones != "" {
+			zones, err := motion.ParseZones(*motionZones)
+			if err != nil {
+				log.Fatalln("Failed to parse motion zones:", err)
+			}
+			config.Zones = zones
+		}
+		options = append(options, server.WithMotion(config))
+	}
+	if *overlay != "" {
+		config := pipeline.DefaultOverlayConfig(*overlay)
+		config.Size = *overlaySize
+		var err error
+		if config.Position, err = imaging.ParsePosition(*overlayPosition); err != nil {
+			log.Fatalln("Failed to parse overlay position:", err)
+		}
+		if config.Color, err = imaging.ParseColor(*overlayColor); err != nil {
+			log.Fatalln("Failed to parse overlay color:", err)
+		}
+		if config.Background, err = imaging.ParseColor(*overlayBgColor); err != nil {
+			log.Fatalln("Failed to parse overlay background:", err)
+		}
+		options = append(options, server.WithOverlay(config))
+	}
+	if *watermark != "" {
+		config := pipeline.DefaultWatermarkConfig(*watermark)
+		config.Scale = *watermarkScale
+		config.Opacity = *watermarkOpacity
+		var err error
+		if config.Position, err = imaging.ParsePosition(*watermarkPos); err != nil {
+			log.Fatalln("Failed to parse watermark position:", err)
+		}
+		options = append(options, server.WithWatermark(config))
+	}
+	if *passthrough {
+		log.Println("Passthrough mode enabled, frames will be published at the source's pace")
+	} else {
+		// The frame rate is only used when not in passthrough mode
+		options = append(options, server.WithFrameRate(*frameRate))
+	}
 
-		w.Write([]byte(`<br>`))
+	// Create the UDP server that receives the frames
+	udpServer := udpserver.NewUDPServerWithAddress(*udpServerAddress)
 
-		// TODO: While this works, it updates very slowly and seems pretty heavy?
-		// w.Write([]byte(`<p>Stream Image</p>`))
-		// w.Write([]byte(`<img src="/video.mjpeg" alt="MJPEG Stream Image" width="640" />`))
+	// Render the placeholder at the output size, until the size of the incoming frames is known
+	if outputWidth > 0 {
+		udpServer.FrameWidth, udpServer.FrameHeight = outputWidth, outputHeight
+	}
 
-		// TODO: Inject custom CSS to adjust the stream and snapshot sizes etc.
+	// Only show the placeholder once the stream has held its last frame for long enough
+	udpServer.Timeout = *staleAfter + *staleHold
 
-		// FIXME: Why doesn't this work, yet the image based solutions work fine?
-		// UPDATE: HTML <video> does NOT support MJPEG streams, only <img> does!
-		w.Write([]byte(`<p>Stream Video</p>`))
-		w.Write([]byte(`<img src="/?action=stream" alt="MJPEG Stream Video" width="640" />`))
-		// w.Write([]byte(`<video src="/?action=stream" alt="MJPEG Stream Video" controls autoplay width="640">`))
-		// // w.Write([]byte(`<video src="http://localhost:8080/?action=stream" alt="MJPEG Stream Video" controls autoplay width="640">`))
-		// w.Write([]byte(`  Your browser does not support the <code>video</code> element.`))
-		// w.Write([]byte(`</video>`))
+	// Reject invalid frames before they are published
+	var err error
+	udpServer.Validation, err = frame.ParseValidation(*validation)
+	if err != nil {
+		log.Fatalln("Failed to parse validation:", err)
+	}
 
-		w.Write([]byte(`<br>`))
+	// Strip the metadata of incoming frames, except for the kept segments
+	if *stripMetadata {
+		udpServer.Metadata, err = frame.ParseMetadataFilter(*keepSegments)
+		if err != nil {
+			log.Fatalln("Failed to parse kept segments:", err)
+		}
+	}
 
-		// TODO: This works fine, it's just very, very large
-		w.Write([]byte(`<p>Stream Snapshot</p>`))
-		w.Write([]byte(`<img src="/?action=snapshot" alt="MJPEG Stream Snapshot Image" width="640" />`))
-	})
+	// Create the placeholder frame that is shown while no frames are received
+	placeholderConfig := placeholder.DefaultConfig()
+	placeholderConfig.Name = *streamName
+	placeholderConfig.ImagePath = *placeholderImage
+	placeholderConfig.Kind, err = placeholder.ParseKind(*placeholderKind)
+	if err != nil {
+		log.Fatalln("Failed to parse placeholder:", err)
+	}
+	placeholderConfig.Background, err = imaging.ParseColor(*placeholderColor)
+	if err != nil {
+		log.Fatalln("Failed to parse placeholder color:", err)
+	}
+	udpServer.Placeholder, err = placeholder.New(placeholderConfig)
+	if err != nil {
+		log.Fatalln("Failed to create placeholder:", err)
+	}
 
-	// Create a new HTTP server
-	log.Println("Creating HTTP server ...")
-	server := &http.Server{Addr: *webServerAddress}
+	// Create the MJPEG server
+	log.Println("Creating MJPEG server ...")
+	mjpegServer, err := server.New(udpServer, options...)
+	if err != nil {
+		log.Fatalln("Failed to create MJPEG server:", err)
+	}
 
 	// Setup graceful shutdown
 	log.Println("Setting up graceful shutdown ...")
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, os.Interrupt)
-	go func() {
-		<-sc
-		log.Println("Shutting down web server ...")
-		server.Shutdown(ctx)
-	}()
-
-	// Start the web server
-	log.Println("Starting web server on", *webServerAddress)
-	server.ListenAndServe()
-
-	// Shutdown the MJPEG stream
-	log.Println("Shutting down MJPEG stream ...")
-	mjpegStream.Close()
-
-	// Mark the context as canceled
-	log.Println("Shutting down ...")
-	cancel()
-
-	// Wait until the wait group is done (capture goroutine has finished)
-	wg.Wait()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	// Run the server until we're interrupted
+	if err := mjpegServer.Run(ctx); err != nil {
+		log.Fatalln("MJPEG server failed:", err)
+	}
 
 	log.Println("Shutdown complete, terminating ...")
 }
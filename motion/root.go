@@ -0,0 +1,415 @@
+package motion
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSensitivity is the sensitivity used when none is given
+	DefaultSensitivity = 90
+
+	// DefaultMinArea is the fraction of a zone that has to change when none is given
+	DefaultMinArea = 0.01
+
+	// DefaultCooldown is how long motion has to be absent for when none is given
+	DefaultCooldown = 3 * time.Second
+
+	// DefaultWidth is the width frames are downsampled to when none is given
+	DefaultWidth = 160
+
+	// maxHistory is the number of recent events that are kept
+	maxHistory = 20
+)
+
+// Zone is a named region of interest, relative to the top left corner of the frame
+// (after it has been rotated and cropped, but before it is zoomed)
+type Zone struct {
+	Name string
+	Rect image.Rectangle
+}
+
+// Encode the zone as JSON, with its rectangle as x, y, width and height
+func (z Zone) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name string `json:"name"`
+		box
+	}{z.Name, newBox(z.Rect)})
+}
+
+// Config configures a Detector
+type Config struct {
+	// Zones to detect motion in, or none to detect motion anywhere in the frame
+	Zones []Zone
+
+	// Sensitivity from 1 to 100, where higher values react to smaller changes in brightness
+	Sensitivity int
+
+	// Fraction of a zone (0 to 1) that has to change for it to count as motion
+	MinArea float64
+
+	// How long motion has to be absent for before it is considered to have stopped
+	Cooldown time.Duration
+
+	// Width that frames are downsampled to before they are compared
+	Width int
+
+	// URL that every event is POSTed to as JSON, if any
+	Webhook string
+
+	// Draw the bounding box of the motion on the frames
+	DrawBox bool
+
+	// Color of the bounding box
+	BoxColor color.RGBA
+
+	// Called with every event, in order
+	OnEvent func(Event)
+}
+
+// Create a new Config with the default settings, detecting motion anywhere in the frame
+func DefaultConfig() Config {
+	return Config{
+		Sensitivity: DefaultSensitivity,
+		MinArea:     DefaultMinArea,
+		Cooldown:    DefaultCooldown,
+		Width:       DefaultWidth,
+		BoxColor:    color.RGBA{255, 0, 0, 255},
+	}
+}
+
+// Parse zones in the "NAME=x,y,width,height" format, separated by |
+func ParseZones(value string) ([]Zone, error) {
+	var zones []Zone
+	for _, part := range strings.Split(value, "|") {
+		name, rect, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("zone must be in the name=x,y,width,height format: %s", part)
+		}
+		var x, y, width, height int
+		if n, err := fmt.Sscanf(rect, "%d,%d,%d,%d", &x, &y, &width, &height); err != nil || n != 4 || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("invalid zone rectangle: %s", rect)
+		}
+		zones = append(zones, Zone{Name: name, Rect: image.Rect(x, y, x+width, y+height)})
+	}
+	return zones, nil
+}
+
+// EventType is the type of a motion event
+type EventType string
+
+const (
+	Start EventType = "start"
+	Stop  EventType = "stop"
+)
+
+// Event is emitted when motion starts or stops
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Frame the event was detected on
+	Sequence uint64
+
+	// Zones that motion was detected in, and the bounding box of the motion (for start events)
+	Zones []string
+	Box   image.Rectangle
+
+	// How long the motion lasted (for stop events)
+	Duration time.Duration
+}
+
+// Encode the event as JSON, with its bounding box as x, y, width and height and its duration in seconds
+func (e Event) MarshalJSON() ([]byte, error) {
+	event := struct {
+		Type     EventType `json:"type"`
+		Time     time.Time `json:"time"`
+		Sequence uint64    `json:"sequence"`
+		Zones    []string  `json:"zones,omitempty"`
+		Box      *box      `json:"box,omitempty"`
+		Duration float64   `json:"duration,omitempty"`
+	}{Type: e.Type, Time: e.Time, Sequence: e.Sequence, Zones: e.Zones, Duration: e.Duration.Seconds()}
+	if !e.Box.Empty() {
+		b := newBox(e.Box)
+		event.Box = &b
+	}
+	return json.Marshal(event)
+}
+
+// box is the JSON encoding of a rectangle
+type box struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Create a new box from the rectangle
+func newBox(rect image.Rectangle) box {
+	return box{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}
+}
+
+// State is the current state of a Detector
+type State struct {
+	Active bool       `json:"active"`
+	Since  *time.Time `json:"since,omitempty"`
+	Zones  []Zone     `json:"zones"`
+	Events []Event    `json:"events"`
+}
+
+// Detector detects motion by comparing downsampled frames, as a frame pipeline stage
+type Detector struct {
+	config    Config
+	threshold int
+
+	mutex            sync.Mutex
+	lastFrame        *frame.Frame
+	previous         []uint8
+	previousSequence uint64
+	size             image.Point
+	box              image.Rectangle
+	active           bool
+	since            time.Time
+	lastSeen         time.Time
+	stopTimer        *time.Timer
+	history          []Event
+
+	webhooks chan Event
+}
+
+// Create a new Detector
+func New(config Config) (*Detector, error) {
+	if config.Sensitivity < 1 || config.Sensitivity > 100 {
+		return nil, errors.New("motion sensitivity must be between 1 and 100")
+	}
+	if config.MinArea < 0 || config.MinArea > 1 {
+		return nil, errors.New("motion minimum area must be between 0 and 1")
+	}
+	if config.Cooldown <= 0 {
+		return nil, errors.New("motion cooldown must be above 0")
+	}
+	if config.Width < 8 {
+		return nil, errors.New("motion detection width must be at least 8")
+	}
+	for _, zone := range config.Zones {
+		if zone.Rect.Empty() {
+			return nil, fmt.Errorf("motion zone %s is empty", zone.Name)
+		}
+	}
+
+	return &Detector{
+		config: config,
+		// Map the sensitivity onto the brightness difference a pixel needs to count as changed
+		threshold: (100-config.Sensitivity)*255/100 + 1,
+		webhooks:  make(chan Event, 16),
+	}, nil
+}
+
+// Run the detector's webhook delivery until the context is done
+func (d *Detector) Run(ctx context.Context) {
+	if d.config.Webhook == "" {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.webhooks:
+			if err := postWebhook(ctx, d.config.Webhook, event); err != nil {
+				log.Println("Failed to deliver motion", event.Type, "event to webhook:", err)
+			}
+		}
+	}
+}
+
+// Get the current state, including the most recent events
+func (d *Detector) State() State {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state := State{Active: d.active, Zones: d.config.Zones, Events: append([]Event(nil), d.history...)}
+	if d.active {
+		since := d.since
+		state.Since = &since
+	}
+	return state
+}
+
+// Forget the previous frame, so the next frame isn't compared with it
+// (such as when the frames were changed in a way that isn't motion)
+func (d *Detector) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.previous = nil
+}
+
+// Detect motion on the decoded image, drawing the bounding box of the motion if configured to
+func (d *Detector) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	// The same frame may go through more than one pipeline (such as for unmasked variants),
+	// but motion is only detected on it once
+	d.mutex.Lock()
+	detect := f != d.lastFrame && (d.lastFrame == nil || f.Sequence >= d.lastFrame.Sequence)
+	if detect {
+		d.lastFrame = f
+	}
+	d.mutex.Unlock()
+	if detect {
+		d.detect(img, f)
+	}
+
+	d.mutex.Lock()
+	box := d.box
+	d.mutex.Unlock()
+	if d.config.DrawBox && !box.Empty() {
+		imaging.DrawRect(img, box.Add(img.Rect.Min), 2, d.config.BoxColor)
+	}
+	return img, nil
+}
+
+// Compare the image with the previous one.
+//
+// The image is downsampled and compared without holding the mutex, so frames that are processed
+// in parallel (such as by a worker pool) don't wait on each other, where frames that are processed
+// out of order are only compared against older frames.
+func (d *Detector) detect(img *image.RGBA, f *frame.Frame) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	smallWidth := d.config.Width
+	if smallWidth > width {
+		smallWidth = width
+	}
+	smallWidth, smallHeight := imaging.FitSize(width, height, smallWidth, 0)
+	small := imaging.Resize(img, smallWidth, smallHeight, imaging.Area)
+	luma := imaging.Luma(small)
+	size := small.Rect.Size()
+
+	// Swap the previous frame for this one, unless a newer frame was compared in the meantime
+	d.mutex.Lock()
+	if d.previous != nil && f.Sequence < d.previousSequence {
+		d.mutex.Unlock()
+		return
+	}
+	previous, previousSize := d.previous, d.size
+	d.previous, d.size, d.previousSequence = luma, size, f.Sequence
+
+	// Start over when the size changes, as there's nothing to compare with
+	if previous == nil || size != previousSize {
+		d.box = image.Rectangle{}
+		d.mutex.Unlock()
+		return
+	}
+	d.mutex.Unlock()
+
+	// Scale the zones down to the downsampled frame
+	zones := d.config.Zones
+	if len(zones) == 0 {
+		zones = []Zone{{Name: "frame", Rect: image.Rect(0, 0, width, height)}}
+	}
+	scaleX, scaleY := float64(size.X)/float64(width), float64(size.Y)/float64(height)
+
+	var triggered []string
+	var box image.Rectangle
+	for _, zone := range zones {
+		rect := image.Rect(
+			int(float64(zone.Rect.Min.X)*scaleX), int(float64(zone.Rect.Min.Y)*scaleY),
+			int(float64(zone.Rect.Max.X)*scaleX+0.999), int(float64(zone.Rect.Max.Y)*scaleY+0.999),
+		).Intersect(image.Rect(0, 0, size.X, size.Y))
+		if rect.Empty() {
+			continue
+		}
+
+		// Count the pixels whose brightness changed enough, and where they are
+		changed := 0
+		var zoneBox image.Rectangle
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				i := y*size.X + x
+				diff := int(luma[i]) - int(previous[i])
+				if diff >= d.threshold || -diff >= d.threshold {
+					changed++
+					zoneBox = zoneBox.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+		if changed > 0 && float64(changed) >= d.config.MinArea*float64(rect.Dx()*rect.Dy()) {
+			triggered = append(triggered, zone.Name)
+			box = box.Union(zoneBox)
+		}
+	}
+	if len(triggered) == 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Scale the bounding box back up to the frame
+	d.box = image.Rect(
+		int(float64(box.Min.X)/scaleX), int(float64(box.Min.Y)/scaleY),
+		int(float64(box.Max.X)/scaleX+0.5), int(float64(box.Max.Y)/scaleY+0.5),
+	).Intersect(image.Rect(0, 0, width, height))
+
+	now := time.Now()
+	d.lastSeen = now
+	if !d.active {
+		d.active, d.since = true, now
+		d.emit(Event{Type: Start, Time: now, Sequence: f.Sequence, Zones: triggered, Box: d.box})
+	}
+
+	// Stop once the motion has been absent for the cooldown, even if no more frames arrive
+	if d.stopTimer == nil {
+		d.stopTimer = time.AfterFunc(d.config.Cooldown, d.checkStop)
+	} else {
+		d.stopTimer.Reset(d.config.Cooldown)
+	}
+}
+
+// Emit a stop event if the motion has been absent for the cooldown
+func (d *Detector) checkStop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.active {
+		return
+	}
+	if remaining := d.config.Cooldown - time.Since(d.lastSeen); remaining > 0 {
+		d.stopTimer.Reset(remaining)
+		return
+	}
+	d.active = false
+	d.box = image.Rectangle{}
+	now := time.Now()
+	d.emit(Event{Type: Stop, Time: now, Sequence: d.lastFrame.Sequence, Duration: now.Sub(d.since)})
+}
+
+// Log, record and deliver an event (the mutex must be held)
+func (d *Detector) emit(event Event) {
+	if event.Type == Start {
+		log.Println("Motion started in", strings.Join(event.Zones, ", "), "at", event.Box)
+	} else {
+		log.Println("Motion stopped after", event.Duration.Round(time.Millisecond))
+	}
+
+	d.history = append(d.history, event)
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
+
+	if d.config.OnEvent != nil {
+		d.config.OnEvent(event)
+	}
+	if d.config.Webhook != "" {
+		select {
+		case d.webhooks <- event:
+		default:
+			log.Println("Too many pending motion webhooks, dropping", event.Type, "event")
+		}
+	}
+}
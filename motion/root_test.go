@@ -0,0 +1,270 @@
+package motion
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long the tests wait for events before failing
+const testTimeout = 5 * time.Second
+
+// Draw a gray test image with a square of the given brightness, if any
+func squareImage(square image.Rectangle, brightness uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 160, 120))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{64, 64, 64, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, square, image.NewUniform(color.RGBA{brightness, brightness, brightness, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+// Run an image through the detector as the frame with the given sequence number
+func apply(t *testing.T, d *Detector, img *image.RGBA, sequence uint64) {
+	t.Helper()
+	if _, err := d.Apply(img, &frame.Frame{Sequence: sequence}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Wait for the next event
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
+
+// Check that no event was emitted
+func noEvent(t *testing.T, events <-chan Event) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event", event.Type)
+	default:
+	}
+}
+
+func TestDetect(t *testing.T) {
+	square := image.Rect(96, 32, 128, 64)
+	zones := []Zone{{Name: "left", Rect: image.Rect(0, 0, 80, 120)}, {Name: "right", Rect: image.Rect(80, 0, 160, 120)}}
+
+	for _, test := range []struct {
+		name        string
+		zones       []Zone
+		sensitivity int
+		minArea     float64
+		brightness  uint8
+		want        []string
+	}{
+		{"anywhere", nil, DefaultSensitivity, DefaultMinArea, 255, []string{"frame"}},
+		{"in a zone", zones, DefaultSensitivity, DefaultMinArea, 255, []string{"right"}},
+		{"outside of the zones", zones[:1], DefaultSensitivity, DefaultMinArea, 255, nil},
+		{"zone outside of the frame", []Zone{{Name: "outside", Rect: image.Rect(200, 200, 300, 300)}}, DefaultSensitivity, DefaultMinArea, 255, nil},
+
+		// The brightness has to change by more than the sensitivity allows
+		{"small change", nil, DefaultSensitivity, DefaultMinArea, 100, []string{"frame"}},
+		{"small change with a low sensitivity", nil, 50, DefaultMinArea, 100, nil},
+		{"large change with a low sensitivity", nil, 50, DefaultMinArea, 255, []string{"frame"}},
+
+		// Enough of the zone has to change (the square covers 5% of the frame and 10% of the right zone)
+		{"small area", nil, DefaultSensitivity, 0.06, 255, nil},
+		{"large enough area of a zone", zones, DefaultSensitivity, 0.06, 255, []string{"right"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			events := make(chan Event, 16)
+			config := DefaultConfig()
+			config.Zones, config.Sensitivity, config.MinArea = test.zones, test.sensitivity, test.minArea
+			config.OnEvent = func(event Event) { events <- event }
+			d, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The first frame has nothing to compare with
+			apply(t, d, squareImage(image.Rectangle{}, 0), 1)
+			noEvent(t, events)
+			apply(t, d, squareImage(square, test.brightness), 2)
+			if test.want == nil {
+				noEvent(t, events)
+				if d.State().Active {
+					t.Error("detector is active without motion")
+				}
+				return
+			}
+
+			event := nextEvent(t, events)
+			if event.Type != Start || event.Sequence != 2 || !reflect.DeepEqual(event.Zones, test.want) {
+				t.Errorf("unexpected event %+v, want a start event on frame 2 in %v", event, test.want)
+			}
+			if event.Box != square {
+				t.Errorf("bounding box is %v, want %v", event.Box, square)
+			}
+			if state := d.State(); !state.Active || state.Since == nil || len(state.Events) != 1 {
+				t.Errorf("unexpected state %+v", state)
+			}
+		})
+	}
+}
+
+func TestDownsampledBox(t *testing.T) {
+	config := DefaultConfig()
+	config.Width, config.DrawBox = 40, true
+	d, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bounding box is scaled back up to the frame, and drawn on it
+	square := image.Rect(96, 32, 128, 64)
+	apply(t, d, squareImage(image.Rectangle{}, 0), 1)
+	img := squareImage(square, 255)
+	apply(t, d, img, 2)
+	box := d.State().Events[0].Box
+	if !square.In(box) || box.Dx() > square.Dx()+8 || box.Dy() > square.Dy()+8 {
+		t.Errorf("bounding box is %v, want about %v", box, square)
+	}
+	if got := img.RGBAAt(box.Min.X, box.Min.Y+box.Dy()/2); got != config.BoxColor {
+		t.Errorf("bounding box wasn't drawn, got %v", got)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	events := make(chan Event, 16)
+	config := DefaultConfig()
+	config.Cooldown = 100 * time.Millisecond
+	config.OnEvent = func(event Event) { events <- event }
+	d, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	still, moved := squareImage(image.Rectangle{}, 0), squareImage(image.Rect(0, 0, 32, 32), 255)
+	apply(t, d, still, 1)
+	apply(t, d, moved, 2)
+	started := nextEvent(t, events)
+	if started.Type != Start {
+		t.Fatalf("unexpected %s event", started.Type)
+	}
+
+	// More motion within the cooldown keeps the motion going, without more start events
+	time.Sleep(config.Cooldown / 2)
+	apply(t, d, still, 3)
+	lastMotion := time.Now()
+	noEvent(t, events)
+
+	// The same frame going through another pipeline isn't compared again
+	f := &frame.Frame{Sequence: 4}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Apply(squareImage(image.Rectangle{}, 0), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Motion stops once it has been absent for the cooldown, even without any more frames
+	stopped := nextEvent(t, events)
+	if stopped.Type != Stop || stopped.Sequence != 4 {
+		t.Errorf("unexpected event %+v, want a stop event on frame 4", stopped)
+	}
+	if elapsed := time.Since(lastMotion); elapsed < config.Cooldown-10*time.Millisecond {
+		t.Errorf("motion stopped %v after the last motion, before the cooldown of %v", elapsed, config.Cooldown)
+	}
+	if stopped.Duration < config.Cooldown+config.Cooldown/2 {
+		t.Errorf("motion lasted %v, want at least %v", stopped.Duration, config.Cooldown+config.Cooldown/2)
+	}
+	if state := d.State(); state.Active || state.Since != nil || len(state.Events) != 2 {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	// Motion can start again afterwards
+	apply(t, d, moved, 5)
+	if event := nextEvent(t, events); event.Type != Start || event.Sequence != 5 {
+		t.Errorf("unexpected event %+v, want a start event on frame 5", event)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	type webhook struct {
+		Type        string `json:"type"`
+		Sequence    uint64 `json:"sequence"`
+		ContentType string
+	}
+	received := make(chan webhook, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&event) != nil {
+			http.Error(w, "invalid webhook", http.StatusBadRequest)
+			return
+		}
+		event.ContentType = r.Header.Get("Content-Type")
+		received <- event
+	}))
+	defer receiver.Close()
+
+	config := DefaultConfig()
+	config.Cooldown = 50 * time.Millisecond
+	config.Webhook = receiver.URL
+	d, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	apply(t, d, squareImage(image.Rectangle{}, 0), 1)
+	apply(t, d, squareImage(image.Rect(0, 0, 32, 32), 255), 2)
+	for _, want := range []webhook{{"start", 2, "application/json"}, {"stop", 2, "application/json"}} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received webhook %+v, want %+v", got, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for the %s webhook", want.Type)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, change := range []func(*Config){
+		func(c *Config) { c.Sensitivity = 0 },
+		func(c *Config) { c.Sensitivity = 101 },
+		func(c *Config) { c.MinArea = 1.5 },
+		func(c *Config) { c.Cooldown = 0 },
+		func(c *Config) { c.Width = 4 },
+		func(c *Config) { c.Zones = []Zone{{Name: "empty"}} },
+	} {
+		config := DefaultConfig()
+		change(&config)
+		if _, err := New(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	zones, err := ParseZones("door=0,0,100,200 | window=150,20,50,40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Zone{{Name: "door", Rect: image.Rect(0, 0, 100, 200)}, {Name: "window", Rect: image.Rect(150, 20, 200, 60)}}
+	if !reflect.DeepEqual(zones, want) {
+		t.Errorf("got %v, want %v", zones, want)
+	}
+	for _, value := range []string{"", "door", "=0,0,1,1", "door=0,0,1", "door=0,0,0,10", "door=a,b,c,d"} {
+		if _, err := ParseZones(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
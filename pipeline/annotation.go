@@ -0,0 +1,359 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAnnotationTTL is how long an annotation is drawn for when no TTL is given
+	DefaultAnnotationTTL = 5 * time.Second
+
+	// MaxAnnotationTTL is the longest an annotation can be drawn for
+	MaxAnnotationTTL = time.Hour
+
+	// MaxAnnotations is the maximum number of annotations that can be drawn at the same time
+	MaxAnnotations = 256
+
+	// maxAnnotationText is the maximum length of the text of an annotation
+	maxAnnotationText = 256
+
+	// maxAnnotationCoordinate is the largest (absolute) pixel coordinate of an annotation,
+	// which keeps the lines that are drawn within reason
+	maxAnnotationCoordinate = 100000
+)
+
+var ErrTooManyAnnotations = fmt.Errorf("too many annotations (at most %d)", MaxAnnotations)
+
+// Annotation is a box, polygon and/or text that is drawn on every frame until it expires,
+// such as the detections of an object detector
+type Annotation struct {
+	// Identifies the annotation, where adding an annotation with the ID of an existing one replaces it
+	// (annotations without one are given a unique ID when they're added)
+	ID string `json:"id,omitempty"`
+
+	// Rectangle to draw, as [x, y, width, height]
+	Box *[4]float64 `json:"box,omitempty"`
+
+	// Polygon of three or more points to draw, as [[x1, y1], [x2, y2], [x3, y3], ...]
+	Polygon [][2]float64 `json:"polygon,omitempty"`
+
+	// Text to draw, as a label above the box or polygon, or with its top left corner at the given point as [x, y]
+	Text string      `json:"text,omitempty"`
+	At   *[2]float64 `json:"at,omitempty"`
+
+	// Color of the outline and the label (#RRGGBB, #RRGGBBAA or a name, red by default),
+	// and of the inside of the box or polygon (transparent by default)
+	Color string `json:"color,omitempty"`
+	Fill  string `json:"fill,omitempty"`
+
+	// Thickness of the outline in pixels, or zero to scale it with the frame
+	Thickness int `json:"thickness,omitempty"`
+
+	// Whether the coordinates are fractions of the width and height of the frame (from 0 to 1) instead of pixels
+	Normalized bool `json:"normalized,omitempty"`
+
+	// Number of seconds the annotation is drawn for, and when it expires
+	TTL     float64   `json:"ttl,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	color color.RGBA
+	fill  color.RGBA
+}
+
+// Validate the annotation, parsing its colors
+func (a *Annotation) validate() error {
+	if a.Box == nil && a.Polygon == nil && a.At == nil {
+		return errors.New("annotation needs a box, a polygon or a point to draw its text at")
+	}
+	if a.At != nil && a.Text == "" {
+		return errors.New("annotation needs text to draw at its point")
+	}
+	if len(a.Text) > maxAnnotationText {
+		return fmt.Errorf("annotation text is too long (at most %d characters)", maxAnnotationText)
+	}
+	if a.Polygon != nil && len(a.Polygon) < 3 {
+		return errors.New("annotation polygon needs at least 3 points")
+	}
+	if a.Box != nil && (a.Box[2] <= 0 || a.Box[3] <= 0) {
+		return errors.New("annotation box must have a positive width and height")
+	}
+
+	// Coordinates may lie outside of the frame, within reason
+	limit := float64(maxAnnotationCoordinate)
+	if a.Normalized {
+		limit = 2
+	}
+	coordinates := make([]float64, 0, 4+2*len(a.Polygon)+2)
+	if a.Box != nil {
+		coordinates = append(coordinates, a.Box[:]...)
+	}
+	for _, point := range a.Polygon {
+		coordinates = append(coordinates, point[:]...)
+	}
+	if a.At != nil {
+		coordinates = append(coordinates, a.At[:]...)
+	}
+	for _, coordinate := range coordinates {
+		if math.IsNaN(coordinate) || math.Abs(coordinate) > limit {
+			return fmt.Errorf("annotation coordinate is out of range: %g", coordinate)
+		}
+	}
+
+	if a.Thickness < 0 || a.Thickness > 64 {
+		return errors.New("annotation thickness must be between 0 and 64")
+	}
+	if math.IsNaN(a.TTL) || a.TTL < 0 || a.TTL > MaxAnnotationTTL.Seconds() {
+		return fmt.Errorf("annotation TTL must be between 0 and %g seconds", MaxAnnotationTTL.Seconds())
+	}
+
+	var err error
+	if a.Color == "" {
+		a.Color = "red"
+	}
+	if a.color, err = imaging.ParseColor(a.Color); err != nil {
+		return err
+	}
+	if a.fill, err = imaging.ParseColor(a.Fill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Convert a coordinate of the annotation to pixels of a frame of the given size
+func (a *Annotation) point(x, y float64, width, height int) image.Point {
+	if a.Normalized {
+		x, y = x*float64(width), y*float64(height)
+	}
+	return image.Pt(int(math.Round(x)), int(math.Round(y)))
+}
+
+// Draw the annotation on the image
+func (a *Annotation) draw(img *image.RGBA) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	thickness := a.Thickness
+	if thickness == 0 {
+		thickness = height / 240
+		if thickness < 2 {
+			thickness = 2
+		}
+	}
+
+	// Draw the shapes, keeping track of their bounds to place the label
+	var bounds image.Rectangle
+	if a.Box != nil {
+		rect := image.Rectangle{
+			Min: a.point(a.Box[0], a.Box[1], width, height),
+			Max: a.point(a.Box[0]+a.Box[2], a.Box[1]+a.Box[3], width, height),
+		}.Add(img.Rect.Min)
+		imaging.FillRect(img, rect, a.fill)
+		imaging.DrawRect(img, rect, thickness, a.color)
+		bounds = rect
+	}
+	if a.Polygon != nil {
+		points := make([]image.Point, len(a.Polygon))
+		for i, point := range a.Polygon {
+			points[i] = a.point(point[0], point[1], width, height)
+		}
+		if a.fill.A > 0 {
+			for _, s := range rasterizePolygon(points, width, height) {
+				imaging.FillRect(img, image.Rect(s.x0, s.y, s.x1, s.y+1).Add(img.Rect.Min), a.fill)
+			}
+		}
+		for i, point := range points {
+			imaging.DrawLine(img, point.Add(img.Rect.Min), points[(i+1)%len(points)].Add(img.Rect.Min), thickness, a.color)
+			bounds = bounds.Union(image.Rectangle{Min: point, Max: point.Add(image.Pt(1, 1))}.Add(img.Rect.Min))
+		}
+	}
+	if a.Text == "" {
+		return
+	}
+
+	// Draw the text on a label in the color of the annotation, either at its point,
+	// or above the shapes (or just inside of them, if there's no room above)
+	scale := imaging.FontScale(height / 32)
+	textWidth, textHeight := imaging.TextSize(a.Text, scale)
+	label := image.Rect(0, 0, textWidth+2*scale, textHeight+2*scale)
+	if a.At != nil {
+		label = label.Add(a.point(a.At[0], a.At[1], width, height)).Add(img.Rect.Min)
+	} else {
+		at := image.Pt(bounds.Min.X, bounds.Min.Y-label.Dy())
+		if at.Y < img.Rect.Min.Y {
+			at.Y = bounds.Min.Y
+		}
+		if max := img.Rect.Max.X - label.Dx(); at.X > max {
+			at.X = max
+		}
+		if at.X < img.Rect.Min.X {
+			at.X = img.Rect.Min.X
+		}
+		label = label.Add(at)
+	}
+	imaging.FillRect(img, label, a.color)
+	imaging.DrawText(img, label.Min.Add(image.Pt(scale, scale)), a.Text, scale, contrastingColor(a.color))
+}
+
+// Get black or white, whichever is easier to read on the given color
+func contrastingColor(c color.RGBA) color.RGBA {
+	if c.A > 0 && (299*uint32(c.R)+587*uint32(c.G)+114*uint32(c.B))*255/uint32(c.A) > 128*1000 {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+// Annotations draws the annotations that were added at runtime (such as the detections of
+// an object detector) on every frame until they expire, relative to the top left corner of the frame
+type Annotations struct {
+	mutex  sync.Mutex
+	items  map[string]Annotation
+	nextID uint64
+}
+
+// Create a new Annotations stage without any annotations
+func NewAnnotations() *Annotations {
+	return &Annotations{items: make(map[string]Annotation)}
+}
+
+// Add annotations, replacing any existing annotations with the same IDs,
+// and returning them with their IDs and expiry times
+func (a *Annotations) Add(annotations ...Annotation) ([]Annotation, error) {
+	return a.add(false, annotations)
+}
+
+// Replace every annotation with the given ones (such as the latest detections),
+// returning them with their IDs and expiry times
+func (a *Annotations) Replace(annotations ...Annotation) ([]Annotation, error) {
+	return a.add(true, annotations)
+}
+
+// Add annotations, optionally removing every existing annotation first,
+// where nothing changes if any of the annotations are invalid
+func (a *Annotations) add(replace bool, annotations []Annotation) ([]Annotation, error) {
+	now := time.Now()
+	added := make([]Annotation, len(annotations))
+	for i, annotation := range annotations {
+		if err := annotation.validate(); err != nil {
+			return nil, err
+		}
+		ttl := DefaultAnnotationTTL
+		if annotation.TTL > 0 {
+			ttl = time.Duration(annotation.TTL * float64(time.Second))
+		}
+		annotation.TTL = ttl.Seconds()
+		annotation.Expires = now.Add(ttl)
+		added[i] = annotation
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.prune(now)
+	existing := a.items
+	if replace {
+		existing = nil
+	}
+	count := len(existing)
+	for _, annotation := range added {
+		if _, ok := existing[annotation.ID]; !ok || annotation.ID == "" {
+			count++
+		}
+	}
+	if count > MaxAnnotations {
+		return nil, ErrTooManyAnnotations
+	}
+	if replace {
+		a.items = make(map[string]Annotation, len(added))
+	}
+	for i := range added {
+		if added[i].ID == "" {
+			a.nextID++
+			added[i].ID = strconv.FormatUint(a.nextID, 10)
+		}
+		a.items[added[i].ID] = added[i]
+	}
+	return added, nil
+}
+
+// Remove the annotation with the given ID, returning false if there is none
+func (a *Annotations) Remove(id string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.prune(time.Now())
+	if _, ok := a.items[id]; !ok {
+		return false
+	}
+	delete(a.items, id)
+	return true
+}
+
+// Remove every annotation, returning the number of annotations that were removed
+func (a *Annotations) Clear() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.prune(time.Now())
+	count := len(a.items)
+	a.items = make(map[string]Annotation)
+	return count
+}
+
+// Get every annotation that hasn't expired yet, in the order they expire
+func (a *Annotations) List() []Annotation {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.active(time.Now())
+}
+
+// Get the annotations that haven't expired yet, in the order they expire (the mutex must be held)
+func (a *Annotations) active(now time.Time) []Annotation {
+	a.prune(now)
+	annotations := make([]Annotation, 0, len(a.items))
+	for _, annotation := range a.items {
+		annotations = append(annotations, annotation)
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		if !annotations[i].Expires.Equal(annotations[j].Expires) {
+			return annotations[i].Expires.Before(annotations[j].Expires)
+		}
+		return annotations[i].ID < annotations[j].ID
+	})
+	return annotations
+}
+
+// Remove the expired annotations (the mutex must be held)
+func (a *Annotations) prune(now time.Time) {
+	for id, annotation := range a.items {
+		if !now.Before(annotation.Expires) {
+			delete(a.items, id)
+		}
+	}
+}
+
+// Pass through frames without decoding them while there are no annotations to draw
+func (a *Annotations) ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.prune(time.Now())
+	if len(a.items) == 0 {
+		return f, true, nil
+	}
+	return nil, false, nil
+}
+
+// Draw the annotations that haven't expired yet on the decoded image, in the order they expire
+func (a *Annotations) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	a.mutex.Lock()
+	annotations := a.active(time.Now())
+	a.mutex.Unlock()
+	for i := range annotations {
+		annotations[i].draw(img)
+	}
+	return img, nil
+}
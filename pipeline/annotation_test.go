@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+	"time"
+)
+
+// Get the IDs of the annotations, in order
+func annotationIDs(annotations []Annotation) []string {
+	ids := make([]string, len(annotations))
+	for i, annotation := range annotations {
+		ids[i] = annotation.ID
+	}
+	return ids
+}
+
+// Check that the annotations have the given IDs, in order
+func checkAnnotations(t *testing.T, what string, annotations []Annotation, ids ...string) {
+	t.Helper()
+	got := annotationIDs(annotations)
+	if len(got) != len(ids) {
+		t.Errorf("%s: got annotations %v, want %v", what, got, ids)
+		return
+	}
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Errorf("%s: got annotations %v, want %v", what, got, ids)
+			return
+		}
+	}
+}
+
+func TestAnnotationsAdd(t *testing.T) {
+	a := NewAnnotations()
+	box := &[4]float64{10, 10, 20, 20}
+
+	// Annotations without an ID are given one, and expire after the default TTL
+	before := time.Now()
+	added, err := a.Add(Annotation{Box: box}, Annotation{Box: box, TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnnotations(t, "added", added, "1", "2")
+	if added[0].TTL != DefaultAnnotationTTL.Seconds() || added[0].Expires.Before(before.Add(DefaultAnnotationTTL)) {
+		t.Errorf("annotation expires at %v after %v seconds, want the default TTL", added[0].Expires, added[0].TTL)
+	}
+	if added[1].Expires.Sub(added[0].Expires) != 5*time.Second {
+		t.Errorf("annotation with a TTL of 10 seconds expires at %v", added[1].Expires)
+	}
+	if added[0].Color != "red" || added[0].color != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("annotation has color %q (%v), want red", added[0].Color, added[0].color)
+	}
+
+	// Annotations are listed in the order they expire, and replace existing ones with the same ID
+	if _, err := a.Add(Annotation{ID: "car", Box: box, TTL: 20}); err != nil {
+		t.Fatal(err)
+	}
+	checkAnnotations(t, "listed", a.List(), "1", "2", "car")
+	if _, err := a.Add(Annotation{ID: "car", Box: &[4]float64{30, 30, 5, 5}, TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	listed := a.List()
+	checkAnnotations(t, "replaced", listed, "car", "1", "2")
+	if listed[0].Box[0] != 30 {
+		t.Errorf("annotation wasn't replaced: %v", listed[0].Box)
+	}
+
+	// Nothing changes if any of the annotations are invalid
+	if _, err := a.Add(Annotation{ID: "person", Box: box}, Annotation{Box: &[4]float64{0, 0, 0, 10}}); err == nil {
+		t.Error("invalid annotation was added")
+	}
+	checkAnnotations(t, "after an invalid annotation", a.List(), "car", "1", "2")
+
+	if a.Remove("person") {
+		t.Error("unknown annotation was removed")
+	}
+	if !a.Remove("1") {
+		t.Error("annotation wasn't removed")
+	}
+	checkAnnotations(t, "after removing one", a.List(), "car", "2")
+
+	// Replacing every annotation gives the new ones IDs that were never used before
+	replaced, err := a.Replace(Annotation{Box: box}, Annotation{ID: "2", Box: box, TTL: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnnotations(t, "replaced every annotation", replaced, "3", "2")
+	checkAnnotations(t, "listed after replacing", a.List(), "2", "3")
+	if count := a.Clear(); count != 2 || len(a.List()) != 0 {
+		t.Errorf("cleared %d annotations, leaving %d", count, len(a.List()))
+	}
+}
+
+func TestAnnotationsLimit(t *testing.T) {
+	a := NewAnnotations()
+	annotations := make([]Annotation, MaxAnnotations)
+	for i := range annotations {
+		annotations[i] = Annotation{At: &[2]float64{0, 0}, Text: "x"}
+	}
+	if _, err := a.Add(annotations...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Add(annotations[0]); !errors.Is(err, ErrTooManyAnnotations) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Existing annotations can still be replaced, by ID or all at once
+	if _, err := a.Add(Annotation{ID: "1", At: &[2]float64{10, 10}, Text: "y"}); err != nil {
+		t.Errorf("replacing an annotation failed: %v", err)
+	}
+	if _, err := a.Replace(annotations...); err != nil {
+		t.Errorf("replacing every annotation failed: %v", err)
+	}
+	if _, err := a.Replace(append(annotations, annotations[0])...); !errors.Is(err, ErrTooManyAnnotations) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(a.List()) != MaxAnnotations {
+		t.Errorf("got %d annotations, want %d", len(a.List()), MaxAnnotations)
+	}
+}
+
+func TestAnnotationsExpiry(t *testing.T) {
+	a := NewAnnotations()
+	if _, err := a.Add(
+		Annotation{ID: "short", Box: &[4]float64{0, 0, 8, 8}, TTL: 1},
+		Annotation{ID: "long", Box: &[4]float64{16, 16, 8, 8}, TTL: 60},
+	); err != nil {
+		t.Fatal(err)
+	}
+	expire := func(id string) {
+		a.mutex.Lock()
+		annotation := a.items[id]
+		annotation.Expires = time.Now()
+		a.items[id] = annotation
+		a.mutex.Unlock()
+	}
+
+	// Expired annotations aren't listed, drawn or removed
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	expire("short")
+	checkAnnotations(t, "after the first expired", a.List(), "long")
+	if _, err := a.Apply(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if img.RGBAAt(0, 0) != (color.RGBA{}) || img.RGBAAt(16, 16) == (color.RGBA{}) {
+		t.Error("expired annotation was drawn, or the other annotation wasn't")
+	}
+	if _, ok, _ := a.ApplyEncoded(nil); ok {
+		t.Error("frame was passed through with an annotation to draw")
+	}
+	if a.Remove("short") {
+		t.Error("expired annotation was removed")
+	}
+
+	// Frames are passed through again once every annotation expired
+	expire("long")
+	if f, ok, err := a.ApplyEncoded(nil); !ok || f != nil || err != nil {
+		t.Error("frame wasn't passed through without any annotations")
+	}
+	if count := a.Clear(); count != 0 {
+		t.Errorf("cleared %d expired annotations", count)
+	}
+}
+
+func TestAnnotationValidate(t *testing.T) {
+	box := &[4]float64{10, 10, 20, 20}
+	for _, annotation := range []Annotation{
+		{Box: box},
+		{Polygon: [][2]float64{{0, 0}, {10, 0}, {10, 10}}, Text: "zone", Color: "#00ff0080", Fill: "blue"},
+		{At: &[2]float64{-100000, 100000}, Text: "far away"},
+		{Box: &[4]float64{0.25, 0.25, 0.5, 0.5}, Normalized: true},
+		{Box: box, Thickness: 64, TTL: MaxAnnotationTTL.Seconds()},
+	} {
+		if err := annotation.validate(); err != nil {
+			t.Errorf("%+v: %v", annotation, err)
+		}
+	}
+	for _, annotation := range []Annotation{
+		{},
+		{Text: "nowhere"},
+		{At: &[2]float64{0, 0}},
+		{Box: box, Text: string(make([]byte, maxAnnotationText+1))},
+		{Polygon: [][2]float64{{0, 0}, {10, 10}}},
+		{Box: &[4]float64{0, 0, -1, 10}},
+		{Box: &[4]float64{0, 0, 10, 0}},
+		{Box: &[4]float64{100001, 0, 10, 10}},
+		{Box: &[4]float64{math.NaN(), 0, 10, 10}},
+		{Polygon: [][2]float64{{0, 0}, {10, 0}, {10, -100001}}},
+		{At: &[2]float64{math.Inf(1), 0}, Text: "infinity"},
+		{Box: &[4]float64{0, 0, 3, 1}, Normalized: true},
+		{Box: box, Thickness: -1},
+		{Box: box, Thickness: 65},
+		{Box: box, TTL: -1},
+		{Box: box, TTL: math.NaN()},
+		{Box: box, TTL: MaxAnnotationTTL.Seconds() + 1},
+		{Box: box, Color: "purple"},
+		{Box: box, Fill: "#12345"},
+	} {
+		if err := annotation.validate(); err == nil {
+			t.Errorf("%+v: expected an error", annotation)
+		}
+	}
+}
+
+func TestAnnotationDraw(t *testing.T) {
+	gray := color.RGBA{128, 128, 128, 255}
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+
+	for _, test := range []struct {
+		name       string
+		annotation Annotation
+
+		// Pixels with the color of the outline, of the fill, and that aren't drawn
+		outline, fill, clear []image.Point
+	}{
+		{"box", Annotation{Box: &[4]float64{10, 10, 20, 20}, Thickness: 2},
+			[]image.Point{{10, 10}, {29, 29}, {11, 20}}, nil, []image.Point{{20, 20}, {9, 9}, {30, 30}}},
+		{"filled box", Annotation{Box: &[4]float64{10, 10, 20, 20}, Thickness: 2, Fill: "blue"},
+			[]image.Point{{10, 10}, {29, 29}}, []image.Point{{20, 20}}, []image.Point{{9, 9}, {30, 30}}},
+		{"normalized box", Annotation{Box: &[4]float64{0.5, 0.5, 0.25, 0.25}, Thickness: 1, Normalized: true},
+			[]image.Point{{32, 24}, {47, 35}}, nil, []image.Point{{40, 30}, {31, 23}, {48, 36}}},
+		{"polygon", Annotation{Polygon: [][2]float64{{0, 0}, {63, 0}, {0, 47}}, Thickness: 1, Fill: "blue"},
+			[]image.Point{{0, 0}, {63, 0}, {0, 47}}, []image.Point{{10, 10}}, []image.Point{{40, 40}}},
+
+		// Lines far outside of the frame are clipped to it
+		{"huge polygon", Annotation{Polygon: [][2]float64{{-100000, -100000}, {100000, 100000}, {-100000, 100000}}, Thickness: 4},
+			[]image.Point{{0, 0}, {24, 24}, {47, 47}}, nil, []image.Point{{63, 0}, {10, 40}}},
+		{"outside of the frame", Annotation{Box: &[4]float64{-100000, -100000, 1000, 1000}, Thickness: 64, Fill: "blue"},
+			nil, nil, []image.Point{{0, 0}, {63, 47}}},
+	} {
+		a := NewAnnotations()
+		if _, err := a.Add(test.annotation); err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+		draw.Draw(img, img.Rect, image.NewUniform(gray), image.Point{}, draw.Src)
+		if _, err := a.Apply(img, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, check := range []struct {
+			points []image.Point
+			want   color.RGBA
+		}{
+			{test.outline, red}, {test.fill, blue}, {test.clear, gray},
+		} {
+			for _, p := range check.points {
+				if got := img.RGBAAt(p.X, p.Y); got != check.want {
+					t.Errorf("%s: pixel %v is %v, want %v", test.name, p, got, check.want)
+				}
+			}
+		}
+	}
+
+	// Labels are drawn above the box in the color of the annotation, with text in a contrasting color
+	a := NewAnnotations()
+	if _, err := a.Add(Annotation{Box: &[4]float64{8, 40, 20, 8}, Text: "car", Color: "yellow"}); err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	if _, err := a.Apply(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	label := map[color.RGBA]int{}
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 64; x++ {
+			label[img.RGBAAt(x, y)]++
+		}
+	}
+	if label[color.RGBA{255, 255, 0, 255}] == 0 || label[color.RGBA{0, 0, 0, 255}] == 0 {
+		t.Errorf("no label above the box: %v", label)
+	}
+}
@@ -0,0 +1,206 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"errors"
+	"image"
+	"math"
+	"sync"
+)
+
+// autoLevelsClip is the fraction of the darkest and brightest pixels that auto-levels ignores,
+// so a few outliers (such as a reflection) don't prevent the rest of the frame from being stretched
+const autoLevelsClip = 0.005
+
+// Adjustments are color and exposure adjustments, where the zero value of every field
+// except Contrast, Gamma and Saturation (which are 1 when unchanged) leaves frames unchanged
+type Adjustments struct {
+	// Brightness offset, from -1 (black) to 1 (white)
+	Brightness float64 `json:"brightness"`
+
+	// Contrast multiplier around the middle gray, from 0 (gray) up to 4
+	Contrast float64 `json:"contrast"`
+
+	// Gamma correction, from 0.1 up to 10, where values above 1 brighten the midtones
+	Gamma float64 `json:"gamma"`
+
+	// Saturation multiplier, from 0 (grayscale) up to 4
+	Saturation float64 `json:"saturation"`
+
+	// Convert frames to grayscale
+	Grayscale bool `json:"grayscale"`
+
+	// Stretch the levels of every frame to use the full range from black to white
+	AutoLevels bool `json:"auto_levels"`
+}
+
+// DefaultAdjustments leave frames unchanged
+var DefaultAdjustments = Adjustments{Contrast: 1, Gamma: 1, Saturation: 1}
+
+// Check if the adjustments are valid
+func (a Adjustments) Validate() error {
+	switch {
+	case math.IsNaN(a.Brightness) || a.Brightness < -1 || a.Brightness > 1:
+		return errors.New("brightness must be between -1 and 1")
+	case math.IsNaN(a.Contrast) || a.Contrast < 0 || a.Contrast > 4:
+		return errors.New("contrast must be between 0 and 4")
+	case math.IsNaN(a.Gamma) || a.Gamma < 0.1 || a.Gamma > 10:
+		return errors.New("gamma must be between 0.1 and 10")
+	case math.IsNaN(a.Saturation) || a.Saturation < 0 || a.Saturation > 4:
+		return errors.New("saturation must be between 0 and 4")
+	}
+	return nil
+}
+
+// Check if the adjustments leave frames unchanged
+func (a Adjustments) IsIdentity() bool {
+	return a == DefaultAdjustments
+}
+
+// Check if the adjustments change the brightness of each channel, rather than just the colors
+func (a Adjustments) adjustsLevels() bool {
+	return a.Brightness != 0 || a.Contrast != 1 || a.Gamma != 1 || a.AutoLevels
+}
+
+// Build the lookup table that maps the input levels to the output levels,
+// after first stretching the levels from black to white if they're given
+func (a Adjustments) lookupTable(black, white int) *[256]uint8 {
+	var table [256]uint8
+	for i := range table {
+		value := float64(i) / 255
+		if white > black {
+			value = (float64(i) - float64(black)) / float64(white-black)
+		}
+		value = (value-0.5)*a.Contrast + 0.5 + a.Brightness
+		if value <= 0 {
+			value = 0
+		} else if value >= 1 {
+			value = 1
+		} else if a.Gamma != 1 {
+			value = math.Pow(value, 1/a.Gamma)
+		}
+		table[i] = uint8(math.Round(value * 255))
+	}
+	return &table
+}
+
+// Color applies color and exposure adjustments that can be changed at runtime to every frame
+type Color struct {
+	mutex       sync.RWMutex
+	adjustments Adjustments
+	table       *[256]uint8
+}
+
+// Create a new Color stage that leaves frames unchanged
+func NewColor() *Color {
+	return &Color{adjustments: DefaultAdjustments, table: DefaultAdjustments.lookupTable(0, 0)}
+}
+
+// Get the current adjustments
+func (c *Color) Adjustments() Adjustments {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.adjustments
+}
+
+// Change the current adjustments
+func (c *Color) SetAdjustments(adjustments Adjustments) error {
+	if err := adjustments.Validate(); err != nil {
+		return err
+	}
+	table := adjustments.lookupTable(0, 0)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.adjustments, c.table = adjustments, table
+	return nil
+}
+
+// Leave the encoded frame as is when there's nothing to adjust
+func (c *Color) ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error) {
+	if c.Adjustments().IsIdentity() {
+		return f, true, nil
+	}
+	return nil, false, nil
+}
+
+// Adjust the decoded image in place
+func (c *Color) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	c.mutex.RLock()
+	adjustments, table := c.adjustments, c.table
+	c.mutex.RUnlock()
+	if adjustments.IsIdentity() {
+		return img, nil
+	}
+
+	// Auto-levels needs a lookup table for the levels of this particular frame
+	if adjustments.AutoLevels {
+		black, white := levels(img)
+		table = adjustments.lookupTable(black, white)
+	}
+
+	// Saturation is applied as a fixed point (8 bit) multiplier of the distance from the pixel's luma
+	saturation := int32(math.Round(adjustments.Saturation * 256))
+	if adjustments.Grayscale {
+		saturation = 0
+	}
+	adjustLevels := adjustments.adjustsLevels()
+
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < height; y++ {
+		offset := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		row := img.Pix[offset : offset+width*4]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := row[i], row[i+1], row[i+2]
+			if adjustLevels {
+				r, g, b = table[r], table[g], table[b]
+			}
+			if saturation != 256 {
+				luma := (77*int32(r) + 150*int32(g) + 29*int32(b)) >> 8
+				r = clampUint8(luma + (int32(r)-luma)*saturation>>8)
+				g = clampUint8(luma + (int32(g)-luma)*saturation>>8)
+				b = clampUint8(luma + (int32(b)-luma)*saturation>>8)
+			}
+			row[i], row[i+1], row[i+2] = r, g, b
+		}
+	}
+	return img, nil
+}
+
+// Find the black and white levels of the image, ignoring the darkest and brightest autoLevelsClip of the pixels
+func levels(img *image.RGBA) (int, int) {
+	var histogram [256]int
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < height; y++ {
+		offset := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		row := img.Pix[offset : offset+width*4]
+		for i := 0; i < len(row); i += 4 {
+			histogram[(77*int(row[i])+150*int(row[i+1])+29*int(row[i+2]))>>8]++
+		}
+	}
+
+	clip := int(float64(width*height) * autoLevelsClip)
+	black, count := 0, 0
+	for ; black < 255; black++ {
+		if count += histogram[black]; count > clip {
+			break
+		}
+	}
+	white, count := 255, 0
+	for ; white > 0; white-- {
+		if count += histogram[white]; count > clip {
+			break
+		}
+	}
+	return black, white
+}
+
+// Clamp a value to the range of a uint8
+func clampUint8(value int32) uint8 {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+	return uint8(value)
+}
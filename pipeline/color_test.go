@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestLookupTable(t *testing.T) {
+	identity := DefaultAdjustments.lookupTable(0, 0)
+	for i, value := range identity {
+		if int(value) != i {
+			t.Fatalf("default adjustments map %d to %d", i, value)
+		}
+	}
+
+	for _, test := range []struct {
+		name        string
+		adjustments Adjustments
+		black       int
+		white       int
+
+		// Expected output levels for some of the input levels
+		want map[int]uint8
+	}{
+		{"black", Adjustments{Brightness: -1, Contrast: 1, Gamma: 1}, 0, 0, map[int]uint8{0: 0, 128: 0, 255: 0}},
+		{"white", Adjustments{Brightness: 1, Contrast: 1, Gamma: 1}, 0, 0, map[int]uint8{0: 255, 128: 255, 255: 255}},
+		{"brighter", Adjustments{Brightness: 0.5, Contrast: 1, Gamma: 1}, 0, 0, map[int]uint8{0: 128, 51: 179, 128: 255}},
+		{"no contrast", Adjustments{Contrast: 0, Gamma: 1}, 0, 0, map[int]uint8{0: 128, 128: 128, 255: 128}},
+		{"most contrast", Adjustments{Contrast: 4, Gamma: 1}, 0, 0, map[int]uint8{0: 0, 64: 0, 192: 255, 255: 255}},
+		{"bright midtones", Adjustments{Contrast: 1, Gamma: 2}, 0, 0, map[int]uint8{0: 0, 64: 128, 255: 255}},
+		{"dark midtones", Adjustments{Contrast: 1, Gamma: 0.5}, 0, 0, map[int]uint8{0: 0, 128: 64, 255: 255}},
+		{"most gamma", Adjustments{Contrast: 1, Gamma: 10}, 0, 0, map[int]uint8{0: 0, 255: 255}},
+		{"stretched levels", DefaultAdjustments, 50, 150, map[int]uint8{0: 0, 50: 0, 100: 128, 150: 255, 200: 255}},
+	} {
+		table := test.adjustments.lookupTable(test.black, test.white)
+		for input, want := range test.want {
+			if got := table[input]; got != want {
+				t.Errorf("%s: %d maps to %d, want %d", test.name, input, got, want)
+			}
+		}
+		for i := 1; i < len(table); i++ {
+			if table[i] < table[i-1] {
+				t.Errorf("%s: levels aren't monotonic at %d", test.name, i)
+				break
+			}
+		}
+	}
+}
+
+func TestColorApply(t *testing.T) {
+	colors := []color.RGBA{{200, 50, 50, 255}, {10, 20, 30, 255}, {128, 128, 128, 255}, {0, 255, 0, 255}}
+	img := image.NewRGBA(image.Rect(0, 0, len(colors), 1))
+	for x, c := range colors {
+		img.SetRGBA(x, 0, c)
+	}
+	luma := func(c color.RGBA) uint8 {
+		return uint8((77*int(c.R) + 150*int(c.G) + 29*int(c.B)) >> 8)
+	}
+
+	for _, test := range []struct {
+		name        string
+		adjustments Adjustments
+		want        func(c color.RGBA) color.RGBA
+	}{
+		{"default", DefaultAdjustments, func(c color.RGBA) color.RGBA { return c }},
+		{"grayscale", Adjustments{Contrast: 1, Gamma: 1, Saturation: 1, Grayscale: true}, func(c color.RGBA) color.RGBA {
+			return color.RGBA{luma(c), luma(c), luma(c), 255}
+		}},
+		{"no saturation", Adjustments{Contrast: 1, Gamma: 1}, func(c color.RGBA) color.RGBA {
+			return color.RGBA{luma(c), luma(c), luma(c), 255}
+		}},
+		{"darkest", Adjustments{Brightness: -1, Contrast: 1, Gamma: 1, Saturation: 1}, func(c color.RGBA) color.RGBA {
+			return color.RGBA{0, 0, 0, 255}
+		}},
+	} {
+		c := NewColor()
+		if err := c.SetAdjustments(test.adjustments); err != nil {
+			t.Fatal(err)
+		}
+		adjusted := image.NewRGBA(img.Rect)
+		copy(adjusted.Pix, img.Pix)
+		adjusted, err := c.Apply(adjusted, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x, original := range colors {
+			if got, want := adjusted.RGBAAt(x, 0), test.want(original); got != want {
+				t.Errorf("%s: %v became %v, want %v", test.name, original, got, want)
+			}
+		}
+	}
+
+	// The most saturation pushes the channels apart, clamped to the range of a channel
+	c := NewColor()
+	if err := c.SetAdjustments(Adjustments{Contrast: 1, Gamma: 1, Saturation: 4}); err != nil {
+		t.Fatal(err)
+	}
+	saturated := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	saturated.SetRGBA(0, 0, color.RGBA{200, 50, 50, 255})
+	if _, err := c.Apply(saturated, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := saturated.RGBAAt(0, 0); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("saturated color is %v", got)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	// A gradient from 50 to 150, with a few outliers that are ignored
+	img := image.NewRGBA(image.Rect(0, 0, 101, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x <= 100; x++ {
+			value := uint8(50 + x)
+			if y == 0 && x < 20 {
+				value = 0
+			} else if y == 0 && x > 80 {
+				value = 255
+			}
+			img.SetRGBA(x, y, color.RGBA{value, value, value, 255})
+		}
+	}
+	if black, white := levels(img); black != 50 || white != 150 {
+		t.Errorf("levels are %d to %d, want 50 to 150", black, white)
+	}
+}
+
+func TestAdjustmentsValidate(t *testing.T) {
+	for _, adjustments := range []Adjustments{
+		DefaultAdjustments,
+		{Brightness: -1, Contrast: 0, Gamma: 0.1, Saturation: 0},
+		{Brightness: 1, Contrast: 4, Gamma: 10, Saturation: 4},
+	} {
+		if err := adjustments.Validate(); err != nil {
+			t.Errorf("%+v: %v", adjustments, err)
+		}
+	}
+	for _, adjustments := range []Adjustments{
+		{Brightness: 1.5, Contrast: 1, Gamma: 1, Saturation: 1},
+		{Brightness: math.NaN(), Contrast: 1, Gamma: 1, Saturation: 1},
+		{Contrast: -1, Gamma: 1, Saturation: 1},
+		{Contrast: 1, Gamma: 0, Saturation: 1},
+		{Contrast: 1, Gamma: math.Inf(1), Saturation: 1},
+		{Contrast: 1, Gamma: 1, Saturation: 5},
+	} {
+		if err := adjustments.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", adjustments)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Crop crops every frame to a fixed rectangle, such as the area of interest of a wide frame
+type Crop struct {
+	rect image.Rectangle
+
+	outsideOnce sync.Once
+}
+
+// Create a new Crop stage that crops frames to the given rectangle,
+// which is relative to the top left corner of the frame (after any rotation)
+func NewCrop(rect image.Rectangle) (*Crop, error) {
+	if rect.Empty() || rect.Min.X < 0 || rect.Min.Y < 0 {
+		return nil, fmt.Errorf("invalid crop rectangle: %v", rect)
+	}
+	return &Crop{rect: rect}, nil
+}
+
+// Parse a crop rectangle in the "x,y,width,height" format
+func ParseCrop(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, errors.New("crop rectangle must be in the x,y,width,height format")
+	}
+	var values [4]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("invalid crop rectangle: %s", value)
+		}
+		values[i] = v
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// Get the crop rectangle
+func (c *Crop) Rect() image.Rectangle {
+	return c.rect
+}
+
+// Crop the decoded image, leaving it as is if the rectangle lies entirely outside of it
+func (c *Crop) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	if !c.rect.Overlaps(image.Rect(0, 0, img.Rect.Dx(), img.Rect.Dy())) {
+		c.outsideOnce.Do(func() {
+			log.Println("Crop rectangle", c.rect, "lies outside of the", img.Rect.Dx(), "x", img.Rect.Dy(), "frame, not cropping")
+		})
+		return img, nil
+	}
+	return imaging.Crop(img, c.rect), nil
+}
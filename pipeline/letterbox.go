@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Letterbox scales every frame to fit within a fixed output size, filling the rest of the frame
+// (letterboxing or pillarboxing it), so every frame has the same size even when the source size changes
+type Letterbox struct {
+	width  int
+	height int
+	fill   color.RGBA
+}
+
+// Create a new Letterbox stage that scales frames to fit the given size, filling the rest with the given color
+func NewLetterbox(width, height int, fill color.RGBA) (*Letterbox, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid output size: %dx%d", width, height)
+	}
+	return &Letterbox{width: width, height: height, fill: fill}, nil
+}
+
+// Parse a size in the "widthxheight" format (eg. "1280x720")
+func ParseSize(value string) (int, int, error) {
+	width, height, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("size must be in the widthxheight format: %s", value)
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(width))
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", value)
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(height))
+	if err != nil || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return w, h, nil
+}
+
+// Get the output size
+func (l *Letterbox) Size() (int, int) {
+	return l.width, l.height
+}
+
+// Pass through frames that already have the output size, without decoding them
+func (l *Letterbox) ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error) {
+	if f.Width == l.width && f.Height == l.height {
+		return f, true, nil
+	}
+	return nil, false, nil
+}
+
+// Scale the decoded image to fit the output size, centering it on the fill color
+func (l *Letterbox) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	srcWidth, srcHeight := img.Rect.Dx(), img.Rect.Dy()
+	if srcWidth == l.width && srcHeight == l.height {
+		return img, nil
+	}
+
+	width, height := imaging.FitSize(srcWidth, srcHeight, l.width, l.height)
+	out := image.NewRGBA(image.Rect(0, 0, l.width, l.height))
+	if width < l.width || height < l.height {
+		draw.Draw(out, out.Rect, image.NewUniform(l.fill), image.Point{}, draw.Src)
+	}
+	resized := imaging.Resize(img, width, height, imaging.DefaultFilter)
+	at := image.Pt((l.width-width)/2, (l.height-height)/2)
+	draw.Draw(out, image.Rectangle{Min: at, Max: at.Add(image.Pt(width, height))}, resized, resized.Rect.Min, draw.Src)
+	return out, nil
+}
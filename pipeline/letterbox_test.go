@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestLetterbox(t *testing.T) {
+	fill := color.RGBA{0, 0, 255, 255}
+	white := color.RGBA{255, 255, 255, 255}
+
+	for _, test := range []struct {
+		name          string
+		src           image.Point
+		width, height int
+
+		// Where the scaled frame is drawn, with the rest of the output filled
+		content image.Rectangle
+	}{
+		{"letterbox", image.Pt(1280, 720), 640, 640, image.Rect(0, 140, 640, 500)},
+		{"pillarbox", image.Pt(480, 640), 640, 480, image.Rect(140, 0, 500, 480)},
+		{"same aspect ratio", image.Pt(640, 360), 1280, 720, image.Rect(0, 0, 1280, 720)},
+		{"downscaled", image.Pt(1920, 1080), 320, 180, image.Rect(0, 0, 320, 180)},
+		{"odd source size", image.Pt(101, 51), 64, 64, image.Rect(0, 16, 64, 48)},
+		{"odd output size", image.Pt(640, 480), 33, 17, image.Rect(5, 0, 28, 17)},
+		{"odd bars", image.Pt(100, 100), 64, 33, image.Rect(15, 0, 48, 33)},
+	} {
+		l, err := NewLetterbox(test.width, test.height, fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewRGBA(image.Rectangle{Max: test.src})
+		draw.Draw(img, img.Rect, image.NewUniform(white), image.Point{}, draw.Src)
+
+		out, err := l.Apply(img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Rect != image.Rect(0, 0, test.width, test.height) {
+			t.Errorf("%s: output is %v, want %dx%d", test.name, out.Rect, test.width, test.height)
+			continue
+		}
+	pixels:
+		for y := 0; y < test.height; y++ {
+			for x := 0; x < test.width; x++ {
+				want := fill
+				if image.Pt(x, y).In(test.content) {
+					want = white
+				}
+				if got := out.RGBAAt(x, y); got != want {
+					t.Errorf("%s: pixel %d,%d is %v, want %v", test.name, x, y, got, want)
+					break pixels
+				}
+			}
+		}
+	}
+}
+
+func TestLetterboxPassthrough(t *testing.T) {
+	l, err := NewLetterbox(64, 48, color.RGBA{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames that already have the output size are used as is
+	img := gradientImage(64, 48)
+	if out, err := l.Apply(img, nil); err != nil || out != img {
+		t.Errorf("frame of the output size was scaled: %v", err)
+	}
+	f := encodeFrame(t, img, 80)
+	if out, ok, err := l.ApplyEncoded(f); err != nil || !ok || out != f {
+		t.Errorf("encoded frame of the output size wasn't passed through: %v", err)
+	}
+	if _, ok, err := l.ApplyEncoded(encodeFrame(t, gradientImage(48, 64), 80)); err != nil || ok {
+		t.Errorf("encoded frame of another size was passed through: %v", err)
+	}
+
+	for _, size := range []image.Point{{0, 48}, {64, 0}, {-1, -1}} {
+		if _, err := NewLetterbox(size.X, size.Y, color.RGBA{}); err == nil {
+			t.Errorf("%v: expected an error", size)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value         string
+		width, height int
+	}{
+		{"1280x720", 1280, 720}, {"640X480", 640, 480}, {" 33 x 17 ", 33, 17},
+	} {
+		width, height, err := ParseSize(test.value)
+		if err != nil || width != test.width || height != test.height {
+			t.Errorf("%q: got %dx%d (%v), want %dx%d", test.value, width, height, err, test.width, test.height)
+		}
+	}
+	for _, value := range []string{"", "1280", "1280x", "x720", "0x720", "1280x-1", "widexhigh"} {
+		if _, _, err := ParseSize(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
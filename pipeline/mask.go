@@ -0,0 +1,266 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBlockSize is the size of the blocks that masks are pixelated with when none is given
+const DefaultBlockSize = 16
+
+// MaskMode selects how a mask hides what's behind it
+type MaskMode int
+
+const (
+	// Fill the mask with a solid color
+	Fill MaskMode = iota
+
+	// Pixelate the mask into large blocks
+	Pixelate
+)
+
+// Mask is a polygon (or rectangle) that is hidden on every frame,
+// relative to the top left corner of the frame as received from the source
+type Mask struct {
+	Polygon []image.Point
+	Mode    MaskMode
+
+	// Color to fill the mask with (Fill mode)
+	Color color.RGBA
+
+	// Size of the blocks to pixelate the mask with (Pixelate mode)
+	BlockSize int
+}
+
+// Create a new Mask that fills the given rectangle with black
+func RectMask(rect image.Rectangle) Mask {
+	return PolygonMask(rect.Min, image.Pt(rect.Max.X, rect.Min.Y), rect.Max, image.Pt(rect.Min.X, rect.Max.Y))
+}
+
+// Create a new Mask that fills the given polygon with black
+func PolygonMask(points ...image.Point) Mask {
+	return Mask{Polygon: points, Mode: Fill, Color: color.RGBA{0, 0, 0, 255}, BlockSize: DefaultBlockSize}
+}
+
+// Parse a mask in the [MODE:]SHAPE format, where the shape is either a rectangle ("x,y,width,height")
+// or a polygon of three or more points ("x1,y1 x2,y2 x3,y3 ..."), and the mode is either
+// "fill" (optionally "fill=COLOR", black by default) or "pixelate" (optionally "pixelate=BLOCKSIZE")
+func ParseMask(value string) (Mask, error) {
+	mode, shape := "fill", strings.TrimSpace(value)
+	if i := strings.IndexByte(shape, ':'); i >= 0 {
+		mode, shape = shape[:i], strings.TrimSpace(shape[i+1:])
+	}
+
+	var mask Mask
+	fields := strings.Fields(shape)
+	if len(fields) == 1 {
+		rect, err := ParseCrop(fields[0])
+		if err != nil {
+			return mask, fmt.Errorf("invalid mask rectangle: %s", shape)
+		}
+		mask = RectMask(rect)
+	} else {
+		if len(fields) < 3 {
+			return mask, fmt.Errorf("mask polygon needs at least 3 points: %s", shape)
+		}
+		points := make([]image.Point, len(fields))
+		for i, field := range fields {
+			x, y, ok := strings.Cut(field, ",")
+			var errX, errY error
+			points[i].X, errX = strconv.Atoi(x)
+			points[i].Y, errY = strconv.Atoi(y)
+			if !ok || errX != nil || errY != nil {
+				return mask, fmt.Errorf("invalid mask point: %s", field)
+			}
+		}
+		mask = PolygonMask(points...)
+	}
+
+	name, argument, _ := strings.Cut(mode, "=")
+	switch strings.ToLower(name) {
+	case "fill":
+		if argument != "" {
+			c, err := imaging.ParseColor(argument)
+			if err != nil {
+				return mask, err
+			}
+			mask.Color = c
+		}
+	case "pixelate":
+		mask.Mode = Pixelate
+		if argument != "" {
+			blockSize, err := strconv.Atoi(argument)
+			if err != nil || blockSize < 1 {
+				return mask, fmt.Errorf("invalid mask block size: %s", argument)
+			}
+			mask.BlockSize = blockSize
+		}
+	default:
+		return mask, fmt.Errorf("unknown mask mode: %s", name)
+	}
+	return mask, nil
+}
+
+// span is a horizontal run of masked pixels [x0, x1) on row y
+type span struct {
+	y, x0, x1 int
+}
+
+// Masks hides privacy sensitive areas of every frame, such as doorways or monitors
+type Masks struct {
+	masks []Mask
+
+	mutex  sync.Mutex
+	size   image.Point
+	spans  [][]span
+	blocks [][]image.Rectangle
+}
+
+// Create a new Masks stage
+func NewMasks(masks ...Mask) (*Masks, error) {
+	if len(masks) == 0 {
+		return nil, errors.New("at least one mask is required")
+	}
+	for _, mask := range masks {
+		if len(mask.Polygon) < 3 {
+			return nil, errors.New("mask polygon needs at least 3 points")
+		}
+		if mask.Mode == Pixelate && mask.BlockSize < 1 {
+			return nil, errors.New("mask block size must be at least 1")
+		}
+	}
+	return &Masks{masks: masks}, nil
+}
+
+// Hide the masked areas of the decoded image
+func (m *Masks) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	spans, blocks := m.rasterize(img.Rect.Dx(), img.Rect.Dy())
+	for i, mask := range m.masks {
+		switch mask.Mode {
+		case Pixelate:
+			pixelate(img, spans[i], blocks[i], mask.BlockSize)
+		default:
+			for _, s := range spans[i] {
+				imaging.FillRect(img, image.Rect(s.x0, s.y, s.x1, s.y+1).Add(img.Rect.Min), mask.Color)
+			}
+		}
+	}
+	return img, nil
+}
+
+// Get the masked spans (and for pixelated masks, the blocks they cover) of every mask
+// for frames of the given size, which are only calculated again when the size changes
+func (m *Masks) rasterize(width, height int) ([][]span, [][]image.Rectangle) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.spans != nil && m.size == image.Pt(width, height) {
+		return m.spans, m.blocks
+	}
+
+	m.size = image.Pt(width, height)
+	m.spans = make([][]span, len(m.masks))
+	m.blocks = make([][]image.Rectangle, len(m.masks))
+	for i, mask := range m.masks {
+		m.spans[i] = rasterizePolygon(mask.Polygon, width, height)
+		if mask.Mode == Pixelate {
+			m.blocks[i] = coveredBlocks(m.spans[i], mask.BlockSize, width, height)
+		}
+	}
+	return m.spans, m.blocks
+}
+
+// Find the spans of pixels whose centers lie inside the polygon (using the even-odd rule), clipped to the frame
+func rasterizePolygon(polygon []image.Point, width, height int) []span {
+	var spans []span
+	crossings := make([]float64, 0, len(polygon))
+	for y := 0; y < height; y++ {
+		center := float64(y) + 0.5
+
+		// Find where the edges of the polygon cross the row's center line
+		crossings = crossings[:0]
+		for i, a := range polygon {
+			b := polygon[(i+1)%len(polygon)]
+			ay, by := float64(a.Y), float64(b.Y)
+			if (ay <= center) == (by <= center) {
+				continue
+			}
+			crossings = append(crossings, float64(a.X)+(center-ay)*float64(b.X-a.X)/(by-ay))
+		}
+		sort.Float64s(crossings)
+
+		// Every pair of crossings encloses the pixels whose centers lie between them
+		for i := 0; i+1 < len(crossings); i += 2 {
+			x0 := clampInt(int(crossings[i]+0.5), 0, width)
+			x1 := clampInt(int(crossings[i+1]+0.5), 0, width)
+			if x0 < x1 {
+				spans = append(spans, span{y: y, x0: x0, x1: x1})
+			}
+		}
+	}
+	return spans
+}
+
+// Find the blocks of the grid of the given block size that contain any of the spans
+func coveredBlocks(spans []span, blockSize, width, height int) []image.Rectangle {
+	covered := make(map[image.Point]bool)
+	var blocks []image.Rectangle
+	for _, s := range spans {
+		for bx := s.x0 / blockSize; bx <= (s.x1-1)/blockSize; bx++ {
+			block := image.Pt(bx, s.y/blockSize)
+			if covered[block] {
+				continue
+			}
+			covered[block] = true
+			rect := image.Rect(bx*blockSize, block.Y*blockSize, (bx+1)*blockSize, (block.Y+1)*blockSize)
+			blocks = append(blocks, rect.Intersect(image.Rect(0, 0, width, height)))
+		}
+	}
+	return blocks
+}
+
+// Pixelate the spans by replacing their pixels with the average color of the block they're in
+func pixelate(img *image.RGBA, spans []span, blocks []image.Rectangle, blockSize int) {
+	// Average every block before any of them are modified
+	averages := make(map[image.Point]color.RGBA, len(blocks))
+	for _, block := range blocks {
+		var r, g, b, a, n uint32
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			offset := img.PixOffset(img.Rect.Min.X+block.Min.X, img.Rect.Min.Y+y)
+			row := img.Pix[offset : offset+block.Dx()*4]
+			for i := 0; i < len(row); i += 4 {
+				r, g, b, a = r+uint32(row[i]), g+uint32(row[i+1]), b+uint32(row[i+2]), a+uint32(row[i+3])
+				n++
+			}
+		}
+		averages[block.Min] = color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)}
+	}
+
+	// Replace the masked pixels with the average of their block
+	for _, s := range spans {
+		offset := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+s.y)
+		for x := s.x0; x < s.x1; x++ {
+			c := averages[image.Pt(x/blockSize*blockSize, s.y/blockSize*blockSize)]
+			i := offset + x*4
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+// Clamp a value to the given range
+func clampInt(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Check that exactly the pixels inside the rectangle were changed by the stage, and that they have the given color
+func checkMasked(t *testing.T, name string, got, original *image.RGBA, rect image.Rectangle, want color.RGBA) {
+	t.Helper()
+	for y := got.Rect.Min.Y; y < got.Rect.Max.Y; y++ {
+		for x := got.Rect.Min.X; x < got.Rect.Max.X; x++ {
+			c := got.RGBAAt(x, y)
+			if image.Pt(x, y).In(rect) {
+				if c != want {
+					t.Fatalf("%s: masked pixel at %d,%d is %v, want %v", name, x, y, c, want)
+				}
+			} else if c != original.RGBAAt(x, y) {
+				t.Fatalf("%s: pixel at %d,%d outside of the mask was changed", name, x, y)
+			}
+		}
+	}
+}
+
+func TestMasksFill(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	original := gradientImage(64, 48)
+
+	for _, test := range []struct {
+		name   string
+		bounds image.Rectangle
+		mask   Mask
+		rect   image.Rectangle
+	}{
+		{"rectangle", original.Rect, RectMask(image.Rect(8, 4, 24, 20)), image.Rect(8, 4, 24, 20)},
+		{"clipped to the frame", original.Rect, RectMask(image.Rect(-10, 40, 100, 100)), image.Rect(0, 40, 64, 48)},
+		{"outside of the frame", original.Rect, RectMask(image.Rect(100, 100, 200, 200)), image.Rectangle{}},
+
+		// Masks are relative to the top left corner of the frame, even when its image doesn't start at 0,0
+		{"offset frame", image.Rect(16, 8, 64, 48), RectMask(image.Rect(0, 0, 8, 8)), image.Rect(16, 8, 24, 16)},
+	} {
+		test.mask.Color = red
+		masks, err := NewMasks(test.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := imaging.CloneRGBA(original).SubImage(test.bounds).(*image.RGBA)
+		img, err = masks.Apply(img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMasked(t, test.name, img, original, test.rect, red)
+	}
+
+	// Polygons mask the pixels whose centers are inside them
+	masks, err := NewMasks(PolygonMask(image.Pt(32, 0), image.Pt(64, 0), image.Pt(64, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := masks.Apply(imaging.CloneRGBA(original), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		x, y   int
+		masked bool
+	}{
+		{60, 2, true}, {63, 30, true}, {40, 1, true}, {50, 10, true},
+		{33, 2, false}, {40, 20, false}, {63, 33, false}, {10, 10, false},
+	} {
+		if masked := img.RGBAAt(test.x, test.y) == (color.RGBA{0, 0, 0, 255}); masked != test.masked {
+			t.Errorf("polygon: pixel at %d,%d is masked: %t, want %t", test.x, test.y, masked, test.masked)
+		}
+	}
+}
+
+func TestMasksPixelate(t *testing.T) {
+	// A checkerboard of black and white pixels, which averages to gray
+	original := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				original.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			} else {
+				original.SetRGBA(x, y, color.RGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	gray := color.RGBA{127, 127, 127, 255}
+
+	for _, test := range []struct {
+		name string
+		rect image.Rectangle
+	}{
+		{"aligned to the blocks", image.Rect(8, 8, 24, 32)},
+
+		// Blocks are averaged over every one of their pixels, including the ones that aren't masked
+		{"not aligned to the blocks", image.Rect(12, 4, 20, 12)},
+		{"clipped to the frame", image.Rect(60, 44, 70, 50)},
+	} {
+		mask := RectMask(test.rect)
+		mask.Mode, mask.BlockSize = Pixelate, 8
+		masks, err := NewMasks(mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := masks.Apply(imaging.CloneRGBA(original), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMasked(t, test.name, img, original, test.rect.Intersect(original.Rect), gray)
+	}
+
+	// Every block is averaged separately
+	gradient := gradientImage(64, 48)
+	mask := RectMask(image.Rect(0, 0, 16, 8))
+	mask.Mode, mask.BlockSize = Pixelate, 8
+	masks, err := NewMasks(mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := masks.Apply(imaging.CloneRGBA(gradient), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, right := img.RGBAAt(0, 0), img.RGBAAt(8, 0)
+	if left == right || img.RGBAAt(7, 7) != left || img.RGBAAt(15, 7) != right {
+		t.Errorf("blocks weren't averaged separately: %v and %v", left, right)
+	}
+	if left == gradient.RGBAAt(0, 0) {
+		t.Error("pixelated block is unchanged")
+	}
+}
+
+func TestNewMasks(t *testing.T) {
+	pixelate := RectMask(image.Rect(0, 0, 8, 8))
+	pixelate.Mode, pixelate.BlockSize = Pixelate, 0
+	for _, masks := range [][]Mask{
+		nil,
+		{PolygonMask(image.Pt(0, 0), image.Pt(8, 8))},
+		{pixelate},
+	} {
+		if _, err := NewMasks(masks...); err == nil {
+			t.Errorf("%+v: expected an error", masks)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/jpegtran"
+	"image"
+	"log"
+	"sync"
+)
+
+// Orientation rotates and/or flips every frame, losslessly when the
+// frame's encoding and MCU geometry allow it, or by decoding it otherwise
+type Orientation struct {
+	op jpegtran.Op
+
+	fallbackOnce sync.Once
+}
+
+// Create a new Orientation stage that rotates frames clockwise by the given
+// number of degrees (0, 90, 180 or 270), then flips them horizontally and/or vertically
+func NewOrientation(rotation int, flipH, flipV bool) (*Orientation, error) {
+	op, err := jpegtran.Rotation(rotation, flipH, flipV)
+	if err != nil {
+		return nil, err
+	}
+	return &Orientation{op: op}, nil
+}
+
+// Check if the stage leaves frames unchanged
+func (o *Orientation) IsIdentity() bool {
+	return o.op.IsIdentity()
+}
+
+// Transform the encoded frame losslessly, if possible
+func (o *Orientation) ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error) {
+	if o.op.IsIdentity() {
+		return f, true, nil
+	}
+	data, err := jpegtran.Transform(f.Data, o.op)
+	if err != nil {
+		o.fallbackOnce.Do(func() {
+			log.Println("Frames can't be rotated losslessly, falling back to re-encoding them:", err)
+		})
+		return nil, false, nil
+	}
+	output, err := Derive(f, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return output, true, nil
+}
+
+// Transform the decoded image
+func (o *Orientation) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	return imaging.Orient(img, o.op.Transpose, o.op.FlipH, o.op.FlipV), nil
+}
@@ -0,0 +1,158 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+const (
+	// maxLosslessDifference is how much a channel of a pixel of a losslessly transformed frame may differ
+	// from the decoded frame transformed after decoding, as the rounding of the inverse DCT isn't exactly symmetric
+	maxLosslessDifference = 4
+
+	// maxReencodedDifference is how much the channels of the pixels of a frame that was transformed
+	// after decoding it may differ on average, after being re-encoded with a quality of 10
+	maxReencodedDifference = 20
+)
+
+// Decode a frame to RGBA
+func decodeFrame(tb testing.TB, f *frame.Frame) *image.RGBA {
+	tb.Helper()
+	img, err := imaging.Decode(f.Data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return imaging.CloneRGBA(img)
+}
+
+// Create a frame from the given JPEG data
+func newFrame(tb testing.TB, data []byte) *frame.Frame {
+	tb.Helper()
+	f, err := frame.New(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+// Encode an image as a frame with the given quality
+func encodeFrame(tb testing.TB, img image.Image, quality int) *frame.Frame {
+	tb.Helper()
+	data, err := imaging.Encode(img, quality)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return newFrame(tb, data)
+}
+
+// Draw a gradient test image of the given size
+func gradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x*7 ^ y*13) & 0xFF), 255})
+		}
+	}
+	return img
+}
+
+// Get the largest and the mean difference between a channel of the same pixel of two images of the same size
+func difference(a, b *image.RGBA) (int, float64) {
+	max, total := 0, 0
+	for i := range a.Pix {
+		difference := int(a.Pix[i]) - int(b.Pix[i])
+		if difference < 0 {
+			difference = -difference
+		}
+		if difference > max {
+			max = difference
+		}
+		total += difference
+	}
+	return max, float64(total) / float64(len(a.Pix))
+}
+
+// Rotate decoded pixels clockwise and then flip them horizontally, as the reference for the stage
+func rotatePixels(src *image.RGBA, degrees int, flipH bool) *image.RGBA {
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if degrees%180 != 0 {
+		width, height = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			rx := x
+			if flipH {
+				rx = width - 1 - x
+			}
+			var srcX, srcY int
+			switch degrees {
+			case 0:
+				srcX, srcY = rx, y
+			case 90:
+				srcX, srcY = y, width-1-rx
+			case 180:
+				srcX, srcY = width-1-rx, height-1-y
+			case 270:
+				srcX, srcY = height-1-y, rx
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+func TestOrientation(t *testing.T) {
+	progressive, err := os.ReadFile("../jpegtran/testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		src  *frame.Frame
+
+		// Whether the frame can be transformed losslessly, which keeps its quality
+		// even though the pipeline re-encodes frames with a very low one
+		lossless bool
+	}{
+		{"baseline", encodeFrame(t, gradientImage(64, 48), 90), true},
+		{"not MCU aligned", encodeFrame(t, gradientImage(70, 45), 90), false},
+		{"progressive", newFrame(t, progressive), false},
+	} {
+		decoded := decodeFrame(t, test.src)
+		for _, degrees := range []int{0, 90, 180, 270} {
+			for _, flipH := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s rotated %d flipped %t", test.name, degrees, flipH), func(t *testing.T) {
+					orientation, err := NewOrientation(degrees, flipH, false)
+					if err != nil {
+						t.Fatal(err)
+					}
+					output, err := New(10, orientation).Process(test.src)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := rotatePixels(decoded, degrees, flipH)
+					got := decodeFrame(t, output)
+					if got.Bounds() != want.Bounds() || output.Width != want.Bounds().Dx() || output.Height != want.Bounds().Dy() {
+						t.Fatalf("rotated frame is %v (%dx%d), want %v", got.Bounds(), output.Width, output.Height, want.Bounds())
+					}
+					// Frames that are decoded are re-encoded with the very low quality of the pipeline,
+					// which still differs far less than a frame that was rotated the wrong way would
+					max, mean := difference(got, want)
+					if test.lossless && max > maxLosslessDifference {
+						t.Errorf("rotated pixels differ by up to %d from the reference, so it wasn't lossless", max)
+					}
+					if !test.lossless && mean > maxReencodedDifference {
+						t.Errorf("rotated pixels differ by %.1f on average from the reference", mean)
+					}
+				})
+			}
+		}
+	}
+}
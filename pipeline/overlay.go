@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverlayConfig configures a text overlay
+type OverlayConfig struct {
+	// Text to draw, which may contain multiple lines, strftime-like conversions (such as %Y-%m-%d %H:%M:%S)
+	// of the frame's capture time and {fields}: {sequence}, {width} and {height} of the frame,
+	// as well as any fields given when creating the overlay
+	Text string
+
+	// Where the text is placed on the frame
+	Position imaging.Position
+
+	// Line height of the text in pixels, or zero to scale it with the height of the frame
+	Size int
+
+	// Color of the text, and of the box behind it (which may be translucent or transparent)
+	Color      color.RGBA
+	Background color.RGBA
+
+	// Distance of the box from the edges of the frame, and of the text from the edges of the box, in pixels
+	Margin  int
+	Padding int
+
+	// Time zone of the capture time, or nil for the local time zone
+	Location *time.Location
+}
+
+// Create a new OverlayConfig with the default style, drawing the given text in the top left corner
+func DefaultOverlayConfig(text string) OverlayConfig {
+	return OverlayConfig{
+		Text:       text,
+		Position:   imaging.TopLeft,
+		Color:      color.RGBA{255, 255, 255, 255},
+		Background: color.RGBA{0, 0, 0, 160},
+		Margin:     8,
+		Padding:    4,
+	}
+}
+
+// Fields provides the values of the overlay's custom {fields}, evaluated for every frame
+type Fields map[string]func() string
+
+// Overlay draws templated text, such as a timestamp, on every frame
+type Overlay struct {
+	config OverlayConfig
+	fields Fields
+}
+
+// Create a new Overlay stage
+func NewOverlay(config OverlayConfig, fields Fields) (*Overlay, error) {
+	if config.Text == "" {
+		return nil, errors.New("overlay text is required")
+	}
+	if config.Size < 0 || config.Margin < 0 || config.Padding < 0 {
+		return nil, errors.New("overlay size, margin and padding can't be negative")
+	}
+	return &Overlay{config: config, fields: fields}, nil
+}
+
+// Draw the overlay on the decoded image
+func (o *Overlay) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	text := o.Render(f, img.Rect.Dx(), img.Rect.Dy())
+
+	// Scale the text with the frame if no size was given
+	size := o.config.Size
+	if size == 0 {
+		size = img.Rect.Dy() / 24
+	}
+	scale := imaging.FontScale(size)
+
+	width, height := imaging.TextSize(text, scale)
+	if width == 0 {
+		return img, nil
+	}
+	box := o.config.Position.Place(img.Rect, width+2*o.config.Padding, height+2*o.config.Padding, o.config.Margin)
+	imaging.FillRect(img, box, o.config.Background)
+	imaging.DrawText(img, box.Min.Add(image.Pt(o.config.Padding, o.config.Padding)), text, scale, o.config.Color)
+	return img, nil
+}
+
+// Render the text of the overlay for the given frame, which has been processed to the given size
+func (o *Overlay) Render(f *frame.Frame, width, height int) string {
+	timestamp := f.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if o.config.Location != nil {
+		timestamp = timestamp.In(o.config.Location)
+	} else {
+		timestamp = timestamp.Local()
+	}
+
+	var b strings.Builder
+	text := o.config.Text
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '%':
+			if i+1 < len(text) && appendStrftime(&b, timestamp, text[i+1]) {
+				i++
+				continue
+			}
+		case '{':
+			if end := strings.IndexByte(text[i:], '}'); end > 0 {
+				if value, ok := o.field(text[i+1:i+end], f, width, height); ok {
+					b.WriteString(value)
+					i += end
+					continue
+				}
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// Get the value of a field, returning false if it doesn't exist
+func (o *Overlay) field(name string, f *frame.Frame, width, height int) (string, bool) {
+	switch name {
+	case "sequence":
+		return strconv.FormatUint(f.Sequence, 10), true
+	case "width":
+		return strconv.Itoa(width), true
+	case "height":
+		return strconv.Itoa(height), true
+	}
+	if value, ok := o.fields[name]; ok {
+		return value(), true
+	}
+	return "", false
+}
@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestOverlayRender(t *testing.T) {
+	location := time.FixedZone("CET", 60*60)
+	f := &frame.Frame{
+		Sequence:  42,
+		Timestamp: time.Date(2024, time.March, 5, 7, 8, 9, 12345678, location),
+	}
+	afternoon := &frame.Frame{Timestamp: time.Date(2024, time.March, 5, 12, 0, 0, 0, location)}
+	midnight := &frame.Frame{Timestamp: time.Date(2024, time.March, 5, 0, 30, 0, 0, location)}
+	fields := Fields{"name": func() string { return "front-door" }, "empty": func() string { return "" }}
+
+	for _, test := range []struct {
+		text string
+		f    *frame.Frame
+		want string
+	}{
+		// Every strftime conversion
+		{"%Y-%m-%d %H:%M:%S", f, "2024-03-05 07:08:09"},
+		{"%y %e %j", f, "24  5 065"},
+		{"%I %p", f, "07 AM"},
+		{"%I %p", afternoon, "12 PM"},
+		{"%I %p", midnight, "12 AM"},
+		{"%S.%L %S.%f", f, "09.012 09.012345"},
+		{"%a %A %b %B", f, "Tue Tuesday Mar March"},
+		{"%Z %z", f, "CET +0100"},
+		{"%s", f, "1709618889"},
+		{"%F %T", f, "2024-03-05 07:08:09"},
+		{"100%%", f, "100%"},
+
+		// Unsupported conversions and a trailing % are kept as they are
+		{"%Q %", f, "%Q %"},
+		{"50% off", f, "50% off"},
+
+		// Built-in and custom fields, where unknown and unterminated fields are kept as they are
+		{"#{sequence} {width}x{height}", f, "#42 640x480"},
+		{"{name}: {empty}.", f, "front-door: ."},
+		{"{unknown} {name", f, "{unknown} {name"},
+		{"{}{{name}}", f, "{}{front-door}"},
+
+		// Multiple lines
+		{"{name}\n%H:%M", f, "front-door\n07:08"},
+	} {
+		config := DefaultOverlayConfig(test.text)
+		config.Location = location
+		overlay, err := NewOverlay(config, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := overlay.Render(test.f, 640, 480); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+
+	// The capture time is shown in the configured time zone
+	config := DefaultOverlayConfig("%H:%M %Z")
+	config.Location = time.UTC
+	overlay, err := NewOverlay(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := overlay.Render(f, 640, 480); got != "06:08 UTC" {
+		t.Errorf("got %q in UTC, want %q", got, "06:08 UTC")
+	}
+}
+
+func TestOverlayApply(t *testing.T) {
+	for _, config := range []OverlayConfig{
+		{},
+		{Text: "text", Size: -1},
+		{Text: "text", Margin: -1},
+		{Text: "text", Padding: -1},
+	} {
+		if _, err := NewOverlay(config, nil); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+
+	config := DefaultOverlayConfig("%H:%M:%S")
+	config.Background = color.RGBA{255, 0, 0, 255}
+	overlay, err := NewOverlay(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	img, err = overlay.Apply(img, &frame.Frame{Timestamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The box is drawn in the top left corner, inside the margin
+	if got := img.RGBAAt(config.Margin, config.Margin); got != config.Background {
+		t.Errorf("box corner is %v, want %v", got, config.Background)
+	}
+	for _, p := range []image.Point{{config.Margin - 1, config.Margin - 1}, {160, 120}, {319, 239}} {
+		if got := img.RGBAAt(p.X, p.Y); got != (color.RGBA{}) {
+			t.Errorf("pixel at %v outside of the box is %v", p, got)
+		}
+	}
+
+	// The text is drawn inside the box
+	text := false
+	for y := config.Margin; y < config.Margin+40; y++ {
+		for x := config.Margin; x < 160; x++ {
+			if img.RGBAAt(x, y) == config.Color {
+				text = true
+			}
+		}
+	}
+	if !text {
+		t.Error("no text was drawn inside the box")
+	}
+}
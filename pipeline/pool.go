@@ -0,0 +1,172 @@
+package pipeline
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"log"
+	"sync"
+)
+
+// Pool processes frames through a pipeline on a bounded number of workers, so that several frames
+// are processed at the same time across cores, and delivers the results in the order the frames were submitted.
+//
+// Frames are dropped instead of queued when every worker is busy, and results that are superseded
+// by a newer one before they are collected are skipped, so the pool never falls behind the source.
+type Pool struct {
+	pipeline *Pipeline
+	workers  int
+	jobs     chan poolJob
+	ready    chan struct{}
+
+	mutex     sync.Mutex
+	last      *frame.Frame
+	next      uint64
+	deliver   uint64
+	completed map[uint64]poolResult
+	source    *frame.Frame
+	output    *frame.Frame
+	collected bool
+	stats     PoolStats
+}
+
+// PoolStats counts the frames that went through a pool
+type PoolStats struct {
+	Workers   int    `json:"workers"`
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"` // Submitted while every worker was busy
+	Skipped   uint64 `json:"skipped"` // Superseded by a newer result before being collected
+	Failed    uint64 `json:"failed"`
+}
+
+// poolJob is a frame waiting to be processed, along with its place in the delivery order
+type poolJob struct {
+	ticket uint64
+	source *frame.Frame
+}
+
+// poolResult is a processed frame waiting to be delivered
+type poolResult struct {
+	source *frame.Frame
+	output *frame.Frame
+	err    error
+}
+
+// Create a new Pool that processes frames through the pipeline on the given number of workers
+func NewPool(pipeline *Pipeline, workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{
+		pipeline:  pipeline,
+		workers:   workers,
+		jobs:      make(chan poolJob),
+		ready:     make(chan struct{}, 1),
+		completed: make(map[uint64]poolResult),
+		stats:     PoolStats{Workers: workers},
+	}
+}
+
+// Run the workers until the context is done
+func (p *Pool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-p.jobs:
+					output, err := p.pipeline.process(job.source)
+					p.complete(job.ticket, poolResult{source: job.source, output: output, err: err})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Submit a frame for processing, unless it was the last frame submitted,
+// returning false if the frame was dropped because every worker is busy
+func (p *Pool) Submit(src *frame.Frame) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if src == p.last {
+		return true
+	}
+	select {
+	case p.jobs <- poolJob{ticket: p.next, source: src}:
+		p.next++
+		p.last = src
+		return true
+	default:
+		p.stats.Dropped++
+		return false
+	}
+}
+
+// Record a processed frame, delivering every result that is next in line
+func (p *Pool) complete(ticket uint64, result poolResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.completed[ticket] = result
+
+	delivered := false
+	for {
+		result, ok := p.completed[p.deliver]
+		if !ok {
+			break
+		}
+		delete(p.completed, p.deliver)
+		p.deliver++
+		if result.err != nil {
+			log.Println("Failed to process frame, skipping frame:", result.err)
+			p.stats.Failed++
+			continue
+		}
+		if p.output != nil && !p.collected {
+			p.stats.Skipped++
+		}
+		p.source, p.output, p.collected = result.source, result.output, false
+		p.stats.Processed++
+		delivered = true
+	}
+
+	if delivered {
+		select {
+		case p.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Get the most recently delivered frame along with the source frame it was processed from,
+// or nil if no frame has been delivered yet
+func (p *Pool) Latest() (*frame.Frame, *frame.Frame) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.collected = true
+	return p.output, p.source
+}
+
+// Get a channel that receives a notification whenever a new result is delivered
+func (p *Pool) Ready() <-chan struct{} {
+	return p.ready
+}
+
+// Discard the cached results of the pipeline and allow the last frame to be submitted again,
+// after a stage has changed at runtime
+func (p *Pool) Invalidate() {
+	p.pipeline.Invalidate()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.last = nil
+}
+
+// Get the statistics of the pool
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stats
+}
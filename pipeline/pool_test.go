@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"fmt"
+	"image"
+	"testing"
+	"time"
+)
+
+// Encode a 1080p frame with enough detail that encoding it isn't trivial
+func benchmarkFrame(b *testing.B) *frame.Frame {
+	img := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	for y := 0; y < 1080; y++ {
+		for x := 0; x < 1920; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i] = uint8(x * 255 / 1920)
+			img.Pix[i+1] = uint8(y * 255 / 1080)
+			img.Pix[i+2] = uint8((x*31 ^ y*17) & 0xFF)
+			img.Pix[i+3] = 0xFF
+		}
+	}
+	data, err := imaging.Encode(img, imaging.DefaultQuality)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := frame.New(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return f
+}
+
+// Measure the throughput of a pool for each number of workers, on 1080p frames that are decoded,
+// adjusted and encoded again, by keeping every worker busy until every frame has been processed
+func BenchmarkPool(b *testing.B) {
+	src := benchmarkFrame(b)
+	color := NewColor()
+	adjustments := DefaultAdjustments
+	adjustments.Contrast = 1.2
+	if err := color.SetAdjustments(adjustments); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool := NewPool(New(imaging.DefaultQuality, color), workers)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go pool.Run(ctx)
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				// Every copy is a new frame, so none of them are skipped as already submitted
+				f := *src
+				for !pool.Submit(&f) {
+					time.Sleep(100 * time.Microsecond)
+				}
+			}
+			for {
+				stats := pool.Stats()
+				if stats.Failed > 0 {
+					b.Fatal("failed to process frames")
+				}
+				if stats.Processed == uint64(b.N) {
+					break
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "frames/s")
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// MaxZoom is the highest supported digital zoom level
+const MaxZoom = 16
+
+// DefaultView is the view that shows the whole frame
+var DefaultView = View{Zoom: 1, Pan: 0.5, Tilt: 0.5}
+
+// View is a digital pan/tilt/zoom position
+type View struct {
+	// Zoom level, from 1 (the whole frame) up to MaxZoom
+	Zoom float64 `json:"zoom"`
+
+	// Horizontal center of the view, from 0 (left edge) to 1 (right edge)
+	Pan float64 `json:"pan"`
+
+	// Vertical center of the view, from 0 (top edge) to 1 (bottom edge)
+	Tilt float64 `json:"tilt"`
+}
+
+// Check if the view is valid
+func (v View) Validate() error {
+	if math.IsNaN(v.Zoom) || v.Zoom < 1 || v.Zoom > MaxZoom {
+		return fmt.Errorf("invalid zoom (must be between 1 and %d): %g", MaxZoom, v.Zoom)
+	}
+	if math.IsNaN(v.Pan) || v.Pan < 0 || v.Pan > 1 {
+		return fmt.Errorf("invalid pan (must be between 0 and 1): %g", v.Pan)
+	}
+	if math.IsNaN(v.Tilt) || v.Tilt < 0 || v.Tilt > 1 {
+		return fmt.Errorf("invalid tilt (must be between 0 and 1): %g", v.Tilt)
+	}
+	return nil
+}
+
+// Check if the view shows the whole frame
+func (v View) IsIdentity() bool {
+	return v.Zoom <= 1
+}
+
+// Calculate the area of a frame of the given size that the view shows,
+// which is moved as needed to stay within the frame
+func (v View) Rect(width, height int) image.Rectangle {
+	if v.IsIdentity() {
+		return image.Rect(0, 0, width, height)
+	}
+
+	// Calculate the size of the area, then center it on the pan/tilt position
+	place := func(size int, center float64) (int, int) {
+		length := int(math.Round(float64(size) / v.Zoom))
+		if length < 1 {
+			length = 1
+		}
+		start := int(math.Round(center*float64(size) - float64(length)/2))
+		if start > size-length {
+			start = size - length
+		}
+		if start < 0 {
+			start = 0
+		}
+		return start, start + length
+	}
+	minX, maxX := place(width, v.Pan)
+	minY, maxY := place(height, v.Tilt)
+	return image.Rect(minX, minY, maxX, maxY)
+}
+
+// PTZ digitally pans, tilts and zooms every frame to a view that can be changed at runtime,
+// scaling the viewed area back up to the size of the frame
+type PTZ struct {
+	mutex sync.RWMutex
+	view  View
+}
+
+// Create a new PTZ stage that shows the whole frame
+func NewPTZ() *PTZ {
+	return &PTZ{view: DefaultView}
+}
+
+// Get the current view
+func (p *PTZ) View() View {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.view
+}
+
+// Change the current view
+func (p *PTZ) SetView(view View) error {
+	if err := view.Validate(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.view = view
+	return nil
+}
+
+// Leave the encoded frame as is when the whole frame is shown
+func (p *PTZ) ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error) {
+	if p.View().IsIdentity() {
+		return f, true, nil
+	}
+	return nil, false, nil
+}
+
+// Zoom the decoded image into the current view
+func (p *PTZ) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	view := p.View()
+	if view.IsIdentity() {
+		return img, nil
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	rect := view.Rect(width, height).Add(img.Rect.Min)
+	return imaging.Resize(img.SubImage(rect).(*image.RGBA), width, height, imaging.Bilinear), nil
+}
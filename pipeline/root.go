@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"image"
+	"sync"
+)
+
+// Stage processes the decoded image of every frame
+type Stage interface {
+	// Apply the stage to the image, which may be modified in place, returning the resulting image
+	Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error)
+}
+
+// EncodedStage is a Stage that can also be applied to the encoded frame,
+// which is used for as long as none of the stages before it needed the frame decoded
+type EncodedStage interface {
+	Stage
+
+	// Apply the stage to the encoded frame, returning false if the frame has to be decoded instead
+	ApplyEncoded(f *frame.Frame) (*frame.Frame, bool, error)
+}
+
+// Pipeline applies a series of stages to every frame, decoding and
+// re-encoding each frame at most once no matter how many stages there are
+type Pipeline struct {
+	quality int
+	stages  []Stage
+
+	mutex  sync.Mutex
+	source *frame.Frame
+	output *frame.Frame
+}
+
+// Create a new Pipeline that re-encodes frames with the given JPEG quality
+func New(quality int, stages ...Stage) *Pipeline {
+	return &Pipeline{quality: quality, stages: stages}
+}
+
+// Get the number of stages
+func (p *Pipeline) Len() int {
+	return len(p.stages)
+}
+
+// Process a frame through every stage, reusing the previous result
+// if the same frame is processed more than once
+func (p *Pipeline) Process(src *frame.Frame) (*frame.Frame, error) {
+	if len(p.stages) == 0 {
+		return src, nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.source == src {
+		return p.output, nil
+	}
+
+	output, err := p.process(src)
+	if err != nil {
+		return nil, err
+	}
+	p.source, p.output = src, output
+	return output, nil
+}
+
+// Discard the previous result, so the next frame is processed again even if it's the same
+// (used by stages whose configuration can change at runtime)
+func (p *Pipeline) Invalidate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.source, p.output = nil, nil
+}
+
+// Process a frame through every stage
+func (p *Pipeline) process(src *frame.Frame) (*frame.Frame, error) {
+	current := src
+
+	// Apply the leading stages that can work on the encoded frame
+	i := 0
+	for ; i < len(p.stages); i++ {
+		encodedStage, ok := p.stages[i].(EncodedStage)
+		if !ok {
+			break
+		}
+		output, ok, err := encodedStage.ApplyEncoded(current)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		current = output
+	}
+	if i == len(p.stages) {
+		return current, nil
+	}
+
+	// Decode the frame and apply the remaining stages
+	decoded, err := imaging.Decode(current.Data)
+	if err != nil {
+		return nil, err
+	}
+	img := imaging.CloneRGBA(decoded)
+	for _, stage := range p.stages[i:] {
+		img, err = stage.Apply(img, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Encode the result
+	data, err := imaging.Encode(img, p.quality)
+	if err != nil {
+		return nil, err
+	}
+	return Derive(src, data)
+}
+
+// Create a new frame from the given data, keeping the sequence number,
+// timestamp and placeholder flag of the frame it was derived from
+func Derive(src *frame.Frame, data []byte) (*frame.Frame, error) {
+	output, err := frame.New(data)
+	if err != nil {
+		return nil, err
+	}
+	output.Sequence = src.Sequence
+	output.Timestamp = src.Timestamp
+	output.Placeholder = src.Placeholder
+	return output, nil
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Append the time formatted with the given strftime conversion character (without the %),
+// returning false if the character isn't supported
+func appendStrftime(b *strings.Builder, t time.Time, conversion byte) bool {
+	switch conversion {
+	case 'Y':
+		fmt.Fprintf(b, "%04d", t.Year())
+	case 'y':
+		fmt.Fprintf(b, "%02d", t.Year()%100)
+	case 'm':
+		fmt.Fprintf(b, "%02d", int(t.Month()))
+	case 'd':
+		fmt.Fprintf(b, "%02d", t.Day())
+	case 'e':
+		fmt.Fprintf(b, "%2d", t.Day())
+	case 'j':
+		fmt.Fprintf(b, "%03d", t.YearDay())
+	case 'H':
+		fmt.Fprintf(b, "%02d", t.Hour())
+	case 'I':
+		hour := t.Hour() % 12
+		if hour == 0 {
+			hour = 12
+		}
+		fmt.Fprintf(b, "%02d", hour)
+	case 'M':
+		fmt.Fprintf(b, "%02d", t.Minute())
+	case 'S':
+		fmt.Fprintf(b, "%02d", t.Second())
+	case 'L':
+		fmt.Fprintf(b, "%03d", t.Nanosecond()/int(time.Millisecond))
+	case 'f':
+		fmt.Fprintf(b, "%06d", t.Nanosecond()/int(time.Microsecond))
+	case 'p':
+		b.WriteString(t.Format("PM"))
+	case 'a':
+		b.WriteString(t.Format("Mon"))
+	case 'A':
+		b.WriteString(t.Format("Monday"))
+	case 'b':
+		b.WriteString(t.Format("Jan"))
+	case 'B':
+		b.WriteString(t.Format("January"))
+	case 'Z':
+		b.WriteString(t.Format("MST"))
+	case 'z':
+		b.WriteString(t.Format("-0700"))
+	case 's':
+		fmt.Fprintf(b, "%d", t.Unix())
+	case 'F':
+		b.WriteString(t.Format("2006-01-02"))
+	case 'T':
+		b.WriteString(t.Format("15:04:05"))
+	case '%':
+		b.WriteByte('%')
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// watermarkCheckInterval is how often the watermark file is checked for changes
+const watermarkCheckInterval = time.Second
+
+// WatermarkConfig configures a watermark
+type WatermarkConfig struct {
+	// Path of the PNG image to draw, which is reloaded whenever it changes
+	Path string
+
+	// Where the image is placed on the frame
+	Position imaging.Position
+
+	// Scale of the image, relative to its own size
+	Scale float64
+
+	// Opacity of the image, from 0 (invisible) to 1 (as is)
+	Opacity float64
+
+	// Distance of the image from the edges of the frame, in pixels
+	Margin int
+}
+
+// Create a new WatermarkConfig with the default style, drawing the given PNG image in the bottom right corner
+func DefaultWatermarkConfig(path string) WatermarkConfig {
+	return WatermarkConfig{
+		Path:     path,
+		Position: imaging.BottomRight,
+		Scale:    1,
+		Opacity:  1,
+		Margin:   8,
+	}
+}
+
+// Watermark composites a PNG image, such as a logo, onto every frame
+type Watermark struct {
+	config WatermarkConfig
+	mask   *image.Uniform
+
+	mutex       sync.Mutex
+	image       *image.RGBA
+	modTime     time.Time
+	size        int64
+	lastChecked time.Time
+}
+
+// Create a new Watermark stage, loading its image
+func NewWatermark(config WatermarkConfig) (*Watermark, error) {
+	if config.Path == "" {
+		return nil, errors.New("watermark path is required")
+	}
+	if math.IsNaN(config.Scale) || config.Scale <= 0 {
+		return nil, errors.New("watermark scale must be above 0")
+	}
+	if math.IsNaN(config.Opacity) || config.Opacity < 0 || config.Opacity > 1 {
+		return nil, errors.New("watermark opacity must be between 0 and 1")
+	}
+	if config.Margin < 0 {
+		return nil, errors.New("watermark margin can't be negative")
+	}
+
+	w := &Watermark{
+		config: config,
+		mask:   image.NewUniform(color.Alpha{A: uint8(math.Round(config.Opacity * 255))}),
+	}
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.load(info); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Composite the image onto the decoded image
+func (w *Watermark) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	watermark := w.current()
+	bounds := watermark.Bounds()
+	rect := w.config.Position.Place(img.Rect, bounds.Dx(), bounds.Dy(), w.config.Margin)
+	draw.DrawMask(img, rect, watermark, bounds.Min, w.mask, image.Point{}, draw.Over)
+	return img, nil
+}
+
+// Get the current image, reloading it first if the file has changed since it was last loaded
+func (w *Watermark) current() *image.RGBA {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.lastChecked) < watermarkCheckInterval {
+		return w.image
+	}
+	w.lastChecked = now
+
+	info, err := os.Stat(w.config.Path)
+	if err != nil {
+		log.Println("Failed to check watermark", w.config.Path+", keeping the current image:", err)
+		return w.image
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return w.image
+	}
+	if err := w.load(info); err != nil {
+		log.Println("Failed to reload watermark", w.config.Path+", keeping the current image:", err)
+		return w.image
+	}
+	log.Println("Reloaded watermark", w.config.Path)
+	return w.image
+}
+
+// Load and scale the image (the mutex must be held, unless the watermark is still being created)
+func (w *Watermark) load(info os.FileInfo) error {
+	// Remember the file even if it fails to load, so a broken file is only reported once
+	w.modTime, w.size = info.ModTime(), info.Size()
+
+	file, err := os.Open(w.config.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoded, err := png.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	img := imaging.ToRGBA(decoded)
+	if w.config.Scale != 1 {
+		width := int(math.Round(float64(img.Rect.Dx()) * w.config.Scale))
+		height := int(math.Round(float64(img.Rect.Dy()) * w.config.Scale))
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+		img = imaging.Resize(img, width, height, imaging.DefaultFilter)
+	}
+	w.image = img
+	return nil
+}
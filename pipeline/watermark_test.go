@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a PNG image of the given size and color, with the given modification time
+func writeWatermark(t *testing.T, path string, size int, c color.RGBA, modTime time.Time) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Apply the watermark to a black image, returning the color of its bottom right pixel
+func watermarkColor(t *testing.T, w *Watermark) color.RGBA {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{A: 255}), image.Point{}, draw.Src)
+	img, err := w.Apply(img, &frame.Frame{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img.RGBAAt(31, 31)
+}
+
+func TestWatermarkReload(t *testing.T) {
+	red, blue, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}
+	path := filepath.Join(t.TempDir(), "logo.png")
+	modTime := time.Now().Add(-time.Hour)
+	writeWatermark(t, path, 4, red, modTime)
+
+	config := DefaultWatermarkConfig(path)
+	config.Margin = 0
+	w, err := NewWatermark(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := watermarkColor(t, w); got != red {
+		t.Fatalf("watermark is %v, want %v", got, red)
+	}
+
+	// The file is checked for changes at most once per check interval
+	modTime = modTime.Add(time.Minute)
+	writeWatermark(t, path, 4, blue, modTime)
+	if got := watermarkColor(t, w); got != red {
+		t.Errorf("watermark was reloaded within the check interval, got %v", got)
+	}
+	w.lastChecked = time.Time{}
+	if got := watermarkColor(t, w); got != blue {
+		t.Errorf("watermark wasn't reloaded after it changed, got %v, want %v", got, blue)
+	}
+
+	// Files with the same modification time and size aren't reloaded
+	writeWatermark(t, path, 4, green, modTime)
+	w.lastChecked = time.Time{}
+	if got := watermarkColor(t, w); got != blue {
+		t.Errorf("unchanged watermark was reloaded, got %v", got)
+	}
+
+	// Broken and missing files keep the current image
+	modTime = modTime.Add(time.Minute)
+	if err := os.WriteFile(path, []byte("not a PNG image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	w.lastChecked = time.Time{}
+	if got := watermarkColor(t, w); got != blue {
+		t.Errorf("broken watermark replaced the image, got %v", got)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.lastChecked = time.Time{}
+	if got := watermarkColor(t, w); got != blue {
+		t.Errorf("missing watermark replaced the image, got %v", got)
+	}
+
+	// The file is loaded again once it's fixed
+	writeWatermark(t, path, 4, green, modTime.Add(time.Minute))
+	w.lastChecked = time.Time{}
+	if got := watermarkColor(t, w); got != green {
+		t.Errorf("fixed watermark wasn't reloaded, got %v, want %v", got, green)
+	}
+}
+
+func TestWatermarkStyle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logo.png")
+	writeWatermark(t, path, 4, color.RGBA{255, 255, 255, 255}, time.Now())
+
+	// The image is scaled, placed inside the margin and blended with the frame
+	config := DefaultWatermarkConfig(path)
+	config.Scale, config.Opacity, config.Margin = 2, 0.5, 2
+	w, err := NewWatermark(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{A: 255}), image.Point{}, draw.Src)
+	if img, err = w.Apply(img, &frame.Frame{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		x, y int
+		want int
+	}{
+		{29, 29, 128}, {22, 22, 128}, {21, 21, 0}, {30, 30, 0}, {0, 0, 0},
+	} {
+		if got := int(img.RGBAAt(test.x, test.y).R); got < test.want-2 || got > test.want+2 {
+			t.Errorf("pixel at %d,%d is %d, want %d", test.x, test.y, got, test.want)
+		}
+	}
+
+	for _, config := range []WatermarkConfig{
+		{},
+		{Path: path, Scale: 0, Opacity: 1},
+		{Path: path, Scale: 1, Opacity: 1.5},
+		{Path: path, Scale: 1, Opacity: 1, Margin: -1},
+		{Path: filepath.Join(t.TempDir(), "missing.png"), Scale: 1, Opacity: 1},
+	} {
+		if _, err := NewWatermark(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package placeholder
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedSizes is the number of resolutions that rendered backgrounds are kept for
+const maxCachedSizes = 4
+
+// Kind selects what the background of the placeholder frame looks like
+type Kind int
+
+const (
+	// Card is a generated test card with color bars
+	Card Kind = iota
+
+	// Solid is a single color
+	Solid
+
+	// Image is a custom image file, scaled to fit the frame
+	Image
+)
+
+// Get the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Card:
+		return "card"
+	case Solid:
+		return "solid"
+	case Image:
+		return "image"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Parse a kind from its name
+func ParseKind(name string) (Kind, error) {
+	switch strings.ToLower(name) {
+	case "", "card":
+		return Card, nil
+	case "solid", "color":
+		return Solid, nil
+	case "image":
+		return Image, nil
+	default:
+		return Card, fmt.Errorf("unknown placeholder kind: %s", name)
+	}
+}
+
+// Config configures a Placeholder
+type Config struct {
+	Kind Kind
+
+	// Name of the stream, shown on the placeholder frame if set
+	Name string
+
+	// Background color (for solid placeholders, and around images that don't fill the frame)
+	Background color.RGBA
+
+	// Text color
+	Foreground color.RGBA
+
+	// Path of the image file (PNG or JPEG) to show, for image placeholders
+	ImagePath string
+
+	// JPEG quality of the placeholder frames
+	Quality int
+}
+
+// Create a new Config for a generated card
+func DefaultConfig() Config {
+	return Config{
+		Kind:       Card,
+		Background: color.RGBA{16, 16, 16, 255},
+		Foreground: color.RGBA{255, 255, 255, 255},
+		Quality:    imaging.DefaultQuality,
+	}
+}
+
+// Placeholder renders the "no signal" frames that are shown when there are no frames to show,
+// rendering the background only once per resolution
+type Placeholder struct {
+	config Config
+	image  *image.RGBA
+
+	mutex       sync.Mutex
+	backgrounds map[image.Point]*image.RGBA
+	sizes       []image.Point
+	last        *frame.Frame
+	lastSize    image.Point
+	lastText    string
+}
+
+// Create a new Placeholder, loading its image file (if any)
+func New(config Config) (*Placeholder, error) {
+	if config.Quality < 1 || config.Quality > 100 {
+		return nil, errors.New("placeholder quality must be between 1 and 100")
+	}
+	p := &Placeholder{config: config, backgrounds: make(map[image.Point]*image.RGBA)}
+	if config.Kind == Image {
+		file, err := os.Open(config.ImagePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		img, _, err := image.Decode(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode placeholder image %s: %w", config.ImagePath, err)
+		}
+		p.image = imaging.ToRGBA(img)
+	}
+	return p, nil
+}
+
+// Get a placeholder frame of the given size, telling how long ago the last frame was received
+// (or that no frame has been received yet, if the time is zero).
+//
+// Every call returns a new frame, so it can be stamped without affecting previous frames,
+// but the frame is only rendered again when its text or size changes.
+func (p *Placeholder) Frame(width, height int, lastReceived time.Time) (*frame.Frame, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid placeholder size: %dx%d", width, height)
+	}
+
+	lines := []string{"NO SIGNAL"}
+	if p.config.Name != "" {
+		lines = append([]string{p.config.Name}, lines...)
+	}
+	if lastReceived.IsZero() {
+		lines = append(lines, "No frame received yet")
+	} else {
+		lines = append(lines, "Last frame received "+formatAge(time.Since(lastReceived))+" ago")
+	}
+	text := strings.Join(lines, "\n")
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	size := image.Pt(width, height)
+	if p.last == nil || p.lastSize != size || p.lastText != text {
+		img := imaging.CloneRGBA(p.background(size))
+		p.drawText(img, lines)
+		data, err := imaging.Encode(img, p.config.Quality)
+		if err != nil {
+			return nil, err
+		}
+		last, err := frame.New(data)
+		if err != nil {
+			return nil, err
+		}
+		last.Placeholder = true
+		p.last, p.lastSize, p.lastText = last, size, text
+	}
+
+	f := *p.last
+	return &f, nil
+}
+
+// Get the background of the given size, rendering it if it isn't cached yet (the mutex must be held)
+func (p *Placeholder) background(size image.Point) *image.RGBA {
+	if background, ok := p.backgrounds[size]; ok {
+		return background
+	}
+
+	log.Println("Rendering", p.config.Kind, "placeholder background at", size.X, "x", size.Y)
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(img, img.Bounds(), &image.Uniform{p.config.Background}, image.Point{}, draw.Src)
+	switch p.config.Kind {
+	case Card:
+		drawCard(img)
+	case Image:
+		width, height := imaging.FitSize(p.image.Rect.Dx(), p.image.Rect.Dy(), size.X, size.Y)
+		scaled := imaging.Resize(p.image, width, height, imaging.DefaultFilter)
+		rect := imaging.Center.Place(img.Rect, width, height, 0)
+		draw.Draw(img, rect, scaled, image.Point{}, draw.Over)
+	}
+
+	// Forget the oldest resolution when the cache is full
+	if len(p.sizes) >= maxCachedSizes {
+		delete(p.backgrounds, p.sizes[0])
+		p.sizes = p.sizes[1:]
+	}
+	p.backgrounds[size] = img
+	p.sizes = append(p.sizes, size)
+	return img
+}
+
+// Draw a test card with color bars over the top two thirds of the image
+func drawCard(img *image.RGBA) {
+	bars := []color.RGBA{
+		{191, 191, 191, 255}, {191, 191, 0, 255}, {0, 191, 191, 255}, {0, 191, 0, 255},
+		{191, 0, 191, 255}, {191, 0, 0, 255}, {0, 0, 191, 255},
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	for i, bar := range bars {
+		rect := image.Rect(i*width/len(bars), 0, (i+1)*width/len(bars), height*2/3)
+		draw.Draw(img, rect, &image.Uniform{bar}, image.Point{}, draw.Src)
+	}
+}
+
+// Draw the lines of text centered at the bottom of the image, on a translucent box
+func (p *Placeholder) drawText(img *image.RGBA, lines []string) {
+	// Make the lines fit the width of the frame
+	longest := 0
+	for _, line := range lines {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+	scale := imaging.FontScale(img.Rect.Dy() / 16)
+	for scale > 1 {
+		if width, _ := imaging.TextSize(strings.Repeat(" ", longest), scale); width <= img.Rect.Dx()*9/10 {
+			break
+		}
+		scale--
+	}
+
+	lineHeight := imaging.LineHeight(scale)
+	padding := 2 * scale
+	box := imaging.Bottom.Place(img.Rect, img.Rect.Dx(), len(lines)*lineHeight+2*padding, img.Rect.Dy()/12)
+	imaging.FillRect(img, box, color.RGBA{0, 0, 0, 160})
+	for i, line := range lines {
+		width, height := imaging.TextSize(line, scale)
+		rect := imaging.Top.Place(box, width, height, padding+i*lineHeight)
+		imaging.DrawText(img, rect.Min, line, scale, p.config.Foreground)
+	}
+}
+
+// Format how long ago something happened, in the largest unit that is still precise enough
+func formatAge(age time.Duration) string {
+	plural := func(value int, unit string) string {
+		if value == 1 {
+			return fmt.Sprintf("%d %s", value, unit)
+		}
+		return fmt.Sprintf("%d %ss", value, unit)
+	}
+	switch {
+	case age < 2*time.Minute:
+		return plural(int(age.Seconds()), "second")
+	case age < 2*time.Hour:
+		return plural(int(age.Minutes()), "minute")
+	default:
+		return plural(int(age.Hours()), "hour")
+	}
+}
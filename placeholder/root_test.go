@@ -0,0 +1,186 @@
+package placeholder
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a new Placeholder with the given config, failing the test if it can't be created
+func newPlaceholder(t *testing.T, config Config) *Placeholder {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestBackgroundCache(t *testing.T) {
+	p := newPlaceholder(t, DefaultConfig())
+	sizes := []image.Point{{64, 48}, {128, 96}, {320, 240}, {640, 480}}
+
+	// Backgrounds are rendered once per size
+	backgrounds := make(map[image.Point]*image.RGBA)
+	for _, size := range sizes {
+		backgrounds[size] = p.background(size)
+		if backgrounds[size].Rect.Size() != size {
+			t.Errorf("background is %v, want %v", backgrounds[size].Rect.Size(), size)
+		}
+	}
+	for _, size := range sizes {
+		if p.background(size) != backgrounds[size] {
+			t.Errorf("background of %v was rendered again", size)
+		}
+	}
+
+	// The oldest size is forgotten once the cache is full
+	p.background(image.Pt(800, 600))
+	if len(p.backgrounds) != maxCachedSizes || len(p.sizes) != maxCachedSizes {
+		t.Errorf("cache holds %d backgrounds of %d sizes, want %d", len(p.backgrounds), len(p.sizes), maxCachedSizes)
+	}
+	if _, ok := p.backgrounds[sizes[0]]; ok {
+		t.Errorf("oldest size %v is still cached", sizes[0])
+	}
+	for _, size := range sizes[1:] {
+		if p.background(size) != backgrounds[size] {
+			t.Errorf("background of %v was rendered again", size)
+		}
+	}
+	if p.background(sizes[0]) == backgrounds[sizes[0]] {
+		t.Errorf("background of %v wasn't rendered again", sizes[0])
+	}
+}
+
+func TestFrame(t *testing.T) {
+	config := DefaultConfig()
+	config.Name = "front-door"
+	p := newPlaceholder(t, config)
+
+	first, err := p.Frame(320, 240, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Placeholder || first.Width != 320 || first.Height != 240 {
+		t.Errorf("unexpected frame %dx%d (placeholder: %t)", first.Width, first.Height, first.Placeholder)
+	}
+
+	// Every call returns a new frame, which can be stamped without changing any other frame,
+	// but the same text at the same size isn't rendered again
+	first.Sequence = 42
+	second, err := p.Frame(320, 240, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || second.Sequence != 0 {
+		t.Error("frame isn't a copy")
+	}
+	if &second.Data[0] != &first.Data[0] {
+		t.Error("same frame was rendered again")
+	}
+
+	// The frame is rendered again when its size or text changes
+	for _, test := range []struct {
+		name          string
+		width, height int
+		lastReceived  time.Time
+	}{
+		{"size", 640, 480, time.Time{}},
+		{"text", 640, 480, time.Now().Add(-time.Minute)},
+	} {
+		f, err := p.Frame(test.width, test.height, test.lastReceived)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if &f.Data[0] == &second.Data[0] || f.Hash == second.Hash {
+			t.Errorf("frame wasn't rendered again after the %s changed", test.name)
+		}
+		if f.Width != test.width || f.Height != test.height {
+			t.Errorf("frame is %dx%d, want %dx%d", f.Width, f.Height, test.width, test.height)
+		}
+		second = f
+	}
+
+	for _, size := range []image.Point{{0, 240}, {320, -1}} {
+		if _, err := p.Frame(size.X, size.Y, time.Time{}); err == nil {
+			t.Errorf("%v: expected an error", size)
+		}
+	}
+}
+
+func TestImagePlaceholder(t *testing.T) {
+	// A square red image, which is centered on a frame of another aspect ratio
+	path := filepath.Join(t.TempDir(), "placeholder.png")
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	config := DefaultConfig()
+	config.Kind, config.ImagePath = Image, path
+	background := newPlaceholder(t, config).background(image.Pt(64, 32))
+	if got := background.RGBAAt(32, 16); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("center of the background is %v", got)
+	}
+	if got := background.RGBAAt(4, 16); got != config.Background {
+		t.Errorf("side of the background is %v, want %v", got, config.Background)
+	}
+
+	for _, config := range []Config{
+		{Kind: Image, ImagePath: filepath.Join(t.TempDir(), "missing.png"), Quality: imaging.DefaultQuality},
+		{Kind: Image, ImagePath: os.DevNull, Quality: imaging.DefaultQuality},
+		{Kind: Card, Quality: 0},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want Kind
+	}{
+		{"", Card}, {"card", Card}, {"Solid", Solid}, {"color", Solid}, {"IMAGE", Image},
+	} {
+		kind, err := ParseKind(test.name)
+		if err != nil || kind != test.want {
+			t.Errorf("%q: got %v (%v), want %v", test.name, kind, err, test.want)
+		}
+	}
+	if _, err := ParseKind("video"); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	for _, test := range []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "0 seconds"},
+		{time.Second, "1 second"},
+		{119 * time.Second, "119 seconds"},
+		{2 * time.Minute, "2 minutes"},
+		{119 * time.Minute, "119 minutes"},
+		{2 * time.Hour, "2 hours"},
+		{49 * time.Hour, "49 hours"},
+	} {
+		if got := formatAge(test.age); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.age, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// MinFrameRate is the lowest frame rate the scheduler accepts
+	MinFrameRate = 1
+
+	// MaxFrameRate is the highest frame rate the scheduler accepts,
+	// as anything higher is well below the timer resolution we can rely on
+	MaxFrameRate = 1000
+)
+
+// Scheduler paces frame publishing at a fixed frame rate.
+//
+// Unlike sleeping for a fixed interval after each frame, the scheduler keeps
+// track of absolute deadlines (start + n * interval), so time spent processing
+// a frame is subtracted from the next wait instead of being added on top of it.
+type Scheduler struct {
+	interval time.Duration
+	next     time.Time
+	timer    *time.Timer
+
+	// Skipped is the number of frame slots that were dropped,
+	// because the consumer fell behind by more than a full interval
+	Skipped uint64
+}
+
+// Validate the given frame rate
+func ValidateFrameRate(frameRate int) error {
+	if frameRate < MinFrameRate || frameRate > MaxFrameRate {
+		return fmt.Errorf("frame rate must be between %d and %d fps, got %d", MinFrameRate, MaxFrameRate, frameRate)
+	}
+	return nil
+}
+
+// Calculate the frame interval for the given frame rate
+func FrameInterval(frameRate int) (time.Duration, error) {
+	if err := ValidateFrameRate(frameRate); err != nil {
+		return 0, err
+	}
+	return time.Second / time.Duration(frameRate), nil
+}
+
+// Create a new Scheduler for the given frame rate
+func NewScheduler(frameRate int) (*Scheduler, error) {
+	interval, err := FrameInterval(frameRate)
+	if err != nil {
+		return nil, err
+	}
+	return &Scheduler{interval: interval}, nil
+}
+
+// Get the frame interval
+func (s *Scheduler) Interval() time.Duration {
+	return s.interval
+}
+
+// Wait until the next frame slot, returning false if the context is done first
+func (s *Scheduler) Wait(ctx context.Context) bool {
+	now := time.Now()
+
+	// Start counting from now on the first call
+	if s.next.IsZero() {
+		s.next = now
+	}
+
+	// Advance to the next deadline
+	s.next = s.next.Add(s.interval)
+
+	// Resynchronize if we fell behind by more than a full interval,
+	// as trying to catch up would only result in a burst of frames
+	if behind := now.Sub(s.next); behind > s.interval {
+		missed := uint64(behind / s.interval)
+		s.Skipped += missed
+		s.next = s.next.Add(time.Duration(missed) * s.interval)
+	}
+
+	// Return immediately if the deadline has already passed
+	delay := s.next.Sub(now)
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	// Reuse the same timer between calls
+	if s.timer == nil {
+		s.timer = time.NewTimer(delay)
+	} else {
+		s.timer.Reset(delay)
+	}
+
+	select {
+	case <-ctx.Done():
+		if !s.timer.Stop() {
+			<-s.timer.C
+		}
+		return false
+	case <-s.timer.C:
+		return true
+	}
+}
+
+// Stop the scheduler and release its timer
+func (s *Scheduler) Stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
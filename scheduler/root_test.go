@@ -0,0 +1,119 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewScheduler(t *testing.T) {
+	for _, frameRate := range []int{MinFrameRate - 1, MaxFrameRate + 1} {
+		if _, err := NewScheduler(frameRate); err == nil {
+			t.Errorf("%d fps: expected an error", frameRate)
+		}
+	}
+	s, err := NewScheduler(25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval := s.Interval(); interval != 40*time.Millisecond {
+		t.Errorf("interval is %s, want 40ms", interval)
+	}
+}
+
+func TestTickSpacing(t *testing.T) {
+	const (
+		frameRate = 100
+		interval  = time.Second / frameRate
+		ticks     = 20
+	)
+	s, err := NewScheduler(frameRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The time spent on each frame is subtracted from the next wait, so it doesn't add up
+	start := time.Now()
+	for i := 0; i < ticks; i++ {
+		if !s.Wait(context.Background()) {
+			t.Fatal("wait was interrupted")
+		}
+		time.Sleep(interval / 2)
+	}
+	elapsed := time.Since(start)
+	if min := ticks * interval; elapsed < min {
+		t.Errorf("%d ticks took %s, want at least %s", ticks, elapsed, min)
+	}
+	if max := ticks*interval + interval/2 + 5*interval; elapsed > max {
+		t.Errorf("%d ticks took %s, want at most %s", ticks, elapsed, max)
+	}
+	if s.Skipped != 0 {
+		t.Errorf("skipped %d ticks, want 0", s.Skipped)
+	}
+}
+
+func TestSkipWhenLate(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	s, err := NewScheduler(int(time.Second / interval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if !s.Wait(context.Background()) {
+		t.Fatal("wait was interrupted")
+	}
+
+	// Falling behind by several intervals skips the missed ticks instead of catching up with a burst
+	time.Sleep(35 * time.Millisecond)
+	start := time.Now()
+	if !s.Wait(context.Background()) {
+		t.Fatal("wait was interrupted")
+	}
+	if delay := time.Since(start); delay > interval {
+		t.Errorf("late tick waited %s, want it to return at once", delay)
+	}
+	if s.Skipped < 2 {
+		t.Errorf("skipped %d ticks, want at least 2", s.Skipped)
+	}
+
+	// The ticks after that are spaced by the interval again
+	skipped := s.Skipped
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		if !s.Wait(context.Background()) {
+			t.Fatal("wait was interrupted")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("3 ticks after resynchronizing took %s, want at least %s", elapsed, 2*interval)
+	}
+	if s.Skipped != skipped {
+		t.Errorf("skipped %d more ticks after resynchronizing", s.Skipped-skipped)
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	s, err := NewScheduler(MinFrameRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s.Wait(ctx) {
+		t.Error("wait returned true with a done context")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if s.Wait(ctx) {
+		t.Error("wait returned true before the next tick")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("wait returned %s after the context was done", elapsed)
+	}
+}
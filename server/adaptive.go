@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAdaptiveMinQuality is the lowest JPEG quality a slow client is stepped down to when none is given
+	DefaultAdaptiveMinQuality = 30
+
+	// DefaultAdaptiveMaxQuality is the highest JPEG quality a client is stepped up to when none is given
+	DefaultAdaptiveMaxQuality = 100
+
+	// DefaultAdaptiveMinScale is the smallest fraction of the requested size
+	// a slow client is stepped down to when none is given
+	DefaultAdaptiveMinScale = 0.25
+
+	// adaptiveWindow is how often the throughput of a client is measured
+	adaptiveWindow = 2 * time.Second
+
+	// adaptiveQualityStep and adaptiveScaleStep are how far a client is stepped down at a time,
+	// first lowering the quality and then the size
+	adaptiveQualityStep = 10
+	adaptiveScaleStep   = 0.75
+
+	// A client that spends more than adaptiveStepDown of its time writing frames can't keep up
+	// and is stepped down, while one that spends less than adaptiveStepUp of its time writing
+	// for adaptiveStepUpWindows windows in a row is stepped back up
+	adaptiveStepDown      = 0.9
+	adaptiveStepUp        = 0.4
+	adaptiveStepUpWindows = 3
+
+	// Every time a client has to be stepped down again after it was stepped up, it waits twice as long
+	// before the next step up (up to adaptiveMaxStepUpWindows), so it doesn't keep flipping between levels
+	// when the network buffers take a while to fill up
+	adaptiveMaxStepUpWindows = 32
+
+	// adaptiveSendBuffer is the size of the socket send buffer of the built-in web server's connections,
+	// which is kept small so that slow clients block on writes (and are measured as slow) before
+	// seconds worth of frames pile up in the buffer
+	adaptiveSendBuffer = 256 * 1024
+)
+
+// AdaptivePolicy is how far the quality and size of the stream are lowered for clients
+// that can't keep up with it, which are measured by how much of their time is spent writing frames
+type AdaptivePolicy struct {
+	// The range of JPEG qualities clients are stepped between
+	MinQuality int
+	MaxQuality int
+
+	// The smallest fraction of the requested size clients are stepped down to once they're at the
+	// lowest quality, where one never changes the size
+	MinScale float64
+}
+
+// Get the default adaptive policy
+func DefaultAdaptivePolicy() AdaptivePolicy {
+	return AdaptivePolicy{
+		MinQuality: DefaultAdaptiveMinQuality,
+		MaxQuality: DefaultAdaptiveMaxQuality,
+		MinScale:   DefaultAdaptiveMinScale,
+	}
+}
+
+// Validate the adaptive policy
+func (p AdaptivePolicy) Validate() error {
+	if p.MinQuality < 1 || p.MaxQuality > 100 || p.MinQuality > p.MaxQuality {
+		return errors.New("adaptive quality range must be within 1 and 100, with the minimum at most the maximum")
+	}
+	if p.MinScale <= 0 || p.MinScale > 1 {
+		return errors.New("adaptive minimum scale must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// adaptiveLevel is a single step of the quality and size of the stream
+type adaptiveLevel struct {
+	quality int
+	scale   float64
+}
+
+// Get the levels a client steps through, from the best to the worst, for a stream with the given quality
+func (p AdaptivePolicy) levels(quality int) []adaptiveLevel {
+	if quality > p.MaxQuality {
+		quality = p.MaxQuality
+	}
+	levels := []adaptiveLevel{{quality: quality, scale: 1}}
+	for quality > p.MinQuality {
+		quality -= adaptiveQualityStep
+		if quality < p.MinQuality {
+			quality = p.MinQuality
+		}
+		levels = append(levels, adaptiveLevel{quality: quality, scale: 1})
+	}
+	for scale := adaptiveScaleStep; scale >= p.MinScale; scale *= adaptiveScaleStep {
+		levels = append(levels, adaptiveLevel{quality: quality, scale: scale})
+	}
+	return levels
+}
+
+// Get the key of the variant for the given level, where quality is the quality of the key itself
+func (k variantKey) adapt(level adaptiveLevel, quality int) variantKey {
+	if level.quality != quality {
+		k.quality = level.quality
+	}
+	if level.scale >= 1 {
+		return k
+	}
+	scaleSize := func(size int) int {
+		if size == 0 {
+			return 0
+		}
+		if scaled := int(float64(size)*level.scale + 0.5); scaled > 0 {
+			return scaled
+		}
+		return 1
+	}
+	switch {
+	case k.scale > 0:
+		k.scale *= level.scale
+	case k.width > 0 || k.height > 0:
+		k.width, k.height = scaleSize(k.width), scaleSize(k.height)
+	default:
+		k.scale = level.scale
+	}
+	return k
+}
+
+// AdaptiveClient is the current state of a client whose quality adapts to its throughput
+type AdaptiveClient struct {
+	Address string `json:"address"`
+
+	// The JPEG quality and the fraction of the requested size the client currently receives
+	Quality int     `json:"quality"`
+	Scale   float64 `json:"scale"`
+
+	// The rate frames were written at while writing, and the fraction of the time spent writing,
+	// in the most recent measurement
+	Throughput  float64 `json:"throughput"`
+	Utilization float64 `json:"utilization"`
+
+	// Number of times the client was stepped down and back up
+	StepDowns uint64 `json:"step_downs"`
+	StepUps   uint64 `json:"step_ups"`
+}
+
+// adaptiveClient streams frames to a single client, switching between the stream
+// and its variants as the client's throughput changes
+type adaptiveClient struct {
+	server  *Server
+	base    variantKey
+	scaled  bool
+	quality int
+	levels  []adaptiveLevel
+	level   int
+
+	stream  *stream
+	variant *variant
+	c       chan *frame.Frame
+
+	windowStart time.Time
+	writeStart  time.Time
+	writeSize   int
+	busy        time.Duration
+	bytes       int
+	idle        int
+	upWindows   int
+	steppedUp   bool
+
+	mutex sync.Mutex
+	state AdaptiveClient
+}
+
+// Check if the client asked to opt out of adaptive quality (?adaptive=false)
+func parseAdaptive(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("adaptive")
+	if value == "" {
+		return true, nil
+	}
+	adaptive, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid adaptive: " + value)
+	}
+	return adaptive, nil
+}
+
+// Write every published frame to the client as a multipart stream, stepping its quality
+// and size down when it can't keep up and back up once it recovers,
+// until either the client disconnects or the stream is closed
+func (s *Server) serveAdaptive(w http.ResponseWriter, r *http.Request, key variantKey, scaled bool) {
+	quality := s.quality
+	if key.quality > 0 {
+		quality = key.quality
+	}
+	a := &adaptiveClient{
+		server:  s,
+		base:    key,
+		scaled:  scaled,
+		quality: quality,
+		levels:  s.adaptive.levels(quality),
+		state:   AdaptiveClient{Address: r.RemoteAddr},
+
+		upWindows: adaptiveStepUpWindows,
+	}
+	if err := a.switchTo(0); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer a.close()
+
+	s.clientsMutex.Lock()
+	s.adaptiveClients[a] = struct{}{}
+	s.clientsMutex.Unlock()
+	defer func() {
+		s.clientsMutex.Lock()
+		delete(s.adaptiveClients, a)
+		s.clientsMutex.Unlock()
+	}()
+
+	parts, err := newPartWriter(w)
+	if err != nil {
+		return
+	}
+
+	// Frames are written by a separate goroutine, so a write that blocks on a slow client
+	// is measured while it's still in progress, and no new frames are taken until it's done
+	frames := make(chan *frame.Frame)
+	written := make(chan error)
+	go func() {
+		for f := range frames {
+			written <- parts.write(f, s.name)
+		}
+	}()
+	writing := false
+	defer func() {
+		if writing {
+			<-written
+		}
+		close(frames)
+	}()
+
+	ticker := time.NewTicker(adaptiveWindow)
+	defer ticker.Stop()
+	a.windowStart = time.Now()
+	for {
+		next := a.c
+		if writing {
+			next = nil
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case f, ok := <-next:
+			if !ok {
+				return
+			}
+			a.writeStart, a.writeSize, writing = time.Now(), len(f.Data), true
+			frames <- f
+		case err := <-written:
+			writing = false
+			if err != nil {
+				return
+			}
+			a.written(time.Now())
+		case now := <-ticker.C:
+			a.measure(now, writing)
+		}
+	}
+}
+
+// Switch the client to the given level, subscribing to the stream or variant that serves it
+func (a *adaptiveClient) switchTo(level int) error {
+	key := a.base.adapt(a.levels[level], a.quality)
+	out := a.server.stream
+	var v *variant
+	if a.scaled || key != a.base {
+		var err error
+		if v, err = a.server.variants.acquire(key); err != nil {
+			return err
+		}
+		out = v.stream
+	}
+	c := out.subscribe()
+	if c == nil {
+		if v != nil {
+			a.server.variants.release(v)
+		}
+		return ErrStreamClosed
+	}
+
+	a.close()
+	a.stream, a.variant, a.c, a.level = out, v, c, level
+	a.mutex.Lock()
+	a.state.Quality, a.state.Scale = a.levels[level].quality, a.levels[level].scale
+	a.mutex.Unlock()
+	return nil
+}
+
+// Unsubscribe from the current stream or variant
+func (a *adaptiveClient) close() {
+	if a.c != nil {
+		a.stream.unsubscribe(a.c)
+	}
+	if a.variant != nil {
+		a.server.variants.release(a.variant)
+	}
+	a.stream, a.variant, a.c = nil, nil, nil
+}
+
+// Record a frame that was written, counting the time spent writing it within the current window
+func (a *adaptiveClient) written(now time.Time) {
+	a.busy += now.Sub(a.later(a.writeStart))
+	a.bytes += a.writeSize
+}
+
+// Get the given time, or the start of the current window if it's later
+func (a *adaptiveClient) later(t time.Time) time.Time {
+	if t.Before(a.windowStart) {
+		return a.windowStart
+	}
+	return t
+}
+
+// Measure the throughput of the client at the end of a window, including any write that's still in progress,
+// and step the client down if it can't keep up or back up if it has recovered
+func (a *adaptiveClient) measure(now time.Time, writing bool) {
+	window := now.Sub(a.windowStart)
+	busy := a.busy
+	if writing {
+		busy += now.Sub(a.later(a.writeStart))
+	}
+	utilization := busy.Seconds() / window.Seconds()
+	throughput := 0.0
+	if busy > 0 {
+		throughput = float64(a.bytes) / busy.Seconds()
+	}
+	a.windowStart, a.busy, a.bytes = now, 0, 0
+	a.mutex.Lock()
+	a.state.Throughput, a.state.Utilization = throughput, utilization
+	a.mutex.Unlock()
+
+	level := a.level
+	switch {
+	case utilization > adaptiveStepDown && a.level < len(a.levels)-1:
+		a.idle = 0
+		level++
+	case utilization < adaptiveStepUp && a.level > 0:
+		a.idle++
+		if a.idle >= a.upWindows {
+			a.idle = 0
+			level--
+		}
+	default:
+		a.idle = 0
+	}
+	if level == a.level {
+		return
+	}
+
+	direction := "down"
+	if level < a.level {
+		direction = "up"
+	}
+	if err := a.switchTo(level); err != nil {
+		log.Println("Failed to step client", a.state.Address, direction+":", err)
+		return
+	}
+	log.Printf("Stepping client %s %s to quality %d at %.0f%% size (%.0f%% of the time spent writing)",
+		a.state.Address, direction, a.levels[level].quality, a.levels[level].scale*100, utilization*100)
+	if direction == "down" && a.steppedUp {
+		if a.upWindows *= 2; a.upWindows > adaptiveMaxStepUpWindows {
+			a.upWindows = adaptiveMaxStepUpWindows
+		}
+	}
+	a.steppedUp = direction == "up"
+	a.mutex.Lock()
+	if direction == "down" {
+		a.state.StepDowns++
+	} else {
+		a.state.StepUps++
+	}
+	a.mutex.Unlock()
+}
+
+// Limit the socket send buffer of a new connection of the built-in web server
+func limitSendBuffer(ctx context.Context, c net.Conn) context.Context {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(adaptiveSendBuffer)
+	}
+	return ctx
+}
+
+// Get the current state of every client whose quality adapts to its throughput
+func (s *Server) AdaptiveClients() []AdaptiveClient {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	clients := make([]AdaptiveClient, 0, len(s.adaptiveClients))
+	for a := range s.adaptiveClients {
+		a.mutex.Lock()
+		clients = append(clients, a.state)
+		a.mutex.Unlock()
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Address < clients[j].Address })
+	return clients
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLevels(t *testing.T) {
+	for _, test := range []struct {
+		policy  AdaptivePolicy
+		quality int
+		want    []adaptiveLevel
+	}{
+		{AdaptivePolicy{MinQuality: 50, MaxQuality: 80, MinScale: 0.5}, 80, []adaptiveLevel{
+			{80, 1}, {70, 1}, {60, 1}, {50, 1}, {50, 0.75}, {50, 0.5625},
+		}},
+
+		// The quality of the stream is capped, and the last quality step stops at the minimum
+		{AdaptivePolicy{MinQuality: 45, MaxQuality: 70, MinScale: 1}, 90, []adaptiveLevel{
+			{70, 1}, {60, 1}, {50, 1}, {45, 1},
+		}},
+		{AdaptivePolicy{MinQuality: 60, MaxQuality: 100, MinScale: 0.75}, 40, []adaptiveLevel{
+			{40, 1}, {40, 0.75},
+		}},
+	} {
+		if levels := test.policy.levels(test.quality); !reflect.DeepEqual(levels, test.want) {
+			t.Errorf("%+v at quality %d: got levels %v, want %v", test.policy, test.quality, levels, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		key   variantKey
+		level adaptiveLevel
+		want  variantKey
+	}{
+		{variantKey{}, adaptiveLevel{80, 1}, variantKey{}},
+		{variantKey{}, adaptiveLevel{60, 1}, variantKey{quality: 60}},
+		{variantKey{}, adaptiveLevel{60, 0.5}, variantKey{quality: 60, scale: 0.5}},
+		{variantKey{scale: 0.5}, adaptiveLevel{80, 0.5}, variantKey{scale: 0.25}},
+		{variantKey{width: 640}, adaptiveLevel{80, 0.75}, variantKey{width: 480}},
+		{variantKey{width: 1, height: 3}, adaptiveLevel{80, 0.25}, variantKey{width: 1, height: 1}},
+	} {
+		if key := test.key.adapt(test.level, 80); key != test.want {
+			t.Errorf("%+v at %v: adapted to %+v, want %+v", test.key, test.level, key, test.want)
+		}
+	}
+}
+
+func TestAdaptiveStepping(t *testing.T) {
+	s, err := New(newTestSource(), WithAddress(""), WithQuality(80),
+		WithAdaptiveQuality(AdaptivePolicy{MinQuality: 50, MaxQuality: 80, MinScale: 0.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adaptiveClient{
+		server:    s,
+		quality:   80,
+		levels:    s.adaptive.levels(80),
+		upWindows: adaptiveStepUpWindows,
+	}
+	if err := a.switchTo(0); err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	a.windowStart = time.Unix(1700000000, 0)
+
+	// Simulate a window of a client that writes a frame in the given time,
+	// or that is stalled on a write that started before the window
+	const frameSize = 50000
+	window := func(writing time.Duration, stalled bool) {
+		end := a.windowStart.Add(adaptiveWindow)
+		a.writeSize = frameSize
+		if stalled {
+			a.writeStart = a.windowStart.Add(-time.Second)
+		} else {
+			a.writeStart = a.windowStart.Add(100 * time.Millisecond)
+			a.written(a.writeStart.Add(writing))
+		}
+		a.measure(end, stalled)
+	}
+
+	const (
+		slow   = -1
+		busy   = adaptiveWindow * 95 / 100
+		steady = adaptiveWindow * 60 / 100
+		fast   = adaptiveWindow * 10 / 100
+	)
+	for i, step := range []struct {
+		writing   time.Duration
+		windows   int
+		level     int
+		upWindows int
+	}{
+		// Clients that can't keep up are stepped down a level every window
+		{slow, 1, 1, 3},
+		{busy, 1, 2, 3},
+
+		// Clients are only stepped up after enough windows in a row where they kept up easily
+		{fast, 2, 2, 3},
+		{steady, 1, 2, 3},
+		{fast, 2, 2, 3},
+		{fast, 1, 1, 3},
+
+		// Clients that have to be stepped down again right after being stepped up wait twice as long
+		{slow, 1, 2, 6},
+		{fast, 5, 2, 6},
+		{fast, 1, 1, 6},
+		{fast, 6, 0, 6},
+		{fast, 10, 0, 6},
+		{slow, 1, 1, 12},
+		{slow, 1, 2, 12},
+
+		// Down to the smallest size at the lowest quality, but no further
+		{slow, 10, len(a.levels) - 1, 12},
+		{fast, 11, len(a.levels) - 1, 12},
+		{fast, 1, len(a.levels) - 2, 12},
+		{slow, 1, len(a.levels) - 1, 24},
+		{slow, 10, len(a.levels) - 1, 24},
+		{fast, 24, len(a.levels) - 2, 24},
+		{slow, 1, len(a.levels) - 1, adaptiveMaxStepUpWindows},
+		{fast, 32, len(a.levels) - 2, adaptiveMaxStepUpWindows},
+		{slow, 1, len(a.levels) - 1, adaptiveMaxStepUpWindows},
+	} {
+		for n := 0; n < step.windows; n++ {
+			window(step.writing, step.writing == slow)
+		}
+		if a.level != step.level || a.upWindows != step.upWindows {
+			t.Fatalf("step %d: client is at level %d waiting %d windows to step up, want level %d waiting %d windows",
+				i, a.level, a.upWindows, step.level, step.upWindows)
+		}
+
+		// The client receives the stream itself at the best level, and a variant at every other level
+		level := a.levels[step.level]
+		if a.state.Quality != level.quality || a.state.Scale != level.scale {
+			t.Errorf("step %d: client receives quality %d at %v, want %v", i, a.state.Quality, a.state.Scale, level)
+		}
+		if (a.variant == nil) != (step.level == 0) || a.c == nil {
+			t.Errorf("step %d: client isn't subscribed to the right stream", i)
+		}
+		if step.writing == slow && a.state.Utilization != 1 {
+			t.Errorf("step %d: stalled client spent %v of its time writing", i, a.state.Utilization)
+		}
+		if step.writing == fast {
+			utilization, throughput := fast.Seconds()/adaptiveWindow.Seconds(), frameSize/fast.Seconds()
+			if math.Abs(a.state.Utilization-utilization) > 1e-9 || math.Abs(a.state.Throughput-throughput) > 1e-6 {
+				t.Errorf("step %d: measured %v of the time writing at %v bytes per second, want %v at %v",
+					i, a.state.Utilization, a.state.Throughput, utilization, throughput)
+			}
+		}
+	}
+	if a.state.StepDowns != 11 || a.state.StepUps != 6 {
+		t.Errorf("client was stepped down %d times and up %d times", a.state.StepDowns, a.state.StepUps)
+	}
+}
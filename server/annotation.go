@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxAnnotationsBody is the largest request body the annotation API accepts
+const maxAnnotationsBody = 1 << 20
+
+var ErrAnnotationsDisabled = errors.New("annotations are disabled")
+
+// Get every annotation that is drawn on the stream, in the order they expire
+func (s *Server) Annotations() []pipeline.Annotation {
+	if s.annotations == nil {
+		return nil
+	}
+	return s.annotations.List()
+}
+
+// Add annotations to draw on the stream until they expire (see pipeline.Annotation),
+// optionally replacing every existing annotation, starting with the next published frame
+func (s *Server) AddAnnotations(replace bool, annotations ...pipeline.Annotation) ([]pipeline.Annotation, error) {
+	if s.annotations == nil {
+		return nil, ErrAnnotationsDisabled
+	}
+	add := s.annotations.Add
+	if replace {
+		add = s.annotations.Replace
+	}
+	added, err := add(annotations...)
+	if err != nil {
+		return nil, err
+	}
+	s.invalidate()
+	s.scheduleAnnotationExpiry()
+	return added, nil
+}
+
+// Remove the annotation with the given ID from the stream, returning false if there is none
+func (s *Server) RemoveAnnotation(id string) bool {
+	if s.annotations == nil || !s.annotations.Remove(id) {
+		return false
+	}
+	s.invalidate()
+	s.scheduleAnnotationExpiry()
+	return true
+}
+
+// Remove every annotation from the stream, returning the number of annotations that were removed
+func (s *Server) ClearAnnotations() int {
+	if s.annotations == nil {
+		return 0
+	}
+	count := s.annotations.Clear()
+	if count > 0 {
+		s.invalidate()
+		s.scheduleAnnotationExpiry()
+	}
+	return count
+}
+
+// Process the current frame again once the next annotation expires, so it disappears
+// even when the source doesn't send a new frame, where a single timer is kept for the earliest expiry
+func (s *Server) scheduleAnnotationExpiry() {
+	s.annotationsMutex.Lock()
+	defer s.annotationsMutex.Unlock()
+	if s.annotationsTimer != nil {
+		s.annotationsTimer.Stop()
+		s.annotationsTimer = nil
+	}
+	if annotations := s.annotations.List(); len(annotations) > 0 {
+		s.annotationsTimer = time.AfterFunc(time.Until(annotations[0].Expires), func() {
+			s.invalidate()
+			s.scheduleAnnotationExpiry()
+		})
+	}
+}
+
+// Get an http.Handler that only serves the annotation API
+func (s *Server) AnnotationsHandler() http.Handler {
+	return http.HandlerFunc(s.ServeAnnotations)
+}
+
+// Serve the annotation API (?action=annotations), which responds with every annotation
+// that is drawn on the stream after handling the request:
+//
+//	GET                  list the annotations
+//	POST                 add the annotation or array of annotations in the JSON body (see pipeline.Annotation),
+//	                     replacing every existing annotation with ?replace=1
+//	DELETE ?id=          remove the annotation with the given ID, or every annotation without one
+//
+// Changes have to present the admin token if there is one. Clients that want the frames
+// without the annotations request them with ?clean=1 (see parseVariantKey).
+func (s *Server) ServeAnnotations(w http.ResponseWriter, r *http.Request) {
+	if s.annotations == nil {
+		http.Error(w, ErrAnnotationsDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.canChange(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		annotations, err := parseAnnotations(http.MaxBytesReader(w, r.Body, maxAnnotationsBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		replace, _ := strconv.ParseBool(r.URL.Query().Get("replace"))
+		if _, err := s.AddAnnotations(replace, annotations...); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, pipeline.ErrTooManyAnnotations) {
+				status = http.StatusTooManyRequests
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	case http.MethodDelete:
+		if id := r.URL.Query().Get("id"); id != "" {
+			if !s.RemoveAnnotation(id) {
+				http.Error(w, fmt.Sprintf("unknown annotation: %s", id), http.StatusNotFound)
+				return
+			}
+		} else {
+			s.ClearAnnotations()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(s.Annotations())
+}
+
+// Parse either a single annotation or an array of annotations from JSON
+func parseAnnotations(body io.Reader) ([]pipeline.Annotation, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("annotation is required")
+	}
+	var annotations []pipeline.Annotation
+	if data[0] == '[' {
+		err = json.Unmarshal(data, &annotations)
+	} else {
+		var annotation pipeline.Annotation
+		err = json.Unmarshal(data, &annotation)
+		annotations = append(annotations, annotation)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotations: %w", err)
+	}
+	return annotations, nil
+}
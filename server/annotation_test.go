@@ -0,0 +1,205 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Make a request to the annotation API with the given body, returning the IDs of the annotations if it succeeded
+func requestAnnotations(t *testing.T, s *Server, method string, query string, body string, token string) (int, []string) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/?action=annotations"+query, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD, POST, DELETE" {
+		t.Errorf("%s %q: unexpected Allow header %q", method, query, w.Header().Get("Allow"))
+	}
+	if w.Code != http.StatusOK || method == http.MethodHead {
+		return w.Code, nil
+	}
+	var annotations []pipeline.Annotation
+	if err := json.NewDecoder(w.Body).Decode(&annotations); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(annotations))
+	for _, annotation := range annotations {
+		ids = append(ids, annotation.ID)
+	}
+	return w.Code, ids
+}
+
+func TestServeAnnotations(t *testing.T) {
+	s, err := New(newTestSource(), WithAddress(""), WithAnnotations(true), WithAdminToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := `{"box": [10, 10, 20, 20]}`
+	tooMany := "[" + strings.Repeat(box+",", pipeline.MaxAnnotations) + box + "]"
+
+	for _, test := range []struct {
+		method string
+		query  string
+		body   string
+		token  string
+		status int
+		want   []string
+	}{
+		// Anyone can list the annotations
+		{http.MethodGet, "", "", "", http.StatusOK, []string{}},
+		{http.MethodHead, "", "", "", http.StatusOK, nil},
+
+		// Changes can only be made with POST or DELETE requests, and require the admin token
+		{http.MethodPut, "", box, "secret", http.StatusMethodNotAllowed, nil},
+		{http.MethodPost, "", box, "", http.StatusForbidden, nil},
+		{http.MethodPost, "", box, "wrong", http.StatusForbidden, nil},
+		{http.MethodPost, "&token=wrong", box, "", http.StatusForbidden, nil},
+		{http.MethodDelete, "", "", "", http.StatusForbidden, nil},
+		{http.MethodGet, "", "", "", http.StatusOK, []string{}},
+
+		// Annotations are listed in the order they expire
+		{http.MethodPost, "", box, "secret", http.StatusOK, []string{"1"}},
+		{http.MethodPost, "&token=secret", `[{"id": "car", "box": [0, 0, 5, 5], "ttl": 20}, {"at": [0, 0], "text": "hi", "ttl": 10}]`, "", http.StatusOK, []string{"1", "2", "car"}},
+		{http.MethodPost, "", `{"id": "car", "box": [1, 1, 5, 5], "ttl": 1}`, "secret", http.StatusOK, []string{"car", "1", "2"}},
+
+		// Invalid annotations change nothing
+		{http.MethodPost, "", "", "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", `{"box": [10, 10`, "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", `{"text": "nowhere"}`, "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", `[` + box + `, {"box": [0, 0, 0, 0]}]`, "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", `{"box": [200000, 0, 10, 10]}`, "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", `{"text": "` + strings.Repeat("x", maxAnnotationsBody) + `"}`, "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "", tooMany, "secret", http.StatusTooManyRequests, nil},
+		{http.MethodGet, "", "", "", http.StatusOK, []string{"car", "1", "2"}},
+
+		{http.MethodPost, "&replace=1", `{"id": "only", "box": [0, 0, 5, 5]}`, "secret", http.StatusOK, []string{"only"}},
+		{http.MethodDelete, "&id=missing", "", "secret", http.StatusNotFound, nil},
+		{http.MethodDelete, "&id=only", "", "secret", http.StatusOK, []string{}},
+		{http.MethodPost, "", `[` + box + `,` + box + `]`, "secret", http.StatusOK, []string{"3", "4"}},
+		{http.MethodDelete, "", "", "secret", http.StatusOK, []string{}},
+	} {
+		status, ids := requestAnnotations(t, s, test.method, test.query, test.body, test.token)
+		if status != test.status {
+			t.Errorf("%s %q with token %q: unexpected status %d, want %d", test.method, test.query, test.token, status, test.status)
+			continue
+		}
+		if test.want != nil && fmt.Sprint(ids) != fmt.Sprint(test.want) {
+			t.Errorf("%s %q: got annotations %v, want %v", test.method, test.query, ids, test.want)
+		}
+	}
+
+	// Without an admin token, anyone can make changes
+	s, err = New(newTestSource(), WithAddress(""), WithAnnotations(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, ids := requestAnnotations(t, s, http.MethodPost, "", box, ""); status != http.StatusOK || len(ids) != 1 {
+		t.Errorf("POST without an admin token: unexpected status %d with %v", status, ids)
+	}
+
+	// The API isn't there unless annotations are enabled
+	s, err = New(newTestSource(), WithAddress(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := requestAnnotations(t, s, http.MethodGet, "", "", ""); status != http.StatusNotFound {
+		t.Errorf("GET with annotations disabled: unexpected status %d", status)
+	}
+	if _, err := s.AddAnnotations(false, pipeline.Annotation{Box: &[4]float64{0, 0, 5, 5}}); !errors.Is(err, ErrAnnotationsDisabled) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAnnotationExpiry(t *testing.T) {
+	source := newTestSource()
+	s := runTestServer(t, source, WithAnnotations(true), WithKeepalive(50*time.Millisecond))
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	source.publish(encodeFrame(t, img, 1))
+	waitForSequence(t, s, 1)
+
+	// Check which of the given points of the current frame are covered by a red annotation
+	annotated := func(points ...image.Point) []bool {
+		t.Helper()
+		w := request(s, http.MethodGet, "/?action=snapshot", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("snapshot failed with %d", w.Code)
+		}
+		decoded, err := imaging.Decode(w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		covered := make([]bool, len(points))
+		for i, p := range points {
+			r, g, b, _ := decoded.At(p.X, p.Y).RGBA()
+			covered[i] = r>>8 > 200 && g>>8 < 80 && b>>8 < 80
+		}
+		return covered
+	}
+	short, long := image.Pt(8, 8), image.Pt(48, 32)
+
+	added := time.Now()
+	if _, err := s.AddAnnotations(false,
+		pipeline.Annotation{ID: "short", Box: &[4]float64{0, 0, 16, 16}, Fill: "red", TTL: 0.3},
+		pipeline.Annotation{ID: "long", Box: &[4]float64{40, 24, 16, 16}, Fill: "red", TTL: 0.8},
+	); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "annotations to be drawn", func() bool {
+		covered := annotated(short, long)
+		return covered[0] && covered[1]
+	})
+
+	// A single timer is kept for the earliest expiry, replacing the previous one whenever the annotations change
+	s.annotationsMutex.Lock()
+	timer := s.annotationsTimer
+	s.annotationsMutex.Unlock()
+	if timer == nil {
+		t.Fatal("no timer for the earliest expiry")
+	}
+	if _, err := s.AddAnnotations(false, pipeline.Annotation{ID: "hour", At: &[2]float64{0, 40}, Text: "x", TTL: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	s.annotationsMutex.Lock()
+	replaced := s.annotationsTimer
+	s.annotationsMutex.Unlock()
+	if replaced == timer || timer.Stop() {
+		t.Error("previous timer wasn't stopped when it was replaced")
+	}
+
+	// Annotations disappear once they expire, even though the source doesn't send any new frames
+	waitFor(t, "short annotation to expire", func() bool { return !annotated(short)[0] })
+	if elapsed := time.Since(added); elapsed < 300*time.Millisecond {
+		t.Errorf("annotation disappeared after %v, before its TTL", elapsed)
+	} else if elapsed < 700*time.Millisecond && !annotated(long)[0] {
+		t.Error("annotation disappeared before its TTL")
+	}
+	waitFor(t, "long annotation to expire", func() bool { return !annotated(long)[0] })
+	if elapsed := time.Since(added); elapsed < 800*time.Millisecond {
+		t.Errorf("annotation disappeared after %v, before its TTL", elapsed)
+	}
+
+	// No timer is kept once there's nothing left to expire
+	if count := s.ClearAnnotations(); count != 1 {
+		t.Errorf("cleared %d annotations, want 1", count)
+	}
+	s.annotationsMutex.Lock()
+	defer s.annotationsMutex.Unlock()
+	if s.annotationsTimer != nil {
+		t.Error("timer is kept without any annotations")
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrChangeForbidden = errors.New("an admin token is required to change the stream")
+
+// Check if the request presents the admin token, either as ?token= or an "Authorization: Bearer" header
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// Check if the request may change the stream at runtime (such as its view), which requires
+// a POST or DELETE request that presents the admin token if there is one,
+// responding with an error if it may not
+func (s *Server) canChange(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "changes require a POST or DELETE request", http.StatusMethodNotAllowed)
+		return false
+	}
+	if s.adminToken != "" && !s.isAdmin(r) {
+		http.Error(w, ErrChangeForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Check if any of the given parameters are set, in either the query or a POST form
+func hasAny(r *http.Request, params ...string) bool {
+	for _, param := range params {
+		if _, ok := r.Form[param]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Get the current color and exposure adjustments of the stream
+func (s *Server) Adjustments() pipeline.Adjustments {
+	return s.color.Adjustments()
+}
+
+// Change the color and exposure adjustments of the stream, starting with the next published frame
+func (s *Server) SetAdjustments(adjustments pipeline.Adjustments) error {
+	if err := s.color.SetAdjustments(adjustments); err != nil {
+		return err
+	}
+	s.invalidate()
+
+	// The change in brightness would otherwise be detected as motion
+	if s.motion != nil {
+		s.motion.Reset()
+	}
+	log.Printf("Changed adjustments to %+v\n", adjustments)
+	return nil
+}
+
+// Get an http.Handler that only serves the color control API
+func (s *Server) ColorHandler() http.Handler {
+	return http.HandlerFunc(s.ServeColor)
+}
+
+// colorParams are the parameters of the color control API that change the adjustments
+var colorParams = []string{"reset", "brightness", "contrast", "gamma", "saturation", "grayscale", "auto_levels"}
+
+// Serve the color control API (?action=color), which responds with the current adjustments
+// after applying any of the following parameters (from either the query or a POST form), in order:
+//
+//	reset=1                                         undo every adjustment
+//	brightness=, contrast=, gamma=, saturation=     change the adjustments (see pipeline.Adjustments)
+//	grayscale=, auto_levels=                        enable or disable grayscale and auto-levels
+//
+// Changes are only made by POST or DELETE requests, which have to present the admin token if there is one.
+func (s *Server) ServeColor(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (hasAny(r, colorParams...) || r.Method != http.MethodGet && r.Method != http.MethodHead) && !s.canChange(w, r) {
+		return
+	}
+
+	base := s.Adjustments()
+	if reset, _ := strconv.ParseBool(r.Form.Get("reset")); reset {
+		base = pipeline.DefaultAdjustments
+	}
+	adjustments, err := parseAdjustments(r.Form, base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if adjustments != s.Adjustments() {
+		if err := s.SetAdjustments(adjustments); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(s.Adjustments())
+}
+
+// Parse the adjustment parameters, using the given adjustments for any that are missing
+func parseAdjustments(values url.Values, base pipeline.Adjustments) (pipeline.Adjustments, error) {
+	adjustments := base
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{
+		{"brightness", &adjustments.Brightness},
+		{"contrast", &adjustments.Contrast},
+		{"gamma", &adjustments.Gamma},
+		{"saturation", &adjustments.Saturation},
+	} {
+		value := values.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return base, fmt.Errorf("invalid %s: %s", param.name, value)
+		}
+		*param.value = parsed
+	}
+	for _, param := range []struct {
+		name  string
+		value *bool
+	}{
+		{"grayscale", &adjustments.Grayscale},
+		{"auto_levels", &adjustments.AutoLevels},
+	} {
+		value := values.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return base, fmt.Errorf("invalid %s: %s", param.name, value)
+		}
+		*param.value = parsed
+	}
+	return adjustments, adjustments.Validate()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Make a request to the color control API, returning the adjustments if it succeeded
+func requestColor(t *testing.T, s *Server, method string, query string, token string) (int, pipeline.Adjustments) {
+	t.Helper()
+	w := request(s, method, "/?action=color"+query, token)
+	var adjustments pipeline.Adjustments
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&adjustments); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD, POST, DELETE" {
+		t.Errorf("%s %q: unexpected Allow header %q", method, query, w.Header().Get("Allow"))
+	}
+	return w.Code, adjustments
+}
+
+func TestServeColor(t *testing.T) {
+	s, err := New(newTestSource(), WithAddress(""), WithAdminToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	brighter := pipeline.Adjustments{Brightness: 0.25, Contrast: 1, Gamma: 1, Saturation: 1}
+	gray := brighter
+	gray.Grayscale = true
+
+	for _, test := range []struct {
+		method string
+		query  string
+		token  string
+		status int
+		want   pipeline.Adjustments
+	}{
+		// Anyone can get the current adjustments
+		{http.MethodGet, "", "", http.StatusOK, pipeline.DefaultAdjustments},
+		{http.MethodHead, "", "", http.StatusOK, pipeline.Adjustments{}},
+
+		// Changes can't be made with GET requests, even by admins
+		{http.MethodGet, "&brightness=0.25", "secret", http.StatusMethodNotAllowed, pipeline.Adjustments{}},
+		{http.MethodGet, "&reset=1", "secret", http.StatusMethodNotAllowed, pipeline.Adjustments{}},
+		{http.MethodPut, "", "secret", http.StatusMethodNotAllowed, pipeline.Adjustments{}},
+
+		// Changes require the admin token
+		{http.MethodPost, "&brightness=0.25", "", http.StatusForbidden, pipeline.Adjustments{}},
+		{http.MethodPost, "&brightness=0.25", "wrong", http.StatusForbidden, pipeline.Adjustments{}},
+		{http.MethodPost, "&brightness=0.25&token=wrong", "", http.StatusForbidden, pipeline.Adjustments{}},
+		{http.MethodPost, "", "", http.StatusForbidden, pipeline.Adjustments{}},
+		{http.MethodGet, "", "", http.StatusOK, pipeline.DefaultAdjustments},
+
+		{http.MethodPost, "&brightness=0.25", "secret", http.StatusOK, brighter},
+		{http.MethodPost, "&grayscale=1&token=secret", "", http.StatusOK, gray},
+		{http.MethodPost, "&gamma=20", "secret", http.StatusBadRequest, pipeline.Adjustments{}},
+		{http.MethodPost, "&contrast=high", "secret", http.StatusBadRequest, pipeline.Adjustments{}},
+		{http.MethodGet, "", "", http.StatusOK, gray},
+		{http.MethodDelete, "&reset=1", "secret", http.StatusOK, pipeline.DefaultAdjustments},
+	} {
+		status, adjustments := requestColor(t, s, test.method, test.query, test.token)
+		if status != test.status {
+			t.Errorf("%s %q with token %q: unexpected status %d, want %d", test.method, test.query, test.token, status, test.status)
+			continue
+		}
+		if status == http.StatusOK && test.method != http.MethodHead && adjustments != test.want {
+			t.Errorf("%s %q: adjustments are %+v, want %+v", test.method, test.query, adjustments, test.want)
+		}
+	}
+
+	// Without an admin token, anyone can make changes, but still only with POST or DELETE requests
+	s, err = New(newTestSource(), WithAddress(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := requestColor(t, s, http.MethodGet, "&brightness=0.25", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET without an admin token: unexpected status %d", status)
+	}
+	if status, adjustments := requestColor(t, s, http.MethodPost, "&brightness=0.25", ""); status != http.StatusOK || adjustments != brighter {
+		t.Errorf("POST without an admin token: unexpected status %d with %+v", status, adjustments)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxConstantRate is the highest constant frame rate a client can request
+const maxConstantRate = 120
+
+// ConstantRateStats counts the frames written to clients at a constant frame rate
+type ConstantRateStats struct {
+	// The frame rate clients get unless they request another one, or zero if they have to request one
+	FPS int `json:"fps"`
+
+	// Number of clients currently connected at a constant frame rate
+	Clients int `json:"clients"`
+
+	// Number of new frames written, and of frames that were written again because there was no new one in time
+	Fresh      uint64 `json:"fresh"`
+	Duplicated uint64 `json:"duplicated"`
+
+	// Number of new frames that were replaced by a newer one before they could be written
+	Dropped uint64 `json:"dropped"`
+}
+
+// constantRateStats keeps track of the frames written at a constant frame rate
+type constantRateStats struct {
+	mutex sync.Mutex
+	stats ConstantRateStats
+}
+
+// Record a client connecting (with a positive delta) or disconnecting (with a negative one)
+func (c *constantRateStats) connect(delta int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Clients += delta
+}
+
+// Record a frame that was written, which is either fresh or a duplicate
+func (c *constantRateStats) written(fresh bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if fresh {
+		c.stats.Fresh++
+	} else {
+		c.stats.Duplicated++
+	}
+}
+
+// Record a frame that was replaced before it could be written
+func (c *constantRateStats) dropped() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Dropped++
+}
+
+// Get the current stats
+func (c *constantRateStats) state() ConstantRateStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// Parse the constant frame rate the client requested (?fps=), or get the stream's default,
+// where zero means the frames are written as they are published
+func (s *Server) parseConstantRate(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("fps")
+	if value == "" {
+		return s.constantRate, nil
+	}
+	fps, err := strconv.Atoi(value)
+	if err != nil || fps < 0 || fps > maxConstantRate {
+		return 0, fmt.Errorf("invalid fps (must be between 0 and %d): %s", maxConstantRate, value)
+	}
+	return fps, nil
+}
+
+// Write the most recently published frame to the client as a multipart stream at exactly the given
+// frame rate, repeating the last frame whenever no new one was published in time,
+// until either the client disconnects or the stream is closed
+func (st *stream) serveConstant(w http.ResponseWriter, r *http.Request, name string, fps int, stats *constantRateStats) {
+	c := st.subscribe()
+	if c == nil {
+		http.Error(w, ErrStreamClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer st.unsubscribe(c)
+	stats.connect(1)
+	defer stats.connect(-1)
+
+	parts, err := newPartWriter(w)
+	if err != nil {
+		return
+	}
+
+	// NOTE: The ticker drops ticks while a write is still in progress,
+	//       so a client that can't keep up gets fewer frames instead of a growing backlog.
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+
+	var latest *frame.Frame
+	fresh := false
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case f, ok := <-c:
+			if !ok {
+				return
+			}
+
+			// Keepalives resend the last frame, which doesn't make it fresh
+			if isDuplicate(f, latest) {
+				continue
+			}
+			if fresh {
+				stats.dropped()
+			}
+			latest, fresh = f, true
+		case <-ticker.C:
+			if latest == nil {
+				continue
+			}
+			if err := parts.write(latest, name); err != nil {
+				return
+			}
+			stats.written(fresh)
+			fresh = false
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Read the next part of a stream, returning its sequence number and when it arrived
+func nextPart(t *testing.T, parts *multipart.Reader) (uint64, time.Time) {
+	t.Helper()
+	part, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, part); err != nil {
+		t.Fatal(err)
+	}
+	sequence, err := strconv.ParseUint(part.Header.Get(frame.HeaderSequence), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sequence, time.Now()
+}
+
+func TestServeConstant(t *testing.T) {
+	const fps = 20
+	const interval = time.Second / fps
+	source := newTestSource()
+	s := runTestServer(t, source, WithConstantRate(fps))
+	ts := serveTest(t, s)
+
+	source.publish(testFrame(t, 64, 48, 1))
+	waitForSequence(t, s, 1)
+	parts := openStream(t, ts.URL+"/?action=stream")
+
+	// The source stalls after its first frame, which is repeated at the constant frame rate
+	sequence, start := nextPart(t, parts)
+	if sequence != 1 {
+		t.Fatalf("stream started with frame %d", sequence)
+	}
+	last, count := start, 0
+	for last.Sub(start) < time.Second {
+		var now time.Time
+		sequence, now = nextPart(t, parts)
+		if sequence != 1 {
+			t.Fatalf("stalled stream wrote frame %d", sequence)
+		}
+		if gap := now.Sub(last); gap > 4*interval {
+			t.Errorf("stalled stream wrote nothing for %v", gap)
+		}
+		last = now
+		count++
+	}
+	if rate := float64(count) / last.Sub(start).Seconds(); rate < fps*0.75 || rate > fps*1.25 {
+		t.Errorf("stalled stream was written at %.1f fps, want %d fps", rate, fps)
+	}
+	stats := s.Health().ConstantRate
+	if stats == nil || stats.FPS != fps || stats.Clients != 1 || stats.Fresh != 1 || stats.Duplicated < uint64(count) {
+		t.Errorf("unexpected stats %+v after %d repeated frames", stats, count)
+	}
+
+	// The new frame is written on the next tick once the source recovers, and repeated from then on
+	source.publish(testFrame(t, 64, 48, 2))
+	for sequence == 1 {
+		var now time.Time
+		sequence, now = nextPart(t, parts)
+		if gap := now.Sub(last); gap > 4*interval {
+			t.Errorf("stream wrote nothing for %v", gap)
+		}
+		last = now
+	}
+	for i := 0; i < 3; i++ {
+		if sequence, _ = nextPart(t, parts); sequence != 2 {
+			t.Errorf("stream went back to frame %d", sequence)
+		}
+	}
+	if stats := s.Health().ConstantRate; stats.Fresh != 2 {
+		t.Errorf("wrote %d fresh frames, want 2", stats.Fresh)
+	}
+}
+
+func TestParseConstantRate(t *testing.T) {
+	s, err := New(newTestSource(), WithAddress(""), WithConstantRate(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"", 10}, {"fps=0", 0}, {"fps=1", 1}, {"fps=120", 120},
+	} {
+		fps, err := s.parseConstantRate(httptest.NewRequest(http.MethodGet, "/?"+test.query, nil))
+		if err != nil || fps != test.want {
+			t.Errorf("%q: got %d fps (%v), want %d", test.query, fps, err, test.want)
+		}
+	}
+	for _, query := range []string{"fps=-1", "fps=121", "fps=1.5", "fps=abc"} {
+		if _, err := s.parseConstantRate(httptest.NewRequest(http.MethodGet, "/?"+query, nil)); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+		if w := request(s, http.MethodGet, "/?action=stream&"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: unexpected status %d", query, w.Code)
+		}
+	}
+
+	if _, err := New(newTestSource(), WithAddress(""), WithConstantRate(maxConstantRate+1)); err == nil {
+		t.Error("constant frame rate above the maximum was accepted")
+	}
+}
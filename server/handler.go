@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+// ServeHTTP serves the index page, the MJPEG stream (?action=stream), snapshots (?action=snapshot),
+// the PTZ and color control APIs (?action=ptz and ?action=color), the motion state (?action=motion),
+// the health of the stream (?action=health), its profiles (?action=profiles)
+// and the annotation API (?action=annotations),
+// compatible with mjpg-streamer and OctoPrint
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Handle action query parameter
+	action := r.URL.Query().Get("action")
+	if len(action) > 0 {
+		if action == "stream" {
+			s.ServeStream(w, r)
+			return
+		} else if action == "snapshot" {
+			s.ServeSnapshot(w, r)
+			return
+		} else if action == "ptz" {
+			s.ServePTZ(w, r)
+			return
+		} else if action == "color" {
+			s.ServeColor(w, r)
+			return
+		} else if action == "health" {
+			s.ServeHealth(w, r)
+			return
+		} else if action == "motion" {
+			s.ServeMotion(w, r)
+			return
+		} else if action == "profiles" {
+			s.ServeProfiles(w, r)
+			return
+		} else if action == "annotations" {
+			s.ServeAnnotations(w, r)
+			return
+		} else {
+			// Redirect back to index page
+			http.Redirect(w, r, r.URL.Path, http.StatusFound)
+			return
+		}
+	}
+
+	s.ServeIndex(w, r)
+}
+
+// Get an http.Handler that only serves the MJPEG stream
+func (s *Server) StreamHandler() http.Handler {
+	return http.HandlerFunc(s.ServeStream)
+}
+
+// Get an http.Handler that only serves snapshots
+func (s *Server) SnapshotHandler() http.Handler {
+	return http.HandlerFunc(s.ServeSnapshot)
+}
+
+// Serve the MJPEG stream, optionally scaled and/or zoomed (see parseVariantKey),
+// and either adapted to the client's throughput if adaptive quality is enabled,
+// or written at a constant frame rate if one was requested (?fps=) or is the default
+func (s *Server) ServeStream(w http.ResponseWriter, r *http.Request) {
+	// Refuse new clients while the stream is offline, if its clients were disconnected
+	if s.staleness.offline(StaleClose) {
+		http.Error(w, ErrStreamOffline.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Use the scaled and/or zoomed variant of the stream if one was requested
+	out := s.stream
+	key, scaled, err := s.parseVariantKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), variantErrorStatus(err))
+		return
+	}
+	fps, err := s.parseConstantRate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Clients at a constant frame rate keep the quality and size they asked for
+	adaptive := false
+	if s.adaptive != nil && fps == 0 {
+		if adaptive, err = parseAdaptive(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if scaled && !adaptive {
+		v, err := s.variants.acquire(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.variants.release(v)
+		out = v.stream
+	}
+
+	// Wait until we have a frame
+	if s.waitForFrame(r.Context()) == nil {
+		return
+	}
+
+	// Adapt the quality and size of the stream to the client's throughput, if enabled
+	if adaptive {
+		s.serveAdaptive(w, r, key, scaled)
+		return
+	}
+
+	// Repeat frames as needed to write them at a constant frame rate, if requested
+	if fps > 0 {
+		out.serveConstant(w, r, s.name, fps, &s.constantStats)
+		return
+	}
+
+	// Return the MJPEG stream
+	out.serve(w, r, s.name)
+}
+
+// Serve the current frame as a JPEG, optionally scaled and/or zoomed (see parseVariantKey)
+func (s *Server) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	// Refuse snapshots while the stream is offline, unless it shows the placeholder
+	if s.staleness.offline(StaleClose) || s.staleness.offline(StaleUnavailable) {
+		http.Error(w, ErrStreamOffline.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	key, scaled, err := s.parseVariantKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), variantErrorStatus(err))
+		return
+	}
+
+	// Wait until we have a frame
+	if s.waitForFrame(r.Context()) == nil {
+		return
+	}
+	currentFrame, sourceFrame := s.currentFrames()
+
+	// Render the scaled and/or zoomed variant of the frame if one was requested
+	if scaled {
+		v, err := s.variants.acquire(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		input, viewed, err := v.input(currentFrame, sourceFrame)
+		if err == nil {
+			currentFrame, err = v.render(input, viewed, &s.variants.decoded, s.quality)
+		}
+		s.variants.release(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s.comment {
+			currentFrame = s.commentFrame(currentFrame)
+		}
+	}
+
+	// Return the current frame as a JPEG
+	currentFrame.SetHeaders(textproto.MIMEHeader(w.Header()), s.name)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Write(currentFrame.Data)
+}
+
+// Serve the index page that shows the MJPEG stream
+func (s *Server) ServeIndex(w http.ResponseWriter, r *http.Request) {
+	// Render the index page
+	w.Header().Set("Content-Type", "text/html")
+
+	w.Write([]byte(`<br>`))
+
+	// TODO: Inject custom CSS to adjust the stream and snapshot sizes etc.
+
+	// NOTE: HTML <video> does NOT support MJPEG streams, only <img> does!
+	//       Both images are scaled by the server, so clients don't download full size frames.
+	w.Write([]byte(`<p>Stream Video</p>`))
+	w.Write([]byte(`<img src="?action=stream&width=640" alt="MJPEG Stream Video" />`))
+
+	w.Write([]byte(`<br>`))
+
+	w.Write([]byte(`<p>Stream Snapshot</p>`))
+	w.Write([]byte(`<img src="?action=snapshot&width=640" alt="MJPEG Stream Snapshot Image" />`))
+}
+
+// Get the HTTP status code for an error parsing the variant parameters
+func variantErrorStatus(err error) int {
+	if errors.Is(err, ErrUnknownProfile) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// Wait until a frame has been published, returning nil if the context is done first
+func (s *Server) waitForFrame(ctx context.Context) *frame.Frame {
+	for {
+		if currentFrame := s.CurrentFrame(); currentFrame != nil {
+			return currentFrame
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"didstopia/mjpeg-server/frame"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"testing"
+)
+
+// Check the frame headers of a stream part or snapshot against the frame it was rendered from
+func checkFrameHeaders(t *testing.T, what string, header textproto.MIMEHeader, data []byte, f *frame.Frame, width, height int) {
+	t.Helper()
+	for key, want := range map[string]string{
+		"Content-Type":        "image/jpeg",
+		"Content-Length":      strconv.Itoa(len(data)),
+		frame.HeaderSequence:  strconv.FormatUint(f.Sequence, 10),
+		frame.HeaderTimestamp: frame.FormatTimestamp(f.Timestamp),
+		frame.HeaderWidth:     strconv.Itoa(width),
+		frame.HeaderHeight:    strconv.Itoa(height),
+		frame.HeaderStream:    "front-door",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s: %s header is %q, want %q", what, key, got, want)
+		}
+	}
+	if timestamp, err := frame.ParseTimestamp(header.Get(frame.HeaderTimestamp)); err != nil || !timestamp.Equal(f.Timestamp) {
+		t.Errorf("%s: timestamp header parses as %s (%v), want %s", what, timestamp, err, f.Timestamp)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: invalid JPEG: %v", what, err)
+	}
+	if config.Width != width || config.Height != height {
+		t.Errorf("%s: frame is %dx%d, want %dx%d", what, config.Width, config.Height, width, height)
+	}
+}
+
+func TestFrameHeaders(t *testing.T) {
+	source := newTestSource()
+	s := runTestServer(t, source, WithName("front-door"))
+	ts := serveTest(t, s)
+
+	f := testFrame(t, 64, 48, 42)
+	source.publish(f)
+	waitForSequence(t, s, 42)
+
+	// Snapshots, both original and scaled
+	for _, test := range []struct {
+		query         string
+		width, height int
+	}{
+		{"", 64, 48},
+		{"&width=32", 32, 24},
+	} {
+		w := request(s, http.MethodGet, "/?action=snapshot"+test.query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("snapshot%s: unexpected status %d", test.query, w.Code)
+		}
+		checkFrameHeaders(t, "snapshot"+test.query, textproto.MIMEHeader(w.Header()), w.Body.Bytes(), f, test.width, test.height)
+	}
+
+	// Stream parts, both original and scaled, where a new variant only has frames once the next one is published
+	for i, test := range []struct {
+		query         string
+		width, height int
+	}{
+		{"", 64, 48},
+		{"&width=32", 32, 24},
+	} {
+		parts := openStream(t, ts.URL+"/?action=stream"+test.query)
+		waitFor(t, "client to connect", func() bool { return s.Viewers() == i+1 })
+		f := testFrame(t, 64, 48, uint64(43+i))
+		source.publish(f)
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				t.Fatalf("stream%s: %v", test.query, err)
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatalf("stream%s: %v", test.query, err)
+			}
+			if part.Header.Get(frame.HeaderSequence) == strconv.FormatUint(f.Sequence, 10) {
+				checkFrameHeaders(t, "stream"+test.query, part.Header, data, f, test.width, test.height)
+				break
+			}
+		}
+	}
+}
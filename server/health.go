@@ -0,0 +1,164 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultKeepalive is how often a duplicate frame is resent when none is given
+	DefaultKeepalive = time.Second
+
+	// DefaultFrozenThreshold is the number of identical frames in a row
+	// after which the source is considered frozen when none is given
+	DefaultFrozenThreshold = 100
+)
+
+// Health is the health of a stream
+type Health struct {
+	// Whether the stream is healthy, which requires it to be live and not frozen
+	Healthy bool `json:"healthy"`
+
+	// Whether the source is sending frames, since when, and when it last sent one
+	State      StreamState `json:"state"`
+	StateSince *time.Time  `json:"state_since,omitempty"`
+	LastFrame  *time.Time  `json:"last_frame,omitempty"`
+
+	// The most recent changes of the state
+	Transitions []Transition `json:"transitions"`
+
+	// Whether the source keeps sending identical frames, and how many it has sent in a row
+	Frozen          bool `json:"frozen"`
+	IdenticalFrames int  `json:"identical_frames"`
+
+	// When the source last sent a frame that was different from the one before it
+	LastChange *time.Time `json:"last_change,omitempty"`
+
+	// Number of duplicate frames that weren't published, and of those that were resent as keepalives
+	Duplicates uint64 `json:"duplicates"`
+	Keepalives uint64 `json:"keepalives"`
+
+	// Number of frames the worker pool processed, dropped, skipped and failed to process
+	Pool *pipeline.PoolStats `json:"pool,omitempty"`
+
+	// The quality and throughput of every client whose quality adapts to its throughput
+	AdaptiveClients []AdaptiveClient `json:"adaptive_clients,omitempty"`
+
+	// Number of fresh and duplicated frames written to clients at a constant frame rate
+	ConstantRate *ConstantRateStats `json:"constant_rate,omitempty"`
+
+	// Number of invalid frames the source rejected, by the reason they were rejected for
+	Rejections map[string]uint64 `json:"rejections,omitempty"`
+}
+
+// healthMonitor keeps track of the health of a stream
+type healthMonitor struct {
+	frozenThreshold int
+
+	mutex      sync.Mutex
+	last       *frame.Frame
+	identical  int
+	frozen     bool
+	lastChange time.Time
+	duplicates uint64
+	keepalives uint64
+}
+
+// Record a new frame from the source, comparing its content with the previous one
+func (h *healthMonitor) observe(f *frame.Frame) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.last != nil && f.Hash == h.last.Hash && f.Size == h.last.Size {
+		h.identical++
+	} else {
+		h.identical = 0
+		h.lastChange = time.Now()
+	}
+	h.last = f
+
+	frozen := h.frozenThreshold > 0 && h.identical >= h.frozenThreshold
+	if frozen && !h.frozen {
+		log.Println("Source appears to be frozen, it has sent", h.identical, "identical frames in a row")
+	} else if !frozen && h.frozen {
+		log.Println("Source is no longer frozen")
+	}
+	h.frozen = frozen
+}
+
+// Record a duplicate frame that either wasn't published, or was resent as a keepalive
+func (h *healthMonitor) duplicate(keepalive bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if keepalive {
+		h.keepalives++
+	} else {
+		h.duplicates++
+	}
+}
+
+// Get the current health
+func (h *healthMonitor) state() Health {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	health := Health{
+		Healthy:         !h.frozen,
+		Frozen:          h.frozen,
+		IdenticalFrames: h.identical,
+		Duplicates:      h.duplicates,
+		Keepalives:      h.keepalives,
+	}
+	if !h.lastChange.IsZero() {
+		lastChange := h.lastChange
+		health.LastChange = &lastChange
+	}
+	return health
+}
+
+// Get the health of the stream
+func (s *Server) Health() Health {
+	health := s.health.state()
+	s.staleness.report(&health)
+	if s.pool != nil {
+		stats := s.pool.Stats()
+		health.Pool = &stats
+	}
+	if source, ok := s.source.(ValidatingSource); ok {
+		health.Rejections = source.Rejections()
+	}
+	if s.adaptive != nil {
+		health.AdaptiveClients = s.AdaptiveClients()
+	}
+	if stats := s.constantStats.state(); s.constantRate > 0 || stats.Fresh+stats.Duplicated > 0 {
+		stats.FPS = s.constantRate
+		health.ConstantRate = &stats
+	}
+	health.Healthy = health.Healthy && health.State == StateLive
+	return health
+}
+
+// Get an http.Handler that only serves the health of the stream
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(s.ServeHealth)
+}
+
+// Serve the health of the stream (?action=health) as JSON,
+// with a 503 status code if the stream is unhealthy so it can be used as a health check
+func (s *Server) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	health := s.Health()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// Check if the frame has the same content as the previous one
+func isDuplicate(f, previous *frame.Frame) bool {
+	return previous != nil && (f == previous || (f.Hash == previous.Hash && f.Size == previous.Size))
+}
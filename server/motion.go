@@ -0,0 +1,32 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/motion"
+	"encoding/json"
+	"net/http"
+)
+
+// Get the state of the motion detector, returning false if motion detection isn't enabled
+func (s *Server) MotionState() (motion.State, bool) {
+	if s.motion == nil {
+		return motion.State{}, false
+	}
+	return s.motion.State(), true
+}
+
+// Get an http.Handler that only serves the motion state
+func (s *Server) MotionHandler() http.Handler {
+	return http.HandlerFunc(s.ServeMotion)
+}
+
+// Serve the state of the motion detector (?action=motion) as JSON, including the most recent events
+func (s *Server) ServeMotion(w http.ResponseWriter, r *http.Request) {
+	state, ok := s.MotionState()
+	if !ok {
+		http.Error(w, "motion detection is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/motion"
+	"didstopia/mjpeg-server/pipeline"
+	"didstopia/mjpeg-server/scheduler"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+	"time"
+)
+
+const (
+	// DefaultAddress is the address the web server listens on when none is given
+	DefaultAddress = ":8080"
+
+	// DefaultFrameRate is the frame rate frames are published at when none is given
+	DefaultFrameRate = 25
+)
+
+// Option configures a Server
+type Option func(*Server) error
+
+// Set the name of the stream
+func WithName(name string) Option {
+	return func(s *Server) error {
+		s.name = name
+		return nil
+	}
+}
+
+// Set the address the built-in web server listens on,
+// or an empty address to only serve through Handler()
+func WithAddress(address string) Option {
+	return func(s *Server) error {
+		s.address = address
+		return nil
+	}
+}
+
+// Set the frame rate that frames are published at
+func WithFrameRate(frameRate int) Option {
+	return func(s *Server) error {
+		if err := scheduler.ValidateFrameRate(frameRate); err != nil {
+			return err
+		}
+		s.frameRate = frameRate
+		return nil
+	}
+}
+
+// Publish every frame as soon as the source has it available,
+// at the source's own pace (ignores the frame rate)
+func WithPassthrough(passthrough bool) Option {
+	return func(s *Server) error {
+		s.passthrough = passthrough
+		return nil
+	}
+}
+
+// Set how often a frame that is the same as the last published one is resent, so clients don't time out,
+// where duplicate frames are otherwise not published at all (zero publishes every frame)
+func WithKeepalive(keepalive time.Duration) Option {
+	return func(s *Server) error {
+		if keepalive < 0 {
+			return errors.New("keepalive can't be negative")
+		}
+		s.keepalive = keepalive
+		return nil
+	}
+}
+
+// Insert a comment segment with the capture timestamp and the name of the stream
+// into every published frame (including scaled variants and snapshots)
+func WithFrameComment(enabled bool) Option {
+	return func(s *Server) error {
+		s.comment = enabled
+		return nil
+	}
+}
+
+// Set what the stream shows when the source stops sending frames
+func WithStalePolicy(policy StalePolicy) Option {
+	return func(s *Server) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		s.stalePolicy = policy
+		return nil
+	}
+}
+
+// Lower the JPEG quality and then the size of the stream for every client that can't keep up with it,
+// and raise them back up once the client recovers (clients can opt out with ?adaptive=false)
+func WithAdaptiveQuality(policy AdaptivePolicy) Option {
+	return func(s *Server) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		s.adaptive = &policy
+		return nil
+	}
+}
+
+// Write frames to every stream client at exactly the given frame rate, repeating the last frame
+// (or the placeholder) whenever the source doesn't send a new one in time, for consumers such as
+// recorders that expect a constant frame rate (clients can request another rate with ?fps=, or opt out with ?fps=0)
+func WithConstantRate(fps int) Option {
+	return func(s *Server) error {
+		if fps < 0 || fps > maxConstantRate {
+			return fmt.Errorf("constant frame rate must be between 0 and %d", maxConstantRate)
+		}
+		s.constantRate = fps
+		return nil
+	}
+}
+
+// Set the number of identical frames in a row after which the source is considered frozen
+// and the stream unhealthy (zero disables the frozen source detection)
+func WithFrozenThreshold(frames int) Option {
+	return func(s *Server) error {
+		if frames < 0 {
+			return errors.New("frozen threshold can't be negative")
+		}
+		s.health.frozenThreshold = frames
+		return nil
+	}
+}
+
+// Set the JPEG quality (1-100) used when frames have to be re-encoded
+func WithQuality(quality int) Option {
+	return func(s *Server) error {
+		if quality < 1 || quality > 100 {
+			return errors.New("quality must be between 1 and 100")
+		}
+		s.quality = quality
+		return nil
+	}
+}
+
+// Set the number of workers that process frames in parallel, where frames are dropped
+// instead of queued when every worker is busy (zero uses a worker for every core)
+func WithWorkers(workers int) Option {
+	return func(s *Server) error {
+		if workers < 0 {
+			return errors.New("number of workers can't be negative")
+		}
+		if workers == 0 {
+			workers = runtime.NumCPU()
+		}
+		s.workers = workers
+		return nil
+	}
+}
+
+// Set the maximum number of scaled variants that can be live at the same time
+func WithMaxVariants(maxVariants int) Option {
+	return func(s *Server) error {
+		if maxVariants < 1 {
+			return errors.New("max variants must be at least 1")
+		}
+		s.maxVariants = maxVariants
+		return nil
+	}
+}
+
+// Hide privacy sensitive areas of every frame before it reaches any output,
+// including snapshots and every variant (unless an admin requests unmasked frames)
+func WithMasks(masks ...pipeline.Mask) Option {
+	return func(s *Server) error {
+		s.masks = append(s.masks, masks...)
+		return nil
+	}
+}
+
+// Set the token that admins can present (as ?token= or an "Authorization: Bearer" header)
+// to request unmasked frames with ?unmasked=1, which is impossible without one,
+// and which is required to change the view, presets, color adjustments and annotations at runtime
+func WithAdminToken(token string) Option {
+	return func(s *Server) error {
+		s.adminToken = token
+		return nil
+	}
+}
+
+// Rotate every frame clockwise by the given number of degrees (0, 90, 180 or 270),
+// then flip it horizontally and/or vertically
+func WithOrientation(rotation int, flipH, flipV bool) Option {
+	return func(s *Server) error {
+		orientation, err := pipeline.NewOrientation(rotation, flipH, flipV)
+		if err != nil {
+			return err
+		}
+		s.orientation = orientation
+		return nil
+	}
+}
+
+// Crop every frame to the given rectangle (after rotating it), such as the area of interest of a wide frame
+func WithCrop(rect image.Rectangle) Option {
+	return func(s *Server) error {
+		crop, err := pipeline.NewCrop(rect)
+		if err != nil {
+			return err
+		}
+		s.crop = crop
+		return nil
+	}
+}
+
+// Scale every frame to fit the given output size, filling the rest with the given color,
+// so every published frame has the same size even when the source size changes
+func WithOutputSize(width, height int, fill color.RGBA) Option {
+	return func(s *Server) error {
+		letterbox, err := pipeline.NewLetterbox(width, height, fill)
+		if err != nil {
+			return err
+		}
+		s.letterbox = letterbox
+		return nil
+	}
+}
+
+// Add named renditions of the stream (such as "hd", "sd" and "thumb"), which clients select with ?profile=
+func WithProfiles(profiles ...Profile) Option {
+	return func(s *Server) error {
+		for _, profile := range profiles {
+			if err := profile.Validate(); err != nil {
+				return err
+			}
+			if _, ok := s.Profile(profile.Name); ok {
+				return fmt.Errorf("duplicate profile: %s", profile.Name)
+			}
+			s.profiles = append(s.profiles, profile)
+		}
+		return nil
+	}
+}
+
+// Set the initial color and exposure adjustments, which can also be changed at runtime
+func WithAdjustments(adjustments pipeline.Adjustments) Option {
+	return func(s *Server) error {
+		return s.color.SetAdjustments(adjustments)
+	}
+}
+
+// Detect motion on every frame (after it has been rotated, cropped and adjusted), see motion.Config
+func WithMotion(config motion.Config) Option {
+	return func(s *Server) error {
+		detector, err := motion.New(config)
+		if err != nil {
+			return err
+		}
+		s.motion = detector
+		return nil
+	}
+}
+
+// Load the pan/tilt/zoom presets from the given JSON file, and save them back to it whenever they change
+func WithPresetsFile(path string) Option {
+	return func(s *Server) error {
+		s.presetsFile = path
+		return nil
+	}
+}
+
+// Draw a text overlay on every frame, such as a timestamp (see pipeline.OverlayConfig),
+// which can use the {name}, {fps} and {viewers} fields of the stream on top of the built-in ones
+func WithOverlay(config pipeline.OverlayConfig) Option {
+	return func(s *Server) error {
+		s.overlays = append(s.overlays, config)
+		return nil
+	}
+}
+
+// Composite a PNG image, such as a logo, onto every frame (see pipeline.WatermarkConfig)
+func WithWatermark(config pipeline.WatermarkConfig) Option {
+	return func(s *Server) error {
+		s.watermarks = append(s.watermarks, config)
+		return nil
+	}
+}
+
+// Allow annotations (such as the detections of an object detector) to be drawn on the stream
+// with the annotation API (?action=annotations), where clients that want the frames without them
+// request them with ?clean=1
+func WithAnnotations(enabled bool) Option {
+	return func(s *Server) error {
+		s.annotations = nil
+		if enabled {
+			s.annotations = pipeline.NewAnnotations()
+		}
+		return nil
+	}
+}
+
+// Add custom stages to the end of the frame pipeline
+func WithStages(stages ...pipeline.Stage) Option {
+	return func(s *Server) error {
+		s.stages = append(s.stages, stages...)
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// Profile is a named rendition of the stream (such as "hd", "sd" or "thumb"), which is rendered
+// at most once per frame and shared between every client that selects it with ?profile=
+type Profile struct {
+	Name string `json:"name"`
+
+	// The size that the frames are scaled to fit within (never upscaling them)
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// The JPEG quality of the rendition, or zero to use the quality of the stream
+	Quality int `json:"quality,omitempty"`
+
+	Filter imaging.Filter `json:"filter"`
+}
+
+// Validate the profile
+func (p Profile) Validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, "=,@&?/ ") {
+		return fmt.Errorf("invalid profile name: %q", p.Name)
+	}
+	if p.Width <= 0 || p.Height <= 0 {
+		return fmt.Errorf("invalid size for profile %s: %dx%d", p.Name, p.Width, p.Height)
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		return fmt.Errorf("invalid quality for profile %s: %d", p.Name, p.Quality)
+	}
+	return nil
+}
+
+// Get the key of the variant that renders the profile
+func (p Profile) key() variantKey {
+	return variantKey{width: p.Width, height: p.Height, filter: p.Filter, view: pipeline.DefaultView, quality: p.Quality}
+}
+
+// Parse profiles in the "name=widthxheight[@quality],..." format (eg. "hd=1280x720@85,sd=640x360@75,thumb=160x90@60")
+func ParseProfiles(value string) ([]Profile, error) {
+	var profiles []Profile
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("profile must be in the name=widthxheight[@quality] format: %s", part)
+		}
+		profile := Profile{Name: strings.TrimSpace(name), Filter: imaging.DefaultFilter}
+		size, quality, hasQuality := strings.Cut(spec, "@")
+		var err error
+		if profile.Width, profile.Height, err = pipeline.ParseSize(size); err != nil {
+			return nil, fmt.Errorf("invalid profile %s: %w", profile.Name, err)
+		}
+		if hasQuality {
+			if profile.Quality, err = strconv.Atoi(strings.TrimSpace(quality)); err != nil {
+				return nil, fmt.Errorf("invalid quality for profile %s: %s", profile.Name, quality)
+			}
+		}
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// ProfileState is a profile along with its current state
+type ProfileState struct {
+	Profile
+
+	// The size of the most recently rendered frame, if any
+	FrameWidth  int `json:"frame_width,omitempty"`
+	FrameHeight int `json:"frame_height,omitempty"`
+
+	// Number of clients connected to the profile's stream
+	Viewers int `json:"viewers"`
+}
+
+// Get the profile with the given name
+func (s *Server) Profile(name string) (Profile, bool) {
+	for _, profile := range s.profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Get every profile along with its current state, in the order they were added
+func (s *Server) Profiles() []ProfileState {
+	states := make([]ProfileState, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		state := ProfileState{Profile: profile}
+		if v := s.variants.pinned(profile.key()); v != nil {
+			state.Viewers = v.stream.count()
+			v.mutex.Lock()
+			if v.rendered != nil {
+				state.FrameWidth, state.FrameHeight = v.rendered.Width, v.rendered.Height
+			}
+			v.mutex.Unlock()
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// Get an http.Handler that only serves the profile listing
+func (s *Server) ProfilesHandler() http.Handler {
+	return http.HandlerFunc(s.ServeProfiles)
+}
+
+// Serve the profiles of the stream (?action=profiles) as JSON
+func (s *Server) ServeProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(s.Profiles())
+}
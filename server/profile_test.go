@@ -0,0 +1,122 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := ParseProfiles(" hd=1280x720@85, sd = 640x360 ,,thumb=160X90@60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Profile{
+		{Name: "hd", Width: 1280, Height: 720, Quality: 85, Filter: imaging.DefaultFilter},
+		{Name: "sd", Width: 640, Height: 360, Filter: imaging.DefaultFilter},
+		{Name: "thumb", Width: 160, Height: 90, Quality: 60, Filter: imaging.DefaultFilter},
+	}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("parsed profiles %+v, want %+v", profiles, want)
+	}
+
+	for _, value := range []string{
+		"hd", "hd:1280x720", "=1280x720", "h d=1280x720", "hd=1280", "hd=0x720",
+		"hd=1280x720@", "hd=1280x720@high", "hd=1280x720@101", "hd=1280x720@-1",
+	} {
+		if _, err := ParseProfiles(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+
+	if _, err := New(newTestSource(), WithAddress(""), WithProfiles(want[0], want[0])); err == nil {
+		t.Error("duplicate profiles were added")
+	}
+}
+
+func TestProfileVariant(t *testing.T) {
+	thumb := Profile{Name: "thumb", Width: 160, Height: 90, Quality: 60, Filter: imaging.DefaultFilter}
+	source := newTestSource()
+	s := runTestServer(t, source, WithProfiles(thumb))
+
+	// A profile selects its rendition
+	key, scaled, err := s.parseVariantKey(httptest.NewRequest(http.MethodGet, "/?profile=thumb", nil))
+	if err != nil || key != thumb.key() || !scaled {
+		t.Errorf("profile parsed as %+v (scaled: %t, %v), want %+v", key, scaled, err, thumb.key())
+	}
+
+	// Profiles can't be combined with any of the other parameters,
+	// and unknown profiles are reported as not found
+	for _, test := range []struct {
+		query  string
+		status int
+	}{
+		{"profile=thumb&width=640", http.StatusBadRequest},
+		{"profile=thumb&height=360", http.StatusBadRequest},
+		{"profile=thumb&scale=0.5", http.StatusBadRequest},
+		{"profile=thumb&filter=nearest", http.StatusBadRequest},
+		{"profile=thumb&preset=door", http.StatusBadRequest},
+		{"profile=thumb&zoom=2", http.StatusBadRequest},
+		{"profile=thumb&pan=0.5", http.StatusBadRequest},
+		{"profile=thumb&tilt=0.5", http.StatusBadRequest},
+		{"profile=thumb&unmasked=1", http.StatusBadRequest},
+		{"profile=thumb&clean=1", http.StatusBadRequest},
+		{"profile=thumb&width=", http.StatusBadRequest},
+		{"profile=hd", http.StatusNotFound},
+		{"profile=THUMB", http.StatusNotFound},
+		{"width=640&profile=hd", http.StatusNotFound},
+	} {
+		_, _, err := s.parseVariantKey(httptest.NewRequest(http.MethodGet, "/?"+test.query, nil))
+		if err == nil {
+			t.Errorf("%q: expected an error", test.query)
+			continue
+		}
+		if errors.Is(err, ErrUnknownProfile) != (test.status == http.StatusNotFound) {
+			t.Errorf("%q: unexpected error %v", test.query, err)
+		}
+		if status := variantErrorStatus(err); status != test.status {
+			t.Errorf("%q: status is %d, want %d", test.query, status, test.status)
+		}
+		for _, action := range []string{"snapshot", "stream"} {
+			if w := request(s, http.MethodGet, "/?action="+action+"&"+test.query, ""); w.Code != test.status {
+				t.Errorf("%s %q: unexpected status %d, want %d", action, test.query, w.Code, test.status)
+			}
+		}
+	}
+
+	// Snapshots of the profile are rendered at its size
+	source.publish(testFrame(t, 320, 180, 1))
+	waitForSequence(t, s, 1)
+	w := request(s, http.MethodGet, "/?action=snapshot&profile=thumb", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("snapshot of the profile failed with %d", w.Code)
+	}
+	img, err := imaging.Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != thumb.Width || size.Y != thumb.Height {
+		t.Errorf("snapshot of the profile is %v, want %dx%d", size, thumb.Width, thumb.Height)
+	}
+
+	// The listing shows the size of the most recently rendered frame of every profile
+	var states []struct {
+		Name        string `json:"name"`
+		Quality     int    `json:"quality"`
+		Filter      string `json:"filter"`
+		FrameWidth  int    `json:"frame_width"`
+		FrameHeight int    `json:"frame_height"`
+	}
+	w = request(s, http.MethodGet, "/?action=profiles", "")
+	if err := json.NewDecoder(w.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Name != thumb.Name || states[0].Quality != thumb.Quality || states[0].Filter != thumb.Filter.String() ||
+		states[0].FrameWidth != thumb.Width || states[0].FrameHeight != thumb.Height {
+		t.Errorf("unexpected profiles %+v", states)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrUnknownPreset = errors.New("unknown preset")
+
+// ptzState is the response of the PTZ control API
+type ptzState struct {
+	View    pipeline.View            `json:"view"`
+	Presets map[string]pipeline.View `json:"presets"`
+}
+
+// Get the current digital pan/tilt/zoom view of the stream
+func (s *Server) View() pipeline.View {
+	return s.ptz.View()
+}
+
+// Change the digital pan/tilt/zoom view of the stream, starting with the next published frame
+func (s *Server) SetView(view pipeline.View) error {
+	if err := s.ptz.SetView(view); err != nil {
+		return err
+	}
+	s.invalidate()
+	log.Printf("Changed view to zoom=%g pan=%g tilt=%g\n", view.Zoom, view.Pan, view.Tilt)
+	return nil
+}
+
+// Get a copy of every saved preset
+func (s *Server) Presets() map[string]pipeline.View {
+	s.presetsMutex.Lock()
+	defer s.presetsMutex.Unlock()
+	presets := make(map[string]pipeline.View, len(s.presets))
+	for name, view := range s.presets {
+		presets[name] = view
+	}
+	return presets
+}
+
+// Get a saved preset
+func (s *Server) Preset(name string) (pipeline.View, bool) {
+	s.presetsMutex.Lock()
+	defer s.presetsMutex.Unlock()
+	view, ok := s.presets[name]
+	return view, ok
+}
+
+// Save the current view as a preset, replacing any existing preset with the same name
+func (s *Server) SavePreset(name string) error {
+	if name == "" {
+		return errors.New("preset name is required")
+	}
+	s.presetsMutex.Lock()
+	defer s.presetsMutex.Unlock()
+	s.presets[name] = s.View()
+	return s.savePresets()
+}
+
+// Change the view to a saved preset
+func (s *Server) RecallPreset(name string) error {
+	view, ok := s.Preset(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPreset, name)
+	}
+	return s.SetView(view)
+}
+
+// Delete a saved preset
+func (s *Server) DeletePreset(name string) error {
+	s.presetsMutex.Lock()
+	defer s.presetsMutex.Unlock()
+	if _, ok := s.presets[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPreset, name)
+	}
+	delete(s.presets, name)
+	return s.savePresets()
+}
+
+// Load the presets from the presets file, if there is one
+func (s *Server) loadPresets() error {
+	if s.presetsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.presetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	presets := make(map[string]pipeline.View)
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return fmt.Errorf("failed to parse presets file %s: %w", s.presetsFile, err)
+	}
+	for name, view := range presets {
+		if err := view.Validate(); err != nil {
+			return fmt.Errorf("invalid preset %s in %s: %w", name, s.presetsFile, err)
+		}
+	}
+	log.Println("Loaded", len(presets), "presets from", s.presetsFile)
+	s.presets = presets
+	return nil
+}
+
+// Save the presets to the presets file, if there is one (the presets mutex must be held)
+func (s *Server) savePresets() error {
+	if s.presetsFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.presets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so the presets file is never left half written
+	temp, err := os.CreateTemp(filepath.Dir(s.presetsFile), ".presets-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.presetsFile)
+}
+
+// Get an http.Handler that only serves the PTZ control API
+func (s *Server) PTZHandler() http.Handler {
+	return http.HandlerFunc(s.ServePTZ)
+}
+
+// ptzParams are the parameters of the PTZ control API that change the view or the presets
+var ptzParams = []string{"preset", "reset", "zoom", "pan", "tilt", "save", "delete"}
+
+// Serve the PTZ control API (?action=ptz), which responds with the current view and presets
+// after applying any of the following parameters (from either the query or a POST form), in order:
+//
+//	preset=NAME           recall a saved preset
+//	reset=1               show the whole frame
+//	zoom=, pan=, tilt=    change the view (see pipeline.View)
+//	save=NAME             save the resulting view as a preset
+//	delete=NAME           delete a saved preset
+//
+// Changes are only made by POST or DELETE requests, which have to present the admin token if there is one.
+func (s *Server) ServePTZ(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (hasAny(r, ptzParams...) || r.Method != http.MethodGet && r.Method != http.MethodHead) && !s.canChange(w, r) {
+		return
+	}
+
+	if name := r.Form.Get("preset"); name != "" {
+		if err := s.RecallPreset(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	base := s.View()
+	if reset, _ := strconv.ParseBool(r.Form.Get("reset")); reset {
+		base = pipeline.DefaultView
+	}
+	view, err := parseView(r.Form, base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if view != s.View() {
+		if err := s.SetView(view); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if name := r.Form.Get("save"); name != "" {
+		if err := s.SavePreset(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if name := r.Form.Get("delete"); name != "" {
+		if err := s.DeletePreset(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(ptzState{View: s.View(), Presets: s.Presets()})
+}
+
+// Parse the zoom, pan and tilt parameters, using the given view for any that are missing
+func parseView(values url.Values, base pipeline.View) (pipeline.View, error) {
+	view := base
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{
+		{"zoom", &view.Zoom},
+		{"pan", &view.Pan},
+		{"tilt", &view.Tilt},
+	} {
+		value := values.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return base, fmt.Errorf("invalid %s: %s", param.name, value)
+		}
+		*param.value = parsed
+	}
+	return view, view.Validate()
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// cornerMarker is a stage that draws a red square in the top left corner of every frame, like an overlay would
+type cornerMarker struct{}
+
+func (cornerMarker) Apply(img *image.RGBA, f *frame.Frame) (*image.RGBA, error) {
+	draw.Draw(img, image.Rect(0, 0, 16, 16).Add(img.Rect.Min), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	return img, nil
+}
+
+// Check if the top left corner of the frame shows the red square of the corner marker
+func hasCornerMarker(t *testing.T, data []byte) bool {
+	t.Helper()
+	img, err := imaging.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := img.At(img.Bounds().Min.X+4, img.Bounds().Min.Y+4).RGBA()
+	return r>>8 > 200 && g>>8 < 60 && b>>8 < 60
+}
+
+// Make a request to the PTZ control API, returning its state if it succeeded
+func requestPTZ(t *testing.T, s *Server, method string, query string, token string) (int, ptzState) {
+	t.Helper()
+	w := request(s, method, "/?action=ptz"+query, token)
+	var state ptzState
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, state
+}
+
+func TestPTZ(t *testing.T) {
+	presetsFile := filepath.Join(t.TempDir(), "presets.json")
+	s, err := New(newTestSource(), WithAddress(""), WithAdminToken("secret"), WithPresetsFile(presetsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	door := pipeline.View{Zoom: 2, Pan: 0.25, Tilt: 0.75}
+
+	for _, test := range []struct {
+		method string
+		query  string
+		token  string
+		status int
+		view   pipeline.View
+	}{
+		// Anyone can get the current view, but only admins can change it
+		{http.MethodGet, "", "", http.StatusOK, pipeline.DefaultView},
+		{http.MethodGet, "&zoom=2", "secret", http.StatusMethodNotAllowed, pipeline.View{}},
+		{http.MethodPut, "&zoom=2", "secret", http.StatusMethodNotAllowed, pipeline.View{}},
+		{http.MethodPost, "&zoom=2", "", http.StatusForbidden, pipeline.View{}},
+		{http.MethodPost, "&zoom=2", "wrong", http.StatusForbidden, pipeline.View{}},
+		{http.MethodPost, "&zoom=2&pan=0.25&tilt=0.75", "secret", http.StatusOK, door},
+
+		// Invalid views are rejected, leaving the view as it was
+		{http.MethodPost, "&zoom=0.5", "secret", http.StatusBadRequest, pipeline.View{}},
+		{http.MethodPost, "&pan=1.5", "secret", http.StatusBadRequest, pipeline.View{}},
+		{http.MethodGet, "", "", http.StatusOK, door},
+
+		// Presets are saved from the current view, and recalled before the other parameters are applied
+		{http.MethodPost, "&save=door", "secret", http.StatusOK, door},
+		{http.MethodPost, "&reset=1", "secret", http.StatusOK, pipeline.DefaultView},
+		{http.MethodPost, "&preset=door", "secret", http.StatusOK, door},
+		{http.MethodPost, "&preset=door&zoom=4", "secret", http.StatusOK, pipeline.View{Zoom: 4, Pan: 0.25, Tilt: 0.75}},
+		{http.MethodPost, "&preset=unknown", "secret", http.StatusNotFound, pipeline.View{}},
+		{http.MethodPost, "&reset=1&save=overview", "secret", http.StatusOK, pipeline.DefaultView},
+		{http.MethodPost, "&delete=overview", "secret", http.StatusOK, pipeline.DefaultView},
+		{http.MethodPost, "&delete=overview", "secret", http.StatusNotFound, pipeline.View{}},
+	} {
+		status, state := requestPTZ(t, s, test.method, test.query, test.token)
+		if status != test.status {
+			t.Errorf("%s %q: unexpected status %d, want %d", test.method, test.query, status, test.status)
+			continue
+		}
+		if status == http.StatusOK && state.View != test.view {
+			t.Errorf("%s %q: view is %+v, want %+v", test.method, test.query, state.View, test.view)
+		}
+	}
+
+	if _, state := requestPTZ(t, s, http.MethodGet, "", ""); len(state.Presets) != 1 || state.Presets["door"] != door {
+		t.Errorf("unexpected presets: %+v", state.Presets)
+	}
+
+	// The presets are saved to the presets file, and loaded from it by the next server
+	loaded, err := New(newTestSource(), WithAddress(""), WithPresetsFile(presetsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presets := loaded.Presets(); len(presets) != 1 || presets["door"] != door {
+		t.Errorf("unexpected presets loaded from the presets file: %+v", presets)
+	}
+}
+
+func TestZoomedVariantOverlays(t *testing.T) {
+	source := newTestSource()
+	s := runTestServer(t, source, WithStages(cornerMarker{}))
+	ts := serveTest(t, s)
+
+	// A blue frame with a white square in the bottom right corner
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(112, 80, 128, 96), image.NewUniform(color.White), image.Point{}, draw.Src)
+	source.publish(encodeFrame(t, img, 1))
+	waitForSequence(t, s, 1)
+
+	// Zooming into the bottom right corner still shows the overlay in the top left corner,
+	// at the same size as on the whole frame
+	const zoom = "&zoom=4&pan=1&tilt=1"
+	w := request(s, http.MethodGet, "/?action=snapshot"+zoom, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if !hasCornerMarker(t, w.Body.Bytes()) {
+		t.Error("zoomed snapshot doesn't show the overlay")
+	}
+	zoomed, err := imaging.Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := zoomed.At(96, 72).RGBA(); r>>8 < 200 || g>>8 < 200 || b>>8 < 200 {
+		t.Error("zoomed snapshot doesn't show the bottom right corner of the frame")
+	}
+	if r, _, b, _ := zoomed.At(24, 4).RGBA(); r>>8 > 100 || b>>8 < 200 {
+		t.Error("overlay was zoomed along with the frame")
+	}
+
+	// The same goes for zoomed streams (with a new image, so the frame isn't skipped as a duplicate)
+	parts := openStream(t, ts.URL+"/?action=stream"+zoom)
+	waitFor(t, "client to connect", func() bool { return s.Viewers() == 1 })
+	draw.Draw(img, image.Rect(0, 0, 16, 16), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	source.publish(encodeFrame(t, img, 2))
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get(frame.HeaderSequence) == strconv.Itoa(2) {
+			if !hasCornerMarker(t, data) {
+				t.Error("zoomed stream doesn't show the overlay")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is the period over which frame rates are measured
+const rateWindow = 2 * time.Second
+
+// rateMeter measures how often something happens over the last rateWindow
+type rateMeter struct {
+	mutex  sync.Mutex
+	events []time.Time
+}
+
+// Record an event that happened now
+func (m *rateMeter) record() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.events = append(m.prune(now), now)
+}
+
+// Get the number of events per second
+func (m *rateMeter) rate() float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.events = m.prune(time.Now())
+	return float64(len(m.events)) / rateWindow.Seconds()
+}
+
+// Drop the events that are older than the window (the mutex must be held)
+func (m *rateMeter) prune(now time.Time) []time.Time {
+	i := 0
+	for i < len(m.events) && now.Sub(m.events[i]) > rateWindow {
+		i++
+	}
+	if i == 0 {
+		return m.events
+	}
+	return append(m.events[:0], m.events[i:]...)
+}
@@ -0,0 +1,615 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/motion"
+	"didstopia/mjpeg-server/pipeline"
+	"didstopia/mjpeg-server/scheduler"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout is how long the built-in web server is given
+// to finish serving any pending requests when the server is stopped
+const shutdownTimeout = 5 * time.Second
+
+var (
+	ErrAlreadyRunning = errors.New("server is already running")
+	ErrNotRunning     = errors.New("server is not running")
+)
+
+// Server publishes the frames of a single Source as an MJPEG stream
+type Server struct {
+	name         string
+	address      string
+	frameRate    int
+	passthrough  bool
+	quality      int
+	maxVariants  int
+	workers      int
+	adminToken   string
+	keepalive    time.Duration
+	stalePolicy  StalePolicy
+	comment      bool
+	adaptive     *AdaptivePolicy
+	constantRate int
+
+	masks       []pipeline.Mask
+	orientation *pipeline.Orientation
+	crop        *pipeline.Crop
+	color       *pipeline.Color
+	motion      *motion.Detector
+	ptz         *pipeline.PTZ
+	letterbox   *pipeline.Letterbox
+	annotations *pipeline.Annotations
+	overlays    []pipeline.OverlayConfig
+	watermarks  []pipeline.WatermarkConfig
+	profiles    []Profile
+	stages      []pipeline.Stage
+
+	presetsFile  string
+	presetsMutex sync.Mutex
+	presets      map[string]pipeline.View
+
+	annotationsMutex sync.Mutex
+	annotationsTimer *time.Timer
+
+	source     Source
+	pipeline   *pipeline.Pipeline
+	allStages  []pipeline.Stage
+	masksStage pipeline.Stage
+	fixed      *pipeline.Pipeline
+	pool       *pipeline.Pool
+	stream     *stream
+	variants   *variants
+
+	sourceRate rateMeter
+	health     healthMonitor
+	staleness  *staleMonitor
+	badge      staleBadge
+
+	clientsMutex    sync.Mutex
+	adaptiveClients map[*adaptiveClient]struct{}
+	constantStats   constantRateStats
+
+	mutex         sync.RWMutex
+	current       *frame.Frame
+	currentSource *frame.Frame
+	generation    uint64
+	cancel        context.CancelFunc
+	done          chan struct{}
+}
+
+// Create a new Server that publishes the frames of the given source
+func New(source Source, options ...Option) (*Server, error) {
+	if source == nil {
+		return nil, errors.New("source is required")
+	}
+
+	s := &Server{
+		name:        "default",
+		address:     DefaultAddress,
+		frameRate:   DefaultFrameRate,
+		quality:     imaging.DefaultQuality,
+		maxVariants: DefaultMaxVariants,
+		keepalive:   DefaultKeepalive,
+		stalePolicy: DefaultStalePolicy(),
+		health:      healthMonitor{frozenThreshold: DefaultFrozenThreshold},
+		color:       pipeline.NewColor(),
+		ptz:         pipeline.NewPTZ(),
+		presets:     make(map[string]pipeline.View),
+		source:      source,
+		stream:      newStream(),
+
+		adaptiveClients: make(map[*adaptiveClient]struct{}),
+	}
+
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.loadPresets(); err != nil {
+		return nil, err
+	}
+
+	stages, masksStage, err := s.pipelineStages()
+	if err != nil {
+		return nil, err
+	}
+	s.pipeline = pipeline.New(s.quality, stages...)
+	s.allStages, s.masksStage = stages, masksStage
+	if s.workers > 1 {
+		s.pool = pipeline.NewPool(s.pipeline, s.workers)
+	}
+	s.variants = newVariants(s.maxVariants, s.quality)
+	s.variants.newPipeline = s.alternatePipeline
+	if s.comment {
+		s.variants.comment = s.commentFrame
+	}
+	for _, profile := range s.profiles {
+		s.variants.pin(profile.key())
+	}
+	s.staleness = newStaleMonitor(s.stalePolicy)
+	s.badge.quality = s.quality
+
+	// Frames that don't go through the pipeline (such as placeholders) still need to have the output size
+	if s.letterbox != nil {
+		s.fixed = pipeline.New(s.quality, s.letterbox)
+	}
+
+	return s, nil
+}
+
+// Create the stages of the frame pipeline, in the order they are applied,
+// along with the stage that applies the privacy masks (if there are any)
+func (s *Server) pipelineStages() ([]pipeline.Stage, pipeline.Stage, error) {
+	var stages []pipeline.Stage
+	var masksStage pipeline.Stage
+	if len(s.masks) > 0 {
+		masks, err := pipeline.NewMasks(s.masks...)
+		if err != nil {
+			return nil, nil, err
+		}
+		masksStage = masks
+		stages = append(stages, masks)
+	}
+	if s.orientation != nil && !s.orientation.IsIdentity() {
+		stages = append(stages, s.orientation)
+	}
+	if s.crop != nil {
+		stages = append(stages, s.crop)
+	}
+	stages = append(stages, s.color)
+	if s.motion != nil {
+		stages = append(stages, s.motion)
+	}
+	stages = append(stages, s.ptz)
+	if s.letterbox != nil {
+		stages = append(stages, s.letterbox)
+	}
+	if s.annotations != nil {
+		stages = append(stages, s.annotations)
+	}
+	for _, config := range s.overlays {
+		overlay, err := pipeline.NewOverlay(config, s.overlayFields())
+		if err != nil {
+			return nil, nil, err
+		}
+		stages = append(stages, overlay)
+	}
+	for _, config := range s.watermarks {
+		watermark, err := pipeline.NewWatermark(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		stages = append(stages, watermark)
+	}
+	return append(stages, s.stages...), masksStage, nil
+}
+
+// Get the custom fields that overlays can use
+func (s *Server) overlayFields() pipeline.Fields {
+	return pipeline.Fields{
+		"name":    s.Name,
+		"fps":     func() string { return strconv.FormatFloat(s.FPS(), 'f', 1, 64) },
+		"viewers": func() string { return strconv.Itoa(s.Viewers()) },
+	}
+}
+
+// Get the name of the stream
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Get the most recently published frame, or nil if no frame has been published yet
+func (s *Server) CurrentFrame() *frame.Frame {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.current
+}
+
+// Get the most recently published frame along with the source frame it was processed from,
+// where the source frame is nil if the published frame doesn't show the scene (such as a placeholder)
+func (s *Server) currentFrames() (*frame.Frame, *frame.Frame) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.current, s.currentSource
+}
+
+// Create the pipeline of an alternate version of the published frames, where unmasked frames
+// (only available to admins) go through every stage except the masks, clean frames through every stage
+// except the annotations, and zoomed frames are zoomed into their view right after the stream's own view
+// (so the annotations, overlays and watermarks are drawn on the zoomed frame)
+func (s *Server) alternatePipeline(alt alternate) *pipeline.Pipeline {
+	var stages []pipeline.Stage
+	for _, stage := range s.allStages {
+		if (alt.unmasked && stage == s.masksStage) || (alt.clean && stage == pipeline.Stage(s.annotations)) {
+			continue
+		}
+		stages = append(stages, stage)
+		if stage == pipeline.Stage(s.ptz) && !alt.view.IsIdentity() {
+			view := pipeline.NewPTZ()
+			if err := view.SetView(alt.view); err != nil {
+				log.Println("Failed to set view of", alt.String(), "frames:", err)
+			}
+			stages = append(stages, view)
+		}
+	}
+	return pipeline.New(s.quality, stages...)
+}
+
+// Discard the cached results of the frame pipelines, after a stage has changed at runtime
+func (s *Server) invalidate() {
+	s.mutex.Lock()
+	s.generation++
+	s.mutex.Unlock()
+	if s.pool != nil {
+		s.pool.Invalidate()
+	} else {
+		s.pipeline.Invalidate()
+	}
+	s.variants.invalidate()
+}
+
+// Get the number of times the frame pipelines were invalidated, which changes whenever a stage changed at runtime
+func (s *Server) pipelineGeneration() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.generation
+}
+
+// Scale a frame that didn't go through the pipeline to the output size, if there is one
+func (s *Server) fitOutput(f *frame.Frame) (*frame.Frame, error) {
+	if s.fixed == nil {
+		return f, nil
+	}
+	return s.fixed.Process(f)
+}
+
+// Insert a comment with the capture timestamp and the name of the stream into the frame,
+// publishing the frame as is if that fails
+func (s *Server) commentFrame(f *frame.Frame) *frame.Frame {
+	text := "stream=" + s.name
+	if !f.Timestamp.IsZero() {
+		text += "; timestamp=" + f.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	data, err := frame.InsertComment(f.Data, text)
+	if err == nil {
+		var commented *frame.Frame
+		if commented, err = pipeline.Derive(f, data); err == nil {
+			return commented
+		}
+	}
+	log.Println("Failed to insert frame comment:", err)
+	return f
+}
+
+// Get the number of clients currently connected to the stream, including its scaled variants
+func (s *Server) Viewers() int {
+	return s.stream.count() + s.variants.count()
+}
+
+// Get the rate at which new frames have been received from the source over the last few seconds
+func (s *Server) FPS() float64 {
+	return s.sourceRate.rate()
+}
+
+// Run the server until the context is done, Shutdown is called or the source fails.
+//
+// This runs the source, the capture loop and (unless the address is empty)
+// the built-in web server. A server can only be run once.
+func (s *Server) Run(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.done != nil {
+		s.mutex.Unlock()
+		return ErrAlreadyRunning
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	s.mutex.Unlock()
+	defer close(s.done)
+	defer s.cancel()
+
+	// Start the source
+	errs := make(chan error, 2)
+	go func() {
+		if err := s.source.Run(ctx); err != nil {
+			errs <- err
+		}
+	}()
+
+	// Start the capture loop
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.capture(ctx)
+	}()
+
+	// Start the workers that process the frames in parallel
+	if s.pool != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pool.Run(ctx)
+		}()
+	}
+
+	// Start delivering motion events
+	if s.motion != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.motion.Run(ctx)
+		}()
+	}
+
+	// Start the built-in web server
+	var httpServer *http.Server
+	if s.address != "" {
+		httpServer = &http.Server{Addr: s.address, Handler: s}
+		if s.adaptive != nil {
+			httpServer.ConnContext = limitSendBuffer
+		}
+		go func() {
+			log.Println("Starting web server on", s.address)
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	// Wait until we're told to stop, or something fails
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	// Shutdown the MJPEG stream first, as any active stream
+	// requests will only finish once the stream has been closed
+	log.Println("Shutting down MJPEG stream ...")
+	s.stream.close()
+	s.variants.close()
+
+	// Shutdown the web server
+	if httpServer != nil {
+		log.Println("Shutting down web server ...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		httpServer.Shutdown(shutdownCtx)
+		cancel()
+	}
+
+	// Stop the source and wait until the capture loop has finished
+	s.cancel()
+	wg.Wait()
+
+	return err
+}
+
+// Shutdown the server and wait until it has stopped, or the context is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.RLock()
+	cancel, done := s.cancel, s.done
+	s.mutex.RUnlock()
+	if done == nil {
+		return ErrNotRunning
+	}
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish frames from the source until the context is done
+func (s *Server) capture(ctx context.Context) {
+	// Create the frame scheduler, unless we're publishing frames at the source's pace
+	var frameScheduler *scheduler.Scheduler
+	if !s.passthrough {
+		var err error
+		frameScheduler, err = scheduler.NewScheduler(s.frameRate)
+		if err != nil {
+			log.Println("Failed to create frame scheduler:", err)
+			return
+		}
+		defer frameScheduler.Stop()
+	}
+
+	// Check the state of the stream regularly, even when the source isn't sending any frames
+	staleCheck := time.NewTicker(staleCheckInterval)
+	defer staleCheck.Stop()
+
+	// Process incoming frames until the context is done
+	var lastSourceFrame, lastPublished *frame.Frame
+	var lastPublishedAt time.Time
+	var held, heldSource, ingested *frame.Frame
+	var ingestedGeneration uint64
+	lastState := s.State()
+	var processed <-chan struct{}
+	if s.pool != nil {
+		processed = s.pool.Ready()
+	}
+
+	// Reuse the same keepalive timer between frames
+	var keepaliveTimer *time.Timer
+	defer func() {
+		if keepaliveTimer != nil {
+			keepaliveTimer.Stop()
+		}
+	}()
+capture:
+	for {
+		checked := false
+		if s.passthrough {
+			// Wait until the source has a complete frame available (or the worker pool has processed one),
+			// or until the last frame has to be resent as a keepalive
+			var keepalive <-chan time.Time
+			if s.keepalive > 0 && lastPublished != nil {
+				delay := s.keepalive - time.Since(lastPublishedAt)
+				if keepaliveTimer == nil {
+					keepaliveTimer = time.NewTimer(delay)
+				} else {
+					keepaliveTimer.Reset(delay)
+				}
+				keepalive = keepaliveTimer.C
+			}
+			select {
+			case <-ctx.Done():
+				break capture
+			case <-s.source.FrameReady():
+			case <-processed:
+			case <-keepalive:
+				keepalive = nil
+			case <-staleCheck.C:
+				checked = true
+			}
+
+			// Stop the keepalive timer unless it fired, so it can be reset for the next frame
+			if keepalive != nil && !keepaliveTimer.Stop() {
+				<-keepaliveTimer.C
+			}
+		} else if !frameScheduler.Wait(ctx) {
+			// Wait until the next frame slot, based on the desired frame rate
+			break
+		}
+
+		// Get the current frame from the source
+		sourceFrame := s.source.GetCurrentFrame()
+		if sourceFrame == nil || len(sourceFrame.Data) == 0 {
+			continue
+		}
+		live, fresh := false, sourceFrame != lastSourceFrame
+		if fresh {
+			lastSourceFrame = sourceFrame
+			if !sourceFrame.Placeholder {
+				live = true
+				s.sourceRate.record()
+				s.health.observe(sourceFrame)
+			}
+		}
+
+		// Update the state of the stream, disconnecting every client when it goes offline if needed
+		state, age := s.staleness.update(live, time.Now())
+		if state != lastState && state == StateOffline && s.stalePolicy.Action == StaleClose {
+			log.Println("Disconnecting every client of the offline stream")
+			s.stream.disconnect()
+			s.variants.disconnect()
+		}
+		changed := state != lastState
+		lastState = state
+
+		// When publishing at the source's pace, the regular state check only publishes a frame
+		// when the state of the stream changed (or to update the badge of a stale stream)
+		if checked && !fresh && !changed && state != StateStale {
+			continue
+		}
+
+		// Frames with the same content as the last one that was processed aren't processed again,
+		// unless a stage changed since (the result of the last one is published instead)
+		generation := s.pipelineGeneration()
+		unchanged := ingested != nil && generation == ingestedGeneration && isDuplicate(sourceFrame, ingested)
+
+		// Decide what to publish, based on the state of the stream
+		var currentFrame *frame.Frame
+		var err error
+		switch {
+		case state == StateLive && !sourceFrame.Placeholder && s.pool != nil:
+			// Hand the frame to the worker pool (where it's dropped if every worker is busy),
+			// and publish the most recent frame it has processed
+			if !unchanged && s.pool.Submit(sourceFrame) {
+				ingested, ingestedGeneration = sourceFrame, generation
+			}
+			if currentFrame, sourceFrame = s.pool.Latest(); currentFrame == nil {
+				continue
+			}
+			held, heldSource = currentFrame, sourceFrame
+		case state == StateLive && !sourceFrame.Placeholder && unchanged && held != nil:
+			// The source sent the same image again, so publish the result of processing it the last time
+			currentFrame, sourceFrame = held, heldSource
+		case state == StateLive && !sourceFrame.Placeholder:
+			// Process the frame through the pipeline (only once per source frame),
+			// holding on to the last good frame if it fails
+			if currentFrame, err = s.pipeline.Process(sourceFrame); err == nil {
+				held, heldSource = currentFrame, sourceFrame
+				ingested, ingestedGeneration = sourceFrame, generation
+			}
+		case state == StateOffline && s.stalePolicy.Action == StaleClose:
+			// Nothing is published until the source is back
+			continue
+		case state == StateOffline && s.stalePolicy.Action == StalePlaceholder && sourceFrame.Placeholder:
+			// Show the placeholder of the source without processing it, as it's not part of the scene
+			currentFrame, err = s.fitOutput(sourceFrame)
+			sourceFrame = nil
+		case held != nil && state == StateLive:
+			// The source already shows its placeholder, but the stream isn't stale yet
+			currentFrame, sourceFrame = held, heldSource
+		case held != nil:
+			// Hold the last frame, with a badge telling how long ago it was received
+			currentFrame, err = s.badge.render(held, age)
+			sourceFrame = nil
+		case sourceFrame.Placeholder:
+			// The source hasn't sent any frames yet
+			currentFrame, err = s.fitOutput(sourceFrame)
+			sourceFrame = nil
+		default:
+			// None of the frames of the source made it through the pipeline,
+			// and they can't be published without it (as that would skip the privacy masks)
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to process frame, skipping frame:", err)
+			continue
+		}
+
+		// Skip publishing frames that are the same as the last one,
+		// unless it's time to resend it so clients don't time out
+		if s.keepalive > 0 && isDuplicate(currentFrame, lastPublished) {
+			keepalive := time.Since(lastPublishedAt) >= s.keepalive
+			s.health.duplicate(keepalive)
+			if !keepalive {
+				continue
+			}
+		}
+		lastPublished, lastPublishedAt = currentFrame, time.Now()
+		if s.comment {
+			currentFrame = s.commentFrame(currentFrame)
+		}
+
+		// Update the MJPEG stream
+		s.mutex.Lock()
+		s.current = currentFrame
+		s.currentSource = sourceFrame
+		s.mutex.Unlock()
+
+		err = s.stream.update(currentFrame)
+		if err != nil {
+			if err == ErrStreamClosed {
+				log.Println("Stream closed, aborting capture")
+				break
+			}
+			log.Println("Failed to update MJPEG stream:", err)
+			break
+		}
+
+		// Update the scaled variants of the MJPEG stream
+		s.variants.publish(currentFrame, sourceFrame)
+	}
+
+	if frameScheduler != nil && frameScheduler.Skipped > 0 {
+		log.Println("Frame scheduler fell behind and skipped", frameScheduler.Skipped, "frames")
+	}
+
+	log.Println("Capture finished")
+}
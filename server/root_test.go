@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"image"
+	"image/color"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long a test waits for something to happen before it fails
+const testTimeout = 5 * time.Second
+
+// testSource is a Source whose frames are published by the test
+type testSource struct {
+	mutex sync.Mutex
+	frame *frame.Frame
+	ready chan struct{}
+}
+
+func newTestSource() *testSource {
+	return &testSource{ready: make(chan struct{}, 1)}
+}
+
+func (s *testSource) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (s *testSource) GetCurrentFrame() *frame.Frame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.frame
+}
+
+func (s *testSource) FrameReady() <-chan struct{} {
+	return s.ready
+}
+
+// Publish the given frame as the current frame of the source
+func (s *testSource) publish(f *frame.Frame) {
+	s.mutex.Lock()
+	s.frame = f
+	s.mutex.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Draw a test image of the given size, whose content is different for every seed
+func testImage(width, height int, seed uint64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x*4 + int(seed)*37), uint8(y * 4), uint8(seed * 91), 255})
+		}
+	}
+	return img
+}
+
+// Encode a test frame of the given size with the given sequence number,
+// whose content is different for every sequence number
+func testFrame(tb testing.TB, width, height int, sequence uint64) *frame.Frame {
+	tb.Helper()
+	return encodeFrame(tb, testImage(width, height, sequence), sequence)
+}
+
+// Encode the image as a frame with the given sequence number
+func encodeFrame(tb testing.TB, img image.Image, sequence uint64) *frame.Frame {
+	tb.Helper()
+	data, err := imaging.Encode(img, imaging.DefaultQuality)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f, err := frame.New(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f.Sequence = sequence
+	f.Timestamp = time.Unix(1700000000, int64(sequence)*1000)
+	return f
+}
+
+// Create a server for the source that publishes frames at the source's pace without a web server,
+// and run it until the test ends
+func runTestServer(t *testing.T, source Source, options ...Option) *Server {
+	t.Helper()
+	options = append([]Option{WithAddress(""), WithPassthrough(true)}, options...)
+	s, err := New(source, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s
+}
+
+// Serve the server's handler with httptest until the test ends
+func serveTest(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// Wait until the condition is true
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Wait until the server has published the frame with the given sequence number
+func waitForSequence(t *testing.T, s *Server, sequence uint64) *frame.Frame {
+	t.Helper()
+	var f *frame.Frame
+	waitFor(t, "frame to be published", func() bool {
+		f = s.CurrentFrame()
+		return f != nil && f.Sequence == sequence
+	})
+	return f
+}
+
+// Make a request to the server's handler, returning the recorded response
+func request(s *Server, method string, target string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Open the MJPEG stream at the given URL, returning a reader for its parts that is closed when the test ends
+func openStream(t *testing.T, url string) *multipart.Reader {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return multipart.NewReader(resp.Body, params["boundary"])
+}
+
+func TestKeepalive(t *testing.T) {
+	const keepalive = 100 * time.Millisecond
+	source := newTestSource()
+	s := runTestServer(t, source, WithKeepalive(keepalive))
+	ts := serveTest(t, s)
+
+	first := testFrame(t, 64, 48, 1)
+	source.publish(first)
+	waitForSequence(t, s, 1)
+	parts := openStream(t, ts.URL+"/?action=stream")
+
+	// The source keeps sending the same image, much more often than the keepalive
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(keepalive / 10)
+		defer ticker.Stop()
+		for sequence := uint64(2); ; sequence++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				duplicate := *first
+				duplicate.Sequence = sequence
+				source.publish(&duplicate)
+			}
+		}
+	}()
+
+	// Only the first frame is published, and resent once per keepalive interval
+	var last time.Time
+	for i := 0; i < 5; i++ {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		if sequence := part.Header.Get(frame.HeaderSequence); sequence != "1" {
+			t.Fatalf("published duplicate frame %s", sequence)
+		}
+		if i > 1 && now.Sub(last) < keepalive*8/10 {
+			t.Errorf("keepalive was resent after %v, before the keepalive of %v", now.Sub(last), keepalive)
+		}
+		last = now
+	}
+	health := s.Health()
+	if health.Keepalives < 3 || health.Duplicates < 10 {
+		t.Errorf("recorded %d keepalives and %d duplicates", health.Keepalives, health.Duplicates)
+	}
+
+	// The keepalive is still resent once the source stops sending frames
+	cancel()
+	keepalives := health.Keepalives
+	waitFor(t, "keepalive without frames from the source", func() bool {
+		return s.Health().Keepalives >= keepalives+2
+	})
+
+	// New frames are published right away
+	source.publish(testFrame(t, 64, 48, 100))
+	waitForSequence(t, s, 100)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/frame"
+)
+
+// Source provides the frames that a Server publishes
+// (see udpserver.UDPServer for the built-in implementation)
+type Source interface {
+	// Run the source until the context is done
+	Run(ctx context.Context) error
+
+	// Get the most recent frame, or nil if there is no frame available yet
+	GetCurrentFrame() *frame.Frame
+
+	// Get a channel that receives a notification whenever a new frame is available
+	FrameReady() <-chan struct{}
+}
+
+// ValidatingSource is a Source that rejects invalid frames,
+// whose rejections are reported as part of the health of the stream
+type ValidatingSource interface {
+	Source
+
+	// Get the number of frames that were rejected so far, by the reason they were rejected for
+	Rejections() map[string]uint64
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStaleAfter is how long the source can go without sending a frame
+	// before the stream is considered stale when none is given
+	DefaultStaleAfter = 5 * time.Second
+
+	// DefaultStaleHold is how long the last frame is held while the stream is stale when none is given
+	DefaultStaleHold = 30 * time.Second
+
+	// staleCheckInterval is how often the state of the stream is checked when no frames arrive,
+	// which is also how often the stale badge is updated
+	staleCheckInterval = time.Second
+
+	// maxTransitions is the number of state transitions that are kept
+	maxTransitions = 20
+)
+
+var (
+	ErrInvalidStaleAction = errors.New("invalid stale action")
+	ErrStreamOffline      = errors.New("stream is offline, the source isn't sending any frames")
+)
+
+// StaleAction is what happens once a stale stream has held its last frame for long enough
+type StaleAction int
+
+const (
+	// StalePlaceholder shows the placeholder frames of the source
+	// (or keeps holding the last frame, if the source has no placeholder)
+	StalePlaceholder StaleAction = iota
+
+	// StaleClose disconnects every stream client, and refuses streams and snapshots until the source is back
+	StaleClose
+
+	// StaleUnavailable keeps holding the last frame on the stream, but refuses snapshots until the source is back
+	StaleUnavailable
+)
+
+var staleActionNames = [...]string{"placeholder", "close", "unavailable"}
+
+// Get the name of the stale action
+func (a StaleAction) String() string {
+	if a < 0 || int(a) >= len(staleActionNames) {
+		return fmt.Sprintf("StaleAction(%d)", int(a))
+	}
+	return staleActionNames[a]
+}
+
+// Parse a stale action from its name
+func ParseStaleAction(name string) (StaleAction, error) {
+	name = strings.ToLower(name)
+	for i, actionName := range staleActionNames {
+		if name == actionName {
+			return StaleAction(i), nil
+		}
+	}
+	return StalePlaceholder, fmt.Errorf("%w: %s", ErrInvalidStaleAction, name)
+}
+
+// StalePolicy decides what a stream shows when its source stops sending frames
+type StalePolicy struct {
+	// After is how long the source can go without sending a frame before the stream is stale
+	After time.Duration
+
+	// Hold is how long the last frame is held (with a stale badge) before the stream goes offline,
+	// where zero goes offline as soon as the stream is stale
+	Hold time.Duration
+
+	// Action is what happens once the stream is offline
+	Action StaleAction
+}
+
+// Get the default stale policy, which holds the last frame for a while and then shows the placeholder
+func DefaultStalePolicy() StalePolicy {
+	return StalePolicy{
+		After:  DefaultStaleAfter,
+		Hold:   DefaultStaleHold,
+		Action: StalePlaceholder,
+	}
+}
+
+// Validate the stale policy
+func (p StalePolicy) Validate() error {
+	if p.After <= 0 {
+		return fmt.Errorf("invalid stale timeout: %s", p.After)
+	}
+	if p.Hold < 0 {
+		return fmt.Errorf("invalid stale hold duration: %s", p.Hold)
+	}
+	if p.Action < 0 || int(p.Action) >= len(staleActionNames) {
+		return fmt.Errorf("%w: %s", ErrInvalidStaleAction, p.Action)
+	}
+	return nil
+}
+
+// StreamState is whether the source of a stream is sending frames
+type StreamState int
+
+const (
+	// StateLive means the source is sending frames
+	StateLive StreamState = iota
+
+	// StateStale means the source stopped sending frames, and the last frame is being held
+	StateStale
+
+	// StateOffline means the source stopped sending frames for longer than the hold duration,
+	// or hasn't sent any frames yet
+	StateOffline
+)
+
+var streamStateNames = [...]string{"live", "stale", "offline"}
+
+// Get the name of the stream state
+func (st StreamState) String() string {
+	if st < 0 || int(st) >= len(streamStateNames) {
+		return fmt.Sprintf("StreamState(%d)", int(st))
+	}
+	return streamStateNames[st]
+}
+
+// Encode the stream state as its name
+func (st StreamState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// Transition is a change of the state of a stream
+type Transition struct {
+	From StreamState `json:"from"`
+	To   StreamState `json:"to"`
+	Time time.Time   `json:"time"`
+}
+
+// staleMonitor keeps track of the state of a stream, based on when its source last sent a frame
+type staleMonitor struct {
+	policy StalePolicy
+
+	mutex       sync.Mutex
+	state       StreamState
+	since       time.Time
+	lastLive    time.Time
+	transitions []Transition
+}
+
+// Create a new staleMonitor, which starts offline until the first frame arrives
+func newStaleMonitor(policy StalePolicy) *staleMonitor {
+	return &staleMonitor{policy: policy, state: StateOffline, since: time.Now()}
+}
+
+// Update the state of the stream, given whether the source has sent a new frame,
+// and return the state along with how long ago the source last sent a frame
+func (m *staleMonitor) update(live bool, now time.Time) (StreamState, time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if live {
+		m.lastLive = now
+	}
+
+	state := StateOffline
+	age := now.Sub(m.lastLive)
+	if !m.lastLive.IsZero() {
+		if age < m.policy.After {
+			state = StateLive
+		} else if age < m.policy.After+m.policy.Hold {
+			state = StateStale
+		}
+	}
+
+	if state != m.state {
+		if m.lastLive.IsZero() {
+			log.Println("Stream is now", state)
+		} else {
+			log.Println("Stream is now", state.String()+",", "last frame was received", age.Truncate(time.Second), "ago")
+		}
+		m.transitions = append(m.transitions, Transition{From: m.state, To: state, Time: now})
+		if len(m.transitions) > maxTransitions {
+			m.transitions = m.transitions[len(m.transitions)-maxTransitions:]
+		}
+		m.state, m.since = state, now
+	}
+	return state, age
+}
+
+// Check if the stream is offline with the given action
+func (m *staleMonitor) offline(action StaleAction) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state == StateOffline && m.policy.Action == action
+}
+
+// Add the state of the stream to its health
+func (m *staleMonitor) report(health *Health) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	health.State = m.state
+	since := m.since
+	health.StateSince = &since
+	if !m.lastLive.IsZero() {
+		lastFrame := m.lastLive
+		health.LastFrame = &lastFrame
+	}
+	health.Transitions = make([]Transition, len(m.transitions))
+	copy(health.Transitions, m.transitions)
+}
+
+// staleBadge draws a badge on the held frame of a stale stream, telling how long ago it was received
+type staleBadge struct {
+	quality int
+
+	source *frame.Frame
+	text   string
+	output *frame.Frame
+}
+
+// Get the frame with a badge for the given age, which is only rendered again when its text changes
+func (b *staleBadge) render(f *frame.Frame, age time.Duration) (*frame.Frame, error) {
+	text := "STALE " + age.Truncate(time.Second).String()
+	if b.source == f && b.text == text {
+		return b.output, nil
+	}
+
+	decoded, err := imaging.Decode(f.Data)
+	if err != nil {
+		return nil, err
+	}
+	img := imaging.ToRGBA(decoded)
+
+	scale := imaging.FontScale(img.Bounds().Dy() / 20)
+	padding := 2 * scale
+	width, height := imaging.TextSize(text, scale)
+	box := imaging.TopRight.Place(img.Bounds(), width+2*padding, height+2*padding, 2*padding)
+	imaging.FillRect(img, box, color.RGBA{R: 200, A: 200})
+	imaging.DrawText(img, box.Min.Add(image.Pt(padding, padding)), text, scale, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+	data, err := imaging.Encode(img, b.quality)
+	if err != nil {
+		return nil, err
+	}
+	output, err := pipeline.Derive(f, data)
+	if err != nil {
+		return nil, err
+	}
+	b.source, b.text, b.output = f, text, output
+	return output, nil
+}
+
+// Get the state of the stream
+func (s *Server) State() StreamState {
+	s.staleness.mutex.Lock()
+	defer s.staleness.mutex.Unlock()
+	return s.staleness.state
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"didstopia/mjpeg-server/imaging"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleMonitor(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	at := func(offset time.Duration) time.Time { return start.Add(offset) }
+
+	// A step updates the monitor at the offset from the start, expecting the state and the age of the last frame
+	type staleStep struct {
+		offset time.Duration
+		live   bool
+		state  StreamState
+		age    time.Duration
+	}
+
+	for _, test := range []struct {
+		name        string
+		policy      StalePolicy
+		steps       []staleStep
+		transitions []Transition
+	}{
+		{
+			name:   "hold",
+			policy: StalePolicy{After: 5 * time.Second, Hold: 30 * time.Second},
+			steps: []staleStep{
+				// Offline until the first frame arrives
+				{0, false, StateOffline, 0},
+				{time.Second, true, StateLive, 0},
+				{5999 * time.Millisecond, false, StateLive, 4999 * time.Millisecond},
+				{6 * time.Second, false, StateStale, 5 * time.Second},
+				{35999 * time.Millisecond, false, StateStale, 34999 * time.Millisecond},
+				{36 * time.Second, false, StateOffline, 35 * time.Second},
+				{time.Hour, false, StateOffline, time.Hour - time.Second},
+				{time.Hour + time.Second, true, StateLive, 0},
+
+				// Every new frame starts the timeout over
+				{time.Hour + 5*time.Second, true, StateLive, 0},
+				{time.Hour + 9*time.Second, false, StateLive, 4 * time.Second},
+				{time.Hour + 10*time.Second, false, StateStale, 5 * time.Second},
+				{time.Hour + 11*time.Second, true, StateLive, 0},
+			},
+			transitions: []Transition{
+				{StateOffline, StateLive, at(time.Second)},
+				{StateLive, StateStale, at(6 * time.Second)},
+				{StateStale, StateOffline, at(36 * time.Second)},
+				{StateOffline, StateLive, at(time.Hour + time.Second)},
+				{StateLive, StateStale, at(time.Hour + 10*time.Second)},
+				{StateStale, StateLive, at(time.Hour + 11*time.Second)},
+			},
+		},
+		{
+			name:   "no hold",
+			policy: StalePolicy{After: 5 * time.Second},
+			steps: []staleStep{
+				{0, true, StateLive, 0},
+				{4 * time.Second, false, StateLive, 4 * time.Second},
+				{5 * time.Second, false, StateOffline, 5 * time.Second},
+				{6 * time.Second, true, StateLive, 0},
+			},
+			transitions: []Transition{
+				{StateOffline, StateLive, at(0)},
+				{StateLive, StateOffline, at(5 * time.Second)},
+				{StateOffline, StateLive, at(6 * time.Second)},
+			},
+		},
+	} {
+		m := newStaleMonitor(test.policy)
+		for _, step := range test.steps {
+			state, age := m.update(step.live, at(step.offset))
+			if state != step.state || (!m.lastLive.IsZero() && age != step.age) {
+				t.Errorf("%s: at %v (live: %t) got %s after %v, want %s after %v", test.name, step.offset, step.live, state, age, step.state, step.age)
+			}
+		}
+
+		var health Health
+		m.report(&health)
+		if len(health.Transitions) != len(test.transitions) {
+			t.Errorf("%s: got transitions %v, want %v", test.name, health.Transitions, test.transitions)
+			continue
+		}
+		for i, transition := range health.Transitions {
+			if transition.From != test.transitions[i].From || transition.To != test.transitions[i].To || !transition.Time.Equal(test.transitions[i].Time) {
+				t.Errorf("%s: transition %d is %+v, want %+v", test.name, i, transition, test.transitions[i])
+			}
+		}
+	}
+
+	// Only the most recent transitions are kept
+	m := newStaleMonitor(StalePolicy{After: time.Second})
+	for i := 0; i < maxTransitions; i++ {
+		m.update(true, at(time.Duration(2*i)*time.Second))
+		m.update(false, at(time.Duration(2*i+1)*time.Second))
+	}
+	var health Health
+	m.report(&health)
+	if len(health.Transitions) != maxTransitions || !health.Transitions[maxTransitions-1].Time.Equal(at(time.Duration(2*maxTransitions-1)*time.Second)) {
+		t.Errorf("kept %d transitions, the last one at %v", len(health.Transitions), health.Transitions[len(health.Transitions)-1].Time)
+	}
+}
+
+func TestStalePlaceholder(t *testing.T) {
+	source := newTestSource()
+	policy := StalePolicy{After: 100 * time.Millisecond, Hold: 200 * time.Millisecond, Action: StalePlaceholder}
+	s := runTestServer(t, source, WithStalePolicy(policy))
+
+	// The source keeps sending its placeholder whenever it has no frames, which wakes the capture loop
+	placeholder := testFrame(t, 64, 48, 0)
+	placeholder.Placeholder = true
+	source.publish(placeholder)
+	waitFor(t, "placeholder to be published", func() bool {
+		f := s.CurrentFrame()
+		return f != nil && f.Placeholder
+	})
+	if state := s.State(); state != StateOffline {
+		t.Errorf("stream is %s before the first frame, want offline", state)
+	}
+
+	live := testFrame(t, 64, 48, 1)
+	lost := time.Now()
+	source.publish(live)
+	waitForSequence(t, s, 1)
+	if state := s.State(); state != StateLive {
+		t.Errorf("stream is %s after a frame, want live", state)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p := *placeholder
+				source.publish(&p)
+			}
+		}
+	}()
+
+	// The last frame is held with a badge while the stream is stale
+	waitFor(t, "stream to go stale", func() bool { return s.State() == StateStale })
+	if elapsed := time.Since(lost); elapsed < policy.After {
+		t.Errorf("stream went stale after %v, before %v", elapsed, policy.After)
+	}
+	waitFor(t, "stale badge to be published", func() bool {
+		f := s.CurrentFrame()
+		return f != nil && !f.Placeholder && f.Hash != live.Hash
+	})
+	held := s.CurrentFrame()
+	if held.Sequence != live.Sequence {
+		t.Errorf("stale stream holds frame %d, want %d", held.Sequence, live.Sequence)
+	}
+	img, err := imaging.Decode(held.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(img.Bounds().Max.X-6, 6).RGBA(); r>>8 < 150 || g>>8 > 100 || b>>8 > 100 {
+		t.Error("held frame has no stale badge")
+	}
+
+	// Once the hold is over, the placeholder of the source is published
+	waitFor(t, "stream to go offline", func() bool { return s.State() == StateOffline })
+	if elapsed := time.Since(lost); elapsed < policy.After+policy.Hold {
+		t.Errorf("stream went offline after %v, before %v", elapsed, policy.After+policy.Hold)
+	}
+	waitFor(t, "placeholder to be published", func() bool {
+		f := s.CurrentFrame()
+		return f != nil && f.Placeholder
+	})
+	if w := request(s, http.MethodGet, "/?action=snapshot", ""); w.Code != http.StatusOK {
+		t.Errorf("snapshot of the offline stream failed with %d", w.Code)
+	}
+
+	// The stream is live again as soon as the source sends a frame
+	cancel()
+	<-done
+	source.publish(testFrame(t, 64, 48, 2))
+	waitForSequence(t, s, 2)
+	if state := s.State(); state != StateLive {
+		t.Errorf("stream is %s after the source is back, want live", state)
+	}
+
+	var want []StreamState
+	for _, transition := range s.Health().Transitions {
+		want = append(want, transition.To)
+	}
+	if len(want) != 4 || want[0] != StateLive || want[1] != StateStale || want[2] != StateOffline || want[3] != StateLive {
+		t.Errorf("unexpected transitions to %v", want)
+	}
+}
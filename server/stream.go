@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"didstopia/mjpeg-server/frame"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"sync"
+)
+
+var ErrStreamClosed = errors.New("stream was closed")
+
+// stream fans out published frames to every connected client
+type stream struct {
+	mutex   sync.Mutex
+	clients map[chan *frame.Frame]struct{}
+	last    *frame.Frame
+	closed  bool
+}
+
+// Create a new stream
+func newStream() *stream {
+	return &stream{clients: make(map[chan *frame.Frame]struct{})}
+}
+
+// Publish a frame to every connected client, dropping it for any
+// client that is still busy writing the previous frame
+func (st *stream) update(f *frame.Frame) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.closed {
+		return ErrStreamClosed
+	}
+	st.last = f
+	for c := range st.clients {
+		select {
+		case c <- f:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close the stream, disconnecting every client
+func (st *stream) close() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.closed {
+		return
+	}
+	for c := range st.clients {
+		close(c)
+		delete(st.clients, c)
+	}
+	st.closed = true
+}
+
+// Disconnect every client, without closing the stream
+func (st *stream) disconnect() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for c := range st.clients {
+		close(c)
+		delete(st.clients, c)
+	}
+	st.last = nil
+}
+
+// Subscribe a new client, returning nil if the stream was closed.
+//
+// The client starts with the last published frame, as duplicate frames
+// aren't published again until the next keepalive.
+func (st *stream) subscribe() chan *frame.Frame {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.closed {
+		return nil
+	}
+	c := make(chan *frame.Frame, 1)
+	if st.last != nil {
+		c <- st.last
+	}
+	st.clients[c] = struct{}{}
+	return c
+}
+
+// Unsubscribe a client
+func (st *stream) unsubscribe(c chan *frame.Frame) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, ok := st.clients[c]; ok {
+		close(c)
+		delete(st.clients, c)
+	}
+}
+
+// Get the number of connected clients
+func (st *stream) count() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return len(st.clients)
+}
+
+// Write every published frame to the client as a multipart stream,
+// until either the client disconnects or the stream is closed
+func (st *stream) serve(w http.ResponseWriter, r *http.Request, name string) {
+	c := st.subscribe()
+	if c == nil {
+		http.Error(w, ErrStreamClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer st.unsubscribe(c)
+
+	parts, err := newPartWriter(w)
+	if err != nil {
+		return
+	}
+
+	for {
+		var f *frame.Frame
+		var ok bool
+		select {
+		case <-r.Context().Done():
+			return
+		case f, ok = <-c:
+			if !ok {
+				return
+			}
+		}
+		if err := parts.write(f, name); err != nil {
+			return
+		}
+	}
+}
+
+// partWriter writes frames to a client as a multipart stream
+type partWriter struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	boundary string
+}
+
+// Create a new partWriter, writing the response headers and the first boundary
+func newPartWriter(w http.ResponseWriter) (*partWriter, error) {
+	// NOTE: The boundary is written right after every frame (like mjpg-streamer does),
+	//       instead of before the next one (like multipart.Writer does),
+	//       so clients don't have to wait for the next frame to finish reading the current one.
+	p := &partWriter{w: w, boundary: multipart.NewWriter(nil).Boundary()}
+	p.flusher, _ = w.(http.Flusher)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+p.boundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "close")
+	if _, err := fmt.Fprintf(w, "--%s\r\n", p.boundary); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write the part headers, the frame itself and the boundary, and flush them to the client
+func (p *partWriter) write(f *frame.Frame, name string) error {
+	header := textproto.MIMEHeader{}
+	f.SetHeaders(header, name)
+	if err := writePart(p.w, header, f.Data, p.boundary); err != nil {
+		return err
+	}
+	if p.flusher != nil {
+		p.flusher.Flush()
+	}
+	return nil
+}
+
+// Write a single multipart part, followed by the boundary
+func writePart(w io.Writer, header textproto.MIMEHeader, data []byte, boundary string) error {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+		}
+	}
+	b.WriteString("\r\n")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\r\n--%s\r\n", boundary)
+	return err
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxVariants is the maximum number of live variants when none is given
+const DefaultMaxVariants = 8
+
+var ErrTooManyVariants = errors.New("too many variants in use, try again later")
+
+// variantKey identifies a variant by the parameters it was requested with
+type variantKey struct {
+	width  int
+	height int
+	scale  float64
+	filter imaging.Filter
+	view   pipeline.View
+
+	// The JPEG quality of the variant, or zero to use the quality of the stream (only set by profiles)
+	quality int
+
+	// Whether the frames skip the privacy masks (only ever set for admins, see parseVariantKey)
+	unmasked bool
+
+	// Whether the frames skip the annotations
+	clean bool
+}
+
+// alternate selects a version of the published frames that skips some of the stages,
+// or zooms into a view before the annotations, overlays and watermarks are drawn
+type alternate struct {
+	unmasked bool
+	clean    bool
+	view     pipeline.View
+}
+
+// Describe the alternate version for logging
+func (a alternate) String() string {
+	var description []string
+	if a.unmasked {
+		description = append(description, "unmasked")
+	}
+	if a.clean {
+		description = append(description, "clean")
+	}
+	if !a.view.IsIdentity() {
+		description = append(description, fmt.Sprintf("zoom=%g pan=%g tilt=%g", a.view.Zoom, a.view.Pan, a.view.Tilt))
+	}
+	if len(description) == 0 {
+		return "published"
+	}
+	return strings.Join(description, " ")
+}
+
+// Get the version of the published frames that the variant is rendered from
+func (k variantKey) alternate() alternate {
+	alt := alternate{unmasked: k.unmasked, clean: k.clean}
+	if !k.view.IsIdentity() {
+		alt.view = k.view
+	}
+	return alt
+}
+
+// Parse the variant parameters (?width=, ?height=, ?scale=, ?filter=, either ?preset=
+// or ?zoom=, ?pan= and ?tilt=, ?unmasked= and ?clean=) from the request's query,
+// returning false if the original frames were requested.
+//
+// A profile (?profile=) selects one of the stream's renditions instead,
+// and can't be combined with any of the other parameters.
+//
+// The zoom, pan and tilt parameters are applied on top of the stream's own view,
+// and scale the viewed area back up to the size of the frame (before any other scaling).
+// Like the stream's own view, they zoom into the frame before the annotations, overlays and watermarks
+// are drawn, so those stay the same size and in the same place (except on placeholder and stale frames,
+// which don't show the scene and are zoomed into as they are).
+//
+// Unmasked frames are only ever returned to requests that present the admin token
+// (every other request gets the masked frames as if it hadn't asked for unmasked ones),
+// and are the same as the original frames when the stream has no masks.
+// Clean frames don't show the annotations, and are the same as the original frames
+// when the stream doesn't support annotations.
+func (s *Server) parseVariantKey(r *http.Request) (variantKey, bool, error) {
+	var key variantKey
+	var err error
+	query := r.URL.Query()
+
+	if name := query.Get("profile"); name != "" {
+		profile, ok := s.Profile(name)
+		if !ok {
+			return key, false, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+		}
+		for _, param := range []string{"width", "height", "scale", "filter", "preset", "zoom", "pan", "tilt", "unmasked", "clean"} {
+			if query.Has(param) {
+				return key, false, fmt.Errorf("profile can't be combined with %s", param)
+			}
+		}
+		return profile.key(), true, nil
+	}
+
+	parseSize := func(name string) (int, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, nil
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("invalid %s: %s", name, value)
+		}
+		return size, nil
+	}
+	if key.width, err = parseSize("width"); err != nil {
+		return key, false, err
+	}
+	if key.height, err = parseSize("height"); err != nil {
+		return key, false, err
+	}
+	if value := query.Get("scale"); value != "" {
+		key.scale, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(key.scale > 0 && key.scale <= 1) {
+			return key, false, fmt.Errorf("invalid scale (must be above 0 and at most 1): %s", value)
+		}
+		if key.width > 0 || key.height > 0 {
+			return key, false, errors.New("scale can't be combined with width or height")
+		}
+	}
+	if key.filter, err = imaging.ParseFilter(query.Get("filter")); err != nil {
+		return key, false, err
+	}
+	key.view = pipeline.DefaultView
+	if name := query.Get("preset"); name != "" {
+		view, ok := s.Preset(name)
+		if !ok {
+			return key, false, fmt.Errorf("%w: %s", ErrUnknownPreset, name)
+		}
+		key.view = view
+	}
+	if key.view, err = parseView(query, key.view); err != nil {
+		return key, false, err
+	}
+	if key.view.IsIdentity() {
+		key.view = pipeline.DefaultView
+	}
+
+	if value := query.Get("unmasked"); value != "" {
+		unmasked, err := strconv.ParseBool(value)
+		if err != nil {
+			return key, false, fmt.Errorf("invalid unmasked: %s", value)
+		}
+		key.unmasked = unmasked && len(s.masks) > 0 && s.isAdmin(r)
+	}
+	if value := query.Get("clean"); value != "" {
+		clean, err := strconv.ParseBool(value)
+		if err != nil {
+			return key, false, fmt.Errorf("invalid clean: %s", value)
+		}
+		key.clean = clean && s.annotations != nil
+	}
+
+	if key.width == 0 && key.height == 0 && (key.scale == 0 || key.scale == 1) && key.view.IsIdentity() && !key.unmasked && !key.clean {
+		return key, false, nil
+	}
+	return key, true, nil
+}
+
+// Calculate the output size of the variant for the given source size,
+// preserving the aspect ratio and never upscaling
+func (k variantKey) size(srcWidth, srcHeight int) (int, int) {
+	if k.scale > 0 {
+		return imaging.FitSize(srcWidth, srcHeight, int(float64(srcWidth)*k.scale+0.5), 0)
+	}
+	width, height := imaging.FitSize(srcWidth, srcHeight, k.width, k.height)
+	if width > srcWidth || height > srcHeight {
+		return srcWidth, srcHeight
+	}
+	return width, height
+}
+
+// Describe the variant parameters for logging
+func (k variantKey) describe() string {
+	description := fmt.Sprintf("width=%d height=%d filter=%s", k.width, k.height, k.filter)
+	if k.scale > 0 {
+		description = fmt.Sprintf("scale=%g filter=%s", k.scale, k.filter)
+	}
+	if !k.view.IsIdentity() {
+		description += fmt.Sprintf(" zoom=%g pan=%g tilt=%g", k.view.Zoom, k.view.Pan, k.view.Tilt)
+	}
+	if k.unmasked {
+		description += " unmasked"
+	}
+	if k.clean {
+		description += " clean"
+	}
+	if k.quality > 0 {
+		description += fmt.Sprintf(" quality=%d", k.quality)
+	}
+	return description
+}
+
+// variant is a scaled and/or zoomed version of the published frames,
+// rendered at most once per source frame and shared between all of its clients
+type variant struct {
+	key    variantKey
+	stream *stream
+
+	// Processes the source frames into the alternate version of the published frames that the variant
+	// is rendered from, or nil if it's rendered from the published frames (shared by every variant of the same alternate)
+	pipeline *pipeline.Pipeline
+
+	mutex    sync.Mutex
+	source   *frame.Frame
+	rendered *frame.Frame
+	refs     int
+	lastUsed time.Time
+
+	// Pinned variants (the profiles) are never evicted, and don't count towards the maximum
+	pinned bool
+}
+
+// Get the frame that the variant is rendered from, given the published frame and the source frame
+// it was processed from (if any), along with whether the view of the variant was already applied to it
+func (v *variant) input(published *frame.Frame, source *frame.Frame) (*frame.Frame, bool, error) {
+	if v.pipeline == nil || source == nil {
+		return published, false, nil
+	}
+	input, err := v.pipeline.Process(source)
+	if err != nil {
+		return nil, false, err
+	}
+	return input, true, nil
+}
+
+// Render the variant for the given input frame (see input), reusing the previous result
+// if the input frame hasn't changed since
+func (v *variant) render(src *frame.Frame, viewed bool, decoded *decodeCache, quality int) (*frame.Frame, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.source == src {
+		return v.rendered, nil
+	}
+
+	// Skip re-encoding if the variant ends up being the same as the input
+	zoom := !viewed && !v.key.view.IsIdentity()
+	width, height := v.key.size(src.Width, src.Height)
+	if width == src.Width && height == src.Height && !zoom && v.key.quality == 0 {
+		v.source, v.rendered = src, src
+		return src, nil
+	}
+
+	img, err := decoded.get(src)
+	if err != nil {
+		return nil, err
+	}
+	if zoom {
+		rect := v.key.view.Rect(img.Rect.Dx(), img.Rect.Dy()).Add(img.Rect.Min)
+		img = img.SubImage(rect).(*image.RGBA)
+	}
+	if v.key.quality > 0 {
+		quality = v.key.quality
+	}
+	data, err := imaging.Encode(imaging.Resize(img, width, height, v.key.filter), quality)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := frame.New(data)
+	if err != nil {
+		return nil, err
+	}
+	rendered.Sequence = src.Sequence
+	rendered.Timestamp = src.Timestamp
+
+	v.source, v.rendered = src, rendered
+	return rendered, nil
+}
+
+// decodeCache holds the decoded image of the most recent source frame,
+// so it only has to be decoded once no matter how many variants need it
+type decodeCache struct {
+	mutex  sync.Mutex
+	source *frame.Frame
+	image  *image.RGBA
+	err    error
+}
+
+// Get the decoded image of the given frame, which must not be modified
+func (c *decodeCache) get(f *frame.Frame) (*image.RGBA, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.source != f {
+		c.source = f
+		c.image, c.err = nil, nil
+		img, err := imaging.Decode(f.Data)
+		if err != nil {
+			c.err = err
+		} else {
+			c.image = imaging.ToRGBA(img)
+		}
+	}
+	return c.image, c.err
+}
+
+// variants keeps track of every live variant, up to a maximum
+type variants struct {
+	max     int
+	quality int
+	decoded decodeCache
+
+	// Create the pipeline that processes source frames into an alternate version of the published frames,
+	// for unmasked, clean and zoomed variants
+	newPipeline func(alternate) *pipeline.Pipeline
+
+	// Insert the frame comment into a rendered frame, if frame comments are enabled
+	comment func(*frame.Frame) *frame.Frame
+
+	mutex  sync.Mutex
+	items  map[variantKey]*variant
+	pins   int
+	closed bool
+}
+
+// Create a new set of variants
+func newVariants(maxVariants int, quality int) *variants {
+	return &variants{max: maxVariants, quality: quality, items: make(map[variantKey]*variant)}
+}
+
+// Get or create the variant for the given key, which must be released when done.
+//
+// When the maximum number of variants is reached, the least recently used
+// variant that is no longer in use is evicted to make room for the new one.
+func (vs *variants) acquire(key variantKey) (*variant, error) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if vs.closed {
+		return nil, ErrStreamClosed
+	}
+
+	v, ok := vs.items[key]
+	if !ok {
+		if len(vs.items)-vs.pins >= vs.max && !vs.evict() {
+			return nil, ErrTooManyVariants
+		}
+		log.Println("Creating new variant:", key.describe())
+		v = vs.create(key)
+	}
+
+	v.refs++
+	v.lastUsed = time.Now()
+	return v, nil
+}
+
+// Create a pinned variant for the given key, which is never evicted
+func (vs *variants) pin(key variantKey) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if v, ok := vs.items[key]; ok {
+		if !v.pinned {
+			v.pinned = true
+			vs.pins++
+		}
+		return
+	}
+	vs.create(key).pinned = true
+	vs.pins++
+}
+
+// Create a new variant for the given key, sharing the pipeline of any other variant
+// of the same alternate version of the published frames (the mutex must be held)
+func (vs *variants) create(key variantKey) *variant {
+	v := &variant{key: key, stream: newStream()}
+	if alt := key.alternate(); alt != (alternate{}) && vs.newPipeline != nil {
+		for _, other := range vs.items {
+			if other.key.alternate() == alt {
+				v.pipeline = other.pipeline
+				break
+			}
+		}
+		if v.pipeline == nil {
+			v.pipeline = vs.newPipeline(alt)
+		}
+	}
+	vs.items[key] = v
+	return v
+}
+
+// Discard the cached results of the pipeline of every variant, after a stage has changed at runtime
+func (vs *variants) invalidate() {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for _, v := range vs.items {
+		if v.pipeline != nil {
+			v.pipeline.Invalidate()
+		}
+	}
+}
+
+// Get the pinned variant for the given key, or nil if there is none
+func (vs *variants) pinned(key variantKey) *variant {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if v, ok := vs.items[key]; ok && v.pinned {
+		return v
+	}
+	return nil
+}
+
+// Release a variant that was acquired
+func (vs *variants) release(v *variant) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	v.refs--
+	v.lastUsed = time.Now()
+}
+
+// Evict the least recently used variant that is no longer in use,
+// returning false if every variant is still in use
+func (vs *variants) evict() bool {
+	var oldest *variant
+	for _, v := range vs.items {
+		if v.refs == 0 && !v.pinned && (oldest == nil || v.lastUsed.Before(oldest.lastUsed)) {
+			oldest = v
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	log.Println("Evicting unused variant:", oldest.key.describe())
+	oldest.stream.close()
+	delete(vs.items, oldest.key)
+	return true
+}
+
+// Render and publish the given frame to every variant that has stream clients,
+// where unmasked, clean and zoomed variants are rendered from the source frame it was processed from instead
+// (unless there is none, when the frame doesn't show the scene)
+func (vs *variants) publish(src *frame.Frame, source *frame.Frame) {
+	vs.mutex.Lock()
+	active := make([]*variant, 0, len(vs.items))
+	for _, v := range vs.items {
+		if v.stream.count() > 0 {
+			active = append(active, v)
+		}
+	}
+	vs.mutex.Unlock()
+
+	for _, v := range active {
+		input, viewed, err := v.input(src, source)
+		if err != nil {
+			log.Println("Failed to process", v.key.alternate().String(), "frame for variant", v.key.describe()+":", err)
+			continue
+		}
+		rendered, err := v.render(input, viewed, &vs.decoded, vs.quality)
+		if err != nil {
+			log.Println("Failed to render variant", v.key.describe()+":", err)
+			continue
+		}
+		if vs.comment != nil {
+			rendered = vs.comment(rendered)
+		}
+		v.stream.update(rendered)
+	}
+}
+
+// Get the number of clients connected to every variant
+func (vs *variants) count() int {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	count := 0
+	for _, v := range vs.items {
+		count += v.stream.count()
+	}
+	return count
+}
+
+// Disconnect the clients of every variant, without closing them
+func (vs *variants) disconnect() {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for _, v := range vs.items {
+		v.stream.disconnect()
+	}
+}
+
+// Close every variant, disconnecting all of their clients
+func (vs *variants) close() {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for key, v := range vs.items {
+		v.stream.close()
+		delete(vs.items, key)
+	}
+	vs.closed = true
+}
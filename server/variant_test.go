@@ -0,0 +1,207 @@
+package server
+
+import (
+	"didstopia/mjpeg-server/imaging"
+	"didstopia/mjpeg-server/pipeline"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseVariantKey(t *testing.T) {
+	s, err := New(newTestSource(), WithAddress(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetView(pipeline.View{Zoom: 2, Pan: 0.25, Tilt: 0.75}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePreset("door"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query  string
+		want   variantKey
+		scaled bool
+	}{
+		{"", variantKey{view: pipeline.DefaultView}, false},
+		{"width=640", variantKey{width: 640, view: pipeline.DefaultView}, true},
+		{"height=360", variantKey{height: 360, view: pipeline.DefaultView}, true},
+		{"width=640&height=360", variantKey{width: 640, height: 360, view: pipeline.DefaultView}, true},
+		{"scale=0.5", variantKey{scale: 0.5, view: pipeline.DefaultView}, true},
+		{"scale=1", variantKey{scale: 1, view: pipeline.DefaultView}, false},
+		{"width=640&filter=bilinear", variantKey{width: 640, filter: imaging.Bilinear, view: pipeline.DefaultView}, true},
+		{"width=640&filter=nearest", variantKey{width: 640, filter: imaging.Nearest, view: pipeline.DefaultView}, true},
+		{"zoom=2&pan=0.25&tilt=0.75", variantKey{view: pipeline.View{Zoom: 2, Pan: 0.25, Tilt: 0.75}}, true},
+		{"zoom=1&pan=0.25", variantKey{view: pipeline.DefaultView}, false},
+		{"preset=door", variantKey{view: pipeline.View{Zoom: 2, Pan: 0.25, Tilt: 0.75}}, true},
+		{"preset=door&zoom=4", variantKey{view: pipeline.View{Zoom: 4, Pan: 0.25, Tilt: 0.75}}, true},
+		{"clean=1", variantKey{view: pipeline.DefaultView}, false}, // The stream has no annotations
+	} {
+		key, scaled, err := s.parseVariantKey(httptest.NewRequest("GET", "/?"+test.query, nil))
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if key != test.want || scaled != test.scaled {
+			t.Errorf("%q: parsed as %+v (scaled: %t), want %+v (scaled: %t)", test.query, key, scaled, test.want, test.scaled)
+		}
+	}
+
+	for _, query := range []string{
+		"width=0", "width=-1", "width=abc", "height=0", "height=1.5",
+		"scale=0", "scale=-0.5", "scale=1.5", "scale=NaN", "scale=Inf", "scale=abc",
+		"scale=0.5&width=640", "scale=0.5&height=360",
+		"filter=bicubic",
+		"zoom=0.5", "zoom=100", "zoom=NaN", "zoom=2&pan=2", "zoom=2&tilt=-1", "zoom=abc",
+		"preset=unknown",
+		"clean=maybe", "unmasked=maybe",
+	} {
+		if _, _, err := s.parseVariantKey(httptest.NewRequest("GET", "/?"+query, nil)); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+	if _, _, err := s.parseVariantKey(httptest.NewRequest("GET", "/?preset=unknown", nil)); !errors.Is(err, ErrUnknownPreset) {
+		t.Errorf("unknown preset: unexpected error %v", err)
+	}
+}
+
+func TestVariantSize(t *testing.T) {
+	for _, test := range []struct {
+		key           variantKey
+		width, height int
+	}{
+		{variantKey{width: 640}, 640, 360},
+		{variantKey{height: 360}, 640, 360},
+		{variantKey{width: 640, height: 100}, 178, 100},
+		{variantKey{scale: 0.5}, 640, 360},
+		{variantKey{scale: 0.25}, 320, 180},
+		{variantKey{width: 4000}, 1280, 720}, // Never upscaled
+	} {
+		if width, height := test.key.size(1280, 720); width != test.width || height != test.height {
+			t.Errorf("%s: size is %dx%d, want %dx%d", test.key.describe(), width, height, test.width, test.height)
+		}
+	}
+}
+
+func TestVariantEviction(t *testing.T) {
+	vs := newVariants(2, imaging.DefaultQuality)
+	keys := []variantKey{{width: 100}, {width: 200}, {width: 300}, {width: 400}}
+	use := func(key variantKey) *variant {
+		t.Helper()
+		v, err := vs.acquire(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key.describe(), err)
+		}
+		// Make sure every use has a distinct time
+		time.Sleep(time.Millisecond)
+		return v
+	}
+	has := func(key variantKey) bool {
+		vs.mutex.Lock()
+		defer vs.mutex.Unlock()
+		_, ok := vs.items[key]
+		return ok
+	}
+
+	// Pinned variants (the profiles) don't count towards the maximum
+	vs.pin(variantKey{width: 50})
+
+	// Using the first variant again makes the second one the least recently used
+	vs.release(use(keys[0]))
+	vs.release(use(keys[1]))
+	vs.release(use(keys[0]))
+	v := use(keys[2])
+	if has(keys[1]) || !has(keys[0]) || !has(keys[2]) {
+		t.Error("least recently used variant wasn't the one evicted")
+	}
+
+	// Variants that are in use are never evicted, even when they were used longer ago
+	v0 := use(keys[0])
+	if _, err := vs.acquire(keys[3]); !errors.Is(err, ErrTooManyVariants) {
+		t.Errorf("evicted a variant in use (%v)", err)
+	}
+	vs.release(v)
+	vs.release(use(keys[3]))
+	vs.release(v0)
+	if has(keys[2]) || !has(keys[0]) || !has(keys[3]) {
+		t.Error("variant that is no longer in use wasn't the one evicted")
+	}
+	if !has(variantKey{width: 50}) {
+		t.Error("pinned variant was evicted")
+	}
+}
+
+func TestDecodeCache(t *testing.T) {
+	var cache decodeCache
+	f1, f2 := testFrame(t, 64, 48, 1), testFrame(t, 64, 48, 2)
+
+	// Every variant of the same frame shares the same decoded image
+	img1, err := cache.get(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.get(f1); again != img1 {
+		t.Error("frame was decoded again")
+	}
+	img2, err := cache.get(f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img2 == img1 || img2.Bounds().Dx() != 64 {
+		t.Error("new frame wasn't decoded")
+	}
+}
+
+func TestUnmaskedVariant(t *testing.T) {
+	source := newTestSource()
+	mask := pipeline.RectMask(image.Rect(0, 0, 32, 32))
+	mask.Color = color.RGBA{R: 255, A: 255}
+	s := runTestServer(t, source, WithMasks(mask), WithAdminToken("secret"))
+
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	source.publish(encodeFrame(t, img, 1))
+	waitForSequence(t, s, 1)
+
+	for _, test := range []struct {
+		query  string
+		token  string
+		masked bool
+	}{
+		{"", "", true},
+		{"&width=64", "secret", true},
+
+		// Requests for unmasked frames without the admin token get the masked frames
+		{"&unmasked=1", "", true},
+		{"&unmasked=1", "wrong", true},
+		{"&unmasked=1&token=wrong", "", true},
+		{"&unmasked=1&width=64", "", true},
+		{"&unmasked=1&width=64", "wrong", true},
+
+		{"&unmasked=1", "secret", false},
+		{"&unmasked=1&token=secret", "", false},
+		{"&unmasked=1&width=64", "secret", false},
+		{"&unmasked=0", "secret", true},
+	} {
+		w := request(s, http.MethodGet, "/?action=snapshot"+test.query, test.token)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q with token %q: unexpected status %d", test.query, test.token, w.Code)
+			continue
+		}
+		decoded, err := imaging.Decode(w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, b, _ := decoded.At(4, 4).RGBA()
+		if masked := r>>8 > 200 && b>>8 < 60; masked != test.masked {
+			t.Errorf("%q with token %q: masked is %t, want %t", test.query, test.token, masked, test.masked)
+		}
+	}
+}
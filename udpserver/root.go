@@ -6,24 +6,54 @@
 package udpserver
 
 import (
-	"bytes"
 	"context"
-	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
+	"didstopia/mjpeg-server/frame"
+	"didstopia/mjpeg-server/jpegtran"
+	"didstopia/mjpeg-server/placeholder"
 	"log"
-	"math"
 	"net"
+	"sync"
 	"time"
 )
 
 type UDPServer struct {
-	Port         string
-	ctx          context.Context
-	frameBuffer  []byte
-	lastFrame    []byte
-	defaultFrame []byte
+	Address string
+
+	// FrameWidth and FrameHeight are the size of the default frame,
+	// until the size of the incoming frames is known
+	FrameWidth  int
+	FrameHeight int
+
+	// Validation is how thoroughly incoming frames are checked, where frames that fail
+	// the validation are rejected and the last good frame is kept
+	Validation frame.Validation
+
+	// Metadata removes the metadata segments (APPn and COM) of incoming frames
+	// that it doesn't keep, or keeps every segment when not set
+	Metadata *frame.MetadataFilter
+
+	// Timeout is how long to wait for new data before reverting to the default frame
+	Timeout time.Duration
+
+	// Placeholder renders the default frame that is shown while no frames are being received,
+	// which is a generated card when not set
+	Placeholder *placeholder.Placeholder
+
+	ctx             context.Context
+	cancel          context.CancelFunc
+	mutex           sync.RWMutex
+	frameBuffer     []byte
+	lastFrame       *frame.Frame
+	lastFrameWidth  int
+	lastFrameHeight int
+	defaultFrame    *frame.Frame
+	frameReady      chan struct{}
+	frameStart      time.Time
+	lastReceived    time.Time
+	sequence        uint64
+	rejections      map[string]uint64
+	insertedTables  bool
+	strippedData    bool
 }
 
 // maxBufferSize specifies the size of the buffers that
@@ -31,66 +61,127 @@ type UDPServer struct {
 // that we receive.
 const maxBufferSize = 65537 // Max segment size (https://github.com/corkami/formats/blob/master/image/jpeg.md)
 
-var (
-	lastFrameWidth  int
-	lastFrameHeight int
+const (
+	// DefaultAddress is the address the server listens on when none is given
+	DefaultAddress = ":8081"
 
-	// FIXME: Add these as configurable options via the CLI and/or environment variables,
-	//        as this way the user can set them to match the size of the incoming frames!
-	defaultFrameWidth  = 640
-	defaultFrameHeight = 480
+	// DefaultTimeout is how long to wait for new data before reverting to the default frame when none is given
+	DefaultTimeout = 5 * time.Second
 
-	// lastAngleOffset      float64
-	// angleOffsetIncrement = 0.5
+	// placeholderRefresh is how often the default frame is rendered again while it's shown,
+	// so it keeps telling how long ago the last frame was received
+	placeholderRefresh = time.Second
 
-	// lastFrameWasDefault bool
+	// DefaultFrameWidth and DefaultFrameHeight are the size of the default frame,
+	// until the size of the incoming frames is known
+	DefaultFrameWidth  = 640
+	DefaultFrameHeight = 480
 )
 
-// Create a new UDPServer with a default port
+// Create a new UDPServer with a default address
 func NewUDPServer() *UDPServer {
-	return NewUDPServerWithPort("8081")
+	return NewUDPServerWithAddress(DefaultAddress)
 }
 
 // Create a new UDPServer with the given port
 func NewUDPServerWithPort(port string) *UDPServer {
-	log.Println("Creating new UDP server on port", port, "...")
-	return &UDPServer{Port: port, ctx: context.Background()}
+	return NewUDPServerWithAddress(":" + port)
 }
 
-// Start the server
+// Create a new UDPServer with the given address
+func NewUDPServerWithAddress(address string) *UDPServer {
+	log.Println("Creating new UDP server on", address, "...")
+	ctx, cancel := context.WithCancel(context.Background())
+	return &UDPServer{
+		Address:     address,
+		FrameWidth:  DefaultFrameWidth,
+		FrameHeight: DefaultFrameHeight,
+		Timeout:     DefaultTimeout,
+		Validation:  frame.DefaultValidation,
+		ctx:         ctx,
+		cancel:      cancel,
+		frameReady:  make(chan struct{}, 1),
+	}
+}
+
+// Start the server and block until it is stopped
 func (s *UDPServer) Start() {
+	if err := s.Run(s.ctx); err != nil {
+		log.Println("UDP server failed:", err)
+	}
+}
+
+// Run the server until the context is done
+func (s *UDPServer) Run(ctx context.Context) error {
 	log.Println("Starting UDP server ...")
 
 	// Set last frame size to default values
-	lastFrameWidth = defaultFrameWidth
-	lastFrameHeight = defaultFrameHeight
+	s.lastFrameWidth = s.FrameWidth
+	s.lastFrameHeight = s.FrameHeight
+
+	// Use the default timeout, unless another one was given
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+
+	// Use a generated card as the default frame, unless another placeholder was given
+	if s.Placeholder == nil {
+		var err error
+		if s.Placeholder, err = placeholder.New(placeholder.DefaultConfig()); err != nil {
+			return err
+		}
+	}
 
 	// Generate a new default frame and set it as the last frame
+	s.mutex.Lock()
 	s.defaultFrame = s.GetDefaultFrame()
+	s.stampFrame(s.defaultFrame, time.Now())
 	s.lastFrame = s.defaultFrame
+	s.mutex.Unlock()
+
+	// Reassemble incoming packets into a single frame buffer, which is reused for every frame
+	// (complete frames are copied out of it, as they're shared with consumers)
+	s.frameBuffer = make([]byte, 0, maxBufferSize)
 
 	// Start listening for incoming UDP packets
-	conn, err := net.ListenPacket("udp", ":"+s.Port)
+	conn, err := net.ListenPacket("udp", s.Address)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Close the connection automatically when done
 	defer conn.Close()
 
+	// Close the connection as soon as the context is done,
+	// so we don't have to wait for the read deadline to expire
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
 	// Create a new buffer of sufficient size
 	buffer := make([]byte, maxBufferSize)
 
 	// Keep processing incoming data until the context is done
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			log.Println("UDP server shutting down ...")
-			return
+			return nil
 		default:
 			// Set a read deadline of the specified time, so if we don't receive a new frame
 			// within the specified time period, we will revert back to the default frame
-			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// (or refresh the default frame, if we're already using it)
+			if s.IsDefaultFrame() {
+				conn.SetReadDeadline(time.Now().Add(placeholderRefresh))
+			} else {
+				conn.SetReadDeadline(time.Now().Add(s.Timeout))
+			}
 
 			// By reading from the connection into the buffer, we block until there's
 			// new content in the socket that we're listening for new packets.
@@ -103,6 +194,11 @@ func (s *UDPServer) Start() {
 			//	  inspecting its contents.
 			n, _, err := conn.ReadFrom(buffer)
 			if err != nil {
+				// The connection was closed because the context is done
+				if ctx.Err() != nil {
+					continue
+				}
+
 				switch e := err.(type) {
 				case *net.OpError:
 					// Check if the frame buffer or last frame is not empty
@@ -112,12 +208,25 @@ func (s *UDPServer) Start() {
 						log.Println("Timeout while reading from UDP socket, reverting to default frame ...")
 
 						// Generate a new default frame and set it as the last frame
+						s.mutex.Lock()
 						s.defaultFrame = s.GetDefaultFrame()
+						s.stampFrame(s.defaultFrame, time.Now())
 						s.lastFrame = s.defaultFrame
+						s.mutex.Unlock()
 
 						// Reset the frame buffer
-						s.frameBuffer = []byte{}
-						// s.lastFrame = []byte{}
+						s.frameBuffer = s.frameBuffer[:0]
+
+						// Notify any waiting consumers that the default frame is now available
+						s.notifyFrameReady()
+					} else {
+						// Refresh the default frame, so it tells how long ago the last frame was received
+						s.mutex.Lock()
+						s.defaultFrame = s.GetDefaultFrame()
+						s.stampFrame(s.defaultFrame, time.Now())
+						s.lastFrame = s.defaultFrame
+						s.mutex.Unlock()
+						s.notifyFrameReady()
 					}
 				default:
 					log.Println("Error reading from UDP connection:", e)
@@ -126,14 +235,6 @@ func (s *UDPServer) Start() {
 				continue
 			}
 
-			// Reset the frame buffer and last frame if we were previously using the default frame
-			if s.IsDefaultFrame() {
-				log.Println("Last rendered frame was the default frame, resetting frame buffer and last frame ...")
-				s.frameBuffer = []byte{}
-				s.lastFrame = []byte{}
-				// lastFrameWasDefault = false
-			}
-
 			// log.Printf("packet-received: bytes=%d from=%s\n", n, addr.String())
 
 			// Setting a deadline for the `write` operation allows us to not block
@@ -145,62 +246,11 @@ func (s *UDPServer) Start() {
 			err = conn.SetWriteDeadline(deadline)
 			if err != nil {
 				log.Println("Error setting write deadline:", err)
-				return
+				return err
 			}
 
-			// TODO: We need to properly protect against invalid incoming data
-
-			// FIXME: This seems to always trigger, but that probably makes sense due to our small and incomplete buffer?
-			// Skip if not a valid JPEG header
-			// if buffer[0] != 0xff || buffer[1] != 0xd8 {
-			// 	log.Println("Invalid JPEG header, skipping ...")
-			// 	continue
-			// }
-
-			// Create a new buffer to hold the current frame
-			newFameBuffer := append(s.frameBuffer, buffer[:n]...)
-
-			// Skip if the new buffer is empty
-			if len(newFameBuffer) <= 0 {
-				log.Println("Empty frame buffer, ignoring packet ...")
-				continue
-			}
-
-			// Check if the frame is a valid JPEG and if it's a complete frame
-			hasJpegHeader := newFameBuffer[0] == 0xFF && newFameBuffer[1] == 0xD8
-			hasJpegFooter := newFameBuffer[len(newFameBuffer)-2] == 0xFF && newFameBuffer[len(newFameBuffer)-1] == 0xD9
-			isCompleteFrame := hasJpegHeader && hasJpegFooter
-
-			// FIXME: If we use ffmpeg without "-re", the framerate varies,
-			//        which causes some packets to not have the JPEG header, but not sure why?!
-			// Abort if we didn't receive a JPEG header
-			if !hasJpegHeader {
-				log.Println("No JPEG header, ignoring packet ...")
-				continue
-			}
-
-			// Store the new frame buffer
-			s.frameBuffer = newFameBuffer
-
-			//
-			// Check if the frame buffer contains a complete JPEG image
-			//
-			// NOTE: JPEG image files begin with FF D8 and end with FF D9.
-			//
-			// log.Println(fmt.Sprintf("%02x", s.frameBuffer[0]), fmt.Sprintf("%02x", s.frameBuffer[1]), fmt.Sprintf("%02x", s.frameBuffer[2]), fmt.Sprintf("%02x", s.frameBuffer[3]), "hasJpegHeader:", hasJpegHeader, "hasJpegFooter:", hasJpegFooter)
-			if isCompleteFrame {
-				// Copy the frame buffer to the last frame
-				s.lastFrame = make([]byte, len(s.frameBuffer))
-				copy(s.lastFrame, s.frameBuffer)
-
-				// TODO: Logging here, as well as using the bytesize library,
-				//       seems to significantly slow down our speed of processing the individual frames
-				// log.Println("Frame received:" /*string(s.frameBuffer),*/, bytesize.New(float64(len(s.lastFrame))), "from:", addr.String())
-				// log.Println("Frame completed")
-
-				// Reset the frame buffer
-				s.frameBuffer = []byte{}
-			}
+			// Add the packet to the frame that is being reassembled, publishing the frame once it's complete
+			s.receive(buffer[:n])
 
 			// TODO: Do we need to return anything back to ffmpeg?
 
@@ -217,168 +267,222 @@ func (s *UDPServer) Start() {
 	}
 }
 
-// Stop the server
-func (s *UDPServer) Stop() {
-	log.Println("Stopping UDP server ...")
-	s.ctx.Done()
-}
-
-// Get the current frame
-func (s *UDPServer) GetFrame() []byte {
-	// Return the default frame if we're using a default frame
+// Add a packet to the frame buffer, and publish the frame once the buffer holds a complete JPEG image
+func (s *UDPServer) receive(packet []byte) {
+	// Reset the frame buffer and last frame if we were previously using the default frame
 	if s.IsDefaultFrame() {
-		// log.Println("GetFrame() -> Returning default frame")
-		return s.defaultFrame
-	}
-
-	// Handle frame size changing
-	currentFrameWidth, currentFrameHeight := s.GetFrameSize()
-	if currentFrameWidth != lastFrameWidth || currentFrameHeight != lastFrameHeight {
-		// FIXME: This is triggering when we go from a REAL frame to the DEFAULT frame,
-		//        and this should NOT be happening!
-		log.Println("GetFrame() -> Frame size changed from", lastFrameWidth, "x", lastFrameHeight, "to", currentFrameWidth, "x", currentFrameHeight)
-
-		// Store the new frame size
-		lastFrameWidth = currentFrameWidth
-		lastFrameHeight = currentFrameHeight
-
-		// Generate a new default frame to match the new frame size
-		s.defaultFrame = s.GetDefaultFrame()
+		log.Println("Last rendered frame was the default frame, resetting frame buffer and last frame ...")
+		s.frameBuffer = s.frameBuffer[:0]
+		s.mutex.Lock()
+		s.lastFrame = nil
+		s.mutex.Unlock()
 	}
 
-	// // Return the default frame if we don't have a frame
-	// if s.lastFrame == nil || len(s.lastFrame) <= 0 {
-	// 	// lastFrameWasDefault = true
-	// 	return s.defaultFrame
+	// FIXME: This seems to always trigger, but that probably makes sense due to our small and incomplete buffer?
+	// Skip if not a valid JPEG header
+	// if buffer[0] != 0xff || buffer[1] != 0xd8 {
+	// 	log.Println("Invalid JPEG header, skipping ...")
+	// 	return
 	// }
 
-	// currentFrameWidth, currentFrameHeight := s.GetFrameSize()
-	// if currentFrameWidth != 0 && currentFrameHeight != 0 {
-	// 	// log.Println("Last frame size:", currentFrameWidth, "x", currentFrameHeight)
-
-	// 	if currentFrameWidth <= 0 {
-	// 		log.Println("Current frame width missing, setting to default value:", currentFrameWidth)
-	// 		lastFrameWidth = defaultFrameWidth
-	// 	}
-	// 	if currentFrameHeight <= 0 {
-	// 		log.Println("Current frame height missing, setting to default value:", currentFrameHeight)
-	// 		lastFrameHeight = defaultFrameHeight
-	// 	}
-
-	// 	if lastFrameHeight != currentFrameHeight {
-	// 		log.Println("Frame width changed:", currentFrameWidth)
-	// 		lastFrameWidth = currentFrameWidth
-	// 	}
-	// 	if lastFrameHeight != currentFrameHeight {
-	// 		log.Println("Frame height changed:", currentFrameHeight)
-	// 		lastFrameHeight = currentFrameHeight
-	// 	}
-	// }
+	// Create a new buffer to hold the current frame
+	newFameBuffer := append(s.frameBuffer, packet...)
 
-	// Return the last frame
-	// log.Println("Get last frame")
-	// log.Println("GetFrame -> Frame buffer size:", len(s.frameBuffer))
-	// log.Println("GetFrame -> Last frame size:", len(s.lastFrame))
-	// log.Println("GetFrame() -> Returning last frame")
-	return s.lastFrame
-}
-
-func (s *UDPServer) IsDefaultFrame() bool {
-	// TODO: Should we also check if eg. s.lastFrame is nil or empty?
-	return bytes.Equal(s.lastFrame, s.defaultFrame)
-}
-
-func (s *UDPServer) GetFrameSize() (int, int) {
-	// Return the last frame size if we're using a default frame
-	if s.IsDefaultFrame() {
-		return lastFrameWidth, lastFrameHeight
+	// Skip if the new buffer is too short to hold a JPEG marker
+	if len(newFameBuffer) < 2 {
+		log.Println("Empty frame buffer, ignoring packet ...")
+		return
 	}
 
-	currentFrame := s.lastFrame
-	if currentFrame == nil || len(currentFrame) <= 0 {
-		// log.Println("Returning default frame size:", defaultFrameWidth, "x", defaultFrameHeight)
-		return defaultFrameWidth, defaultFrameHeight
+	// Check if the frame is a valid JPEG and if it's a complete frame
+	hasJpegHeader := newFameBuffer[0] == 0xFF && newFameBuffer[1] == 0xD8
+	hasJpegFooter := newFameBuffer[len(newFameBuffer)-2] == 0xFF && newFameBuffer[len(newFameBuffer)-1] == 0xD9
+	isCompleteFrame := hasJpegHeader && hasJpegFooter
+
+	// FIXME: If we use ffmpeg without "-re", the framerate varies,
+	//        which causes some packets to not have the JPEG header, but not sure why?!
+	// Abort if we didn't receive a JPEG header
+	if !hasJpegHeader {
+		log.Println("No JPEG header, ignoring packet ...")
+		return
 	}
-	reader := bytes.NewReader(currentFrame)
-	image, _, err := image.DecodeConfig(reader)
-	if err != nil {
-		log.Println("Failed to get frame size:", err)
-		// log.Println("Returning default frame size:", defaultFrameWidth, "x", defaultFrameHeight)
-		return defaultFrameWidth, defaultFrameHeight
+
+	// Keep track of when the first packet of the frame was received
+	if len(s.frameBuffer) == 0 {
+		s.frameStart = time.Now()
 	}
-	// log.Println("Returning current frame size:", image.Width, "x", image.Height)
-	return image.Width, image.Height
-}
 
-// FIXME: Draw a static image ONCE, but redraw it EVERY TIME the resolution changes!
-func (s *UDPServer) GetDefaultFrame() []byte {
-	log.Println("Generating a new default frame")
+	// Store the new frame buffer
+	s.frameBuffer = newFameBuffer
+
+	//
+	// Check if the frame buffer contains a complete JPEG image
+	//
+	// NOTE: JPEG image files begin with FF D8 and end with FF D9.
+	//
+	// log.Println(fmt.Sprintf("%02x", s.frameBuffer[0]), fmt.Sprintf("%02x", s.frameBuffer[1]), fmt.Sprintf("%02x", s.frameBuffer[2]), fmt.Sprintf("%02x", s.frameBuffer[3]), "hasJpegHeader:", hasJpegHeader, "hasJpegFooter:", hasJpegFooter)
+	if isCompleteFrame {
+		// Copy the frame buffer, as the frame is shared with consumers
+		// while the frame buffer is reused for the next frame
+		data := make([]byte, len(s.frameBuffer))
+		copy(data, s.frameBuffer)
+
+		// Reset the frame buffer
+		s.frameBuffer = s.frameBuffer[:0]
+
+		// Insert the standard Huffman tables into frames that don't have any,
+		// so they can be decoded on their own
+		if fixed, inserted := jpegtran.InsertStandardTables(data); inserted {
+			if !s.insertedTables {
+				log.Println("Frames have no Huffman tables, inserting the standard tables ...")
+				s.insertedTables = true
+			}
+			data = fixed
+		}
 
-	// Prepare a new image
-	img := image.NewRGBA(image.Rect(0, 0, lastFrameWidth, lastFrameHeight))
+		// Remove the metadata segments that aren't kept, without re-encoding the frame
+		if s.Metadata != nil {
+			if stripped, removed := s.Metadata.Apply(data); removed > 0 {
+				if !s.strippedData {
+					log.Println("Stripping metadata from frames,", removed, "bytes removed from the first frame ...")
+					s.strippedData = true
+				}
+				data = stripped
+			}
+		}
 
-	// Draw the image background
-	backgroundColor := color.RGBA{0, 0, 0, 0}
-	draw.Draw(img, img.Bounds(), &image.Uniform{backgroundColor}, image.Point{0, 0}, draw.Src)
+		// Reject invalid frames before they reach any consumers, keeping the last good frame
+		if err := frame.Validate(data, s.Validation); err != nil {
+			s.reject(err)
+			return
+		}
 
-	// offsetX := lastAngle
-	// offsetY := lastAngle
+		// Parse the frame metadata once, so consumers don't have to
+		newFrame, err := frame.New(data)
+		if err != nil {
+			s.reject(err)
+			return
+		}
+		s.stampFrame(newFrame, s.frameStart)
+		s.lastReceived = time.Now()
+
+		// Handle frame size changing
+		if newFrame.Width != s.lastFrameWidth || newFrame.Height != s.lastFrameHeight {
+			log.Println("Frame size changed from", s.lastFrameWidth, "x", s.lastFrameHeight, "to", newFrame.Width, "x", newFrame.Height)
+
+			// Store the new frame size
+			s.lastFrameWidth = newFrame.Width
+			s.lastFrameHeight = newFrame.Height
+
+			// Generate a new default frame to match the new frame size
+			defaultFrame := s.GetDefaultFrame()
+			s.mutex.Lock()
+			s.defaultFrame = defaultFrame
+			s.mutex.Unlock()
+		}
 
-	// angleOffset := lastAngleOffset
+		// Store the new frame as the last frame
+		s.mutex.Lock()
+		s.lastFrame = newFrame
+		s.mutex.Unlock()
 
-	// Draw a large red cross in a 45 degree angle in the center of the image, by looping through the image pixels and using img.Set to set the red pixel color
-	for x := 0; x < lastFrameWidth; x++ {
-		for y := 0; y < lastFrameHeight; y++ {
-			// Calculate the angle of the pixel
-			angle := math.Atan2(float64(y-lastFrameHeight/2), float64(x-lastFrameWidth/2))
+		// TODO: Logging here, as well as using the bytesize library,
+		//       seems to significantly slow down our speed of processing the individual frames
+		// log.Println("Frame received:" /*string(s.frameBuffer),*/, bytesize.New(float64(len(s.lastFrame))), "from:", addr.String())
+		// log.Println("Frame completed")
 
-			// Increase the angle's rotation
-			// angle += angleOffset * math.Pi / 180
+		// Notify any waiting consumers that a new frame is available
+		s.notifyFrameReady()
+	}
+}
 
-			// Calculate the red color value
-			red := uint8(255 * (1 - math.Cos(angle)))
+// Stop the server
+func (s *UDPServer) Stop() {
+	log.Println("Stopping UDP server ...")
+	s.cancel()
+}
 
-			// Calculate the green color value
-			green := uint8(255 * (1 - math.Sin(angle)))
+// Get a channel that receives a notification whenever a complete frame has been received
+func (s *UDPServer) FrameReady() <-chan struct{} {
+	return s.frameReady
+}
 
-			// Calculate the blue color value
-			blue := uint8(255 * (1 - math.Cos(angle)))
+// Assign the next sequence number and the given capture timestamp to the frame
+func (s *UDPServer) stampFrame(f *frame.Frame, timestamp time.Time) {
+	s.sequence++
+	f.Sequence = s.sequence
+	f.Timestamp = timestamp
+}
 
-			// Calculate the alpha color value
-			alpha := uint8(255 * (1 - math.Sin(angle)))
+// Notify any waiting consumers that a new frame is available,
+// without blocking if the previous notification is still pending
+func (s *UDPServer) notifyFrameReady() {
+	select {
+	case s.frameReady <- struct{}{}:
+	default:
+	}
+}
 
-			// Set the pixel color
-			img.Set(x, y, color.RGBA{red, green, blue, alpha})
-		}
+// Count a rejected frame by the reason it was rejected for
+func (s *UDPServer) reject(err error) {
+	reason := frame.Reason(err)
+	s.mutex.Lock()
+	if s.rejections == nil {
+		s.rejections = make(map[string]uint64)
 	}
+	s.rejections[reason]++
+	count := s.rejections[reason]
+	s.mutex.Unlock()
+	log.Println("Rejected invalid frame:", err, "(reason:", reason+",", count, "so far)")
+}
 
-	// Increase the angle offset until it makes a full revolution
-	// if lastAngleOffset+angleOffsetIncrement < 360 {
-	// 	lastAngleOffset += angleOffsetIncrement
-	// } else {
-	// 	lastAngleOffset = 0
-	// }
+// Get the number of frames that were rejected so far, by the reason they were rejected for
+func (s *UDPServer) Rejections() map[string]uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rejections := make(map[string]uint64, len(s.rejections))
+	for reason, count := range s.rejections {
+		rejections[reason] = count
+	}
+	return rejections
+}
 
-	// for x := 0; x < lastFrameWidth; x++ {
-	// 	for y := 0; y < lastFrameHeight; y++ {
-	// 		if x == lastFrameWidth/2 || y == lastFrameHeight/2 {
-	// 			img.Set(x, y, color.RGBA{255, 0, 0, 255})
-	// 		}
-	// 	}
-	// }
+// Get the current frame
+func (s *UDPServer) GetFrame() []byte {
+	currentFrame := s.GetCurrentFrame()
+	if currentFrame == nil {
+		return nil
+	}
+	return currentFrame.Data
+}
+
+// Get the current frame along with its metadata
+func (s *UDPServer) GetCurrentFrame() *frame.Frame {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lastFrame
+}
 
-	// crossColor := color.RGBA{255, 0, 0, 255}
-	// crossWidth := 10
-	// crossHeight := 10
-	// crossStartX := (lastFrameWidth / 2) - (crossWidth / 2)
-	// crossStartY := (lastFrameHeight / 2) - (crossHeight / 2)
-	// crossRect := image.Rect(crossX, crossY, crossX+crossWidth, crossY+crossHeight)
-	// draw.Draw(img, crossRect, &image.Uniform{crossColor}, image.Point{0, 0}, draw.Src)
+func (s *UDPServer) IsDefaultFrame() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lastFrame != nil && s.lastFrame == s.defaultFrame
+}
 
-	// Encode the image to a buffer
-	var buff bytes.Buffer
-	jpeg.Encode(&buff, img, nil)
+func (s *UDPServer) GetFrameSize() (int, int) {
+	currentFrame := s.GetCurrentFrame()
+	if currentFrame == nil {
+		return s.FrameWidth, s.FrameHeight
+	}
+	return currentFrame.Width, currentFrame.Height
+}
 
-	// Return the image buffer
-	return buff.Bytes()
+// Get the placeholder frame for the current frame size, telling how long ago the last frame was received
+func (s *UDPServer) GetDefaultFrame() *frame.Frame {
+	defaultFrame, err := s.Placeholder.Frame(s.lastFrameWidth, s.lastFrameHeight, s.lastReceived)
+	if err != nil {
+		log.Println("Failed to render default frame:", err)
+		return &frame.Frame{}
+	}
+	return defaultFrame
 }
@@ -0,0 +1,244 @@
+package udpserver
+
+import (
+	"bytes"
+	"didstopia/mjpeg-server/frame"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// packetSize is the size of the packets that test frames are split into
+const packetSize = 8192
+
+// Encode a test frame of the given size
+func testJPEG(tb testing.TB, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Encode a 1280x720 test frame, split into packets
+func testPackets(tb testing.TB) [][]byte {
+	data := testJPEG(tb, 1280, 720)
+	var packets [][]byte
+	for len(data) > packetSize {
+		packets = append(packets, data[:packetSize])
+		data = data[packetSize:]
+	}
+	return append(packets, data)
+}
+
+// Create a server that receives packets without listening on a socket
+func testServer() *UDPServer {
+	return &UDPServer{
+		Validation:      frame.DefaultValidation,
+		lastFrameWidth:  1280,
+		lastFrameHeight: 720,
+		frameBuffer:     make([]byte, 0, maxBufferSize),
+		frameReady:      make(chan struct{}, 1),
+	}
+}
+
+// Find the first segment with the given marker before the scan data, returning its start and end offsets
+func findSegment(tb testing.TB, data []byte, marker byte) (int, int) {
+	tb.Helper()
+	for i := 2; i+4 <= len(data); {
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if data[i+1] == marker {
+			return i, i + 2 + length
+		}
+		if data[i+1] == 0xDA {
+			break
+		}
+		i += 2 + length
+	}
+	tb.Fatalf("no segment with marker 0x%02X", marker)
+	return 0, 0
+}
+
+// Remove every segment with the given marker before the scan data
+func removeSegments(data []byte, marker byte) []byte {
+	out := append([]byte(nil), data[:2]...)
+	for i := 2; i+4 <= len(data); {
+		if data[i+1] == 0xDA {
+			return append(out, data[i:]...)
+		}
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if data[i+1] != marker {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out
+}
+
+func TestReceive(t *testing.T) {
+	packets := testPackets(t)
+	s := testServer()
+	for _, packet := range packets {
+		if f := s.GetCurrentFrame(); f != nil {
+			t.Fatalf("frame %d was published before its last packet", f.Sequence)
+		}
+		s.receive(packet)
+	}
+	f := s.GetCurrentFrame()
+	if f == nil || f.Sequence != 1 || f.Width != 1280 || f.Height != 720 {
+		t.Fatalf("frame was not published: %+v", f)
+	}
+	if !bytes.Equal(f.Data, bytes.Join(packets, nil)) {
+		t.Error("published frame differs from the received frame")
+	}
+	select {
+	case <-s.FrameReady():
+	default:
+		t.Error("consumers weren't notified of the frame")
+	}
+
+	// Packets without a JPEG header are dropped until the next frame starts
+	s.receive([]byte("not a frame"))
+	if len(s.frameBuffer) != 0 {
+		t.Errorf("frame buffer holds %d bytes of a packet without a JPEG header", len(s.frameBuffer))
+	}
+}
+
+func TestReceiveWithoutHuffmanTables(t *testing.T) {
+	// Some MJPEG sources leave out the Huffman tables, which are the standard tables
+	// that image/jpeg encodes with anyway
+	original := testJPEG(t, 1280, 720)
+	stripped := removeSegments(original, 0xC4)
+	if err := frame.Validate(stripped, frame.ValidateHeader); frame.Reason(err) != frame.ReasonHeader {
+		t.Fatalf("frame without Huffman tables wasn't rejected: %v", err)
+	}
+
+	s := testServer()
+	s.Validation = frame.ValidateHeader
+	for len(stripped) > packetSize {
+		s.receive(stripped[:packetSize])
+		stripped = stripped[packetSize:]
+	}
+	s.receive(stripped)
+
+	f := s.GetCurrentFrame()
+	if f == nil {
+		t.Fatalf("frame was rejected: %v", s.Rejections())
+	}
+	if !s.insertedTables {
+		t.Error("standard tables weren't inserted")
+	}
+	got, err := jpeg.Decode(bytes.NewReader(f.Data))
+	if err != nil {
+		t.Fatalf("published frame doesn't decode: %v", err)
+	}
+	want, err := jpeg.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.(*image.YCbCr).Y, want.(*image.YCbCr).Y) || !bytes.Equal(got.(*image.YCbCr).Cb, want.(*image.YCbCr).Cb) {
+		t.Error("published frame decodes differently from the original frame")
+	}
+}
+
+func TestRejections(t *testing.T) {
+	valid := testJPEG(t, 64, 48)
+	_, scan := findSegment(t, valid, 0xDA)
+	middle := scan + (len(valid)-scan)/2
+	dqtStart, dqtEnd := findSegment(t, valid, 0xDB)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	eoi := []byte{0xFF, 0xD9}
+
+	s := testServer()
+	s.Validation = frame.ValidateDecode
+	s.lastFrameWidth, s.lastFrameHeight = 64, 48
+	s.receive(valid)
+	good := s.GetCurrentFrame()
+	if good == nil {
+		t.Fatal("valid frame was rejected")
+	}
+
+	// Every invalid frame is counted by the reason it was rejected for
+	want := make(map[string]uint64)
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{"truncated headers", join(valid[:30], eoi), frame.ReasonTruncated},
+		{"trailing data", join(valid, []byte("trailing"), eoi), frame.ReasonStructure},
+		{"missing quantization tables", join(valid[:dqtStart], valid[dqtEnd:]), frame.ReasonHeader},
+		{"corrupt scan", join(valid[:scan+16], valid[middle:]), frame.ReasonDecode},
+		{"truncated headers again", join(valid[:40], eoi), frame.ReasonTruncated},
+	} {
+		s.receive(test.data)
+		want[test.reason]++
+		rejections := s.Rejections()
+		if len(rejections) != len(want) {
+			t.Errorf("%s: got rejections %v, want %v", test.name, rejections, want)
+		}
+		for reason, count := range want {
+			if rejections[reason] != count {
+				t.Errorf("%s: got %d rejections as %s, want %d", test.name, rejections[reason], reason, count)
+			}
+		}
+		if f := s.GetCurrentFrame(); f != good {
+			t.Errorf("%s: frame %d replaced the last good frame", test.name, f.Sequence)
+		}
+		if len(s.frameBuffer) != 0 {
+			t.Errorf("%s: frame buffer wasn't reset", test.name)
+		}
+	}
+
+	// The counters are a copy
+	s.Rejections()[frame.ReasonDecode] = 100
+	if s.Rejections()[frame.ReasonDecode] != 1 {
+		t.Error("rejections were changed through the returned map")
+	}
+
+	// The next valid frame is published again
+	s.receive(valid)
+	if f := s.GetCurrentFrame(); f == good || f.Sequence != 2 {
+		t.Errorf("valid frame wasn't published after the rejected frames: %+v", f)
+	}
+}
+
+// Measure the ingest path of a frame: reassembling its packets, validating it,
+// parsing its metadata and publishing it
+func BenchmarkReceive(b *testing.B) {
+	packets := testPackets(b)
+	s := testServer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, packet := range packets {
+			s.receive(packet)
+		}
+	}
+	b.StopTimer()
+	if f := s.GetCurrentFrame(); f == nil || f.Width != 1280 || f.Height != 720 {
+		b.Fatalf("frame was not published: %+v", f)
+	}
+}
+
+// Measure getting the size of the current frame, which the capture loop does on every tick
+func BenchmarkGetFrameSize(b *testing.B) {
+	s := testServer()
+	for _, packet := range testPackets(b) {
+		s.receive(packet)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if width, height := s.GetFrameSize(); width != 1280 || height != 720 {
+			b.Fatalf("unexpected frame size: %dx%d", width, height)
+		}
+	}
+}